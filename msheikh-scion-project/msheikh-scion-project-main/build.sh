@@ -47,6 +47,6 @@ if [[ ! -f "verifier-app" ]]; then
 fi
 
 echo "Building client-app for GOARCH=$GOARCH"
-CGO_ENABLED=0 GOOS=linux GOARCH=$GOARCH go build -o "client-app" project/main.go
+CGO_ENABLED=0 GOOS=linux GOARCH=$GOARCH go build -o "client-app" ./project
 
 echo "Build complete."
\ No newline at end of file
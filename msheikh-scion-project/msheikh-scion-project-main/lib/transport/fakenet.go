@@ -0,0 +1,203 @@
+package transport
+
+import (
+	"fmt"
+	"math/rand"
+	"net"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/scionproto/scion/pkg/private/serrors"
+)
+
+// FakeNetwork is an in-memory network between one sender and one receiver
+// that are connected by a fixed number of paths. Every path has its own loss
+// rate and delay, which makes it possible to exercise the transport against
+// packet loss and failing paths without a SCION network.
+type FakeNetwork struct {
+	mu    sync.Mutex
+	rng   *rand.Rand
+	loss  []float64
+	delay []time.Duration
+
+	toReceiver chan fakePacket
+	toSender   []chan []byte
+}
+
+type fakePacket struct {
+	data []byte
+	path int
+}
+
+// fakeAddr is the address of a path as seen by the receiver.
+type fakeAddr int
+
+func (a fakeAddr) Network() string { return "fake" }
+func (a fakeAddr) String() string  { return fmt.Sprintf("path-%d", int(a)) }
+
+// NewFakeNetwork creates a network with the given number of lossless paths.
+// The seed makes the packet losses reproducible.
+func NewFakeNetwork(paths int, seed int64) *FakeNetwork {
+	n := &FakeNetwork{
+		rng:        rand.New(rand.NewSource(seed)),
+		loss:       make([]float64, paths),
+		delay:      make([]time.Duration, paths),
+		toReceiver: make(chan fakePacket, 4096),
+		toSender:   make([]chan []byte, paths),
+	}
+	for i := range n.toSender {
+		n.toSender[i] = make(chan []byte, 4096)
+	}
+	return n
+}
+
+// SetLoss sets the probability with which a packet on the path is dropped,
+// in both directions. A rate of 1 takes the path down.
+func (n *FakeNetwork) SetLoss(path int, rate float64) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.loss[path] = rate
+}
+
+// SetDelay sets the one-way delay of the path.
+func (n *FakeNetwork) SetDelay(path int, delay time.Duration) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.delay[path] = delay
+}
+
+// PathConn returns the sender's end of the path.
+func (n *FakeNetwork) PathConn(path int) PathConn {
+	return &fakePathConn{network: n, path: path}
+}
+
+// ReceiverConn returns the receiver's end of all paths. Replies are sent back
+// on the path the packet arrived on.
+func (n *FakeNetwork) ReceiverConn() net.PacketConn {
+	return &fakeReceiverConn{network: n}
+}
+
+// transmit decides whether the packet survives the path and delivers it
+// after the path delay.
+func (n *FakeNetwork) transmit(path int, deliver func()) {
+	n.mu.Lock()
+	dropped := n.rng.Float64() < n.loss[path]
+	delay := n.delay[path]
+	n.mu.Unlock()
+	if dropped {
+		return
+	}
+	if delay > 0 {
+		time.AfterFunc(delay, deliver)
+		return
+	}
+	deliver()
+}
+
+// fakeDeadline is a read deadline shared by the fake connections.
+type fakeDeadline struct {
+	mu       sync.Mutex
+	deadline time.Time
+}
+
+func (d *fakeDeadline) set(t time.Time) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.deadline = t
+}
+
+// timeout returns a channel that fires at the deadline, or nil if there is
+// none.
+func (d *fakeDeadline) timeout() (<-chan time.Time, func()) {
+	d.mu.Lock()
+	deadline := d.deadline
+	d.mu.Unlock()
+	if deadline.IsZero() {
+		return nil, func() {}
+	}
+	timer := time.NewTimer(time.Until(deadline))
+	return timer.C, func() { timer.Stop() }
+}
+
+type fakePathConn struct {
+	network *FakeNetwork
+	path    int
+	fakeDeadline
+}
+
+func (c *fakePathConn) Write(b []byte) (int, error) {
+	pkt := fakePacket{data: append([]byte(nil), b...), path: c.path}
+	c.network.transmit(c.path, func() {
+		select {
+		case c.network.toReceiver <- pkt:
+		default:
+			// Queue overflow, the packet is dropped.
+		}
+	})
+	return len(b), nil
+}
+
+func (c *fakePathConn) Read(b []byte) (int, error) {
+	timeout, stop := c.timeout()
+	defer stop()
+	select {
+	case data := <-c.network.toSender[c.path]:
+		return copy(b, data), nil
+	case <-timeout:
+		return 0, os.ErrDeadlineExceeded
+	}
+}
+
+func (c *fakePathConn) SetReadDeadline(t time.Time) error {
+	c.set(t)
+	return nil
+}
+
+type fakeReceiverConn struct {
+	network *FakeNetwork
+	fakeDeadline
+}
+
+func (c *fakeReceiverConn) ReadFrom(b []byte) (int, net.Addr, error) {
+	timeout, stop := c.timeout()
+	defer stop()
+	select {
+	case pkt := <-c.network.toReceiver:
+		return copy(b, pkt.data), fakeAddr(pkt.path), nil
+	case <-timeout:
+		return 0, nil, os.ErrDeadlineExceeded
+	}
+}
+
+func (c *fakeReceiverConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	path, ok := addr.(fakeAddr)
+	if !ok || int(path) < 0 || int(path) >= len(c.network.toSender) {
+		return 0, serrors.New("unknown fake path", "addr", addr)
+	}
+	data := append([]byte(nil), b...)
+	c.network.transmit(int(path), func() {
+		select {
+		case c.network.toSender[path] <- data:
+		default:
+		}
+	})
+	return len(b), nil
+}
+
+func (c *fakeReceiverConn) Close() error        { return nil }
+func (c *fakeReceiverConn) LocalAddr() net.Addr { return fakeAddr(-1) }
+
+func (c *fakeReceiverConn) SetDeadline(t time.Time) error {
+	c.set(t)
+	return nil
+}
+
+func (c *fakeReceiverConn) SetReadDeadline(t time.Time) error {
+	c.set(t)
+	return nil
+}
+
+func (c *fakeReceiverConn) SetWriteDeadline(t time.Time) error {
+	return nil
+}
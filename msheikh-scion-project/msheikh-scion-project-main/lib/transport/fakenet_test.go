@@ -0,0 +1,181 @@
+package transport
+
+import (
+	"sync"
+	"testing"
+	"time"
+)
+
+// shardDropper drops the first transmission of the shards with the given
+// index in their FEC group, whichever path they are sent on. If groups is set,
+// only shards of these groups are dropped.
+type shardDropper struct {
+	groupSize uint32
+	drop      map[uint32]bool
+	groups    map[uint32]bool
+
+	mu   sync.Mutex
+	seen map[uint32]bool
+}
+
+// first reports whether the shard is to be dropped.
+func (d *shardDropper) first(hdr header) bool {
+	if hdr.Type != frameShard || !d.drop[hdr.Seq%d.groupSize] ||
+		d.groups != nil && !d.groups[hdr.Seq/d.groupSize] {
+
+		return false
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	first := !d.seen[hdr.Seq]
+	d.seen[hdr.Seq] = true
+	return first
+}
+
+// dropConn passes everything but the shards its dropper drops on to the fake
+// network.
+type dropConn struct {
+	PathConn
+	dropper *shardDropper
+}
+
+func (c *dropConn) Write(b []byte) (int, error) {
+	if hdr, err := decodeHeader(b); err == nil && c.dropper.first(hdr) {
+		return len(b), nil
+	}
+	return c.PathConn.Write(b)
+}
+
+func TestFECOverFakeNetwork(t *testing.T) {
+	const (
+		k, m  = 4, 2
+		chunk = 100
+		paths = 3
+	)
+	tests := []struct {
+		name string
+		size int
+		// drop are the shard indices lost once in every group, or only in
+		// the groups in dropGroups if set.
+		drop       []uint32
+		dropGroups []uint32
+		// down is the path that is down from the start, -1 if none.
+		down int
+		// window limits the congestion window of every path if set.
+		window float64
+		// recovered is how many groups must be recovered from parity: none,
+		// some or all of them. Empty does not check it.
+		recovered  string
+		retransmit bool
+	}{
+		{name: "empty", size: 0, down: -1, recovered: "none"},
+		{name: "one byte", size: 1, down: -1, recovered: "none"},
+		{name: "lossless", size: 20000, down: -1, recovered: "none"},
+		{
+			// Data shards that wait for the narrow windows arrive after the
+			// parity shards completed their groups.
+			name: "lossless with narrow windows", size: 20000, down: -1, window: 2,
+			recovered: "none",
+		},
+		{name: "one data shard lost", size: 20000, drop: []uint32{0}, down: -1, recovered: "all"},
+		{name: "m data shards lost", size: 20000, drop: []uint32{0, 3}, down: -1, recovered: "all"},
+		{name: "data and parity shard lost", size: 20000, drop: []uint32{1, 4}, down: -1,
+			recovered: "all"},
+		{name: "parity shards lost", size: 20000, drop: []uint32{4, 5}, down: -1, recovered: "none"},
+		{name: "path down", size: 20000, down: 1, recovered: "all"},
+		{name: "more than m shards lost", size: 20000, drop: []uint32{0, 1, 2},
+			dropGroups: []uint32{3, 20}, down: -1, retransmit: true},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			n := NewFakeNetwork(paths, 1)
+			// Different delays let parity shards overtake data shards.
+			for i := 0; i < paths; i++ {
+				n.SetDelay(i, time.Duration(paths-i)*2*time.Millisecond)
+			}
+			if tc.down >= 0 {
+				n.SetLoss(tc.down, 1)
+			}
+			senderPaths := fakePaths(n, paths)
+			if len(tc.drop) > 0 {
+				dropper := &shardDropper{groupSize: k + m, drop: make(map[uint32]bool),
+					seen: make(map[uint32]bool)}
+				for _, i := range tc.drop {
+					dropper.drop[i] = true
+				}
+				if tc.dropGroups != nil {
+					dropper.groups = make(map[uint32]bool)
+					for _, g := range tc.dropGroups {
+						dropper.groups[g] = true
+					}
+				}
+				for i := range senderPaths {
+					senderPaths[i].Conn = &dropConn{PathConn: senderPaths[i].Conn, dropper: dropper}
+				}
+			}
+			opts := Options{ChunkSize: chunk, InitialWindow: tc.window, MaxWindow: tc.window,
+				FEC: FECConfig{DataShards: k, ParityShards: m}}
+			res := runTransfer(t, n, senderPaths, testData(tc.size), opts, nil)
+
+			groupData := k*chunk - groupLenPrefix
+			wantGroups := (tc.size + groupData - 1) / groupData
+			if res.sent.Groups != wantGroups || res.received.Groups != wantGroups {
+				t.Errorf("sent %d and received %d groups, want %d",
+					res.sent.Groups, res.received.Groups, wantGroups)
+			}
+			if retransmitted := res.sent.Retransmissions > 0; retransmitted != tc.retransmit {
+				t.Errorf("%d retransmissions, want retransmissions %t",
+					res.sent.Retransmissions, tc.retransmit)
+			}
+			recovered := res.received.Recovered
+			switch {
+			case tc.recovered == "none" && recovered != 0,
+				tc.recovered == "some" && (recovered == 0 || recovered > wantGroups),
+				tc.recovered == "all" && recovered != wantGroups:
+				t.Errorf("recovered %d of %d groups, want %s", recovered, wantGroups, tc.recovered)
+			}
+		})
+	}
+}
+
+// staleFrame returns a frame of the transfer before testTransfer.
+func staleFrame(typ byte, seq uint32, payload []byte) []byte {
+	frame := make([]byte, headerLen+len(payload))
+	header{Type: typ, Transfer: testTransfer - 1, Seq: seq}.encode(frame)
+	copy(frame[headerLen:], payload)
+	return frame
+}
+
+func TestReceiveIgnoresStaleFrames(t *testing.T) {
+	const chunk = 100
+	tests := []struct {
+		name string
+		opts Options
+	}{
+		{name: "plain", opts: Options{ChunkSize: chunk}},
+		{name: "fec", opts: Options{ChunkSize: chunk, FEC: FECConfig{DataShards: 4, ParityShards: 2}}},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			n := NewFakeNetwork(2, 1)
+			// The leftovers of an earlier transfer are queued before the
+			// receiver starts: a data frame, a shard and the FINs that would
+			// end a one-chunk or an empty stream.
+			stale := n.PathConn(0)
+			for _, frame := range [][]byte{
+				staleFrame(frameData, 0, []byte("stale")),
+				staleFrame(frameShard, 0, append([]byte{4, 2}, []byte("stale")...)),
+				staleFrame(frameFin, 1, nil),
+				staleFrame(frameFin, 0, nil),
+			} {
+				if _, err := stale.Write(frame); err != nil {
+					t.Fatal(err)
+				}
+			}
+			res := runTransfer(t, n, fakePaths(n, 2), testData(250), tc.opts, nil)
+			if res.received.Bytes != 250 {
+				t.Errorf("received %d bytes, want 250", res.received.Bytes)
+			}
+		})
+	}
+}
@@ -0,0 +1,866 @@
+// Package transport implements a simple reliable byte-stream transfer that
+// stripes data over several (ideally disjoint) SCION paths at once.
+//
+// The sender splits the stream into numbered chunks and keeps a congestion
+// window per path. Every chunk is acknowledged individually by the receiver on
+// the path it arrived on. Chunks that time out are handed to whichever path
+// has room next, so a failing path only slows the transfer down until it is
+// declared dead and its chunks have been moved to the remaining paths.
+//
+// With forward error correction enabled, every group of k chunks is encoded
+// into k data and m parity shards with a Reed-Solomon code, and the shards of
+// a group are spread over the paths. The receiver acknowledges a group as soon
+// as any k of its shards arrived, so losing single packets or a whole path
+// does not require a retransmission as long as no group loses more than m
+// shards.
+package transport
+
+import (
+	"context"
+	"encoding/binary"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/scionproto/scion/pkg/private/serrors"
+)
+
+const (
+	frameMagic = 0x4d
+
+	frameData   byte = 1
+	frameAck    byte = 2
+	frameFin    byte = 3
+	frameFinAck byte = 4
+	// frameShard carries one shard of an FEC group. The payload starts with
+	// the number of data and parity shards of the group.
+	frameShard byte = 5
+	// frameGroupAck acknowledges all shards of the FEC group in the sequence
+	// field.
+	frameGroupAck byte = 6
+
+	headerLen = 10
+	// shardPrefixLen is the length of the shard counts in a shard frame.
+	shardPrefixLen = 2
+	// groupLenPrefix is the length of the stream length stored in front of
+	// the data of an FEC group.
+	groupLenPrefix = 4
+
+	// DefaultChunkSize keeps a chunk plus the SCION/UDP headers of a path with
+	// a few hops below the 1472 byte MTU of the local topology.
+	DefaultChunkSize = 1000
+)
+
+// header is the fixed part of every frame.
+//
+//	0       1       2               6               10
+//	+-------+-------+---------------+---------------+
+//	| magic | type  |  transfer ID  |   sequence    |
+//	+-------+-------+---------------+---------------+
+type header struct {
+	Type     byte
+	Transfer uint32
+	Seq      uint32
+}
+
+func (h header) encode(b []byte) {
+	b[0] = frameMagic
+	b[1] = h.Type
+	binary.BigEndian.PutUint32(b[2:6], h.Transfer)
+	binary.BigEndian.PutUint32(b[6:10], h.Seq)
+}
+
+func decodeHeader(b []byte) (header, error) {
+	if len(b) < headerLen || b[0] != frameMagic {
+		return header{}, serrors.New("invalid frame", "len", len(b))
+	}
+	return header{
+		Type:     b[1],
+		Transfer: binary.BigEndian.Uint32(b[2:6]),
+		Seq:      binary.BigEndian.Uint32(b[6:10]),
+	}, nil
+}
+
+// PathConn is a connection bound to a single path. *snet.Conn returned by
+// snet.SCIONNetwork.Dial satisfies it.
+type PathConn interface {
+	Read(b []byte) (int, error)
+	Write(b []byte) (int, error)
+	SetReadDeadline(t time.Time) error
+}
+
+// SenderPath is one of the paths a Sender stripes data across.
+type SenderPath struct {
+	// Name identifies the path in the statistics, e.g. its fingerprint.
+	Name string
+	Conn PathConn
+}
+
+// FECConfig configures forward error correction. FEC is disabled if
+// DataShards is zero.
+type FECConfig struct {
+	// DataShards is the number of chunks encoded together (k).
+	DataShards int
+	// ParityShards is the number of parity shards added to each group (m).
+	ParityShards int
+}
+
+// Enabled reports whether FEC is used.
+func (c FECConfig) Enabled() bool {
+	return c.DataShards > 0
+}
+
+// Options configure a Sender.
+type Options struct {
+	// ChunkSize is the payload size of a data frame.
+	ChunkSize int
+	// InitialWindow is the congestion window (in chunks) every path starts with.
+	InitialWindow float64
+	// MaxWindow caps the congestion window of a path.
+	MaxWindow float64
+	// MaxFailures is the number of consecutive timeouts after which a path
+	// is considered dead.
+	MaxFailures int
+	// MinRTO bounds the retransmission timeout from below.
+	MinRTO time.Duration
+	// Linger is how long the receiver keeps confirming the end of a finished
+	// transfer, in case the confirmation got lost.
+	Linger time.Duration
+	// FEC enables forward error correction on the sender. The receiver
+	// detects it from the frames.
+	FEC FECConfig
+	// Transfer is the ID of the transfer the receiver accepts. The sender
+	// takes it as an argument of NewSender.
+	Transfer uint32
+}
+
+func (o *Options) initDefaults() {
+	if o.ChunkSize <= 0 {
+		o.ChunkSize = DefaultChunkSize
+	}
+	if o.InitialWindow <= 0 {
+		o.InitialWindow = 4
+	}
+	if o.MaxWindow <= 0 {
+		o.MaxWindow = 256
+	}
+	if o.MaxFailures <= 0 {
+		o.MaxFailures = 5
+	}
+	if o.MinRTO <= 0 {
+		o.MinRTO = 200 * time.Millisecond
+	}
+	if o.Linger <= 0 {
+		o.Linger = time.Second
+	}
+}
+
+// PathStats describes how a single path was used during a transfer.
+type PathStats struct {
+	Name          string
+	Sent          int
+	Acked         int
+	Timeouts      int
+	FinalWindow   float64
+	SmoothedRTT   time.Duration
+	Dead          bool
+	Retransmitted int
+}
+
+// Stats summarizes a transfer.
+type Stats struct {
+	Bytes  int64
+	Chunks int
+	// Groups is the number of FEC groups and Recovered the number of groups
+	// the receiver had to reconstruct from parity shards because a data shard
+	// was lost. Data shards that arrive after their group was decoded do not
+	// count as lost.
+	Groups          int
+	Recovered       int
+	Retransmissions int
+	Duration        time.Duration
+	Paths           []PathStats
+}
+
+// Throughput returns the goodput of the transfer in bytes per second.
+func (s Stats) Throughput() float64 {
+	if s.Duration <= 0 {
+		return 0
+	}
+	return float64(s.Bytes) / s.Duration.Seconds()
+}
+
+// pathState is the congestion and loss state of one path.
+type pathState struct {
+	SenderPath
+	stats PathStats
+
+	cwnd     float64
+	ssthresh float64
+	srtt     time.Duration
+	rttvar   time.Duration
+	rto      time.Duration
+	failures int
+	dead     bool
+	// backoff is when the window was last reduced. Timeouts within one RTO
+	// of it belong to the same loss event.
+	backoff  time.Time
+	inflight map[uint32]time.Time
+	// queued holds the shards assigned to this path that were not sent yet.
+	queued []uint32
+}
+
+func (p *pathState) updateRTT(sample time.Duration, minRTO time.Duration) {
+	if p.srtt == 0 {
+		p.srtt = sample
+		p.rttvar = sample / 2
+	} else {
+		delta := p.srtt - sample
+		if delta < 0 {
+			delta = -delta
+		}
+		p.rttvar = (3*p.rttvar + delta) / 4
+		p.srtt = (7*p.srtt + sample) / 8
+	}
+	p.rto = p.srtt + 4*p.rttvar
+	if p.rto < minRTO {
+		p.rto = minRTO
+	}
+}
+
+// Sender transfers a byte stream over several paths.
+type Sender struct {
+	opts     Options
+	paths    []*pathState
+	transfer uint32
+	rs       *reedSolomon
+}
+
+// NewSender creates a sender that stripes data over the given paths. The
+// transfer ID must be unique per receiver.
+func NewSender(paths []SenderPath, transfer uint32, opts Options) (*Sender, error) {
+	if len(paths) == 0 {
+		return nil, serrors.New("no paths to send on")
+	}
+	opts.initDefaults()
+	s := &Sender{opts: opts, transfer: transfer}
+	if opts.FEC.Enabled() {
+		rs, err := newReedSolomon(opts.FEC.DataShards, opts.FEC.ParityShards)
+		if err != nil {
+			return nil, err
+		}
+		if opts.ChunkSize*opts.FEC.DataShards <= groupLenPrefix {
+			return nil, serrors.New("chunk size too small for FEC")
+		}
+		s.rs = rs
+	}
+	for _, p := range paths {
+		s.paths = append(s.paths, &pathState{
+			SenderPath: p,
+			stats:      PathStats{Name: p.Name},
+			cwnd:       opts.InitialWindow,
+			ssthresh:   opts.MaxWindow,
+			rto:        time.Second,
+			inflight:   make(map[uint32]time.Time),
+		})
+	}
+	return s, nil
+}
+
+// Send transfers everything read from r and returns once the receiver
+// confirmed the complete stream. The path connections are not closed.
+func (s *Sender) Send(ctx context.Context, r io.Reader) (Stats, error) {
+	start := time.Now()
+	acks := make(chan header, 1024)
+
+	var wg sync.WaitGroup
+	readCtx, cancel := context.WithCancel(ctx)
+	defer func() {
+		cancel()
+		wg.Wait()
+	}()
+	for _, p := range s.paths {
+		wg.Add(1)
+		go func(conn PathConn) {
+			defer wg.Done()
+			readAcks(readCtx, conn, s.transfer, acks)
+		}(p.Conn)
+	}
+
+	frameType := frameData
+	if s.rs != nil {
+		frameType = frameShard
+	}
+
+	var (
+		stats    Stats
+		chunks   = make(map[uint32][]byte)
+		owner    = make(map[uint32]int)
+		retrans  []uint32
+		nextSeq  uint32
+		eof      bool
+		frame    = make([]byte, headerLen+shardPrefixLen+s.opts.ChunkSize)
+		finSent  time.Time
+		finTries int
+	)
+
+	send := func(p *pathState, seq uint32, typ byte, payload []byte) error {
+		header{Type: typ, Transfer: s.transfer, Seq: seq}.encode(frame)
+		n := copy(frame[headerLen:], payload)
+		if _, err := p.Conn.Write(frame[:headerLen+n]); err != nil {
+			return err
+		}
+		p.stats.Sent++
+		return nil
+	}
+
+	// ack retires a chunk or shard and grows the window of the path it was in
+	// flight on.
+	ack := func(seq uint32) {
+		if _, ok := chunks[seq]; !ok {
+			return
+		}
+		p := s.paths[owner[seq]]
+		delete(chunks, seq)
+		delete(owner, seq)
+		sent, ok := p.inflight[seq]
+		if !ok {
+			return
+		}
+		p.updateRTT(time.Since(sent), s.opts.MinRTO)
+		delete(p.inflight, seq)
+		p.stats.Acked++
+		p.failures = 0
+		if p.cwnd < p.ssthresh {
+			p.cwnd++
+		} else {
+			p.cwnd += 1 / p.cwnd
+		}
+		if p.cwnd > s.opts.MaxWindow {
+			p.cwnd = s.opts.MaxWindow
+		}
+	}
+
+	for {
+		if err := ctx.Err(); err != nil {
+			return s.stats(stats, start), err
+		}
+
+		// Fill the window of every live path: retransmissions first, then the
+		// shards assigned to the path, then new data.
+		alive := 0
+		for i, p := range s.paths {
+			if p.dead {
+				continue
+			}
+			alive++
+			for float64(len(p.inflight)) < p.cwnd {
+				seq, ok := s.takeRetransmission(&retrans, chunks, owner, i)
+				if ok {
+					stats.Retransmissions++
+					p.stats.Retransmitted++
+				} else {
+					seq, ok = s.takeQueued(p, chunks)
+				}
+				if !ok {
+					if eof {
+						break
+					}
+					var err error
+					eof, err = s.readNext(r, &stats, chunks, owner, &nextSeq, i)
+					if err != nil {
+						return s.stats(stats, start), err
+					}
+					continue
+				}
+				if err := send(p, seq, frameType, chunks[seq]); err != nil {
+					retrans = append(retrans, seq)
+					s.fail(p, &retrans)
+					break
+				}
+				p.inflight[seq] = time.Now()
+				owner[seq] = i
+			}
+		}
+		if alive == 0 {
+			return s.stats(stats, start), serrors.New("all paths failed")
+		}
+
+		// Once everything is acknowledged, close the transfer. The FIN carries
+		// the number of chunks, or of groups with FEC.
+		total := nextSeq
+		if s.rs != nil {
+			total = nextSeq / uint32(s.rs.k+s.rs.m)
+		}
+		if eof && len(chunks) == 0 {
+			if finSent.IsZero() || time.Since(finSent) > time.Second {
+				if finTries >= s.opts.MaxFailures {
+					return s.stats(stats, start), serrors.New("transfer end not confirmed")
+				}
+				for _, p := range s.paths {
+					if !p.dead {
+						_ = send(p, total, frameFin, nil)
+					}
+				}
+				finSent = time.Now()
+				finTries++
+			}
+		}
+
+		timer := time.NewTimer(s.nextTimeout())
+		select {
+		case a := <-acks:
+			timer.Stop()
+			switch a.Type {
+			case frameFinAck:
+				if eof && len(chunks) == 0 && a.Seq == total {
+					return s.stats(stats, start), nil
+				}
+			case frameAck:
+				ack(a.Seq)
+			case frameGroupAck:
+				if s.rs == nil {
+					continue
+				}
+				n := uint32(s.rs.k + s.rs.m)
+				for seq := a.Seq * n; seq < (a.Seq+1)*n; seq++ {
+					ack(seq)
+				}
+			}
+		case <-timer.C:
+			s.expire(&retrans)
+		case <-ctx.Done():
+			timer.Stop()
+		}
+	}
+}
+
+// readNext reads the next chunk, or the next FEC group, from r. A plain chunk
+// is queued on path i, the shards of a group are spread over all live paths.
+// It reports whether the end of the stream was reached.
+func (s *Sender) readNext(r io.Reader, stats *Stats, chunks map[uint32][]byte,
+	owner map[uint32]int, nextSeq *uint32, i int) (bool, error) {
+
+	if s.rs == nil {
+		buf := make([]byte, s.opts.ChunkSize)
+		n, eof, err := readChunk(r, buf)
+		if err != nil || n == 0 {
+			return eof, err
+		}
+		seq := *nextSeq
+		*nextSeq++
+		chunks[seq] = buf[:n]
+		owner[seq] = i
+		s.paths[i].queued = append(s.paths[i].queued, seq)
+		stats.Bytes += int64(n)
+		stats.Chunks++
+		return eof, nil
+	}
+
+	k, m := s.rs.k, s.rs.m
+	// The length prefix and the data together fill at most k chunks.
+	data := make([]byte, k*s.opts.ChunkSize)
+	n, eof, err := readChunk(r, data[groupLenPrefix:])
+	if err != nil || n == 0 {
+		return eof, err
+	}
+	binary.BigEndian.PutUint32(data, uint32(n))
+	shardSize := (groupLenPrefix + n + k - 1) / k
+
+	shards := make([][]byte, k+m)
+	for j := range shards {
+		shards[j] = make([]byte, shardSize)
+		if j < k {
+			copy(shards[j], data[j*shardSize:])
+		}
+	}
+	s.rs.encode(shards)
+
+	var alive []int
+	for j, p := range s.paths {
+		if !p.dead {
+			alive = append(alive, j)
+		}
+	}
+	// Rotate the assignment so that the parity shards do not always end up
+	// on the same paths.
+	offset := stats.Groups
+	for j, shard := range shards {
+		seq := *nextSeq
+		*nextSeq++
+		payload := make([]byte, shardPrefixLen+len(shard))
+		payload[0], payload[1] = byte(k), byte(m)
+		copy(payload[shardPrefixLen:], shard)
+		chunks[seq] = payload
+
+		p := alive[(j+offset)%len(alive)]
+		owner[seq] = p
+		s.paths[p].queued = append(s.paths[p].queued, seq)
+	}
+	stats.Bytes += int64(n)
+	stats.Chunks += k + m
+	stats.Groups++
+	return eof, nil
+}
+
+// readChunk fills buf from r as far as possible.
+func readChunk(r io.Reader, buf []byte) (int, bool, error) {
+	n, err := io.ReadFull(r, buf)
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		return n, true, nil
+	}
+	if err != nil {
+		return n, false, serrors.WrapStr("reading stream", err)
+	}
+	return n, false, nil
+}
+
+// takeQueued removes the next chunk assigned to the path that is not yet
+// acknowledged.
+func (s *Sender) takeQueued(p *pathState, chunks map[uint32][]byte) (uint32, bool) {
+	for len(p.queued) > 0 {
+		seq := p.queued[0]
+		p.queued = p.queued[1:]
+		if _, ok := chunks[seq]; ok {
+			return seq, true
+		}
+	}
+	return 0, false
+}
+
+// takeRetransmission removes the first chunk from the retransmission queue
+// that was not last sent on path i. Chunks are only retransmitted on the path
+// they timed out on if no other path is alive.
+func (s *Sender) takeRetransmission(retrans *[]uint32, chunks map[uint32][]byte,
+	owner map[uint32]int, i int) (uint32, bool) {
+
+	others := 0
+	for j, p := range s.paths {
+		if j != i && !p.dead {
+			others++
+		}
+	}
+	queue := *retrans
+	for k := 0; k < len(queue); k++ {
+		seq := queue[k]
+		if _, ok := chunks[seq]; !ok {
+			// Acknowledged in the meantime.
+			queue = append(queue[:k], queue[k+1:]...)
+			k--
+			continue
+		}
+		if owner[seq] == i && others > 0 {
+			continue
+		}
+		*retrans = append(queue[:k], queue[k+1:]...)
+		return seq, true
+	}
+	*retrans = queue
+	return 0, false
+}
+
+// nextTimeout returns how long to wait until the earliest in-flight chunk
+// times out.
+func (s *Sender) nextTimeout() time.Duration {
+	wait := time.Second
+	now := time.Now()
+	for _, p := range s.paths {
+		for _, sent := range p.inflight {
+			if d := sent.Add(p.rto).Sub(now); d < wait {
+				wait = d
+			}
+		}
+	}
+	if wait < time.Millisecond {
+		wait = time.Millisecond
+	}
+	return wait
+}
+
+// expire requeues every chunk whose retransmission timeout passed and backs
+// off the window of the path it was sent on, at most once per RTO.
+func (s *Sender) expire(retrans *[]uint32) {
+	now := time.Now()
+	for _, p := range s.paths {
+		timedOut := false
+		for seq, sent := range p.inflight {
+			if now.Sub(sent) >= p.rto {
+				delete(p.inflight, seq)
+				*retrans = append(*retrans, seq)
+				timedOut = true
+			}
+		}
+		if !timedOut || now.Sub(p.backoff) < p.rto {
+			continue
+		}
+		p.backoff = now
+		p.stats.Timeouts++
+		p.failures++
+		p.ssthresh = p.cwnd / 2
+		if p.ssthresh < 1 {
+			p.ssthresh = 1
+		}
+		p.cwnd = 1
+		p.rto *= 2
+		if p.failures >= s.opts.MaxFailures {
+			s.fail(p, retrans)
+		}
+	}
+}
+
+// fail marks the path as dead and moves its in-flight and queued chunks to the
+// others.
+func (s *Sender) fail(p *pathState, retrans *[]uint32) {
+	p.dead = true
+	for seq := range p.inflight {
+		*retrans = append(*retrans, seq)
+	}
+	p.inflight = make(map[uint32]time.Time)
+
+	// Shards that were never sent are not retransmissions, they are handed
+	// to the remaining paths in turn.
+	var alive []*pathState
+	for _, other := range s.paths {
+		if !other.dead {
+			alive = append(alive, other)
+		}
+	}
+	for j, seq := range p.queued {
+		if len(alive) == 0 {
+			break
+		}
+		other := alive[j%len(alive)]
+		other.queued = append(other.queued, seq)
+	}
+	p.queued = nil
+}
+
+func (s *Sender) stats(stats Stats, start time.Time) Stats {
+	stats.Duration = time.Since(start)
+	for _, p := range s.paths {
+		ps := p.stats
+		ps.FinalWindow = p.cwnd
+		ps.SmoothedRTT = p.srtt
+		ps.Dead = p.dead
+		stats.Paths = append(stats.Paths, ps)
+	}
+	return stats
+}
+
+// readAcks forwards the acknowledgments received on conn until ctx is done.
+// The read deadline is renewed regularly so that cancellation is noticed.
+func readAcks(ctx context.Context, conn PathConn, transfer uint32, acks chan<- header) {
+	buf := make([]byte, 64)
+	for ctx.Err() == nil {
+		_ = conn.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+		n, err := conn.Read(buf)
+		if err != nil {
+			if ne, ok := err.(net.Error); ok && ne.Timeout() {
+				continue
+			}
+			return
+		}
+		hdr, err := decodeHeader(buf[:n])
+		if err != nil || hdr.Transfer != transfer {
+			continue
+		}
+		select {
+		case acks <- hdr:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// Receive reads the transfer opts.Transfer from conn, writes the reassembled
+// stream to w and returns once the sender closed the transfer. Frames of other
+// transfers, e.g. leftovers of an earlier one, are ignored.
+func Receive(ctx context.Context, conn net.PacketConn, w io.Writer, opts Options) (Stats, error) {
+	opts.initDefaults()
+	start := time.Now()
+
+	var (
+		stats    Stats
+		transfer = opts.Transfer
+		next     uint32
+		total    = ^uint32(0)
+		buffered = make(map[uint32][]byte)
+		buf      = make([]byte, headerLen+shardPrefixLen+opts.ChunkSize+64)
+		reply    = make([]byte, headerLen)
+		finished time.Time
+
+		// With FEC, buffered and next count groups instead of chunks.
+		rs      *reedSolomon
+		pending = make(map[uint32][][]byte)
+		// late holds the data shards that were missing when their group was
+		// decoded, and missing how many of them every recovered group still
+		// lacks. If all of them arrive later, the group was only reordered
+		// and does not count as recovered.
+		late    = make(map[uint32]bool)
+		missing = make(map[uint32]int)
+	)
+
+	for {
+		if err := ctx.Err(); err != nil {
+			return stats, err
+		}
+		deadline := time.Now().Add(100 * time.Millisecond)
+		if d, ok := ctx.Deadline(); ok && d.Before(deadline) {
+			deadline = d
+		}
+		_ = conn.SetReadDeadline(deadline)
+		n, from, err := conn.ReadFrom(buf)
+		if err != nil {
+			if ne, ok := err.(net.Error); ok && ne.Timeout() {
+				if !finished.IsZero() && time.Since(finished) > opts.Linger {
+					return stats, nil
+				}
+				continue
+			}
+			return stats, serrors.WrapStr("reading frame", err)
+		}
+		hdr, err := decodeHeader(buf[:n])
+		if err != nil {
+			continue
+		}
+		if hdr.Transfer != transfer {
+			continue
+		}
+
+		switch hdr.Type {
+		case frameData:
+			header{Type: frameAck, Transfer: transfer, Seq: hdr.Seq}.encode(reply)
+			_, _ = conn.WriteTo(reply, from)
+			if hdr.Seq < next {
+				continue
+			}
+			if _, ok := buffered[hdr.Seq]; !ok {
+				buffered[hdr.Seq] = append([]byte(nil), buf[headerLen:n]...)
+				stats.Chunks++
+			}
+		case frameShard:
+			payload := buf[headerLen:n]
+			if len(payload) <= shardPrefixLen {
+				continue
+			}
+			k, m := int(payload[0]), int(payload[1])
+			if rs == nil || rs.k != k || rs.m != m {
+				if rs, err = newReedSolomon(k, m); err != nil {
+					rs = nil
+					continue
+				}
+			}
+			group := hdr.Seq / uint32(k+m)
+			if late[hdr.Seq] {
+				delete(late, hdr.Seq)
+				if missing[group]--; missing[group] == 0 {
+					delete(missing, group)
+					stats.Recovered--
+				}
+			}
+			_, decoded := buffered[group]
+			if group >= next && !decoded {
+				stats.Chunks++
+				data, lost, err := addShard(rs, pending, hdr.Seq, payload[shardPrefixLen:])
+				if err != nil {
+					// Start over, the sender retransmits the unacknowledged
+					// shards.
+					delete(pending, group)
+					continue
+				}
+				if data == nil {
+					continue
+				}
+				buffered[group] = data
+				delete(pending, group)
+				stats.Groups++
+				if len(lost) > 0 {
+					stats.Recovered++
+					missing[group] = len(lost)
+					for _, seq := range lost {
+						late[seq] = true
+					}
+				}
+			}
+			header{Type: frameGroupAck, Transfer: transfer, Seq: group}.encode(reply)
+			_, _ = conn.WriteTo(reply, from)
+		case frameFin:
+			total = hdr.Seq
+		}
+
+		for {
+			data, ok := buffered[next]
+			if !ok {
+				break
+			}
+			if _, err := w.Write(data); err != nil {
+				return stats, serrors.WrapStr("writing stream", err)
+			}
+			delete(buffered, next)
+			stats.Bytes += int64(len(data))
+			next++
+		}
+
+		if total != ^uint32(0) && next >= total {
+			header{Type: frameFinAck, Transfer: transfer, Seq: total}.encode(reply)
+			_, _ = conn.WriteTo(reply, from)
+			if finished.IsZero() {
+				finished = time.Now()
+				stats.Duration = finished.Sub(start)
+			}
+		}
+	}
+}
+
+// addShard stores a shard of an FEC group. Once k shards of the group are
+// present it returns the decoded data of the group and the sequence numbers
+// of the data shards that were recovered from parity shards.
+func addShard(rs *reedSolomon, pending map[uint32][][]byte, seq uint32,
+	shard []byte) ([]byte, []uint32, error) {
+
+	n := uint32(rs.k + rs.m)
+	group, index := seq/n, seq%n
+	shards, ok := pending[group]
+	if !ok {
+		shards = make([][]byte, n)
+		pending[group] = shards
+	}
+	if shards[index] == nil {
+		shards[index] = append([]byte(nil), shard...)
+	}
+
+	present := 0
+	var lost []uint32
+	for i, sh := range shards {
+		if sh != nil {
+			present++
+		} else if i < rs.k {
+			lost = append(lost, group*n+uint32(i))
+		}
+	}
+	if present < rs.k {
+		return nil, nil, nil
+	}
+	for _, sh := range shards {
+		if sh != nil && len(sh) != len(shard) {
+			return nil, nil, serrors.New("inconsistent shard sizes", "group", group)
+		}
+	}
+	if err := rs.reconstruct(shards); err != nil {
+		return nil, nil, serrors.WrapStr("decoding group", err, "group", group)
+	}
+
+	data := make([]byte, 0, rs.k*len(shard))
+	for _, sh := range shards[:rs.k] {
+		data = append(data, sh...)
+	}
+	if len(data) < groupLenPrefix {
+		return nil, nil, serrors.New("group too short", "group", group)
+	}
+	length := int(binary.BigEndian.Uint32(data))
+	if length > len(data)-groupLenPrefix {
+		return nil, nil, serrors.New("invalid group length", "group", group, "length", length)
+	}
+	return data[groupLenPrefix : groupLenPrefix+length], lost, nil
+}
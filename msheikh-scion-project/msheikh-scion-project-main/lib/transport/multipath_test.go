@@ -0,0 +1,208 @@
+package transport
+
+import (
+	"bytes"
+	"context"
+	"math/rand"
+	"testing"
+	"time"
+)
+
+// testTransfer is the ID of the transfers of the tests.
+const testTransfer = 7
+
+// testData returns n reproducible random bytes.
+func testData(n int) []byte {
+	data := make([]byte, n)
+	rand.New(rand.NewSource(int64(n))).Read(data)
+	return data
+}
+
+// transferResult is the outcome of a transfer over a FakeNetwork.
+type transferResult struct {
+	sent, received Stats
+}
+
+// fakePaths returns the sender's end of the first count paths of the network.
+func fakePaths(n *FakeNetwork, count int) []SenderPath {
+	var paths []SenderPath
+	for i := 0; i < count; i++ {
+		paths = append(paths, SenderPath{Name: fakeAddr(i).String(), Conn: n.PathConn(i)})
+	}
+	return paths
+}
+
+// runTransfer sends data over the given paths to the receiver of the network.
+// onWrite, if set, is called with the number of bytes the receiver
+// reassembled so far.
+func runTransfer(t *testing.T, n *FakeNetwork, paths []SenderPath, data []byte, opts Options,
+	onWrite func(int)) transferResult {
+
+	t.Helper()
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	sender, err := NewSender(paths, testTransfer, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	out := &notifyWriter{onWrite: onWrite}
+	type received struct {
+		stats Stats
+		err   error
+	}
+	done := make(chan received, 1)
+	go func() {
+		stats, err := Receive(ctx, n.ReceiverConn(), out,
+			Options{Linger: 50 * time.Millisecond, Transfer: testTransfer})
+		done <- received{stats, err}
+	}()
+
+	sent, err := sender.Send(ctx, bytes.NewReader(data))
+	if err != nil {
+		t.Fatalf("sending: %v (stats %+v)", err, sent)
+	}
+	r := <-done
+	if r.err != nil {
+		t.Fatalf("receiving: %v", r.err)
+	}
+	if !bytes.Equal(out.buf.Bytes(), data) {
+		t.Fatalf("received %d bytes that differ from the %d bytes sent", out.buf.Len(), len(data))
+	}
+	return transferResult{sent: sent, received: r.stats}
+}
+
+// notifyWriter collects the reassembled stream.
+type notifyWriter struct {
+	buf     bytes.Buffer
+	onWrite func(int)
+}
+
+func (w *notifyWriter) Write(b []byte) (int, error) {
+	n, err := w.buf.Write(b)
+	if w.onWrite != nil {
+		w.onWrite(w.buf.Len())
+	}
+	return n, err
+}
+
+func TestTransferReassembly(t *testing.T) {
+	const chunk = 100
+	tests := []struct {
+		name  string
+		size  int
+		paths int
+	}{
+		{"empty", 0, 1},
+		{"empty on several paths", 0, 3},
+		{"one byte", 1, 1},
+		{"one byte on several paths", 1, 3},
+		{"one chunk", chunk, 2},
+		{"chunk plus one", chunk + 1, 2},
+		{"many chunks", 250*chunk + 17, 3},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			n := NewFakeNetwork(tc.paths, 1)
+			// Different delays reorder the chunks at the receiver.
+			for i := 0; i < tc.paths; i++ {
+				n.SetDelay(i, time.Duration(i)*2*time.Millisecond)
+			}
+			res := runTransfer(t, n, fakePaths(n, tc.paths), testData(tc.size),
+				Options{ChunkSize: chunk}, nil)
+
+			wantChunks := (tc.size + chunk - 1) / chunk
+			if res.sent.Bytes != int64(tc.size) || res.sent.Chunks != wantChunks {
+				t.Errorf("sender counted %d bytes in %d chunks, want %d in %d",
+					res.sent.Bytes, res.sent.Chunks, tc.size, wantChunks)
+			}
+			if res.received.Bytes != int64(tc.size) || res.received.Chunks != wantChunks {
+				t.Errorf("receiver counted %d bytes in %d chunks, want %d in %d",
+					res.received.Bytes, res.received.Chunks, tc.size, wantChunks)
+			}
+			if res.sent.Retransmissions != 0 {
+				t.Errorf("%d retransmissions on lossless paths", res.sent.Retransmissions)
+			}
+		})
+	}
+}
+
+func TestTransferPathWindows(t *testing.T) {
+	n := NewFakeNetwork(2, 1)
+	n.SetDelay(0, time.Millisecond)
+	n.SetDelay(1, time.Millisecond)
+	n.SetLoss(1, 0.3)
+	opts := Options{ChunkSize: 100, InitialWindow: 2, MaxFailures: 100}
+	res := runTransfer(t, n, fakePaths(n, 2), testData(50000), opts, nil)
+
+	lossless, lossy := res.sent.Paths[0], res.sent.Paths[1]
+	if lossless.Timeouts != 0 {
+		t.Errorf("lossless path timed out %d times", lossless.Timeouts)
+	}
+	if lossless.FinalWindow <= opts.InitialWindow {
+		t.Errorf("window of the lossless path stayed at %g", lossless.FinalWindow)
+	}
+	if lossy.Timeouts == 0 {
+		t.Error("lossy path never timed out")
+	}
+	if lossless.Acked <= lossy.Acked {
+		t.Errorf("lossless path carried %d chunks, lossy path %d", lossless.Acked, lossy.Acked)
+	}
+	if res.sent.Retransmissions == 0 {
+		t.Error("lost chunks were not retransmitted")
+	}
+	for _, p := range res.sent.Paths {
+		if p.Dead {
+			t.Errorf("path %s declared dead", p.Name)
+		}
+	}
+}
+
+func TestTransferFailover(t *testing.T) {
+	const size = 100000
+	tests := []struct {
+		name string
+		// failAt is the number of received bytes after which path 1 goes
+		// down, 0 if it is down from the start.
+		failAt int
+	}{
+		{"down from the start", 0},
+		{"fails during the transfer", size / 4},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			n := NewFakeNetwork(3, 1)
+			for i := 0; i < 3; i++ {
+				n.SetDelay(i, time.Millisecond)
+			}
+			onWrite := func(received int) {
+				if received >= tc.failAt {
+					n.SetLoss(1, 1)
+				}
+			}
+			if tc.failAt == 0 {
+				n.SetLoss(1, 1)
+				onWrite = nil
+			}
+			// The first timeout kills a path, the transfer might end before a
+			// second one. The chunks lost on the failed path cannot arrive
+			// before it timed out. The timeout is generous so that the working
+			// paths do not time out as well on a slow machine.
+			opts := Options{ChunkSize: 100, MinRTO: 300 * time.Millisecond, MaxFailures: 1}
+			res := runTransfer(t, n, fakePaths(n, 3), testData(size), opts, onWrite)
+
+			if failed := res.sent.Paths[1]; !failed.Dead {
+				t.Errorf("failed path not declared dead: %+v", failed)
+			}
+			if res.sent.Retransmissions == 0 {
+				t.Error("chunks of the failed path were not retransmitted")
+			}
+			for _, i := range []int{0, 2} {
+				if p := res.sent.Paths[i]; p.Dead || p.Acked == 0 {
+					t.Errorf("working path %s: %+v", p.Name, p)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,180 @@
+package transport
+
+import (
+	"github.com/scionproto/scion/pkg/private/serrors"
+)
+
+// Arithmetic in GF(2^8) with the primitive polynomial x^8+x^4+x^3+x^2+1.
+var (
+	gfExp [512]byte
+	gfLog [256]byte
+)
+
+func init() {
+	x := 1
+	for i := 0; i < 255; i++ {
+		gfExp[i] = byte(x)
+		gfLog[x] = byte(i)
+		x <<= 1
+		if x&0x100 != 0 {
+			x ^= 0x11d
+		}
+	}
+	for i := 255; i < len(gfExp); i++ {
+		gfExp[i] = gfExp[i-255]
+	}
+}
+
+func gfMul(a, b byte) byte {
+	if a == 0 || b == 0 {
+		return 0
+	}
+	return gfExp[int(gfLog[a])+int(gfLog[b])]
+}
+
+func gfInv(a byte) byte {
+	return gfExp[255-int(gfLog[a])]
+}
+
+// reedSolomon is a systematic Reed-Solomon code with k data and m parity
+// shards. The parity rows form a Cauchy matrix, so any k of the k+m shards
+// suffice to recover the data.
+type reedSolomon struct {
+	k, m int
+	// matrix is the (k+m) x k encoding matrix, the identity on top of the
+	// Cauchy rows.
+	matrix [][]byte
+}
+
+func newReedSolomon(k, m int) (*reedSolomon, error) {
+	if k <= 0 || m < 0 || k+m > 256 {
+		return nil, serrors.New("invalid shard counts", "data", k, "parity", m)
+	}
+	rs := &reedSolomon{k: k, m: m, matrix: make([][]byte, k+m)}
+	for i := 0; i < k; i++ {
+		rs.matrix[i] = make([]byte, k)
+		rs.matrix[i][i] = 1
+	}
+	for i := 0; i < m; i++ {
+		row := make([]byte, k)
+		for j := 0; j < k; j++ {
+			// x_i = k+i and y_j = j are distinct, so x_i ^ y_j is never 0.
+			row[j] = gfInv(byte(k+i) ^ byte(j))
+		}
+		rs.matrix[k+i] = row
+	}
+	return rs, nil
+}
+
+// encode fills the parity shards shards[k:] from the data shards shards[:k].
+// All shards must have the same length.
+func (rs *reedSolomon) encode(shards [][]byte) {
+	for i := 0; i < rs.m; i++ {
+		parity := shards[rs.k+i]
+		for b := range parity {
+			parity[b] = 0
+		}
+		for j, coeff := range rs.matrix[rs.k+i] {
+			mulAdd(parity, shards[j], coeff)
+		}
+	}
+}
+
+// reconstruct recovers the missing (nil) data shards from any k present
+// shards. Parity shards are not restored.
+func (rs *reedSolomon) reconstruct(shards [][]byte) error {
+	missing := false
+	for i := 0; i < rs.k; i++ {
+		if shards[i] == nil {
+			missing = true
+			break
+		}
+	}
+	if !missing {
+		return nil
+	}
+
+	var rows []int
+	size := 0
+	for i, shard := range shards {
+		if shard != nil && len(rows) < rs.k {
+			rows = append(rows, i)
+			size = len(shard)
+		}
+	}
+	if len(rows) < rs.k {
+		return serrors.New("not enough shards", "present", len(rows), "needed", rs.k)
+	}
+
+	sub := make([][]byte, rs.k)
+	for r, i := range rows {
+		sub[r] = append([]byte(nil), rs.matrix[i]...)
+	}
+	inv, err := invertMatrix(sub)
+	if err != nil {
+		return err
+	}
+
+	for i := 0; i < rs.k; i++ {
+		if shards[i] != nil {
+			continue
+		}
+		out := make([]byte, size)
+		for r, row := range rows {
+			mulAdd(out, shards[row], inv[i][r])
+		}
+		shards[i] = out
+	}
+	return nil
+}
+
+// mulAdd computes dst ^= coeff * src.
+func mulAdd(dst, src []byte, coeff byte) {
+	if coeff == 0 {
+		return
+	}
+	for i, b := range src {
+		dst[i] ^= gfMul(coeff, b)
+	}
+}
+
+// invertMatrix inverts a square matrix with Gauss-Jordan elimination.
+func invertMatrix(m [][]byte) ([][]byte, error) {
+	n := len(m)
+	inv := make([][]byte, n)
+	for i := range inv {
+		inv[i] = make([]byte, n)
+		inv[i][i] = 1
+	}
+	for col := 0; col < n; col++ {
+		pivot := -1
+		for r := col; r < n; r++ {
+			if m[r][col] != 0 {
+				pivot = r
+				break
+			}
+		}
+		if pivot == -1 {
+			return nil, serrors.New("singular matrix")
+		}
+		m[col], m[pivot] = m[pivot], m[col]
+		inv[col], inv[pivot] = inv[pivot], inv[col]
+
+		scale := gfInv(m[col][col])
+		for c := 0; c < n; c++ {
+			m[col][c] = gfMul(m[col][c], scale)
+			inv[col][c] = gfMul(inv[col][c], scale)
+		}
+		for r := 0; r < n; r++ {
+			if r == col || m[r][col] == 0 {
+				continue
+			}
+			factor := m[r][col]
+			for c := 0; c < n; c++ {
+				m[r][c] ^= gfMul(factor, m[col][c])
+				inv[r][c] ^= gfMul(factor, inv[col][c])
+			}
+		}
+	}
+	return inv, nil
+}
@@ -0,0 +1,224 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/scionproto/scion/pkg/log"
+	"github.com/scionproto/scion/pkg/private/serrors"
+	"github.com/scionproto/scion/pkg/snet"
+)
+
+// disjointMode selects what two paths must not share to count as disjoint.
+type disjointMode string
+
+const (
+	// linkDisjoint counts the inter-AS links two paths have in common.
+	linkDisjoint disjointMode = "link"
+	// asDisjoint counts the on-path ASes (excluding source and destination)
+	// two paths have in common.
+	asDisjoint disjointMode = "as"
+)
+
+func (m *disjointMode) String() string {
+	return string(*m)
+}
+
+func (m *disjointMode) Set(s string) error {
+	switch disjointMode(s) {
+	case linkDisjoint, asDisjoint:
+		*m = disjointMode(s)
+		return nil
+	default:
+		return serrors.New("unknown disjointness mode", "mode", s)
+	}
+}
+
+// The kind of disjointness used when several paths are needed at once.
+var pathDisjointness = linkDisjoint
+
+func init() {
+	flag.Var(&pathDisjointness, "disjoint",
+		"How multipath selection measures path overlap: link or as")
+}
+
+// pathElements returns the elements of a path that are compared for
+// disjointness: the inter-AS links in link mode, the transit ASes in AS mode.
+func pathElements(p snet.Path, mode disjointMode) []string {
+	metadata := p.Metadata()
+	if metadata == nil {
+		return nil
+	}
+	interfaces := metadata.Interfaces
+
+	var elements []string
+	switch mode {
+	case asDisjoint:
+		seen := make(map[string]bool)
+		for i := 1; i < len(interfaces)-1; i++ {
+			ia := interfaces[i].IA.String()
+			if !seen[ia] {
+				seen[ia] = true
+				elements = append(elements, ia)
+			}
+		}
+	default:
+		// Interfaces come in pairs, one for each end of an inter-AS link.
+		for i := 0; i+1 < len(interfaces); i += 2 {
+			a := fmt.Sprintf("%s#%d", interfaces[i].IA, interfaces[i].ID)
+			b := fmt.Sprintf("%s#%d", interfaces[i+1].IA, interfaces[i+1].ID)
+			if b < a {
+				a, b = b, a
+			}
+			elements = append(elements, a+"-"+b)
+		}
+	}
+	return elements
+}
+
+// pathOverlap returns the number of elements two paths share.
+func pathOverlap(a, b snet.Path, mode disjointMode) int {
+	set := make(map[string]bool)
+	for _, e := range pathElements(a, mode) {
+		set[e] = true
+	}
+	overlap := 0
+	for _, e := range pathElements(b, mode) {
+		if set[e] {
+			overlap++
+		}
+	}
+	return overlap
+}
+
+// overlapMatrix returns the pairwise overlap of the given paths.
+func overlapMatrix(paths []snet.Path, mode disjointMode) [][]int {
+	matrix := make([][]int, len(paths))
+	for i := range paths {
+		matrix[i] = make([]int, len(paths))
+		for j := range paths {
+			matrix[i][j] = pathOverlap(paths[i], paths[j], mode)
+		}
+	}
+	return matrix
+}
+
+// logOverlapMatrix logs the overlap matrix row by row.
+func logOverlapMatrix(ctx context.Context, paths []snet.Path, mode disjointMode) {
+	logger := log.FromCtx(ctx)
+
+	matrix := overlapMatrix(paths, mode)
+	for i, row := range matrix {
+		cells := make([]string, len(row))
+		for j, overlap := range row {
+			cells[j] = fmt.Sprintf("%d", overlap)
+		}
+		logger.Info("Path overlap", pathFields(paths[i], "mode", mode, "path", i,
+			"overlap", strings.Join(cells, " "))...)
+	}
+}
+
+// pathLatency returns the announced latency of a path and the number of hops
+// without latency information.
+func pathLatency(p snet.Path) (time.Duration, int) {
+	metadata := p.Metadata()
+	if metadata == nil || len(metadata.Latency) == 0 {
+		return 0, 1
+	}
+	var total time.Duration
+	missing := 0
+	for _, lat := range metadata.Latency {
+		if lat == snet.LatencyUnset || lat < 0 {
+			missing++
+		} else {
+			total += lat
+		}
+	}
+	return total, missing
+}
+
+// latencyRank ranks a path by the given metrics, then by fewer unknown
+// latencies and then by lower latency.
+func latencyRank(p snet.Path, metrics ...float64) pathRank {
+	latency, missing := pathLatency(p)
+	return newPathRank(p, append(metrics, float64(missing), float64(latency))...)
+}
+
+// selectDisjointPaths greedily picks k paths that share as few links (or ASes)
+// as possible. The selection starts with seed if it is set and with the
+// lowest-latency path otherwise. Each further path minimizes the largest
+// overlap with the already selected paths, then the total overlap; remaining
+// ties are broken by latency and then by the common path order.
+func selectDisjointPaths(ctx context.Context, paths []snet.Path, k int,
+	mode disjointMode, seed snet.Path) ([]snet.Path, error) {
+
+	logger := log.FromCtx(ctx)
+
+	if k > len(paths) {
+		return nil, serrors.New("not enough paths for disjoint selection",
+			"needed", k, "available", len(paths))
+	}
+	if k <= 0 {
+		return nil, nil
+	}
+
+	used := make([]bool, len(paths))
+	var selected []snet.Path
+
+	first := -1
+	if seed != nil {
+		for i, p := range paths {
+			if snet.Fingerprint(p) == snet.Fingerprint(seed) {
+				first = i
+				break
+			}
+		}
+	} else {
+		ranks := make([]pathRank, len(paths))
+		for i, p := range paths {
+			ranks[i] = latencyRank(p)
+		}
+		first = bestPathRank(ranks)
+	}
+	if first == -1 {
+		return nil, serrors.New("seed path is not among the candidates")
+	}
+	used[first] = true
+	selected = append(selected, paths[first])
+	logger.Info("Disjoint selection start", pathFields(paths[first], "path_index", first,
+		"mode", mode)...)
+
+	for len(selected) < k {
+		var (
+			ranks   []pathRank
+			indices []int
+		)
+		for i, p := range paths {
+			if used[i] {
+				continue
+			}
+			maxOverlap, sumOverlap := 0, 0
+			for _, s := range selected {
+				overlap := pathOverlap(p, s, mode)
+				sumOverlap += overlap
+				if overlap > maxOverlap {
+					maxOverlap = overlap
+				}
+			}
+			ranks = append(ranks, latencyRank(p, float64(maxOverlap), float64(sumOverlap)))
+			indices = append(indices, i)
+		}
+		r := bestPathRank(ranks)
+		best, bestMax, bestSum := indices[r], int(ranks[r].metrics[0]), int(ranks[r].metrics[1])
+		used[best] = true
+		selected = append(selected, paths[best])
+		logger.Info("Disjoint selection next", pathFields(paths[best], "path_index", best,
+			"max_overlap", bestMax, "total_overlap", bestSum)...)
+	}
+
+	logOverlapMatrix(ctx, selected, mode)
+	return selected, nil
+}
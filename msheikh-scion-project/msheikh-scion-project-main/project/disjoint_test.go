@@ -0,0 +1,148 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/scionproto/scion/pkg/snet"
+)
+
+// disjointTestPaths lead from 1-ff00:0:110 to 1-ff00:0:112. B shares its first
+// link with A, D runs through the same AS as A and B on other links and C
+// through another AS.
+var disjointTestPaths = map[string]fixturePath{
+	"A": {Interfaces: []string{"1-ff00:0:110#1", "1-ff00:0:111#1", "1-ff00:0:111#2",
+		"1-ff00:0:112#1"}, LatencyMs: []int64{10, 0, 0}},
+	"B": {Interfaces: []string{"1-ff00:0:110#1", "1-ff00:0:111#1", "1-ff00:0:111#3",
+		"1-ff00:0:112#2"}, LatencyMs: []int64{5, 0, 0}},
+	"C": {Interfaces: []string{"1-ff00:0:110#2", "1-ff00:0:113#1", "1-ff00:0:113#2",
+		"1-ff00:0:112#3"}, LatencyMs: []int64{30, 0, 0}},
+	"D": {Interfaces: []string{"1-ff00:0:110#3", "1-ff00:0:111#4", "1-ff00:0:111#5",
+		"1-ff00:0:112#4"}, LatencyMs: []int64{20, 0, 0}},
+	// E is disjoint from the others like C, but its latency is unknown.
+	"E": {Interfaces: []string{"1-ff00:0:110#4", "1-ff00:0:114#1", "1-ff00:0:114#2",
+		"1-ff00:0:112#5"}, LatencyMs: []int64{-1, 0, 0}},
+
+	// S, T, X, Y and W tell the largest from the total AS overlap apart. After
+	// S and T, X shares two ASes with S, Y one with S and one with T and W one
+	// with S only.
+	"S": {Interfaces: []string{"1-ff00:0:110#10", "1-ff00:0:121#1", "1-ff00:0:121#2",
+		"1-ff00:0:123#1", "1-ff00:0:123#2", "1-ff00:0:112#10"}, LatencyMs: []int64{1, 0, 0, 0, 0}},
+	"T": {Interfaces: []string{"1-ff00:0:110#11", "1-ff00:0:124#1", "1-ff00:0:124#2",
+		"1-ff00:0:112#11"}, LatencyMs: []int64{50, 0, 0}},
+	"X": {Interfaces: []string{"1-ff00:0:110#12", "1-ff00:0:121#3", "1-ff00:0:121#4",
+		"1-ff00:0:123#3", "1-ff00:0:123#4", "1-ff00:0:112#12"}, LatencyMs: []int64{2, 0, 0, 0, 0}},
+	"Y": {Interfaces: []string{"1-ff00:0:110#13", "1-ff00:0:121#5", "1-ff00:0:121#6",
+		"1-ff00:0:124#3", "1-ff00:0:124#4", "1-ff00:0:112#13"}, LatencyMs: []int64{3, 0, 0, 0, 0}},
+	"W": {Interfaces: []string{"1-ff00:0:110#14", "1-ff00:0:121#7", "1-ff00:0:121#8",
+		"1-ff00:0:112#14"}, LatencyMs: []int64{4, 0, 0}},
+}
+
+func TestSelectDisjointPaths(t *testing.T) {
+	tests := []struct {
+		name  string
+		paths string
+		k     int
+		mode  disjointMode
+		seed  string
+		// want are the selected paths in order, empty if the selection
+		// must fail.
+		want string
+	}{
+		{name: "lowest latency first", paths: "ABCD", k: 1, mode: linkDisjoint, want: "B"},
+		{
+			// C and D share nothing with B, D has the lower latency.
+			name: "link disjoint", paths: "ABCD", k: 2, mode: linkDisjoint, want: "BD",
+		},
+		{
+			// D runs through 1-ff00:0:111 like B.
+			name: "AS disjoint", paths: "ABCD", k: 2, mode: asDisjoint, want: "BC",
+		},
+		{name: "link disjoint three", paths: "ABCD", k: 3, mode: linkDisjoint, want: "BDC"},
+		{
+			// A and D both share 1-ff00:0:111 with B, A has the lower latency.
+			name: "AS overlap latency tie-break", paths: "ABCD", k: 3, mode: asDisjoint,
+			want: "BCA",
+		},
+		{
+			// Every path runs through 1-ff00:0:111, so latency decides.
+			name: "no disjoint path", paths: "ABD", k: 3, mode: asDisjoint, want: "BAD",
+		},
+		{
+			// Unknown latencies rank behind known ones, however high.
+			name: "unknown latency", paths: "BCE", k: 2, mode: linkDisjoint, want: "BC",
+		},
+		{
+			// X has the lowest latency, but shares two ASes with S.
+			name: "largest overlap first", paths: "STXY", k: 3, mode: asDisjoint,
+			want: "STY",
+		},
+		{
+			// Y and W share at most one AS with a selected path, W fewer in
+			// total.
+			name: "total overlap second", paths: "STXYW", k: 3, mode: asDisjoint,
+			want: "STW",
+		},
+		{name: "seed", paths: "ABCD", k: 2, mode: linkDisjoint, seed: "A", want: "AD"},
+		{name: "all paths", paths: "ABCD", k: 4, mode: linkDisjoint, want: "BDCA"},
+		{name: "more than available", paths: "ABCD", k: 5, mode: linkDisjoint},
+		{name: "seed not a candidate", paths: "BCD", k: 2, mode: linkDisjoint, seed: "A"},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			names := make(map[snet.PathFingerprint]string)
+			var paths []snet.Path
+			for _, name := range tc.paths {
+				p := buildPaths(t, disjointTestPaths[string(name)])[0]
+				names[snet.Fingerprint(p)] = string(name)
+				paths = append(paths, p)
+			}
+			var seed snet.Path
+			if tc.seed != "" {
+				seed = buildPaths(t, disjointTestPaths[tc.seed])[0]
+			}
+			selected, err := selectDisjointPaths(context.Background(), paths, tc.k, tc.mode, seed)
+			if tc.want == "" {
+				if err == nil {
+					t.Errorf("selected %d paths, want an error", len(selected))
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			var got strings.Builder
+			for _, p := range selected {
+				got.WriteString(names[snet.Fingerprint(p)])
+			}
+			if got.String() != tc.want {
+				t.Errorf("selected %s, want %s", got.String(), tc.want)
+			}
+		})
+	}
+}
+
+func TestPathOverlap(t *testing.T) {
+	paths := make(map[string]snet.Path)
+	for name, f := range disjointTestPaths {
+		paths[name] = buildPaths(t, f)[0]
+	}
+	tests := []struct {
+		a, b       string
+		link, asys int
+	}{
+		{"A", "A", 2, 1},
+		{"A", "B", 1, 1},
+		{"A", "D", 0, 1},
+		{"A", "C", 0, 0},
+	}
+	for _, tc := range tests {
+		if got := pathOverlap(paths[tc.a], paths[tc.b], linkDisjoint); got != tc.link {
+			t.Errorf("%s and %s share %d links, want %d", tc.a, tc.b, got, tc.link)
+		}
+		if got := pathOverlap(paths[tc.a], paths[tc.b], asDisjoint); got != tc.asys {
+			t.Errorf("%s and %s share %d ASes, want %d", tc.a, tc.b, got, tc.asys)
+		}
+	}
+}
@@ -0,0 +1,337 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/scionproto/scion/pkg/addr"
+	"github.com/scionproto/scion/pkg/daemon"
+	"github.com/scionproto/scion/pkg/drkey"
+	"github.com/scionproto/scion/pkg/log"
+	"github.com/scionproto/scion/pkg/private/serrors"
+	"golang.org/x/sync/singleflight"
+)
+
+// drkeyPrefetchMargin is how long before the end of its epoch a key is
+// fetched again in the background.
+const drkeyPrefetchMargin = 30 * time.Second
+
+// drkeyID identifies a key independent of its epoch. An AS-to-host key is
+// identified by the on-path AS that derived it and the source AS and host it
+// was derived for, the path key by the source and destination AS and the host
+// pair.
+type drkeyID struct {
+	ia           addr.IA
+	srcAS, dstAS addr.IA
+	host         string
+}
+
+// cachedDRKey is either an AS-to-host key of an on-path AS or the
+// host-to-host path key, together with the epoch it is valid in.
+type cachedDRKey struct {
+	epoch   drkey.Epoch
+	asKey   drkey.ASHostKey
+	pathKey drkey.HostHostKey
+}
+
+// drkeyCache is a daemon.Connector that caches FABRID DRKeys per key and
+// epoch. Only the keys missing from the cache are requested from the daemon,
+// concurrent identical requests are collapsed into one, and keys are fetched
+// again shortly before their epoch ends.
+type drkeyCache struct {
+	daemon.Connector
+
+	mu sync.Mutex
+	// keys holds the keys of every epoch that has not ended yet.
+	keys  map[drkeyID][]cachedDRKey
+	group singleflight.Group
+	// prefetching holds the requests with a prefetch in progress.
+	prefetching map[string]bool
+
+	hits       atomic.Int64
+	misses     atomic.Int64
+	shared     atomic.Int64
+	prefetches atomic.Int64
+	fetches    atomic.Int64
+	fetchNanos atomic.Int64
+	maxNanos   atomic.Int64
+}
+
+func newDRKeyCache(conn daemon.Connector) *drkeyCache {
+	return &drkeyCache{
+		Connector:   conn,
+		keys:        make(map[drkeyID][]cachedDRKey),
+		prefetching: make(map[string]bool),
+	}
+}
+
+// asKeyID identifies the key the on-path AS ia derived for the source host of
+// a request.
+func asKeyID(meta drkey.FabridKeysMeta, ia addr.IA) drkeyID {
+	return drkeyID{ia: ia, srcAS: meta.SrcAS, host: meta.SrcHost}
+}
+
+// pathKeyID identifies the host-to-host key of a request.
+func pathKeyID(meta drkey.FabridKeysMeta) (drkeyID, bool) {
+	if meta.DstHost == nil {
+		return drkeyID{}, false
+	}
+	return drkeyID{srcAS: meta.SrcAS, dstAS: meta.DstAS,
+		host: meta.SrcHost + ">" + *meta.DstHost}, true
+}
+
+// FabridKeys returns the keys of the request, fetching only those that are not
+// cached for the current epoch. The AS keys are returned in the order of
+// meta.PathASes.
+func (c *drkeyCache) FabridKeys(ctx context.Context,
+	meta drkey.FabridKeysMeta) (drkey.FabridKeysResponse, error) {
+
+	now := time.Now()
+	resp, missing, needPath, expiring := c.lookup(meta, now)
+	if len(missing) == 0 && !needPath {
+		c.hits.Add(1)
+		if expiring {
+			c.prefetch(ctx, meta)
+		}
+		return resp, nil
+	}
+
+	c.misses.Add(1)
+	partial := meta
+	partial.PathASes = missing
+	if !needPath {
+		partial.DstHost = nil
+	}
+	if _, err := c.fetch(ctx, partial); err != nil {
+		return drkey.FabridKeysResponse{}, err
+	}
+	resp, missing, needPath, _ = c.lookup(meta, now)
+	if len(missing) > 0 || needPath {
+		return drkey.FabridKeysResponse{}, serrors.New("daemon returned no key for the current epoch",
+			"missing", len(missing), "path_key", needPath)
+	}
+	return resp, nil
+}
+
+// lookup assembles the response from the cache. It returns the ASes without a
+// valid key, whether the path key is missing, and whether any key is about to
+// expire.
+func (c *drkeyCache) lookup(meta drkey.FabridKeysMeta, now time.Time) (
+	drkey.FabridKeysResponse, []addr.IA, bool, bool) {
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	var (
+		resp     drkey.FabridKeysResponse
+		missing  []addr.IA
+		expiring bool
+	)
+	resp.ASHostKeys = make([]drkey.ASHostKey, 0, len(meta.PathASes))
+	for _, ia := range meta.PathASes {
+		key, ok := c.findValid(asKeyID(meta, ia), now)
+		if !ok {
+			missing = append(missing, ia)
+			continue
+		}
+		resp.ASHostKeys = append(resp.ASHostKeys, key.asKey)
+		expiring = expiring || now.After(key.epoch.NotAfter.Add(-drkeyPrefetchMargin))
+	}
+
+	needPath := false
+	if id, ok := pathKeyID(meta); ok {
+		if key, ok := c.findValid(id, now); ok {
+			resp.PathKey = key.pathKey
+			expiring = expiring || now.After(key.epoch.NotAfter.Add(-drkeyPrefetchMargin))
+		} else {
+			needPath = true
+		}
+	}
+	return resp, missing, needPath, expiring
+}
+
+// findValid returns the key for id whose epoch contains now. Keys of epochs
+// that ended are dropped on the way. The caller holds the lock.
+func (c *drkeyCache) findValid(id drkeyID, now time.Time) (cachedDRKey, bool) {
+	var found cachedDRKey
+	ok := false
+	keys := c.keys[id][:0]
+	for _, key := range c.keys[id] {
+		if now.After(key.epoch.NotAfter) {
+			continue
+		}
+		keys = append(keys, key)
+		if !now.Before(key.epoch.NotBefore) {
+			found, ok = key, true
+		}
+	}
+	if len(keys) == 0 {
+		delete(c.keys, id)
+	} else {
+		c.keys[id] = keys
+	}
+	return found, ok
+}
+
+// fetch requests keys from the daemon and stores them. Identical concurrent
+// requests share one daemon call.
+func (c *drkeyCache) fetch(ctx context.Context,
+	meta drkey.FabridKeysMeta) (drkey.FabridKeysResponse, error) {
+
+	res, err, shared := c.group.Do(fabridKeysMetaKey(meta), func() (interface{}, error) {
+		start := time.Now()
+		resp, err := c.Connector.FabridKeys(ctx, meta)
+		elapsed := time.Since(start)
+		c.fetches.Add(1)
+		c.fetchNanos.Add(int64(elapsed))
+		for {
+			max := c.maxNanos.Load()
+			if int64(elapsed) <= max || c.maxNanos.CompareAndSwap(max, int64(elapsed)) {
+				break
+			}
+		}
+		if err != nil {
+			return drkey.FabridKeysResponse{}, err
+		}
+		c.store(meta, resp)
+		log.FromCtx(ctx).Debug("DRKeys fetched", "request", fabridKeysMetaKey(meta),
+			"duration", elapsed)
+		return resp, nil
+	})
+	if shared {
+		c.shared.Add(1)
+	}
+	if err != nil {
+		return drkey.FabridKeysResponse{}, err
+	}
+	return res.(drkey.FabridKeysResponse), nil
+}
+
+func (c *drkeyCache) store(meta drkey.FabridKeysMeta, resp drkey.FabridKeysResponse) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for i, key := range resp.ASHostKeys {
+		if i >= len(meta.PathASes) {
+			break
+		}
+		c.add(asKeyID(meta, meta.PathASes[i]), cachedDRKey{epoch: key.Epoch, asKey: key})
+	}
+	if id, ok := pathKeyID(meta); ok {
+		c.add(id, cachedDRKey{epoch: resp.PathKey.Epoch, pathKey: resp.PathKey})
+	}
+}
+
+// add stores a key, replacing the one of the same epoch. The caller holds the
+// lock.
+func (c *drkeyCache) add(id drkeyID, key cachedDRKey) {
+	if key.epoch.NotAfter.IsZero() {
+		// Without epoch information the key is only reused briefly.
+		key.epoch.NotBefore = time.Now()
+		key.epoch.NotAfter = key.epoch.NotBefore.Add(time.Minute)
+	}
+	keys := c.keys[id]
+	for i, cached := range keys {
+		if cached.epoch.NotBefore.Equal(key.epoch.NotBefore) {
+			keys[i] = key
+			return
+		}
+	}
+	c.keys[id] = append(keys, key)
+}
+
+// prefetch fetches the keys of the request in the background because one of
+// them is about to expire. If the daemon still hands out the old epoch, the
+// fetch is repeated once that epoch ended.
+func (c *drkeyCache) prefetch(ctx context.Context, meta drkey.FabridKeysMeta) {
+	logger := log.FromCtx(ctx)
+	key := fabridKeysMetaKey(meta)
+
+	c.mu.Lock()
+	if c.prefetching[key] {
+		c.mu.Unlock()
+		return
+	}
+	c.prefetching[key] = true
+	c.mu.Unlock()
+	c.prefetches.Add(1)
+
+	done := func() {
+		c.mu.Lock()
+		delete(c.prefetching, key)
+		c.mu.Unlock()
+	}
+	fetch := func() (drkey.FabridKeysResponse, error) {
+		resp, err := c.fetch(context.Background(), meta)
+		if err != nil {
+			logger.Info("Prefetching DRKeys failed", "request", key, "err", err)
+		}
+		return resp, err
+	}
+
+	go func() {
+		resp, err := fetch()
+		if err != nil {
+			done()
+			return
+		}
+		end := resp.PathKey.Epoch.NotAfter
+		for _, k := range resp.ASHostKeys {
+			if end.IsZero() || k.Epoch.NotAfter.Before(end) {
+				end = k.Epoch.NotAfter
+			}
+		}
+		wait := time.Until(end)
+		if wait <= 0 || wait >= drkeyPrefetchMargin {
+			done()
+			return
+		}
+		time.AfterFunc(wait+time.Second, func() {
+			defer done()
+			_, _ = fetch()
+		})
+	}()
+}
+
+// fabridKeysMetaKey identifies a key request.
+func fabridKeysMetaKey(meta drkey.FabridKeysMeta) string {
+	ases := make([]string, len(meta.PathASes))
+	for i, ia := range meta.PathASes {
+		ases[i] = ia.String()
+	}
+	sort.Strings(ases)
+	dstHost := ""
+	if meta.DstHost != nil {
+		dstHost = *meta.DstHost
+	}
+	return fmt.Sprintf("%s,%s>%s,%s [%s]", meta.SrcAS, meta.SrcHost, meta.DstAS, dstHost,
+		strings.Join(ases, " "))
+}
+
+// logStats logs the hit rate of the cache and the latency of the daemon
+// requests.
+func (c *drkeyCache) logStats() {
+	hits, misses := c.hits.Load(), c.misses.Load()
+	var hitRate float64
+	if hits+misses > 0 {
+		hitRate = float64(hits) / float64(hits+misses)
+	}
+	var avg time.Duration
+	if fetches := c.fetches.Load(); fetches > 0 {
+		avg = time.Duration(c.fetchNanos.Load() / fetches)
+	}
+	log.Info("DRKey cache statistics",
+		"hits", hits,
+		"misses", misses,
+		"shared", c.shared.Load(),
+		"prefetches", c.prefetches.Load(),
+		"fetches", c.fetches.Load(),
+		"hit_rate", fmt.Sprintf("%.2f", hitRate),
+		"avg_fetch_latency", avg,
+		"max_fetch_latency", time.Duration(c.maxNanos.Load()))
+}
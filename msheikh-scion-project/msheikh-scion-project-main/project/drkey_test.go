@@ -0,0 +1,264 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/scionproto/scion/pkg/addr"
+	"github.com/scionproto/scion/pkg/daemon"
+	"github.com/scionproto/scion/pkg/drkey"
+	"github.com/scionproto/scion/pkg/scrypto/cppki"
+)
+
+// drkeyEpoch returns the epoch from begin to end, relative to now.
+func drkeyEpoch(now time.Time, begin, end time.Duration) drkey.Epoch {
+	return drkey.Epoch{Validity: cppki.Validity{NotBefore: now.Add(begin),
+		NotAfter: now.Add(end)}}
+}
+
+// keyConnector hands out keys of its current epoch and counts the requests.
+// The keys name the source AS and host they were derived for. If release is
+// set, every request waits for it to be closed.
+type keyConnector struct {
+	daemon.Connector
+	release chan struct{}
+
+	mu       sync.Mutex
+	epoch    drkey.Epoch
+	requests int
+}
+
+func (c *keyConnector) FabridKeys(_ context.Context,
+	meta drkey.FabridKeysMeta) (drkey.FabridKeysResponse, error) {
+
+	c.mu.Lock()
+	c.requests++
+	epoch := c.epoch
+	c.mu.Unlock()
+	if c.release != nil {
+		<-c.release
+	}
+
+	var resp drkey.FabridKeysResponse
+	for _, ia := range meta.PathASes {
+		resp.ASHostKeys = append(resp.ASHostKeys, drkey.ASHostKey{Epoch: epoch, SrcIA: ia,
+			DstIA: meta.SrcAS, DstHost: meta.SrcHost})
+	}
+	if meta.DstHost != nil {
+		resp.PathKey = drkey.HostHostKey{Epoch: epoch, SrcIA: meta.SrcAS, DstIA: meta.DstAS,
+			SrcHost: meta.SrcHost, DstHost: *meta.DstHost}
+	}
+	return resp, nil
+}
+
+func (c *keyConnector) setEpoch(epoch drkey.Epoch) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.epoch = epoch
+}
+
+func (c *keyConnector) requestCount() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.requests
+}
+
+// drkeyTestMeta requests the keys of two on-path ASes for host 10.0.0.1 in
+// src and the path key to host 10.0.0.2 in dst.
+func drkeyTestMeta(src, dst string) drkey.FabridKeysMeta {
+	dstHost := "10.0.0.2"
+	return drkey.FabridKeysMeta{
+		SrcAS:    addr.MustParseIA(src),
+		SrcHost:  "10.0.0.1",
+		PathASes: []addr.IA{addr.MustParseIA("1-ff00:0:111"), addr.MustParseIA("1-ff00:0:112")},
+		DstAS:    addr.MustParseIA(dst),
+		DstHost:  &dstHost,
+	}
+}
+
+func TestDRKeyCacheSeparatesASes(t *testing.T) {
+	conn := &keyConnector{epoch: drkeyEpoch(time.Now(), -time.Hour, time.Hour)}
+	cache := newDRKeyCache(conn)
+	ctx := context.Background()
+
+	requests := []drkey.FabridKeysMeta{
+		drkeyTestMeta("1-ff00:0:110", "1-ff00:0:113"),
+		// The same source host in another AS.
+		drkeyTestMeta("2-ff00:0:210", "1-ff00:0:113"),
+		// The same host pair between other ASes.
+		drkeyTestMeta("1-ff00:0:110", "2-ff00:0:213"),
+	}
+	for round := 0; round < 2; round++ {
+		for i, meta := range requests {
+			resp, err := cache.FabridKeys(ctx, meta)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for j, key := range resp.ASHostKeys {
+				if key.SrcIA != meta.PathASes[j] || key.DstIA != meta.SrcAS {
+					t.Errorf("request %d: key of %s for %s, want of %s for %s", i,
+						key.SrcIA, key.DstIA, meta.PathASes[j], meta.SrcAS)
+				}
+			}
+			if resp.PathKey.SrcIA != meta.SrcAS || resp.PathKey.DstIA != meta.DstAS {
+				t.Errorf("request %d: path key %s>%s, want %s>%s", i, resp.PathKey.SrcIA,
+					resp.PathKey.DstIA, meta.SrcAS, meta.DstAS)
+			}
+		}
+	}
+	if n := conn.requestCount(); n != len(requests) {
+		t.Errorf("daemon asked %d times, want once per request", n)
+	}
+	if hits := cache.hits.Load(); hits != int64(len(requests)) {
+		t.Errorf("%d hits, want %d", hits, len(requests))
+	}
+}
+
+func TestDRKeyCacheEpochRollover(t *testing.T) {
+	now := time.Now()
+	meta := drkeyTestMeta("1-ff00:0:110", "1-ff00:0:113")
+	old := drkeyEpoch(now, -time.Hour, time.Minute)
+	next := drkeyEpoch(now, time.Minute, time.Hour)
+
+	cache := newDRKeyCache(nil)
+	for _, epoch := range []drkey.Epoch{old, next} {
+		conn := &keyConnector{epoch: epoch}
+		resp, err := conn.FabridKeys(context.Background(), meta)
+		if err != nil {
+			t.Fatal(err)
+		}
+		cache.store(meta, resp)
+	}
+	// Storing an epoch again replaces its keys.
+	cache.store(meta, drkey.FabridKeysResponse{
+		ASHostKeys: []drkey.ASHostKey{{Epoch: next}, {Epoch: next}},
+		PathKey:    drkey.HostHostKey{Epoch: next},
+	})
+	id, _ := pathKeyID(meta)
+
+	tests := []struct {
+		name string
+		at   time.Duration
+		// want is the epoch of the keys handed out, nil if they are missing.
+		want     *drkey.Epoch
+		expiring bool
+		// cached is how many epochs of the path key are left.
+		cached int
+	}{
+		{name: "old epoch", at: 0, want: &old, cached: 2},
+		{name: "old epoch ending", at: time.Minute - drkeyPrefetchMargin/2, want: &old,
+			expiring: true, cached: 2},
+		{name: "next epoch", at: time.Minute + time.Second, want: &next, cached: 1},
+		{name: "all ended", at: time.Hour + time.Second, cached: 0},
+	}
+	for _, tc := range tests {
+		resp, missing, needPath, expiring := cache.lookup(meta, now.Add(tc.at))
+		switch {
+		case tc.want == nil:
+			if len(missing) != len(meta.PathASes) || !needPath {
+				t.Errorf("%s: %d AS keys and path key %t missing, want all", tc.name,
+					len(missing), needPath)
+			}
+		case len(missing) > 0 || needPath:
+			t.Errorf("%s: %d AS keys and path key %t missing", tc.name, len(missing), needPath)
+		default:
+			for _, key := range append(resp.ASHostKeys, drkey.ASHostKey{
+				Epoch: resp.PathKey.Epoch}) {
+
+				if key.Epoch != *tc.want {
+					t.Errorf("%s: key of epoch %v, want %v", tc.name, key.Epoch, *tc.want)
+				}
+			}
+			if expiring != tc.expiring {
+				t.Errorf("%s: expiring %t, want %t", tc.name, expiring, tc.expiring)
+			}
+		}
+		if n := len(cache.keys[id]); n != tc.cached {
+			t.Errorf("%s: %d epochs of the path key cached, want %d", tc.name, n, tc.cached)
+		}
+	}
+}
+
+func TestDRKeyCachePrefetch(t *testing.T) {
+	now := time.Now()
+	meta := drkeyTestMeta("1-ff00:0:110", "1-ff00:0:113")
+	conn := &keyConnector{epoch: drkeyEpoch(now, -time.Hour, drkeyPrefetchMargin/2)}
+	cache := newDRKeyCache(conn)
+	ctx := context.Background()
+
+	if _, err := cache.FabridKeys(ctx, meta); err != nil {
+		t.Fatal(err)
+	}
+	// The next request is answered from the cache and fetches the keys of
+	// the next epoch in the background.
+	next := drkeyEpoch(now, drkeyPrefetchMargin/2, time.Hour)
+	conn.setEpoch(next)
+	resp, err := cache.FabridKeys(ctx, meta)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.PathKey.Epoch == next {
+		t.Error("the hit waited for the next epoch")
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		_, missing, needPath, _ := cache.lookup(meta,
+			next.NotBefore.Add(time.Second))
+		if len(missing) == 0 && !needPath {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("keys of the next epoch not prefetched")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if n := conn.requestCount(); n != 2 {
+		t.Errorf("daemon asked %d times, want 2", n)
+	}
+	if got := [3]int64{cache.hits.Load(), cache.misses.Load(), cache.prefetches.Load()}; got !=
+		[3]int64{1, 1, 1} {
+
+		t.Errorf("hits, misses, prefetches %v, want [1 1 1]", got)
+	}
+}
+
+func TestDRKeyCacheSharesConcurrentFetches(t *testing.T) {
+	const callers = 8
+	meta := drkeyTestMeta("1-ff00:0:110", "1-ff00:0:113")
+	conn := &keyConnector{epoch: drkeyEpoch(time.Now(), -time.Hour, time.Hour),
+		release: make(chan struct{})}
+	cache := newDRKeyCache(conn)
+
+	var wg sync.WaitGroup
+	errs := make(chan error, callers)
+	for i := 0; i < callers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, err := cache.FabridKeys(context.Background(), meta)
+			errs <- err
+		}()
+	}
+	// Release the daemon once every caller missed the cache and had the time
+	// to join the request in flight.
+	for cache.misses.Load() < callers {
+		time.Sleep(time.Millisecond)
+	}
+	time.Sleep(20 * time.Millisecond)
+	close(conn.release)
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if n := conn.requestCount(); n != 1 {
+		t.Errorf("daemon asked %d times, want once", n)
+	}
+	if shared := cache.shared.Load(); shared != callers {
+		t.Errorf("%d callers shared the request, want %d", shared, callers)
+	}
+}
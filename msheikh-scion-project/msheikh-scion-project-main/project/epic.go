@@ -0,0 +1,269 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/scionproto/scion/pkg/addr"
+	"github.com/scionproto/scion/pkg/daemon"
+	"github.com/scionproto/scion/pkg/log"
+	"github.com/scionproto/scion/pkg/private/serrors"
+	"github.com/scionproto/scion/pkg/snet"
+	"github.com/scionproto/scion/pkg/snet/path"
+)
+
+// epicStats counts what an EPIC session sent and received.
+type epicStats struct {
+	packets     atomic.Int64
+	bytes       atomic.Int64
+	received    atomic.Int64
+	errors      atomic.Int64
+	refreshes   atomic.Int64
+	pathChanges atomic.Int64
+}
+
+// newEPICDataplane returns the EPIC-HP dataplane path of p, which stamps
+// every packet with a fresh packet ID and hop validation fields. Its packet
+// counter starts anew, so every refreshed path gets its own dataplane path.
+func newEPICDataplane(p snet.Path) (*path.EPIC, error) {
+	metadata := p.Metadata()
+	if metadata == nil || !metadata.EpicAuths.SupportsEpic() {
+		return nil, serrors.New("path does not support EPIC")
+	}
+	scionPath, ok := p.Dataplane().(path.SCION)
+	if !ok {
+		return nil, serrors.New("EPIC requires a SCION dataplane path",
+			"type", fmt.Sprintf("%T", p.Dataplane()))
+	}
+	dataplane, err := path.NewEPICDataplanePath(scionPath, metadata.EpicAuths)
+	if err != nil {
+		return nil, serrors.WrapStr("creating EPIC dataplane path", err)
+	}
+	return dataplane, nil
+}
+
+// epicSession is a connection to the remote over an EPIC-HP path. Every
+// packet gets its own packet ID, and the path and its EPIC authenticators are
+// fetched again shortly before the path expires.
+type epicSession struct {
+	daemonConn daemon.Connector
+	network    *snet.SCIONNetwork
+	localAddr  *net.UDPAddr
+	localIA    addr.IA
+
+	mu     sync.Mutex
+	path   snet.Path
+	conn   *snet.Conn
+	expiry time.Time
+	stats  epicStats
+}
+
+// newEPICSession opens a session over p, which must carry EPIC authenticators.
+func newEPICSession(ctx context.Context, daemonConn daemon.Connector,
+	network *snet.SCIONNetwork, localAddr *net.UDPAddr, localIA addr.IA,
+	p snet.Path) (*epicSession, error) {
+
+	s := &epicSession{
+		daemonConn: daemonConn,
+		network:    network,
+		localAddr:  localAddr,
+		localIA:    localIA,
+	}
+	if err := s.use(ctx, p); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// use switches the session to path p.
+func (s *epicSession) use(ctx context.Context, p snet.Path) error {
+	dataplane, err := newEPICDataplane(p)
+	if err != nil {
+		return err
+	}
+	dst := remote.Copy()
+	dst.Path = dataplane
+	dst.NextHop = p.UnderlayNextHop()
+	conn, err := s.network.Dial(ctx, "udp", s.localAddr, dst)
+	if err != nil {
+		return serrors.WrapStr("dialing EPIC path", err)
+	}
+
+	if s.conn != nil {
+		s.conn.Close()
+	}
+	if s.path != nil && snet.Fingerprint(s.path) != snet.Fingerprint(p) {
+		s.stats.pathChanges.Add(1)
+	}
+	s.path = p
+	s.conn = conn
+	s.expiry = earliestExpiry([]snet.Path{p}).Add(-pathExpiryMargin)
+	return nil
+}
+
+// refresh fetches fresh hidden paths and continues on the current path if it
+// is still offered, or on the best other EPIC path otherwise.
+func (s *epicSession) refresh(ctx context.Context) error {
+	logger := log.FromCtx(ctx)
+
+	s.stats.refreshes.Add(1)
+	paths, err := s.daemonConn.Paths(ctx, remote.IA, s.localIA, daemon.PathReqFlags{
+		Hidden:  true,
+		Refresh: true,
+	})
+	if err != nil {
+		return serrors.WrapStr("refreshing EPIC paths", err)
+	}
+
+	var next snet.Path
+	for _, p := range paths {
+		if snet.Fingerprint(p) == snet.Fingerprint(s.path) && hasEPICPath(p) {
+			next = p
+			break
+		}
+	}
+	if next == nil {
+		if next, err = findEPICPath(ctx, paths); err != nil {
+			return err
+		}
+	}
+	if err := s.use(ctx, next); err != nil {
+		return err
+	}
+	logger.Info("EPIC path refreshed", "fingerprint", snet.Fingerprint(next),
+		"valid_until", s.expiry)
+	return nil
+}
+
+// Write sends b as one EPIC packet, refreshing the path first if it is about
+// to expire.
+func (s *epicSession) Write(ctx context.Context, b []byte) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if time.Now().After(s.expiry) {
+		if err := s.refresh(ctx); err != nil {
+			s.stats.errors.Add(1)
+			return 0, err
+		}
+	}
+	n, err := s.conn.Write(b)
+	if err != nil {
+		// An outdated info field timestamp also shows up as a write error, so
+		// the path is refreshed once before giving up.
+		if rerr := s.refresh(ctx); rerr != nil {
+			s.stats.errors.Add(1)
+			return 0, serrors.WrapStr("writing EPIC packet", err, "refresh_err", rerr)
+		}
+		if n, err = s.conn.Write(b); err != nil {
+			s.stats.errors.Add(1)
+			return 0, serrors.WrapStr("writing EPIC packet", err)
+		}
+	}
+	s.stats.packets.Add(1)
+	s.stats.bytes.Add(int64(n))
+	return n, nil
+}
+
+// Read reads the next reply from the remote.
+func (s *epicSession) Read(b []byte, deadline time.Time) (int, error) {
+	s.mu.Lock()
+	conn := s.conn
+	s.mu.Unlock()
+
+	if err := conn.SetReadDeadline(deadline); err != nil {
+		return 0, err
+	}
+	n, err := conn.Read(b)
+	if err == nil {
+		s.stats.received.Add(1)
+	}
+	return n, err
+}
+
+func (s *epicSession) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.conn.Close()
+}
+
+// logStats logs the send statistics of the session.
+func (s *epicSession) logStats(ctx context.Context) {
+	log.FromCtx(ctx).Info("EPIC session statistics",
+		"packets", s.stats.packets.Load(),
+		"bytes", s.stats.bytes.Load(),
+		"received", s.stats.received.Load(),
+		"errors", s.stats.errors.Load(),
+		"refreshes", s.stats.refreshes.Load(),
+		"path_changes", s.stats.pathChanges.Load())
+}
+
+// runEPICStream implements the epic-stream subcommand. It sends a series of
+// Test 20 requests over one EPIC session to exercise the per-packet EPIC
+// fields and the path refresh.
+func runEPICStream(args []string) error {
+	fs := flag.NewFlagSet("epic-stream", flag.ContinueOnError)
+	count := fs.Int("count", 100, "The number of requests to send")
+	interval := fs.Duration("interval", 100*time.Millisecond, "The pause between requests")
+	if err := fs.Parse(args); err != nil {
+		return serrors.WrapStr("parsing epic-stream arguments", err)
+	}
+
+	ctx := context.Background()
+	daemonConn, localIA, err := connectDaemon(ctx)
+	if err != nil {
+		return err
+	}
+	defer daemonConn.Close()
+
+	paths, err := daemonConn.Paths(ctx, remote.IA, localIA, daemon.PathReqFlags{Hidden: true})
+	if err != nil {
+		return serrors.WrapStr("querying EPIC paths", err)
+	}
+	best, err := findEPICPath(ctx, paths)
+	if err != nil {
+		return serrors.WrapStr("finding EPIC path", err)
+	}
+
+	network := &snet.SCIONNetwork{
+		Topology: daemonConn,
+	}
+	session, err := newEPICSession(ctx, daemonConn, network,
+		&net.UDPAddr{IP: net.ParseIP(local)}, localIA, best)
+	if err != nil {
+		return err
+	}
+	defer session.Close()
+	defer session.logStats(ctx)
+
+	requestBytes, err := json.Marshal(Request{ID: 20, Payload: map[string]interface{}{}})
+	if err != nil {
+		return serrors.WrapStr("marshaling request", err)
+	}
+	buffer := make([]byte, 16000)
+	passed := 0
+	for i := 0; i < *count; i++ {
+		if _, err := session.Write(ctx, requestBytes); err != nil {
+			return err
+		}
+		n, err := session.Read(buffer, time.Now().Add(5*time.Second))
+		if err != nil {
+			log.Info("No EPIC response", "request", i, "err", err)
+		} else {
+			var response Response
+			if err := json.Unmarshal(buffer[:n], &response); err == nil &&
+				response.State == "TestPassed" {
+				passed++
+			}
+		}
+		time.Sleep(*interval)
+	}
+	fmt.Printf("epic-stream requests=%d passed=%d\n", *count, passed)
+	return nil
+}
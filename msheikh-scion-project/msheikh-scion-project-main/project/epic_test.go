@@ -0,0 +1,48 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/scionproto/scion/pkg/slayers"
+	"github.com/scionproto/scion/pkg/slayers/path/epic"
+	"github.com/scionproto/scion/pkg/snet"
+	"github.com/scionproto/scion/pkg/snet/path"
+)
+
+func TestEPICDataplanePacketIDs(t *testing.T) {
+	p := epicTestPath(t)
+	dataplane, err := newEPICDataplane(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var ids []epic.PktID
+	for i := 0; i < 2; i++ {
+		raw := epicTestPacketOver(t, p, dataplane)
+		checks, err := validateEPICPacket(raw, p.Metadata().EpicAuths, p, time.Now())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if failed := failedEPICChecks(checks); len(failed) != 0 {
+			t.Errorf("packet %d failed %q", i, failed)
+		}
+		var s slayers.SCION
+		if err := s.DecodeFromBytes(raw, gopacket.NilDecodeFeedback); err != nil {
+			t.Fatal(err)
+		}
+		ids = append(ids, s.Path.(*epic.Path).PktID)
+	}
+	if ids[0] == ids[1] {
+		t.Errorf("both packets have the packet ID %+v", ids[0])
+	}
+}
+
+func TestNewEPICDataplaneRequiresAuths(t *testing.T) {
+	p := epicTestPath(t).(*path.Path)
+	p.Meta.EpicAuths = snet.EpicAuths{}
+	if _, err := newEPICDataplane(p); err == nil {
+		t.Error("path without EPIC authenticators accepted")
+	}
+}
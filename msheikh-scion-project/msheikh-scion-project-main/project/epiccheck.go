@@ -0,0 +1,383 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"net/netip"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/scionproto/scion/pkg/addr"
+	"github.com/scionproto/scion/pkg/daemon"
+	libepic "github.com/scionproto/scion/pkg/experimental/epic"
+	"github.com/scionproto/scion/pkg/private/serrors"
+	"github.com/scionproto/scion/pkg/slayers"
+	slpath "github.com/scionproto/scion/pkg/slayers/path"
+	"github.com/scionproto/scion/pkg/slayers/path/epic"
+	"github.com/scionproto/scion/pkg/slayers/path/scion"
+	"github.com/scionproto/scion/pkg/snet"
+	"github.com/scionproto/scion/pkg/snet/path"
+)
+
+// epicCheck is the outcome of one validation step of an EPIC packet.
+type epicCheck struct {
+	name string
+	// hop is the index of the hop field the check belongs to, -1 if it
+	// concerns the whole packet.
+	hop int
+	ia  addr.IA
+	err error
+}
+
+func (c epicCheck) String() string {
+	status := " OK "
+	if c.err != nil {
+		status = "FAIL"
+	}
+	where := ""
+	if c.hop >= 0 {
+		where = fmt.Sprintf(" hop %d", c.hop)
+		if !c.ia.IsZero() {
+			where += fmt.Sprintf(" (%s)", c.ia)
+		}
+	}
+	line := fmt.Sprintf("[%s] %s%s", status, c.name, where)
+	if c.err != nil {
+		line += ": " + c.err.Error()
+	}
+	return line
+}
+
+// validateEPICPacket decodes a SCION packet with an EPIC path and recomputes
+// its timestamps and hop validation fields as of the capture time now. The
+// path the packet was built from is optional. It is used to name the ASes of
+// the failing hops, to check the path expiry and to compare the hop field
+// MACs.
+func validateEPICPacket(raw []byte, auths snet.EpicAuths, p snet.Path,
+	now time.Time) ([]epicCheck, error) {
+
+	var s slayers.SCION
+	if err := s.DecodeFromBytes(raw, gopacket.NilDecodeFeedback); err != nil {
+		return nil, serrors.WrapStr("decoding SCION header", err)
+	}
+	if s.PathType != epic.PathType {
+		return nil, serrors.New("packet does not carry an EPIC path", "path_type", s.PathType)
+	}
+	ep, ok := s.Path.(*epic.Path)
+	if !ok || ep.ScionPath == nil {
+		return nil, serrors.New("unexpected EPIC path layer", "type", fmt.Sprintf("%T", s.Path))
+	}
+	sp := ep.ScionPath
+	numHops := sp.NumHops
+
+	var (
+		metadata *snet.PathMetadata
+		expected *scion.Raw
+	)
+	if p != nil {
+		metadata = p.Metadata()
+		if scionPath, ok := p.Dataplane().(path.SCION); ok {
+			expected = &scion.Raw{}
+			if err := expected.DecodeFromBytes(scionPath.Raw); err != nil {
+				return nil, serrors.WrapStr("decoding the hop fields of the path", err)
+			}
+		}
+	}
+
+	// Name the hops after the ASes of the path metadata if they line up.
+	hopIA := func(i int) addr.IA {
+		switch i {
+		case numHops - 1:
+			return s.DstIA
+		case numHops - 2:
+			if metadata != nil && len(metadata.Interfaces) >= 2 {
+				return metadata.Interfaces[len(metadata.Interfaces)-2].IA
+			}
+		case 0:
+			return s.SrcIA
+		}
+		return 0
+	}
+
+	var checks []epicCheck
+
+	info, err := sp.GetInfoField(0)
+	if err != nil {
+		return nil, serrors.WrapStr("reading first info field", err)
+	}
+	infoTime := time.Unix(int64(info.Timestamp), 0)
+	sendTime := infoTime.Add((time.Duration(ep.PktID.Timestamp) + 1) * libepic.TimestampResolution)
+
+	check := epicCheck{name: "packet freshness", hop: -1}
+	check.err = libepic.VerifyTimestamp(infoTime, ep.PktID.Timestamp, now)
+	checks = append(checks, check)
+
+	if metadata != nil && !metadata.Expiry.IsZero() {
+		check = epicCheck{name: "path expiry", hop: -1}
+		if sendTime.After(metadata.Expiry) {
+			check.err = serrors.New("packet sent after the path expired",
+				"send_time", sendTime, "expiry", metadata.Expiry)
+		}
+		checks = append(checks, check)
+	}
+
+	if expected != nil && expected.NumHops != numHops {
+		checks = append(checks, epicCheck{name: "hop fields", hop: -1,
+			err: serrors.New("packet and path differ in the number of hop fields",
+				"packet", numHops, "path", expected.NumHops)})
+		expected = nil
+	}
+
+	// Every hop field expires relative to the info field of its segment. Its
+	// MAC does not change while the packet is forwarded, so it must be the one
+	// of the path.
+	hop := 0
+	for seg := 0; seg < sp.NumINF; seg++ {
+		segInfo, err := sp.GetInfoField(seg)
+		if err != nil {
+			return nil, serrors.WrapStr("reading info field", err, "segment", seg)
+		}
+		for i := 0; i < int(sp.PathMeta.SegLen[seg]); i++ {
+			hf, err := sp.GetHopField(hop)
+			if err != nil {
+				return nil, serrors.WrapStr("reading hop field", err, "hop", hop)
+			}
+			expiry := time.Unix(int64(segInfo.Timestamp), 0).Add(slpath.ExpTimeToDuration(hf.ExpTime))
+			check = epicCheck{name: "hop field expiry", hop: hop, ia: hopIA(hop)}
+			if sendTime.After(expiry) {
+				check.err = serrors.New("hop field expired before the packet was sent",
+					"send_time", sendTime, "expiry", expiry)
+			}
+			checks = append(checks, check)
+
+			if expected != nil {
+				check = epicCheck{name: "hop field MAC", hop: hop, ia: hopIA(hop)}
+				if want, err := expected.GetHopField(hop); err != nil {
+					check.err = serrors.WrapStr("reading hop field of the path", err)
+				} else if hf.Mac != want.Mac {
+					check.err = serrors.New("hop field MAC differs from the path",
+						"packet", hex.EncodeToString(hf.Mac[:]),
+						"path", hex.EncodeToString(want.Mac[:]))
+				}
+				checks = append(checks, check)
+			}
+			hop++
+		}
+	}
+
+	// The PHVF is checked by the penultimate AS, the LHVF by the destination.
+	hvfs := []struct {
+		name string
+		hop  int
+		auth []byte
+		hvf  []byte
+	}{
+		{name: "PHVF", hop: numHops - 2, auth: auths.AuthPHVF, hvf: ep.PHVF},
+		{name: "LHVF", hop: numHops - 1, auth: auths.AuthLHVF, hvf: ep.LHVF},
+	}
+	for _, h := range hvfs {
+		check = epicCheck{name: h.name, hop: h.hop, ia: hopIA(h.hop)}
+		mac, err := libepic.CalcMac(h.auth, ep.PktID, &s, info.Timestamp, nil)
+		switch {
+		case err != nil:
+			check.err = serrors.WrapStr("computing validation field", err)
+		case !bytes.Equal(mac, h.hvf):
+			check.err = serrors.New("validation field mismatch",
+				"packet", hex.EncodeToString(h.hvf), "computed", hex.EncodeToString(mac))
+		}
+		checks = append(checks, check)
+	}
+	return checks, nil
+}
+
+// readPacketFile reads a packet that is stored either as raw bytes or as a
+// hex dump. The file must start with the SCION common header.
+func readPacketFile(name string) ([]byte, error) {
+	raw, err := os.ReadFile(name)
+	if err != nil {
+		return nil, serrors.WrapStr("reading packet file", err)
+	}
+	text := strings.Join(strings.Fields(string(raw)), "")
+	if decoded, err := hex.DecodeString(text); err == nil && len(decoded) > 0 {
+		return decoded, nil
+	}
+	return raw, nil
+}
+
+// findPathForPacket returns the path among paths whose hop fields match the
+// ones in the packet.
+func findPathForPacket(raw []byte, paths []snet.Path) (snet.Path, error) {
+	var s slayers.SCION
+	if err := s.DecodeFromBytes(raw, gopacket.NilDecodeFeedback); err != nil {
+		return nil, serrors.WrapStr("decoding SCION header", err)
+	}
+	ep, ok := s.Path.(*epic.Path)
+	if !ok || ep.ScionPath == nil {
+		return nil, serrors.New("packet does not carry an EPIC path")
+	}
+	for _, p := range paths {
+		scionPath, ok := p.Dataplane().(path.SCION)
+		if !ok {
+			continue
+		}
+		var candidate scion.Raw
+		if err := candidate.DecodeFromBytes(scionPath.Raw); err != nil {
+			continue
+		}
+		if sameHopFields(ep.ScionPath, &candidate) {
+			return p, nil
+		}
+	}
+	return nil, serrors.New("no known path matches the packet")
+}
+
+// sameHopFields compares the hop field MACs of two paths, which do not change
+// while the packet is forwarded.
+func sameHopFields(a, b *scion.Raw) bool {
+	if a.NumHops != b.NumHops {
+		return false
+	}
+	for i := 0; i < a.NumHops; i++ {
+		ha, errA := a.GetHopField(i)
+		hb, errB := b.GetHopField(i)
+		if errA != nil || errB != nil || ha.Mac != hb.Mac {
+			return false
+		}
+	}
+	return true
+}
+
+// buildEPICPacket serializes a Test 20 request as it would be sent over p.
+func buildEPICPacket(p snet.Path, localIA addr.IA) ([]byte, error) {
+	dataplane, err := newEPICDataplane(p)
+	if err != nil {
+		return nil, err
+	}
+	srcIP, err := netip.ParseAddr(local)
+	if err != nil {
+		return nil, serrors.WrapStr("parsing local address", err)
+	}
+	dstIP, ok := netip.AddrFromSlice(remote.Host.IP)
+	if !ok {
+		return nil, serrors.New("invalid remote address", "remote", remote.String())
+	}
+	payload, err := json.Marshal(Request{ID: 20, Payload: map[string]interface{}{}})
+	if err != nil {
+		return nil, serrors.WrapStr("marshaling request", err)
+	}
+
+	pkt := &snet.Packet{
+		PacketInfo: snet.PacketInfo{
+			Destination: snet.SCIONAddress{IA: remote.IA, Host: addr.HostIP(dstIP.Unmap())},
+			Source:      snet.SCIONAddress{IA: localIA, Host: addr.HostIP(srcIP)},
+			Path:        dataplane,
+			Payload: snet.UDPPayload{
+				DstPort: uint16(remote.Host.Port),
+				Payload: payload,
+			},
+		},
+	}
+	if err := pkt.Serialize(); err != nil {
+		return nil, serrors.WrapStr("serializing EPIC packet", err)
+	}
+	return append([]byte(nil), pkt.Bytes...), nil
+}
+
+// runEPICCheck implements the epic-check subcommand. It validates an EPIC
+// packet read from a file, or one built the same way as in Test 20, and
+// reports every check with the hop it belongs to.
+func runEPICCheck(args []string) error {
+	fs := flag.NewFlagSet("epic-check", flag.ContinueOnError)
+	packetFile := fs.String("packet", "",
+		"A captured packet (raw or hex, starting at the SCION header); built like Test 20 if empty")
+	authPHVF := fs.String("auth-phvf", "", "The PHVF authenticator in hex instead of asking the daemon")
+	authLHVF := fs.String("auth-lhvf", "", "The LHVF authenticator in hex instead of asking the daemon")
+	at := fs.String("at", "", "Validate the freshness as of this RFC 3339 time instead of now")
+	if err := fs.Parse(args); err != nil {
+		return serrors.WrapStr("parsing epic-check arguments", err)
+	}
+
+	now := time.Now()
+	if *at != "" {
+		t, err := time.Parse(time.RFC3339, *at)
+		if err != nil {
+			return serrors.WrapStr("parsing --at", err)
+		}
+		now = t
+	}
+
+	var (
+		raw   []byte
+		auths snet.EpicAuths
+		p     snet.Path
+		err   error
+	)
+	if *authPHVF != "" || *authLHVF != "" {
+		if auths.AuthPHVF, err = hex.DecodeString(*authPHVF); err != nil {
+			return serrors.WrapStr("parsing --auth-phvf", err)
+		}
+		if auths.AuthLHVF, err = hex.DecodeString(*authLHVF); err != nil {
+			return serrors.WrapStr("parsing --auth-lhvf", err)
+		}
+		if *packetFile == "" {
+			return serrors.New("--packet is required with explicit authenticators")
+		}
+		if raw, err = readPacketFile(*packetFile); err != nil {
+			return err
+		}
+	} else {
+		ctx := context.Background()
+		daemonConn, localIA, err := connectDaemon(ctx)
+		if err != nil {
+			return err
+		}
+		defer daemonConn.Close()
+
+		paths, err := daemonConn.Paths(ctx, remote.IA, localIA, daemon.PathReqFlags{Hidden: true})
+		if err != nil {
+			return serrors.WrapStr("querying EPIC paths", err)
+		}
+		if *packetFile != "" {
+			if raw, err = readPacketFile(*packetFile); err != nil {
+				return err
+			}
+			if p, err = findPathForPacket(raw, paths); err != nil {
+				return err
+			}
+		} else {
+			if p, err = findEPICPath(ctx, paths); err != nil {
+				return serrors.WrapStr("finding EPIC path", err)
+			}
+			if raw, err = buildEPICPacket(p, localIA); err != nil {
+				return err
+			}
+		}
+		if metadata := p.Metadata(); metadata == nil || !metadata.EpicAuths.SupportsEpic() {
+			return serrors.New("path carries no EPIC authenticators",
+				"fingerprint", snet.Fingerprint(p))
+		}
+		auths = p.Metadata().EpicAuths
+	}
+
+	checks, err := validateEPICPacket(raw, auths, p, now)
+	if err != nil {
+		return err
+	}
+	failed := 0
+	for _, c := range checks {
+		fmt.Println(c)
+		if c.err != nil {
+			failed++
+		}
+	}
+	if failed > 0 {
+		return serrors.New("EPIC packet is invalid", "failed_checks", failed)
+	}
+	return nil
+}
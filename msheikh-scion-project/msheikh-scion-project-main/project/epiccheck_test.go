@@ -0,0 +1,198 @@
+package main
+
+import (
+	"fmt"
+	"net/netip"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/scionproto/scion/pkg/addr"
+	"github.com/scionproto/scion/pkg/slayers"
+	slpath "github.com/scionproto/scion/pkg/slayers/path"
+	"github.com/scionproto/scion/pkg/slayers/path/epic"
+	"github.com/scionproto/scion/pkg/slayers/path/scion"
+	"github.com/scionproto/scion/pkg/snet"
+	"github.com/scionproto/scion/pkg/snet/path"
+)
+
+// epicTestPath returns the single-segment path 1-ff00:0:110 > 1-ff00:0:111 >
+// 1-ff00:0:112 with EPIC authenticators, created a minute ago.
+func epicTestPath(t *testing.T) snet.Path {
+	t.Helper()
+	ias := []addr.IA{addr.MustParseIA("1-ff00:0:110"), addr.MustParseIA("1-ff00:0:111"),
+		addr.MustParseIA("1-ff00:0:112")}
+	created := time.Now().Add(-time.Minute)
+
+	decoded := scion.Decoded{
+		Base: scion.Base{
+			PathMeta: scion.MetaHdr{SegLen: [3]uint8{3}},
+			NumINF:   1,
+			NumHops:  3,
+		},
+		InfoFields: []slpath.InfoField{{ConsDir: true, SegID: 0x1234,
+			Timestamp: uint32(created.Unix())}},
+		HopFields: []slpath.HopField{
+			{ExpTime: 63, ConsEgress: 1, Mac: [slpath.MacLen]byte{1, 1, 1, 1, 1, 1}},
+			{ExpTime: 63, ConsIngress: 2, ConsEgress: 3, Mac: [slpath.MacLen]byte{2, 2, 2, 2, 2, 2}},
+			{ExpTime: 63, ConsIngress: 4, Mac: [slpath.MacLen]byte{3, 3, 3, 3, 3, 3}},
+		},
+	}
+	raw := make([]byte, decoded.Len())
+	if err := decoded.SerializeTo(raw); err != nil {
+		t.Fatal(err)
+	}
+
+	meta := snet.PathMetadata{
+		Interfaces: []snet.PathInterface{{IA: ias[0], ID: 1}, {IA: ias[1], ID: 2},
+			{IA: ias[1], ID: 3}, {IA: ias[2], ID: 4}},
+		Expiry: created.Add(slpath.ExpTimeToDuration(63)),
+		EpicAuths: snet.EpicAuths{
+			AuthPHVF: []byte("phvf-auth-16byte"),
+			AuthLHVF: []byte("lhvf-auth-16byte"),
+		},
+	}
+	return &path.Path{Src: ias[0], Dst: ias[2], DataplanePath: path.SCION{Raw: raw}, Meta: meta}
+}
+
+// epicTestPacket serializes a packet over the EPIC dataplane path of p.
+func epicTestPacket(t *testing.T, p snet.Path) []byte {
+	t.Helper()
+	dataplane, err := path.NewEPICDataplanePath(p.Dataplane().(path.SCION),
+		p.Metadata().EpicAuths)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return epicTestPacketOver(t, p, dataplane)
+}
+
+// epicTestPacketOver serializes a packet over the given dataplane path of p.
+func epicTestPacketOver(t *testing.T, p snet.Path, dataplane snet.DataplanePath) []byte {
+	t.Helper()
+	pkt := &snet.Packet{
+		PacketInfo: snet.PacketInfo{
+			Destination: snet.SCIONAddress{IA: p.Destination(),
+				Host: addr.HostIP(netip.MustParseAddr("10.0.0.2"))},
+			Source: snet.SCIONAddress{IA: p.Source(),
+				Host: addr.HostIP(netip.MustParseAddr("10.0.0.1"))},
+			Path: dataplane,
+			Payload: snet.UDPPayload{SrcPort: 31000, DstPort: 30100,
+				Payload: []byte(`{"ID":20}`)},
+		},
+	}
+	if err := pkt.Serialize(); err != nil {
+		t.Fatal(err)
+	}
+	return append([]byte(nil), pkt.Bytes...)
+}
+
+// epicPathOffset returns the offset of the EPIC path in the packet.
+func epicPathOffset(t *testing.T, raw []byte) int {
+	t.Helper()
+	var s slayers.SCION
+	if err := s.DecodeFromBytes(raw, gopacket.NilDecodeFeedback); err != nil {
+		t.Fatal(err)
+	}
+	return slayers.CmnHdrLen + s.AddrHdrLen()
+}
+
+// failedEPICChecks lists the failed checks as "name hop", e.g. "PHVF 1".
+func failedEPICChecks(checks []epicCheck) []string {
+	var failed []string
+	for _, c := range checks {
+		switch {
+		case c.err == nil:
+		case c.hop < 0:
+			failed = append(failed, c.name)
+		default:
+			failed = append(failed, fmt.Sprintf("%s %d", c.name, c.hop))
+		}
+	}
+	sort.Strings(failed)
+	return failed
+}
+
+func TestValidateEPICPacket(t *testing.T) {
+	p := epicTestPath(t)
+	// The offsets of the fields within the EPIC path.
+	const (
+		phvf    = epic.PktIDLen
+		lhvf    = epic.PktIDLen + epic.HVFLen
+		hopMACs = epic.MetadataLen + scion.MetaLen + slpath.InfoLen + slpath.HopLen - slpath.MacLen
+	)
+	tests := []struct {
+		name string
+		// flip is the offset within the EPIC path of the byte to flip, -1 for
+		// none.
+		flip int
+		// capture is when the packet was captured, relative to when it was
+		// built.
+		capture time.Duration
+		// failed are the checks that must fail, as "name hop".
+		failed []string
+		// ia is the AS the failed check must be attributed to.
+		ia string
+	}{
+		{name: "valid", flip: -1},
+		{name: "PHVF", flip: phvf, failed: []string{"PHVF 1"}, ia: "1-ff00:0:111"},
+		{name: "LHVF", flip: lhvf + epic.HVFLen - 1, failed: []string{"LHVF 2"},
+			ia: "1-ff00:0:112"},
+		{name: "first hop MAC", flip: hopMACs, failed: []string{"hop field MAC 0"},
+			ia: "1-ff00:0:110"},
+		{name: "middle hop MAC", flip: hopMACs + slpath.HopLen + 2,
+			failed: []string{"hop field MAC 1"}, ia: "1-ff00:0:111"},
+		{name: "last hop MAC", flip: hopMACs + 2*slpath.HopLen + slpath.MacLen - 1,
+			failed: []string{"hop field MAC 2"}, ia: "1-ff00:0:112"},
+		{name: "captured too late", flip: -1, capture: 10 * time.Second,
+			failed: []string{"packet freshness"}},
+		{name: "captured before it was sent", flip: -1, capture: -10 * time.Second,
+			failed: []string{"packet freshness"}},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			raw := epicTestPacket(t, p)
+			built := time.Now()
+			if tc.flip >= 0 {
+				raw[epicPathOffset(t, raw)+tc.flip] ^= 0x80
+			}
+			checks, err := validateEPICPacket(raw, p.Metadata().EpicAuths, p,
+				built.Add(tc.capture))
+			if err != nil {
+				t.Fatal(err)
+			}
+			failed := failedEPICChecks(checks)
+			if strings.Join(failed, ",") != strings.Join(tc.failed, ",") {
+				t.Fatalf("failed checks %q, want %q", failed, tc.failed)
+			}
+			if tc.ia == "" {
+				return
+			}
+			for _, c := range checks {
+				if c.err != nil && c.ia.String() != tc.ia {
+					t.Errorf("%s attributed to %s, want %s", c, c.ia, tc.ia)
+				}
+			}
+		})
+	}
+}
+
+func TestValidateEPICPacketWithoutPath(t *testing.T) {
+	p := epicTestPath(t)
+	raw := epicTestPacket(t, p)
+	raw[epicPathOffset(t, raw)+epic.PktIDLen] ^= 0x80
+
+	checks, err := validateEPICPacket(raw, p.Metadata().EpicAuths, nil, time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, c := range checks {
+		if c.name == "hop field MAC" || c.name == "path expiry" {
+			t.Errorf("%s checked without a path", c.name)
+		}
+	}
+	if failed := failedEPICChecks(checks); len(failed) != 1 || failed[0] != "PHVF 1" {
+		t.Errorf("failed checks %q, want the PHVF", failed)
+	}
+}
@@ -0,0 +1,426 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/scionproto/scion/pkg/addr"
+	"github.com/scionproto/scion/pkg/daemon"
+	"github.com/scionproto/scion/pkg/experimental/fabrid"
+	"github.com/scionproto/scion/pkg/log"
+	"github.com/scionproto/scion/pkg/private/common"
+	"github.com/scionproto/scion/pkg/private/serrors"
+	"github.com/scionproto/scion/pkg/snet"
+	"github.com/scionproto/scion/pkg/snet/path"
+	"github.com/scionproto/scion/private/path/fabridquery"
+)
+
+// fabridRecheckInterval is how often a FABRID connection evaluates its query
+// against freshly fetched paths to notice changed policy matches.
+const fabridRecheckInterval = 30 * time.Second
+
+// fabridHopInterfaces turns the interface list of a path into one hop
+// interface per on-path AS, annotated with the FABRID policies of the hop.
+func fabridHopInterfaces(metadata *snet.PathMetadata) []snet.HopInterface {
+	interfaces := metadata.Interfaces
+	var hops []snet.HopInterface
+
+	i := 0
+	for i < len(interfaces) {
+		var igIf, egIf common.IFIDType
+		ia := interfaces[i].IA
+
+		switch {
+		case i == 0:
+			egIf = interfaces[i].ID
+			i++
+		case i == len(interfaces)-1:
+			igIf = interfaces[i].ID
+			i++
+		case interfaces[i].IA == interfaces[i+1].IA:
+			igIf = interfaces[i].ID
+			egIf = interfaces[i+1].ID
+			i += 2
+		default:
+			igIf = interfaces[i].ID
+			i++
+		}
+
+		hop := snet.HopInterface{IgIf: igIf, EgIf: egIf, IA: ia}
+		if idx := len(hops); idx < len(metadata.FabridInfo) {
+			hop.FabridEnabled = metadata.FabridInfo[idx].Enabled
+			hop.Policies = metadata.FabridInfo[idx].Policies
+		}
+		hops = append(hops, hop)
+	}
+	return hops
+}
+
+// fabridHopPolicy returns the name of the policy selected for a hop, "-" if
+// the hop forwards without a policy.
+func fabridHopPolicy(p *fabridquery.Policy) string {
+	if p == nil || p.Type != fabridquery.STANDARD_POLICY_TYPE || p.Policy == nil {
+		return "-"
+	}
+	return p.Policy.String()
+}
+
+// fabridMatch is the result of evaluating a FABRID query on a path.
+type fabridMatch struct {
+	path      snet.Path
+	hops      []snet.HopInterface
+	selected  []*fabridquery.Policy
+	policyIDs []*fabrid.PolicyID
+}
+
+// String lists the policy chosen for every hop, e.g.
+// "1-ff00:0:110=- 1-ff00:0:111=L1000 1-ff00:0:112=-".
+func (m fabridMatch) String() string {
+	parts := make([]string, len(m.hops))
+	for i, hop := range m.hops {
+		var p *fabridquery.Policy
+		if i < len(m.selected) {
+			p = m.selected[i]
+		}
+		parts[i] = fmt.Sprintf("%s=%s", hop.IA, fabridHopPolicy(p))
+	}
+	return strings.Join(parts, " ")
+}
+
+// matchFabridQuery evaluates the query on every FABRID-enabled path and
+// returns the best match under the preferences. A path with the given
+// fingerprint is preferred if it is still among the best.
+func matchFabridQuery(ctx context.Context, query fabridquery.Expressor, paths []snet.Path,
+	prefer snet.PathFingerprint, prefs fabridPreferences) (fabridMatch, error) {
+
+	matches, scores := fabridCandidates(ctx, query, paths, prefs)
+	if len(matches) == 0 {
+		return fabridMatch{}, serrors.New("no path matches the FABRID query")
+	}
+	for i, m := range matches {
+		if prefs.less(scores[0], scores[i]) {
+			break
+		}
+		if snet.Fingerprint(m.path) == prefer {
+			return m, nil
+		}
+	}
+	return matches[0], nil
+}
+
+// selectFabridTestPath returns the best match of the query under the
+// preferences that accept allows, accept nil allows every match. If there is
+// none, the first FABRID-enabled path is used with the policies of the
+// wildcard query and the match is reported as not fulfilling the query.
+func selectFabridTestPath(ctx context.Context, query, wildcard fabridquery.Expressor,
+	paths []snet.Path, prefs fabridPreferences,
+	accept func(fabridMatch) bool) (fabridMatch, bool, error) {
+
+	logger := log.FromCtx(ctx)
+
+	matches, scores := fabridCandidates(ctx, query, paths, prefs)
+	for i, m := range matches {
+		if accept != nil && !accept(m) {
+			continue
+		}
+		logger.Info("Selected matching path", pathFields(m.path, "num_hops", len(m.hops),
+			"score", scores[i].String(prefs), "policies", m.String())...)
+		return m, true, nil
+	}
+
+	if len(paths) == 0 {
+		return fabridMatch{}, false, serrors.New("no paths available")
+	}
+	logger.Info("No paths match policy, using fallback")
+	fallback := paths[0]
+	for _, p := range paths {
+		if metadata := p.Metadata(); metadata != nil && len(metadata.FabridInfo) > 0 {
+			fallback = p
+			break
+		}
+	}
+	metadata := fallback.Metadata()
+	if metadata == nil {
+		return fabridMatch{}, false, serrors.New("fallback path has no metadata")
+	}
+	hops := fabridHopInterfaces(metadata)
+	_, result := evaluateFabridQuery(wildcard, hops)
+	return fabridMatch{
+		path:      fallback,
+		hops:      hops,
+		selected:  result.SelectedPolicies,
+		policyIDs: result.Policies(),
+	}, false, nil
+}
+
+// fabridConn is a connection to the remote over a FABRID path. The dataplane
+// path computes a fresh packet identifier and path validator for every packet
+// from DRKeys, which the daemon connection caches and prefetches. The query is
+// re-evaluated regularly and the path is rebuilt when the per-hop policy
+// match changes.
+type fabridConn struct {
+	daemonConn daemon.Connector
+	network    *snet.SCIONNetwork
+	localAddr  *net.UDPAddr
+	localIA    addr.IA
+	query      fabridquery.Expressor
+	prefs      fabridPreferences
+	// dial connects to the remote over the dataplane path of a match.
+	dial func(context.Context, fabridMatch) (net.Conn, error)
+
+	mu       sync.Mutex
+	match    fabridMatch
+	conn     net.Conn
+	checked  time.Time
+	expiry   time.Time
+	rebuilds int
+	// sent counts the packets per hop and policy, keyed by hop index.
+	sent []map[string]int64
+}
+
+func newFabridConn(ctx context.Context, daemonConn daemon.Connector,
+	network *snet.SCIONNetwork, localAddr *net.UDPAddr, localIA addr.IA,
+	query string, prefs fabridPreferences) (*fabridConn, error) {
+
+	expr, err := parseFabridQuery(query)
+	if err != nil {
+		return nil, err
+	}
+	c := &fabridConn{
+		daemonConn: daemonConn,
+		network:    network,
+		localAddr:  localAddr,
+		localIA:    localIA,
+		query:      expr,
+		prefs:      prefs,
+	}
+	c.dial = c.dialPath
+	if err := c.recheck(ctx, false); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// recheck evaluates the query on the current paths and rebuilds the dataplane
+// path if the match differs from the one in use.
+func (c *fabridConn) recheck(ctx context.Context, refresh bool) error {
+	logger := log.FromCtx(ctx)
+
+	paths, err := c.daemonConn.Paths(ctx, remote.IA, c.localIA, daemon.PathReqFlags{
+		FetchFabridDetachedMaps: true,
+		Refresh:                 refresh,
+	})
+	if err != nil {
+		return serrors.WrapStr("querying FABRID paths", err)
+	}
+	var prefer snet.PathFingerprint
+	if c.match.path != nil {
+		prefer = snet.Fingerprint(c.match.path)
+	}
+	match, err := matchFabridQuery(ctx, c.query, paths, prefer, c.prefs)
+	if err != nil {
+		return err
+	}
+	c.checked = time.Now()
+
+	if c.conn != nil && snet.Fingerprint(match.path) == prefer &&
+		match.String() == c.match.String() && !refresh {
+		return nil
+	}
+	if c.conn != nil {
+		logger.Info("FABRID policy match changed", "old", c.match, "new", match)
+	}
+	return c.build(ctx, match)
+}
+
+// build connects over the path of the match and makes it the one in use.
+func (c *fabridConn) build(ctx context.Context, match fabridMatch) error {
+	conn, err := c.dial(ctx, match)
+	if err != nil {
+		return err
+	}
+	if c.conn != nil {
+		c.conn.Close()
+		c.rebuilds++
+	}
+	c.conn = conn
+	c.match = match
+	c.expiry = earliestExpiry([]snet.Path{match.path}).Add(-pathExpiryMargin)
+	if len(c.sent) < len(match.hops) {
+		c.sent = append(c.sent, make([]map[string]int64, len(match.hops)-len(c.sent))...)
+	}
+	log.FromCtx(ctx).Info("FABRID path built", "fingerprint", snet.Fingerprint(match.path),
+		"policies", match)
+	return nil
+}
+
+// dialPath creates the FABRID dataplane path of the match and dials the remote
+// over it.
+func (c *fabridConn) dialPath(ctx context.Context, match fabridMatch) (net.Conn, error) {
+	scionPath, ok := match.path.Dataplane().(path.SCION)
+	if !ok {
+		return nil, serrors.New("FABRID requires a SCION dataplane path")
+	}
+	if len(match.policyIDs) == 0 {
+		return nil, serrors.New("FABRID query selected no policies")
+	}
+	dataplane, err := path.NewFABRIDDataplanePath(
+		scionPath,
+		match.hops,
+		match.policyIDs,
+		&path.FabridConfig{
+			LocalIA:         c.localIA,
+			LocalAddr:       c.localAddr.IP.String(),
+			DestinationIA:   remote.IA,
+			DestinationAddr: remote.Host.IP.String(),
+		},
+		c.daemonConn.FabridKeys,
+	)
+	if err != nil {
+		return nil, serrors.WrapStr("creating FABRID dataplane path", err)
+	}
+
+	dst := remote.Copy()
+	dst.Path = dataplane
+	dst.NextHop = match.path.UnderlayNextHop()
+	conn, err := c.network.Dial(ctx, "udp", c.localAddr, dst)
+	if err != nil {
+		return nil, serrors.WrapStr("dialing FABRID path", err)
+	}
+	return conn, nil
+}
+
+// Write sends b as one FABRID packet.
+func (c *fabridConn) Write(ctx context.Context, b []byte) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	now := time.Now()
+	if now.After(c.expiry) {
+		if err := c.recheck(ctx, true); err != nil {
+			return 0, err
+		}
+	} else if now.Sub(c.checked) > fabridRecheckInterval {
+		if err := c.recheck(ctx, false); err != nil {
+			return 0, err
+		}
+	}
+
+	n, err := c.conn.Write(b)
+	if err != nil {
+		return 0, serrors.WrapStr("writing FABRID packet", err)
+	}
+	for i, hop := range c.match.hops {
+		var p *fabridquery.Policy
+		if i < len(c.match.selected) {
+			p = c.match.selected[i]
+		}
+		if c.sent[i] == nil {
+			c.sent[i] = make(map[string]int64)
+		}
+		c.sent[i][fmt.Sprintf("%s %s", hop.IA, fabridHopPolicy(p))]++
+	}
+	return n, nil
+}
+
+// Read reads the next reply from the remote.
+func (c *fabridConn) Read(b []byte, deadline time.Time) (int, error) {
+	c.mu.Lock()
+	conn := c.conn
+	c.mu.Unlock()
+
+	if err := conn.SetReadDeadline(deadline); err != nil {
+		return 0, err
+	}
+	return conn.Read(b)
+}
+
+func (c *fabridConn) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.conn.Close()
+}
+
+// logStats logs how many packets were sent under each per-hop policy.
+func (c *fabridConn) logStats(ctx context.Context) {
+	logger := log.FromCtx(ctx)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	logger.Info("FABRID connection statistics", "rebuilds", c.rebuilds)
+	for i, counts := range c.sent {
+		for hopPolicy, n := range counts {
+			logger.Info("FABRID packets per hop policy", "hop", i, "policy", hopPolicy,
+				"packets", n)
+		}
+	}
+}
+
+// runFabridStream implements the fabrid-stream subcommand. It sends a series
+// of FABRID requests over one connection using the given query.
+func runFabridStream(args []string) error {
+	fs := flag.NewFlagSet("fabrid-stream", flag.ContinueOnError)
+	query := fs.String("query", "0-0#0,0@0", "The FABRID query the path has to match")
+	id := fs.Int("id", 30, "The test ID sent in the requests")
+	count := fs.Int("count", 100, "The number of requests to send")
+	interval := fs.Duration("interval", 100*time.Millisecond, "The pause between requests")
+	prefer := fs.String("prefer", "", "Comma-separated policy identifiers to prefer, e.g. L1002,G:remote-attestation")
+	optimize := fs.String("optimize", "",
+		"Comma-separated criteria to order the paths by: preferred, carbon, hops, opennet, direct")
+	if err := fs.Parse(args); err != nil {
+		return serrors.WrapStr("parsing fabrid-stream arguments", err)
+	}
+	prefs, err := parseFabridPreferences(*prefer, *optimize)
+	if err != nil {
+		return err
+	}
+
+	ctx := context.Background()
+	daemonConn, localIA, err := connectDaemon(ctx)
+	if err != nil {
+		return err
+	}
+	defer daemonConn.Close()
+
+	network := &snet.SCIONNetwork{
+		Topology: daemonConn,
+	}
+	conn, err := newFabridConn(ctx, daemonConn, network,
+		&net.UDPAddr{IP: net.ParseIP(local)}, localIA, *query, prefs)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	defer conn.logStats(ctx)
+
+	requestBytes, err := json.Marshal(Request{ID: *id, Payload: true})
+	if err != nil {
+		return serrors.WrapStr("marshaling request", err)
+	}
+	buffer := make([]byte, 16000)
+	passed := 0
+	for i := 0; i < *count; i++ {
+		if _, err := conn.Write(ctx, requestBytes); err != nil {
+			return err
+		}
+		n, err := conn.Read(buffer, time.Now().Add(5*time.Second))
+		if err != nil {
+			log.Info("No FABRID response", "request", i, "err", err)
+		} else {
+			var response Response
+			if err := json.Unmarshal(buffer[:n], &response); err == nil &&
+				response.State == "TestPassed" {
+				passed++
+			}
+		}
+		time.Sleep(*interval)
+	}
+	fmt.Printf("fabrid-stream requests=%d passed=%d\n", *count, passed)
+	return nil
+}
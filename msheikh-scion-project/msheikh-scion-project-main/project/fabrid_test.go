@@ -0,0 +1,298 @@
+package main
+
+import (
+	"context"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/scionproto/scion/pkg/snet"
+	"github.com/scionproto/scion/private/path/fabridquery"
+)
+
+// copyingFabridQuery selects the policies of its testFabridQuery but returns
+// copies of them, like a query that builds its own policy values.
+type copyingFabridQuery struct {
+	testFabridQuery
+}
+
+func (q copyingFabridQuery) Evaluate(hops []snet.HopInterface,
+	ml *fabridquery.MatchList) (bool, *fabridquery.MatchList) {
+
+	matched, res := q.testFabridQuery.Evaluate(hops, ml)
+	for _, p := range res.SelectedPolicies {
+		if p != nil && p.Policy != nil {
+			policy := *p.Policy
+			p.Policy = &policy
+		}
+	}
+	return matched, res
+}
+
+// testFabridQueryOf returns a strict query that allows the given policies.
+func testFabridQueryOf(allowed ...string) testFabridQuery {
+	q := testFabridQuery{allowed: make(map[string]bool), strict: true}
+	for _, id := range allowed {
+		q.allowed[id] = true
+	}
+	return q
+}
+
+// selectedPolicies lists the policies of a match, e.g. "- L1000 -".
+func selectedPolicies(m fabridMatch) string {
+	parts := make([]string, len(m.selected))
+	for i, p := range m.selected {
+		parts[i] = fabridHopPolicy(p)
+	}
+	return strings.Join(parts, " ")
+}
+
+func TestOptimizeFabridHopsComparesIdentifiers(t *testing.T) {
+	f := fixturePath{
+		Interfaces: []string{"1-ff00:0:110#1", "1-ff00:0:111#2", "1-ff00:0:111#3",
+			"1-ff00:0:112#4"},
+		Fabrid: []fixtureHop{{}, {Enabled: true, Policies: []string{"L1000", "L1001"}}, {}},
+	}
+	hops := fabridHopInterfaces(buildPaths(t, f)[0].Metadata())
+	prefs := fabridPreferences{preferred: []string{"L1001"}}
+	for name, query := range map[string]fabridquery.Expressor{
+		"same policies":   testFabridQueryOf("L1000", "L1001"),
+		"copied policies": copyingFabridQuery{testFabridQueryOf("L1000", "L1001")},
+	} {
+		matched, res := optimizeFabridHops(query, hops, prefs)
+		if !matched {
+			t.Fatalf("%s: query did not match", name)
+		}
+		if got := fabridHopPolicy(res.SelectedPolicies[1]); got != "L1001" {
+			t.Errorf("%s: selected %s, want the preferred L1001", name, got)
+		}
+	}
+}
+
+func TestSelectFabridTestPath(t *testing.T) {
+	// Both paths lead from 1-ff00:0:110 to 1-ff00:0:112, the long one through
+	// two transit ASes.
+	short := func(policies ...string) fixturePath {
+		return fixturePath{
+			Interfaces: []string{"1-ff00:0:110#1", "1-ff00:0:111#2", "1-ff00:0:111#3",
+				"1-ff00:0:112#4"},
+			Fabrid: []fixtureHop{{}, {Enabled: true, Policies: policies}, {}},
+		}
+	}
+	long := func(policies ...string) fixturePath {
+		return fixturePath{
+			Interfaces: []string{"1-ff00:0:110#5", "1-ff00:0:113#6", "1-ff00:0:113#7",
+				"1-ff00:0:114#8", "1-ff00:0:114#9", "1-ff00:0:112#10"},
+			Fabrid: []fixtureHop{{}, {Enabled: true, Policies: policies},
+				{Enabled: true, Policies: policies}, {}},
+		}
+	}
+	tests := []struct {
+		name     string
+		paths    []fixturePath
+		query    testFabridQuery
+		optimize string
+		prefer   string
+		accept   func(fabridMatch) bool
+		// want is the index of the expected path and wantPolicies its
+		// policies, fulfilled whether the query is reported as fulfilled.
+		want         int
+		wantPolicies string
+		fulfilled    bool
+	}{
+		{
+			name:         "fewest hops",
+			paths:        []fixturePath{long("L1000"), short("L1001")},
+			query:        testFabridQueryOf("L1000", "L1001"),
+			optimize:     "hops",
+			want:         1,
+			wantPolicies: "- L1001 -",
+			fulfilled:    true,
+		},
+		{
+			name:         "only long path matches",
+			paths:        []fixturePath{short("L2000"), long("L1000")},
+			query:        testFabridQueryOf("L1000"),
+			optimize:     "hops",
+			want:         1,
+			wantPolicies: "- L1000 L1000 -",
+			fulfilled:    true,
+		},
+		{
+			name:         "preferred policy",
+			paths:        []fixturePath{long("L1000"), short("L1000", "L1001")},
+			query:        testFabridQueryOf("L1000", "L1001"),
+			optimize:     "preferred,hops",
+			prefer:       "L1001",
+			want:         1,
+			wantPolicies: "- L1001 -",
+			fulfilled:    true,
+		},
+		{
+			name:         "last hop attested",
+			paths:        []fixturePath{short("L1002"), long("L2000")},
+			query:        testFabridQueryOf("L2000", "L1002"),
+			optimize:     "hops",
+			accept:       lastAttested,
+			want:         1,
+			wantPolicies: "- L2000 L2000 -",
+			fulfilled:    true,
+		},
+		{
+			name: "no match falls back to the first FABRID path",
+			paths: []fixturePath{
+				{Interfaces: []string{"1-ff00:0:110#1", "1-ff00:0:112#2"}},
+				short("L2000"),
+			},
+			query:        testFabridQueryOf("L1000"),
+			optimize:     "hops",
+			want:         1,
+			wantPolicies: "- - -",
+			fulfilled:    false,
+		},
+		{
+			name:         "no accepted match falls back",
+			paths:        []fixturePath{short("L1002")},
+			query:        testFabridQueryOf("L1002"),
+			optimize:     "hops",
+			accept:       lastAttested,
+			want:         0,
+			wantPolicies: "- - -",
+			fulfilled:    false,
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			paths := buildPaths(t, tc.paths...)
+			prefs, err := parseFabridPreferences(tc.prefer, tc.optimize)
+			if err != nil {
+				t.Fatal(err)
+			}
+			m, fulfilled, err := selectFabridTestPath(context.Background(), tc.query,
+				testFabridQuery{}, paths, prefs, tc.accept)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if m.path != paths[tc.want] {
+				t.Errorf("selected %s, want path %d", pathHopString(m.path), tc.want)
+			}
+			if got := selectedPolicies(m); got != tc.wantPolicies {
+				t.Errorf("policies %q, want %q", got, tc.wantPolicies)
+			}
+			if fulfilled != tc.fulfilled {
+				t.Errorf("fulfilled %t, want %t", fulfilled, tc.fulfilled)
+			}
+		})
+	}
+}
+
+// fakeFabridPathConn is the connection over one built FABRID path.
+type fakeFabridPathConn struct {
+	net.Conn
+	match  fabridMatch
+	writes int
+	closed bool
+}
+
+func (c *fakeFabridPathConn) Write(b []byte) (int, error) {
+	c.writes++
+	return len(b), nil
+}
+
+func (c *fakeFabridPathConn) Close() error {
+	c.closed = true
+	return nil
+}
+
+func TestFabridConnRecheck(t *testing.T) {
+	path := func(policies ...string) fixturePath {
+		return fixturePath{
+			Interfaces: []string{"1-ff00:0:110#1", "1-ff00:0:111#2", "1-ff00:0:111#3",
+				"1-ff00:0:112#4"},
+			Fabrid: []fixtureHop{{}, {Enabled: true, Policies: policies}, {}},
+		}
+	}
+	detour := fixturePath{
+		Interfaces: []string{"1-ff00:0:110#5", "1-ff00:0:113#6", "1-ff00:0:113#7",
+			"1-ff00:0:112#8"},
+		Fabrid: []fixtureHop{{}, {Enabled: true, Policies: []string{"L1000"}}, {}},
+	}
+
+	daemonConn := &countingConnector{paths: buildPaths(t, path("L1000"))}
+	var dialed []*fakeFabridPathConn
+	c := &fabridConn{
+		daemonConn: daemonConn,
+		query:      testFabridQueryOf("L1000", "L1001"),
+		dial: func(_ context.Context, m fabridMatch) (net.Conn, error) {
+			conn := &fakeFabridPathConn{match: m}
+			dialed = append(dialed, conn)
+			return conn, nil
+		},
+	}
+	ctx := context.Background()
+	if err := c.recheck(ctx, false); err != nil {
+		t.Fatal(err)
+	}
+	// write sends n packets, the first one after the recheck interval, and
+	// checks the connection they were sent on.
+	write := func(step string, n int, want string) {
+		t.Helper()
+		c.checked = time.Now().Add(-2 * fabridRecheckInterval)
+		for i := 0; i < n; i++ {
+			if _, err := c.Write(ctx, []byte("request")); err != nil {
+				t.Fatalf("%s: %v", step, err)
+			}
+		}
+		last := dialed[len(dialed)-1]
+		if got := last.match.String(); got != want {
+			t.Errorf("%s: sent over %s, want %s", step, got, want)
+		}
+		if last.closed {
+			t.Errorf("%s: sent over a closed connection", step)
+		}
+	}
+
+	write("initial path", 2, "1-ff00:0:110=- 1-ff00:0:111=L1000 1-ff00:0:112=-")
+	write("unchanged", 1, "1-ff00:0:110=- 1-ff00:0:111=L1000 1-ff00:0:112=-")
+	if len(dialed) != 1 || dialed[0].writes != 3 {
+		t.Fatalf("unchanged match rebuilt the path: %d dials", len(dialed))
+	}
+
+	daemonConn.paths = buildPaths(t, path("L1001"))
+	write("policy changed", 2, "1-ff00:0:110=- 1-ff00:0:111=L1001 1-ff00:0:112=-")
+	daemonConn.paths = buildPaths(t, detour)
+	write("path changed", 1, "1-ff00:0:110=- 1-ff00:0:113=L1000 1-ff00:0:112=-")
+
+	if daemonConn.queries != 5 {
+		t.Errorf("paths queried %d times, want 5", daemonConn.queries)
+	}
+	if len(dialed) != 3 || c.rebuilds != 2 {
+		t.Fatalf("%d dials and %d rebuilds, want 3 and 2", len(dialed), c.rebuilds)
+	}
+	for i, conn := range dialed[:2] {
+		if !conn.closed {
+			t.Errorf("connection %d was not closed on the rebuild", i)
+		}
+	}
+
+	// The packets are counted per hop index, across rebuilds.
+	want := []map[string]int64{
+		{"1-ff00:0:110 -": 6},
+		{"1-ff00:0:111 L1000": 3, "1-ff00:0:111 L1001": 2, "1-ff00:0:113 L1000": 1},
+		{"1-ff00:0:112 -": 6},
+	}
+	if len(c.sent) != len(want) {
+		t.Fatalf("counted %d hops, want %d", len(c.sent), len(want))
+	}
+	for i := range want {
+		for key, n := range want[i] {
+			if c.sent[i][key] != n {
+				t.Errorf("hop %d: %d packets with %q, want %d", i, c.sent[i][key], key, n)
+			}
+		}
+		if len(c.sent[i]) != len(want[i]) {
+			t.Errorf("hop %d: counted %v, want %v", i, c.sent[i], want[i])
+		}
+	}
+}
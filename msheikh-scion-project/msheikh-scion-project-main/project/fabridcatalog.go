@@ -0,0 +1,419 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/scionproto/scion/pkg/addr"
+	"github.com/scionproto/scion/pkg/daemon"
+	"github.com/scionproto/scion/pkg/experimental/fabrid"
+	"github.com/scionproto/scion/pkg/private/serrors"
+	"github.com/scionproto/scion/pkg/snet"
+	"github.com/scionproto/scion/private/path/fabridquery"
+	"gopkg.in/yaml.v3"
+)
+
+// The registry naming the global FABRID policy identifiers.
+var fabridGlobalPoliciesFile = flag.String("fabrid-global-policies",
+	filepath.Join(topologyStorage, "fabrid_global_policies.yaml"),
+	"The registry of global FABRID policy identifiers and their names")
+
+// fabridGlobalPolicy is one entry of the global policy registry.
+type fabridGlobalPolicy struct {
+	Identifier  uint32 `yaml:"global_identifier"`
+	Name        string `yaml:"name"`
+	Description string `yaml:"description"`
+}
+
+// fabridGlobalRegistry maps global policy identifiers to the policies they
+// denote in every AS.
+type fabridGlobalRegistry struct {
+	Policies []fabridGlobalPolicy `yaml:"policies"`
+}
+
+// loadFabridGlobalRegistry reads the registry from name. A missing file is an
+// empty registry.
+func loadFabridGlobalRegistry(name string) (*fabridGlobalRegistry, error) {
+	var reg fabridGlobalRegistry
+	raw, err := os.ReadFile(name)
+	if errors.Is(err, fs.ErrNotExist) {
+		return &reg, nil
+	}
+	if err != nil {
+		return nil, serrors.WrapStr("reading global FABRID policies", err, "file", name)
+	}
+	if err := yaml.Unmarshal(raw, &reg); err != nil {
+		return nil, serrors.WrapStr("parsing global FABRID policies", err, "file", name)
+	}
+
+	ids := make(map[uint32]bool)
+	names := make(map[string]bool)
+	for _, p := range reg.Policies {
+		if ids[p.Identifier] || (p.Name != "" && names[p.Name]) {
+			return nil, serrors.New("duplicate global FABRID policy", "file", name,
+				"identifier", p.Identifier, "name", p.Name)
+		}
+		ids[p.Identifier] = true
+		names[p.Name] = true
+	}
+	return &reg, nil
+}
+
+func (r *fabridGlobalRegistry) byID(id uint32) (fabridGlobalPolicy, bool) {
+	for _, p := range r.Policies {
+		if p.Identifier == id {
+			return p, true
+		}
+	}
+	return fabridGlobalPolicy{}, false
+}
+
+func (r *fabridGlobalRegistry) byName(name string) (fabridGlobalPolicy, bool) {
+	for _, p := range r.Policies {
+		if p.Name == name {
+			return p, true
+		}
+	}
+	return fabridGlobalPolicy{}, false
+}
+
+var (
+	fabridRegistryOnce sync.Once
+	fabridRegistry     *fabridGlobalRegistry
+	fabridRegistryErr  error
+)
+
+// fabridGlobals returns the registry selected with -fabrid-global-policies.
+func fabridGlobals() (*fabridGlobalRegistry, error) {
+	fabridRegistryOnce.Do(func() {
+		fabridRegistry, fabridRegistryErr = loadFabridGlobalRegistry(*fabridGlobalPoliciesFile)
+	})
+	return fabridRegistry, fabridRegistryErr
+}
+
+// parseFabridPolicy parses a policy identifier: L<n> for a local policy, G<n>
+// or G:<name> for a global one.
+func parseFabridPolicy(s string, reg *fabridGlobalRegistry) (*fabrid.Policy, error) {
+	if name, ok := strings.CutPrefix(s, "G:"); ok {
+		p, ok := reg.byName(name)
+		if !ok {
+			known := make([]string, len(reg.Policies))
+			for i, p := range reg.Policies {
+				known[i] = p.Name
+			}
+			return nil, serrors.New("unknown global FABRID policy", "name", name,
+				"known", strings.Join(known, ","))
+		}
+		return &fabrid.Policy{Identifier: p.Identifier}, nil
+	}
+	if len(s) < 2 || (s[0] != 'L' && s[0] != 'G') {
+		return nil, serrors.New("invalid FABRID policy identifier", "policy", s)
+	}
+	id, err := strconv.ParseUint(s[1:], 10, 32)
+	if err != nil {
+		return nil, serrors.WrapStr("invalid FABRID policy identifier", err, "policy", s)
+	}
+	return &fabrid.Policy{IsLocal: s[0] == 'L', Identifier: uint32(id)}, nil
+}
+
+// fabridPolicyToken matches the policy part of a hop predicate in a query.
+var fabridPolicyToken = regexp.MustCompile(`@(G:[A-Za-z0-9_-]+|[A-Za-z0-9]+)`)
+
+// resolveFabridQuery checks the policy identifiers of a query and replaces
+// named global policies with their identifier, so "0-0#0,0@G:remote-attestation"
+// becomes "0-0#0,0@G1".
+func resolveFabridQuery(query string, reg *fabridGlobalRegistry) (string, error) {
+	var firstErr error
+	resolved := fabridPolicyToken.ReplaceAllStringFunc(query, func(tok string) string {
+		policy := tok[1:]
+		if policy == "0" || policy == "REJECT" {
+			return tok
+		}
+		p, err := parseFabridPolicy(policy, reg)
+		if err != nil {
+			if firstErr == nil {
+				firstErr = err
+			}
+			return tok
+		}
+		return "@" + p.String()
+	})
+	if firstErr != nil {
+		return "", serrors.WrapStr("resolving FABRID query", firstErr, "query", query)
+	}
+	return resolved, nil
+}
+
+// parseFabridQuery resolves the global policy names of a query and parses it.
+func parseFabridQuery(query string) (fabridquery.Expressor, error) {
+	reg, err := fabridGlobals()
+	if err != nil {
+		return nil, err
+	}
+	resolved, err := resolveFabridQuery(query, reg)
+	if err != nil {
+		return nil, err
+	}
+	expr, err := fabridquery.ParseFabridQuery(resolved)
+	if err != nil {
+		return nil, serrors.WrapStr("parsing FABRID query", err, "query", resolved)
+	}
+	return expr, nil
+}
+
+// fabridPolicyFile is a FABRID policy definition of one AS, as read by its
+// border routers.
+type fabridPolicyFile struct {
+	Local            bool               `yaml:"local"`
+	LocalIdentifier  uint32             `yaml:"local_identifier,omitempty"`
+	LocalDescription string             `yaml:"local_description,omitempty"`
+	GlobalIdentifier uint32             `yaml:"global_identifier,omitempty"`
+	Connections      []fabridConnection `yaml:"connections"`
+}
+
+// fabridConnection is a pair of ingress and egress a policy applies to.
+type fabridConnection struct {
+	Ingress   fabridConnectionEnd `yaml:"ingress"`
+	Egress    fabridConnectionEnd `yaml:"egress"`
+	MPLSLabel int                 `yaml:"mpls_label"`
+}
+
+// fabridConnectionEnd is one side of a connection, typically an interface.
+type fabridConnectionEnd struct {
+	Type      string `yaml:"type"`
+	Interface uint16 `yaml:"interface,omitempty"`
+}
+
+// fabridCatalogEntry is a policy offered by an AS of the topology.
+type fabridCatalogEntry struct {
+	ia          addr.IA
+	policy      fabrid.Policy
+	description string
+	connections int
+	file        string
+}
+
+// fabridCatalog lists the policies of every AS of a topology together with
+// the global policy registry.
+type fabridCatalog struct {
+	entries []fabridCatalogEntry
+	globals *fabridGlobalRegistry
+}
+
+// loadFabridCatalog reads the policy files of the <AS>_fabrid directories in
+// the topology directory dir.
+func loadFabridCatalog(dir string, globals *fabridGlobalRegistry) (*fabridCatalog, error) {
+	topo, err := loadTopoFile(dir)
+	if err != nil {
+		return nil, err
+	}
+	dirs, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, serrors.WrapStr("reading topology directory", err, "dir", dir)
+	}
+
+	catalog := &fabridCatalog{globals: globals}
+	for _, d := range dirs {
+		asName, ok := strings.CutSuffix(d.Name(), "_fabrid")
+		if !d.IsDir() || !ok {
+			continue
+		}
+		ia, ok := topo.iaForFileName(asName)
+		if !ok {
+			return nil, serrors.New("FABRID policies of an AS missing from the topology",
+				"dir", d.Name())
+		}
+		files, err := filepath.Glob(filepath.Join(dir, d.Name(), "*.yaml"))
+		if err != nil {
+			return nil, err
+		}
+		for _, name := range files {
+			raw, err := os.ReadFile(name)
+			if err != nil {
+				return nil, serrors.WrapStr("reading FABRID policy", err, "file", name)
+			}
+			var pf fabridPolicyFile
+			if err := yaml.Unmarshal(raw, &pf); err != nil {
+				return nil, serrors.WrapStr("parsing FABRID policy", err, "file", name)
+			}
+			entry := fabridCatalogEntry{
+				ia:          ia,
+				connections: len(pf.Connections),
+				file:        name,
+			}
+			if pf.Local {
+				entry.policy = fabrid.Policy{IsLocal: true, Identifier: pf.LocalIdentifier}
+				entry.description = pf.LocalDescription
+			} else {
+				entry.policy = fabrid.Policy{Identifier: pf.GlobalIdentifier}
+			}
+			catalog.entries = append(catalog.entries, entry)
+		}
+	}
+	sort.SliceStable(catalog.entries, func(i, j int) bool {
+		a, b := catalog.entries[i], catalog.entries[j]
+		if a.ia != b.ia {
+			return a.ia < b.ia
+		}
+		if a.policy.IsLocal != b.policy.IsLocal {
+			return !a.policy.IsLocal
+		}
+		return a.policy.Identifier < b.policy.Identifier
+	})
+	return catalog, nil
+}
+
+// describe returns the description of a policy offered by ia. Global policies
+// are described by the registry, local ones by the policy file of the AS.
+func (c *fabridCatalog) describe(ia addr.IA, p *fabrid.Policy) string {
+	if !p.IsLocal {
+		g, ok := c.globals.byID(p.Identifier)
+		if !ok {
+			return "(not in the global registry)"
+		}
+		return fmt.Sprintf("%s: %s", g.Name, g.Description)
+	}
+	for _, e := range c.entries {
+		if e.ia == ia && e.policy.IsLocal && e.policy.Identifier == p.Identifier {
+			return e.description
+		}
+	}
+	return "(no local description)"
+}
+
+// printFabridLivePolicies prints the policies every on-path AS announces in
+// its FABRID map, with the index under which it applies them.
+func printFabridLivePolicies(paths []snet.Path, catalog *fabridCatalog) {
+	seen := make(map[addr.IA]bool)
+	for _, p := range paths {
+		metadata := p.Metadata()
+		if metadata == nil {
+			continue
+		}
+		for _, hop := range fabridHopInterfaces(metadata) {
+			if seen[hop.IA] || !hop.FabridEnabled {
+				continue
+			}
+			seen[hop.IA] = true
+			for _, policy := range hop.Policies {
+				if policy == nil {
+					continue
+				}
+				fmt.Printf("%-14s index %-3d %-7s %s\n", hop.IA, policy.Index, policy,
+					catalog.describe(hop.IA, policy))
+			}
+		}
+	}
+}
+
+// printFabridResolution prints, for every path, the index under which each
+// on-path AS applies the policy according to its FABRID map.
+func printFabridResolution(paths []snet.Path, want *fabrid.Policy) {
+	for _, p := range paths {
+		metadata := p.Metadata()
+		if metadata == nil || len(metadata.FabridInfo) == 0 {
+			continue
+		}
+		var parts []string
+		for _, hop := range fabridHopInterfaces(metadata) {
+			part := fmt.Sprintf("%s=-", hop.IA)
+			for _, policy := range hop.Policies {
+				if policy != nil && policy.IsLocal == want.IsLocal &&
+					policy.Identifier == want.Identifier {
+					part = fmt.Sprintf("%s=#%d", hop.IA, policy.Index)
+				}
+			}
+			parts = append(parts, part)
+		}
+		fmt.Printf("%s %s: %s\n", snet.Fingerprint(p), want, strings.Join(parts, " "))
+	}
+}
+
+// runFabridPolicies implements the fabrid-policies subcommand. It prints the
+// policy catalog of the topology and, with --live, the policies announced in
+// the FABRID maps of the ASes on the paths to the remote.
+func runFabridPolicies(args []string) error {
+	fs := flag.NewFlagSet("fabrid-policies", flag.ContinueOnError)
+	dir := fs.String("dir", "", "The topology directory (default: the directory of -topology)")
+	live := fs.Bool("live", false, "Also list the policies in the FABRID maps of on-path ASes")
+	resolve := fs.String("resolve", "",
+		"Resolve a policy (e.g. G1 or G:remote-attestation) through the FABRID maps of every path")
+	if err := fs.Parse(args); err != nil {
+		return serrors.WrapStr("parsing fabrid-policies arguments", err)
+	}
+	if *dir == "" {
+		*dir = topologyDir()
+	}
+
+	globals, err := fabridGlobals()
+	if err != nil {
+		return err
+	}
+	catalog, err := loadFabridCatalog(*dir, globals)
+	if err != nil {
+		return err
+	}
+
+	fmt.Println("Global policies:")
+	for _, g := range globals.Policies {
+		var offeredBy []string
+		for _, e := range catalog.entries {
+			if !e.policy.IsLocal && e.policy.Identifier == g.Identifier {
+				offeredBy = append(offeredBy, e.ia.String())
+			}
+		}
+		if len(offeredBy) == 0 {
+			offeredBy = []string{"none"}
+		}
+		fmt.Printf("  G%-5d %-20s %s (offered by: %s)\n", g.Identifier, g.Name, g.Description,
+			strings.Join(offeredBy, ", "))
+	}
+	fmt.Println("Policies per AS:")
+	for _, e := range catalog.entries {
+		fmt.Printf("  %-14s %-7s %s (%d connections)\n", e.ia, e.policy.String(),
+			catalog.describe(e.ia, &e.policy), e.connections)
+	}
+
+	if !*live && *resolve == "" {
+		return nil
+	}
+	var want *fabrid.Policy
+	if *resolve != "" {
+		if want, err = parseFabridPolicy(*resolve, globals); err != nil {
+			return err
+		}
+	}
+
+	ctx := context.Background()
+	daemonConn, localIA, err := connectDaemon(ctx)
+	if err != nil {
+		return err
+	}
+	defer daemonConn.Close()
+
+	paths, err := daemonConn.Paths(ctx, remote.IA, localIA, daemon.PathReqFlags{
+		FetchFabridDetachedMaps: true,
+	})
+	if err != nil {
+		return serrors.WrapStr("querying FABRID paths", err)
+	}
+	if *live {
+		fmt.Println("Policies in the FABRID maps of on-path ASes:")
+		printFabridLivePolicies(paths, catalog)
+	}
+	if want != nil {
+		fmt.Println("Resolution through the FABRID maps:")
+		printFabridResolution(paths, want)
+	}
+	return nil
+}
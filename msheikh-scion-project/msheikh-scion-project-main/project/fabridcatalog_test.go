@@ -0,0 +1,131 @@
+package main
+
+import (
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// testFabridRegistry loads the checked-in global policy registry and adds
+// "remote", a name that is a prefix of "remote-attestation".
+func testFabridRegistry(t *testing.T) *fabridGlobalRegistry {
+	t.Helper()
+	reg, err := loadFabridGlobalRegistry(filepath.Join("..", topologyStorage,
+		"fabrid_global_policies.yaml"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p, ok := reg.byName("remote-attestation"); !ok || p.Identifier != 1 {
+		t.Fatalf("registry lacks remote-attestation as G1: %+v", reg.Policies)
+	}
+	reg.Policies = append(reg.Policies, fabridGlobalPolicy{Identifier: 4, Name: "remote"})
+	return reg
+}
+
+func TestParseFabridPolicy(t *testing.T) {
+	reg := testFabridRegistry(t)
+	tests := []struct {
+		policy string
+		// want is the parsed policy, empty if parsing must fail.
+		want string
+	}{
+		{policy: "L1000", want: "L1000"},
+		{policy: "G2", want: "G2"},
+		{policy: "G:remote-attestation", want: "G1"},
+		{policy: "G:eu-jurisdiction", want: "G2"},
+		{policy: "G:renewable-energy", want: "G3"},
+		{policy: "G:remote", want: "G4"},
+		{policy: "G:attestation"},
+		{policy: "G:remote-attestation2"},
+		{policy: "G:"},
+		{policy: "L"},
+		{policy: "X1000"},
+		{policy: "L-1"},
+		{policy: "L4294967296"},
+	}
+	for _, tc := range tests {
+		p, err := parseFabridPolicy(tc.policy, reg)
+		switch {
+		case tc.want == "" && err == nil:
+			t.Errorf("%s parsed as %s, want an error", tc.policy, p)
+		case tc.want != "" && err != nil:
+			t.Errorf("%s: %v", tc.policy, err)
+		case tc.want != "" && p.String() != tc.want:
+			t.Errorf("%s parsed as %s, want %s", tc.policy, p, tc.want)
+		}
+	}
+}
+
+func TestResolveFabridQuery(t *testing.T) {
+	reg := testFabridRegistry(t)
+	tests := []struct {
+		name  string
+		query string
+		// want is the resolved query, empty if resolving must fail. err is
+		// the unknown name the error must mention.
+		want string
+		err  string
+	}{
+		{
+			name:  "identifiers only",
+			query: fabridQuery31,
+			want:  fabridQuery31,
+		},
+		{
+			name:  "named global policy",
+			query: "0-0#0,0@G:remote-attestation",
+			want:  "0-0#0,0@G1",
+		},
+		{
+			name:  "mixed local and global",
+			query: "0-0#0,0@L1000#0-0#0,0@G:eu-jurisdiction#0-0#0,0@G3#0-0#0,0@REJECT",
+			want:  "0-0#0,0@L1000#0-0#0,0@G2#0-0#0,0@G3#0-0#0,0@REJECT",
+		},
+		{
+			name: "conditional",
+			query: "{1-0#0,0@0 ? 1-0#0,0@G:renewable-energy + 1-0#0,0@L1000 : " +
+				"1-0#0,0@0}",
+			want: "{1-0#0,0@0 ? 1-0#0,0@G3 + 1-0#0,0@L1000 : 1-0#0,0@0}",
+		},
+		{
+			name:  "name that is a prefix of another",
+			query: "0-0#0,0@G:remote+0-0#0,0@G:remote-attestation+0-0#0,0@G:remote",
+			want:  "0-0#0,0@G4+0-0#0,0@G1+0-0#0,0@G4",
+		},
+		{
+			name:  "unknown name",
+			query: "0-0#0,0@L1000#0-0#0,0@G:attestation",
+			err:   "attestation",
+		},
+		{
+			name:  "unknown name extending a known one",
+			query: "0-0#0,0@G:remote-attestation-v2",
+			err:   "remote-attestation-v2",
+		},
+		{
+			name:  "invalid local identifier",
+			query: "0-0#0,0@Lx",
+			err:   "Lx",
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			got, err := resolveFabridQuery(tc.query, reg)
+			if tc.err != "" {
+				if err == nil {
+					t.Fatalf("resolved to %q, want an error", got)
+				}
+				if !strings.Contains(err.Error(), tc.err) {
+					t.Errorf("error %q does not mention %q", err, tc.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != tc.want {
+				t.Errorf("resolved to %q, want %q", got, tc.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,313 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+
+	"github.com/scionproto/scion/pkg/daemon"
+	"github.com/scionproto/scion/pkg/experimental/fabrid"
+	"github.com/scionproto/scion/pkg/private/serrors"
+	"github.com/scionproto/scion/pkg/snet"
+	"github.com/scionproto/scion/private/path/fabridquery"
+)
+
+// fabridCriteria are the path properties a FABRID match can be optimized for.
+var fabridCriteria = map[string]bool{
+	"preferred": true,
+	"carbon":    true,
+	"hops":      true,
+	"opennet":   true,
+	"direct":    true,
+}
+
+// The preferences tests 31 to 33 choose their FABRID path with. By default the
+// matching path with the fewest hops is used with the policies of the query.
+var (
+	fabridTestPrefer = flag.String("fabrid-prefer", "",
+		"Comma-separated policy identifiers the FABRID tests prefer, e.g. L1002,G:remote-attestation")
+	fabridTestOptimize = flag.String("fabrid-optimize", "hops",
+		"Comma-separated criteria the FABRID tests order the paths by: preferred, carbon, hops, opennet, direct")
+)
+
+// fabridPreferences decide between the matches of a FABRID query. The zero
+// value keeps the policies chosen by the query and the first matching path.
+type fabridPreferences struct {
+	// preferred lists policy identifiers such as "L1002" or "G1", most preferred
+	// first. At every hop the most preferred policy that still satisfies the
+	// query is chosen.
+	preferred []string
+	// criteria orders the matching paths, most important first.
+	criteria []string
+}
+
+// parseFabridPreferences parses comma-separated lists of preferred policies
+// and optimization criteria, e.g. "L1002,G:remote-attestation" and
+// "preferred,carbon".
+func parseFabridPreferences(prefer, optimize string) (fabridPreferences, error) {
+	var prefs fabridPreferences
+	for _, id := range strings.Split(prefer, ",") {
+		if id = strings.TrimSpace(id); id == "" {
+			continue
+		}
+		reg, err := fabridGlobals()
+		if err != nil {
+			return fabridPreferences{}, err
+		}
+		policy, err := parseFabridPolicy(id, reg)
+		if err != nil {
+			return fabridPreferences{}, err
+		}
+		prefs.preferred = append(prefs.preferred, policy.String())
+	}
+	for _, c := range strings.Split(optimize, ",") {
+		c = strings.TrimSpace(c)
+		if c == "" {
+			continue
+		}
+		if !fabridCriteria[c] {
+			return fabridPreferences{}, serrors.New("unknown optimization criterion",
+				"criterion", c)
+		}
+		prefs.criteria = append(prefs.criteria, c)
+	}
+	return prefs, nil
+}
+
+// rank is the position of the policy in the preferred list, or the length of
+// the list if it is not preferred.
+func (p fabridPreferences) rank(policy *fabrid.Policy) int {
+	if policy != nil {
+		for i, id := range p.preferred {
+			if policy.String() == id {
+				return i
+			}
+		}
+	}
+	return len(p.preferred)
+}
+
+// evaluateFabridQuery evaluates the query on hops with a fresh match list.
+func evaluateFabridQuery(query fabridquery.Expressor,
+	hops []snet.HopInterface) (bool, *fabridquery.MatchList) {
+
+	matchList := fabridquery.MatchList{
+		SelectedPolicies: make([]*fabridquery.Policy, len(hops)),
+	}
+	return query.Evaluate(hops, &matchList)
+}
+
+// sameFabridPolicy reports whether a and b identify the same policy. Queries
+// may return copies of the policies of a hop.
+func sameFabridPolicy(a, b *fabrid.Policy) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	return a.IsLocal == b.IsLocal && a.Identifier == b.Identifier
+}
+
+// selectedPolicy returns the policy the match list applies at hop i, nil if
+// the hop forwards without a policy.
+func selectedPolicy(ml *fabridquery.MatchList, i int) *fabrid.Policy {
+	if ml == nil || i >= len(ml.SelectedPolicies) {
+		return nil
+	}
+	p := ml.SelectedPolicies[i]
+	if p == nil || p.Type != fabridquery.STANDARD_POLICY_TYPE {
+		return nil
+	}
+	return p.Policy
+}
+
+// optimizeFabridHops evaluates the query on hops and then, hop by hop, tries
+// the policies of the hop in order of preference. A policy is kept if the
+// query still matches with the hop restricted to it, so the result is always a
+// valid match of the query.
+func optimizeFabridHops(query fabridquery.Expressor, hops []snet.HopInterface,
+	prefs fabridPreferences) (bool, *fabridquery.MatchList) {
+
+	matched, result := evaluateFabridQuery(query, hops)
+	if !matched || len(prefs.preferred) == 0 {
+		return matched, result
+	}
+
+	chosen := append([]snet.HopInterface(nil), hops...)
+	for i, hop := range hops {
+		if len(hop.Policies) < 2 || selectedPolicy(result, i) == nil {
+			continue
+		}
+		candidates := append([]*fabrid.Policy(nil), hop.Policies...)
+		sort.SliceStable(candidates, func(a, b int) bool {
+			return prefs.rank(candidates[a]) < prefs.rank(candidates[b])
+		})
+		for _, candidate := range candidates {
+			trial := append([]snet.HopInterface(nil), chosen...)
+			trial[i].Policies = []*fabrid.Policy{candidate}
+			ok, res := evaluateFabridQuery(query, trial)
+			if ok && sameFabridPolicy(selectedPolicy(res, i), candidate) {
+				chosen, result = trial, res
+				break
+			}
+		}
+	}
+	return true, result
+}
+
+// fabridScore holds the value of every optimization criterion of a match.
+type fabridScore map[string]float64
+
+func scoreFabridMatch(ctx context.Context, m fabridMatch, prefs fabridPreferences) fabridScore {
+	score := make(fabridScore, len(prefs.criteria))
+	for _, c := range prefs.criteria {
+		switch c {
+		case "preferred":
+			rank := 0
+			for _, p := range m.selected {
+				if p != nil && p.Type == fabridquery.STANDARD_POLICY_TYPE {
+					rank += prefs.rank(p.Policy)
+				}
+			}
+			score[c] = float64(rank)
+		case "carbon":
+			intensity, _, complete := calculateCarbonIntensity(ctx, m.path)
+			if !complete {
+				intensity = math.Inf(1)
+			}
+			score[c] = intensity
+		case "hops":
+			score[c] = float64(len(m.hops))
+		case "opennet":
+			score[c] = float64(countLinks(m.path.Metadata(), isOpennet))
+		case "direct":
+			score[c] = float64(countLinks(m.path.Metadata(), isNotDirect))
+		}
+	}
+	return score
+}
+
+// less compares two scores criterion by criterion.
+func (p fabridPreferences) less(a, b fabridScore) bool {
+	for _, c := range p.criteria {
+		if a[c] != b[c] {
+			return a[c] < b[c]
+		}
+	}
+	return false
+}
+
+// String formats the score in the order of the criteria.
+func (s fabridScore) String(prefs fabridPreferences) string {
+	parts := make([]string, len(prefs.criteria))
+	for i, c := range prefs.criteria {
+		parts[i] = fmt.Sprintf("%s=%g", c, s[c])
+	}
+	return strings.Join(parts, " ")
+}
+
+// fabridCandidates returns the optimized match of every path the query
+// matches, best first. Matches with equal scores are in the common path order.
+func fabridCandidates(ctx context.Context, query fabridquery.Expressor, paths []snet.Path,
+	prefs fabridPreferences) ([]fabridMatch, []fabridScore) {
+
+	var (
+		matches []fabridMatch
+		scores  []fabridScore
+	)
+	for _, p := range paths {
+		metadata := p.Metadata()
+		if metadata == nil || len(metadata.FabridInfo) == 0 {
+			continue
+		}
+		hops := fabridHopInterfaces(metadata)
+		matched, result := optimizeFabridHops(query, hops, prefs)
+		if !matched {
+			continue
+		}
+		m := fabridMatch{
+			path:      p,
+			hops:      hops,
+			selected:  result.SelectedPolicies,
+			policyIDs: result.Policies(),
+		}
+		matches = append(matches, m)
+		scores = append(scores, scoreFabridMatch(ctx, m, prefs))
+	}
+
+	order := make([]int, len(matches))
+	for i := range order {
+		order[i] = i
+	}
+	sort.SliceStable(order, func(a, b int) bool {
+		sa, sb := scores[order[a]], scores[order[b]]
+		if prefs.less(sa, sb) || prefs.less(sb, sa) {
+			return prefs.less(sa, sb)
+		}
+		return comparePathRanks(newPathRank(matches[order[a]].path),
+			newPathRank(matches[order[b]].path)) < 0
+	})
+	sortedMatches := make([]fabridMatch, len(order))
+	sortedScores := make([]fabridScore, len(order))
+	for i, j := range order {
+		sortedMatches[i], sortedScores[i] = matches[j], scores[j]
+	}
+	return sortedMatches, sortedScores
+}
+
+// runFabridPlan implements the fabrid-plan subcommand. It lists the matches of
+// a FABRID query under the given preferences and prints the per-hop policies
+// and the dataplane path that would be used.
+func runFabridPlan(args []string) error {
+	fs := flag.NewFlagSet("fabrid-plan", flag.ContinueOnError)
+	query := fs.String("query", "0-0#0,0@0", "The FABRID query the path has to match")
+	prefer := fs.String("prefer", "", "Comma-separated policy identifiers to prefer, e.g. L1002,G:remote-attestation")
+	optimize := fs.String("optimize", "preferred",
+		"Comma-separated criteria to order the paths by: preferred, carbon, hops, opennet, direct")
+	if err := fs.Parse(args); err != nil {
+		return serrors.WrapStr("parsing fabrid-plan arguments", err)
+	}
+	prefs, err := parseFabridPreferences(*prefer, *optimize)
+	if err != nil {
+		return err
+	}
+	expr, err := parseFabridQuery(*query)
+	if err != nil {
+		return err
+	}
+
+	ctx := context.Background()
+	daemonConn, localIA, err := connectDaemon(ctx)
+	if err != nil {
+		return err
+	}
+	defer daemonConn.Close()
+
+	paths, err := daemonConn.Paths(ctx, remote.IA, localIA, daemon.PathReqFlags{
+		FetchFabridDetachedMaps: true,
+	})
+	if err != nil {
+		return serrors.WrapStr("querying FABRID paths", err)
+	}
+	matches, scores := fabridCandidates(ctx, expr, paths, prefs)
+	if len(matches) == 0 {
+		return serrors.New("no path matches the FABRID query", "query", *query)
+	}
+
+	for i, m := range matches {
+		fmt.Printf("%2d %s %s\n   policies: %s\n", i, snet.Fingerprint(m.path),
+			scores[i].String(prefs), m)
+	}
+	best := matches[0]
+	ids := make([]string, len(best.policyIDs))
+	for i, id := range best.policyIDs {
+		ids[i] = "-"
+		if id != nil {
+			ids[i] = fmt.Sprintf("%d", *id)
+		}
+	}
+	fmt.Printf("chosen path: %s\nchosen policies: %s\npolicy IDs: [%s]\n",
+		best.path, best, strings.Join(ids, " "))
+	return nil
+}
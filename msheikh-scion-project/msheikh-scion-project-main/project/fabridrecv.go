@@ -0,0 +1,366 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/google/gopacket"
+	"github.com/scionproto/scion/pkg/addr"
+	"github.com/scionproto/scion/pkg/daemon"
+	"github.com/scionproto/scion/pkg/drkey"
+	fabridcrypto "github.com/scionproto/scion/pkg/experimental/fabrid/crypto"
+	"github.com/scionproto/scion/pkg/log"
+	"github.com/scionproto/scion/pkg/private/common"
+	"github.com/scionproto/scion/pkg/private/serrors"
+	"github.com/scionproto/scion/pkg/slayers"
+	"github.com/scionproto/scion/pkg/slayers/extension"
+	"github.com/scionproto/scion/pkg/slayers/path/scion"
+	"github.com/scionproto/scion/pkg/snet"
+)
+
+const fabridPort = 31400
+
+// fabridCheck is the validation result of one hop field of a FABRID packet,
+// or of the path validator if hop is -1.
+type fabridCheck struct {
+	hop int
+	ia  addr.IA
+	// unverifiable is set for the FABRID-enabled hop fields. Their policy and
+	// hop validation field are keyed with the DRKey the AS derived for the
+	// source host, which only the source AS hands out.
+	unverifiable bool
+	err          error
+}
+
+func (c fabridCheck) String() string {
+	status := " OK "
+	switch {
+	case c.err != nil:
+		status = "FAIL"
+	case c.unverifiable:
+		status = " -- "
+	}
+	line := fmt.Sprintf("[%s] path validator", status)
+	switch {
+	case c.hop < 0:
+	case c.unverifiable:
+		line = fmt.Sprintf("[%s] hop %d (%s) unverifiable: policy and hop validation "+
+			"field need the DRKey of the source host", status, c.hop, c.ia)
+	default:
+		line = fmt.Sprintf("[%s] hop %d (%s) without FABRID", status, c.hop, c.ia)
+	}
+	if c.err != nil {
+		line += ": " + c.err.Error()
+	}
+	return line
+}
+
+// fabridPacket is a received packet decoded down to its FABRID options.
+type fabridPacket struct {
+	scn        slayers.SCION
+	path       *scion.Raw
+	identifier *extension.IdentifierOption
+	option     *extension.FabridOption
+	// ingress and egress are the interfaces of every hop field in the
+	// direction the packet travelled.
+	ingress []uint16
+	egress  []uint16
+}
+
+// decodeFabridPacket parses the SCION header of raw together with the FABRID
+// hop-by-hop option and the identifier end-to-end option.
+func decodeFabridPacket(raw []byte) (*fabridPacket, error) {
+	var (
+		p   fabridPacket
+		hbh slayers.HopByHopExtn
+		e2e slayers.EndToEndExtn
+		udp slayers.UDP
+	)
+	parser := gopacket.NewDecodingLayerParser(slayers.LayerTypeSCION, &p.scn, &hbh, &e2e, &udp)
+	parser.IgnoreUnsupported = true
+	var decoded []gopacket.LayerType
+	if err := parser.DecodeLayers(raw, &decoded); err != nil {
+		return nil, serrors.WrapStr("decoding packet", err)
+	}
+
+	var ok bool
+	if p.path, ok = p.scn.Path.(*scion.Raw); !ok {
+		return nil, serrors.New("packet has no SCION path", "type", p.scn.PathType)
+	}
+	numHops := p.path.NumHops
+	info, err := p.path.GetInfoField(0)
+	if err != nil {
+		return nil, err
+	}
+
+	var fabridOpt *slayers.HopByHopOption
+	for _, opt := range hbh.Options {
+		if opt.OptType == slayers.OptTypeFabrid {
+			fabridOpt = opt
+		}
+	}
+	var identifierOpt *slayers.EndToEndOption
+	for _, opt := range e2e.Options {
+		if opt.OptType == slayers.OptTypeIdentifier {
+			identifierOpt = opt
+		}
+	}
+	if fabridOpt == nil || identifierOpt == nil {
+		return nil, serrors.New("packet carries no FABRID options",
+			"fabrid", fabridOpt != nil, "identifier", identifierOpt != nil)
+	}
+	if p.identifier, err = extension.ParseIdentifierOption(identifierOpt, info.Timestamp); err != nil {
+		return nil, serrors.WrapStr("parsing identifier option", err)
+	}
+	if p.option, err = extension.ParseFabridOptionFullExtension(fabridOpt, numHops); err != nil {
+		return nil, serrors.WrapStr("parsing FABRID option", err)
+	}
+
+	seg, segEnd := 0, int(p.path.PathMeta.SegLen[0])
+	for i := 0; i < numHops; i++ {
+		for i >= segEnd && seg < 2 {
+			seg++
+			segEnd += int(p.path.PathMeta.SegLen[seg])
+		}
+		info, err := p.path.GetInfoField(seg)
+		if err != nil {
+			return nil, err
+		}
+		hf, err := p.path.GetHopField(i)
+		if err != nil {
+			return nil, err
+		}
+		ingress, egress := hf.ConsIngress, hf.ConsEgress
+		if !info.ConsDir {
+			ingress, egress = egress, ingress
+		}
+		p.ingress = append(p.ingress, ingress)
+		p.egress = append(p.egress, egress)
+	}
+	return &p, nil
+}
+
+// hopIAs names the AS of every hop field by matching the interface IDs of the
+// packet against the paths from the local AS back to the source.
+func (p *fabridPacket) hopIAs(paths []snet.Path) ([]addr.IA, error) {
+	var ids []common.IFIDType
+	for i := range p.ingress {
+		for _, id := range []uint16{p.ingress[i], p.egress[i]} {
+			if id != 0 {
+				ids = append(ids, common.IFIDType(id))
+			}
+		}
+	}
+
+	for _, path := range paths {
+		metadata := path.Metadata()
+		if metadata == nil || len(metadata.Interfaces) != len(ids) {
+			continue
+		}
+		n := len(ids)
+		same := true
+		for i, intf := range metadata.Interfaces {
+			if intf.ID != ids[n-1-i] {
+				same = false
+				break
+			}
+		}
+		if !same {
+			continue
+		}
+
+		ias := make([]addr.IA, len(p.ingress))
+		j := 0
+		for i := range p.ingress {
+			ias[i] = metadata.Interfaces[n-1-j].IA
+			if p.ingress[i] != 0 {
+				j++
+			}
+			if p.egress[i] != 0 {
+				j++
+			}
+		}
+		return ias, nil
+	}
+	return nil, serrors.New("no known path matches the interfaces of the packet",
+		"interfaces", len(ids))
+}
+
+// validateFabridPacket checks the path validator of a FABRID packet with the
+// host-to-host key of the source and the local host, the one key the
+// destination can fetch. The hop fields are named by AS and the FABRID-enabled
+// ones reported as unverifiable.
+func validateFabridPacket(ctx context.Context, daemonConn daemon.Connector, localIA addr.IA,
+	raw []byte) ([]fabridCheck, error) {
+
+	p, err := decodeFabridPacket(raw)
+	if err != nil {
+		return nil, err
+	}
+	srcHost, err := p.scn.SrcAddr()
+	if err != nil {
+		return nil, serrors.WrapStr("reading source address", err)
+	}
+	dstHost, err := p.scn.DstAddr()
+	if err != nil {
+		return nil, serrors.WrapStr("reading destination address", err)
+	}
+
+	paths, err := daemonConn.Paths(ctx, p.scn.SrcIA, localIA, daemon.PathReqFlags{})
+	if err != nil {
+		return nil, serrors.WrapStr("querying paths to the source", err)
+	}
+	ias, err := p.hopIAs(paths)
+	if err != nil {
+		return nil, err
+	}
+
+	dst := dstHost.String()
+	keys, err := daemonConn.FabridKeys(ctx, drkey.FabridKeysMeta{
+		SrcAS:   p.scn.SrcIA,
+		SrcHost: srcHost.String(),
+		DstAS:   localIA,
+		DstHost: &dst,
+	})
+	if err != nil {
+		return nil, serrors.WrapStr("fetching FABRID path key", err)
+	}
+
+	var checks []fabridCheck
+	for i, meta := range p.option.HopfieldMetadata {
+		if i >= len(ias) {
+			break
+		}
+		checks = append(checks, fabridCheck{hop: i, ia: ias[i], unverifiable: meta.FabridEnabled})
+	}
+
+	validator := fabridCheck{hop: -1}
+	tmp := make([]byte, fabridcrypto.FabridMacInputSize)
+	if _, err := fabridcrypto.VerifyPathValidator(p.option, tmp, keys.PathKey.Key[:]); err != nil {
+		validator.err = err
+	}
+	return append(checks, validator), nil
+}
+
+// replyFabrid answers a request packet over the reversed path so that a
+// fabrid-stream client counts it. The reply carries no FABRID options.
+func replyFabrid(conn snet.PacketConn, pkt *snet.Packet, ov *net.UDPAddr, passed bool) error {
+	rawPath, ok := pkt.Path.(snet.RawPath)
+	if !ok {
+		return serrors.New("unexpected path type", "type", fmt.Sprintf("%T", pkt.Path))
+	}
+	udp, ok := pkt.Payload.(snet.UDPPayload)
+	if !ok {
+		return serrors.New("request is not a UDP packet")
+	}
+	replyPath, err := snet.DefaultReplyPather{}.ReplyPath(rawPath)
+	if err != nil {
+		return serrors.WrapStr("reversing path", err)
+	}
+
+	response := Response{State: "TestFailed"}
+	var request Request
+	if err := json.Unmarshal(udp.Payload, &request); err == nil {
+		response.ID = request.ID
+	}
+	if passed {
+		response.State = "TestPassed"
+	}
+	payload, err := json.Marshal(response)
+	if err != nil {
+		return serrors.WrapStr("marshaling response", err)
+	}
+
+	reply := snet.Packet{
+		PacketInfo: snet.PacketInfo{
+			Destination: pkt.Source,
+			Source:      pkt.Destination,
+			Path:        replyPath,
+			Payload: snet.UDPPayload{
+				SrcPort: udp.DstPort,
+				DstPort: udp.SrcPort,
+				Payload: payload,
+			},
+		},
+	}
+	if err := reply.Serialize(); err != nil {
+		return serrors.WrapStr("serializing reply", err)
+	}
+	return conn.WriteTo(&reply, ov)
+}
+
+// runFabridServer implements the fabrid-server subcommand. It receives FABRID
+// packets, validates their path validator and prints the per-hop result of
+// each packet. The hop validation fields cannot be checked at the destination
+// and are listed as unverifiable, a packet passes on its path validator.
+func runFabridServer(args []string) error {
+	fs := flag.NewFlagSet("fabrid-server", flag.ContinueOnError)
+	port := fs.Int("port", fabridPort, "The UDP port to receive FABRID packets on")
+	count := fs.Int("count", 0, "The number of packets to receive before exiting (0 = unlimited)")
+	reply := fs.Bool("reply", true, "Answer every request with its validation result")
+	if err := fs.Parse(args); err != nil {
+		return serrors.WrapStr("parsing fabrid-server arguments", err)
+	}
+
+	ctx := context.Background()
+	daemonConn, localIA, err := connectDaemon(ctx)
+	if err != nil {
+		return err
+	}
+	defer daemonConn.Close()
+
+	network := &snet.SCIONNetwork{
+		Topology: daemonConn,
+	}
+	conn, err := network.OpenRaw(ctx, &net.UDPAddr{IP: net.ParseIP(local), Port: *port})
+	if err != nil {
+		return serrors.WrapStr("listening for FABRID packets", err)
+	}
+	defer conn.Close()
+
+	log.Info("Waiting for FABRID packets", "addr", conn.LocalAddr())
+
+	received, valid := 0, 0
+	defer func() {
+		log.Info("FABRID validation statistics", "received", received, "valid", valid)
+		daemonConn.logStats()
+	}()
+	for *count == 0 || received < *count {
+		pkt := snet.Packet{Bytes: make(snet.Bytes, common.SupportedMTU)}
+		var ov net.UDPAddr
+		if err := conn.ReadFrom(&pkt, &ov); err != nil {
+			log.Info("Reading packet failed", "err", err)
+			continue
+		}
+		received++
+
+		passed := true
+		checks, err := validateFabridPacket(ctx, daemonConn, localIA, pkt.Bytes)
+		if err != nil {
+			passed = false
+			fmt.Printf("packet %d from %s: %s\n", received, pkt.Source, err)
+		} else {
+			lines := make([]string, len(checks))
+			for i, check := range checks {
+				lines[i] = "  " + check.String()
+				passed = passed && check.err == nil
+			}
+			fmt.Printf("packet %d from %s:\n%s\n", received, pkt.Source,
+				strings.Join(lines, "\n"))
+		}
+		if passed {
+			valid++
+		}
+
+		if *reply {
+			if err := replyFabrid(conn, &pkt, &ov, passed); err != nil {
+				log.Info("Replying failed", "err", err)
+			}
+		}
+	}
+	return nil
+}
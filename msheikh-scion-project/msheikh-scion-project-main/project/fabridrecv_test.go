@@ -0,0 +1,269 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"net/netip"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/scionproto/scion/pkg/addr"
+	"github.com/scionproto/scion/pkg/drkey"
+	fabridcrypto "github.com/scionproto/scion/pkg/experimental/fabrid/crypto"
+	"github.com/scionproto/scion/pkg/slayers"
+	"github.com/scionproto/scion/pkg/slayers/extension"
+	"github.com/scionproto/scion/pkg/slayers/path/scion"
+	"github.com/scionproto/scion/pkg/snet/path"
+)
+
+// fabridTestKey is the host-to-host key of the FABRID test packets.
+var fabridTestKey = drkey.Key{'f', 'a', 'b', 'r', 'i', 'd', '-', 'p', 'a', 't', 'h', '-', 'k', 'e',
+	'y', '!'}
+
+// fabridTestPacket is a FABRID packet from 10.0.0.1 in 1-ff00:0:110 to 10.0.0.2
+// in 1-ff00:0:112 over the path of epicTestPath. Only the hop field of
+// 1-ff00:0:111 is FABRID-enabled.
+type fabridTestPacket struct {
+	raw []byte
+	// option is the offset of the FABRID option data in raw: 4 bytes of
+	// metadata per hop field, followed by the 4-byte path validator.
+	option int
+}
+
+func newFabridTestPacket(t *testing.T, key drkey.Key) fabridTestPacket {
+	t.Helper()
+	var sp scion.Raw
+	if err := sp.DecodeFromBytes(epicTestPath(t).Dataplane().(path.SCION).Raw); err != nil {
+		t.Fatal(err)
+	}
+	info, err := sp.GetInfoField(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	opt := extension.FabridOption{HopfieldMetadata: []*extension.FabridHopfieldMetadata{
+		{},
+		{FabridEnabled: true, EncryptedPolicyID: 5, HopValidationField: [3]byte{1, 2, 3}},
+		{},
+	}}
+	validator, _ := fabridcrypto.VerifyPathValidator(&opt,
+		make([]byte, fabridcrypto.FabridMacInputSize), key[:])
+	binary.BigEndian.PutUint32(opt.PathValidator[:], validator)
+	optData := make([]byte, 4*len(opt.HopfieldMetadata)+4)
+	if err := opt.SerializeTo(optData); err != nil {
+		t.Fatal(err)
+	}
+	id := extension.IdentifierOption{Timestamp: time.Unix(int64(info.Timestamp), 0).Add(time.Second),
+		PacketID: 42, BaseTimestamp: info.Timestamp}
+	idData := make([]byte, 8)
+	if err := id.Serialize(idData); err != nil {
+		t.Fatal(err)
+	}
+
+	scn := &slayers.SCION{
+		FlowID:   1,
+		NextHdr:  slayers.HopByHopClass,
+		PathType: scion.PathType,
+		Path:     &sp,
+		SrcIA:    addr.MustParseIA("1-ff00:0:110"),
+		DstIA:    addr.MustParseIA("1-ff00:0:112"),
+	}
+	if err := scn.SetSrcAddr(addr.HostIP(netip.MustParseAddr("10.0.0.1"))); err != nil {
+		t.Fatal(err)
+	}
+	if err := scn.SetDstAddr(addr.HostIP(netip.MustParseAddr("10.0.0.2"))); err != nil {
+		t.Fatal(err)
+	}
+	hbh := &slayers.HopByHopExtn{Options: []*slayers.HopByHopOption{{
+		OptType: slayers.OptTypeFabrid, OptData: optData, OptDataLen: uint8(len(optData))}}}
+	hbh.NextHdr = slayers.End2EndClass
+	e2e := &slayers.EndToEndExtn{Options: []*slayers.EndToEndOption{{
+		OptType: slayers.OptTypeIdentifier, OptData: idData, OptDataLen: uint8(len(idData))}}}
+	e2e.NextHdr = slayers.L4UDP
+	udp := &slayers.UDP{SrcPort: 31000, DstPort: fabridPort}
+	udp.SetNetworkLayerForChecksum(scn)
+
+	buf := gopacket.NewSerializeBuffer()
+	if err := gopacket.SerializeLayers(buf, gopacket.SerializeOptions{FixLengths: true,
+		ComputeChecksums: true}, scn, hbh, e2e, udp, gopacket.Payload(`{"ID":30}`)); err != nil {
+		t.Fatal(err)
+	}
+	raw := append([]byte(nil), buf.Bytes()...)
+	offset := bytes.Index(raw, optData)
+	if offset < 0 {
+		t.Fatal("FABRID option not found in the packet")
+	}
+	return fabridTestPacket{raw: raw, option: offset}
+}
+
+// fabridTestReturnPaths are the paths from 1-ff00:0:112 back to 1-ff00:0:110,
+// the first of them the reverse of the path of the test packets.
+var fabridTestReturnPaths = []fixturePath{
+	{Interfaces: []string{"1-ff00:0:112#4", "1-ff00:0:111#3", "1-ff00:0:111#2",
+		"1-ff00:0:110#1"}},
+	{Interfaces: []string{"1-ff00:0:112#8", "2-ff00:0:211#7", "2-ff00:0:211#6",
+		"1-ff00:0:110#5"}},
+}
+
+// fabridKeyConnector returns fixed paths and a fixed path key, and records the
+// key request.
+type fabridKeyConnector struct {
+	countingConnector
+	key  drkey.Key
+	meta *drkey.FabridKeysMeta
+}
+
+func (c *fabridKeyConnector) FabridKeys(_ context.Context,
+	meta drkey.FabridKeysMeta) (drkey.FabridKeysResponse, error) {
+
+	c.meta = &meta
+	return drkey.FabridKeysResponse{PathKey: drkey.HostHostKey{Key: c.key}}, nil
+}
+
+func TestDecodeFabridPacket(t *testing.T) {
+	pkt := newFabridTestPacket(t, fabridTestKey)
+	p, err := decodeFabridPacket(pkt.raw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := [2][3]uint16{[3]uint16(p.ingress), [3]uint16(p.egress)},
+		[2][3]uint16{{0, 2, 4}, {1, 3, 0}}; got != want {
+		t.Errorf("ingress and egress %v, want %v", got, want)
+	}
+	if p.identifier.PacketID != 42 {
+		t.Errorf("packet ID %d, want 42", p.identifier.PacketID)
+	}
+	if n := len(p.option.HopfieldMetadata); n != 3 || !p.option.HopfieldMetadata[1].FabridEnabled {
+		t.Errorf("%d hop field metadata, want 3 with the middle one FABRID-enabled", n)
+	}
+
+	for name, raw := range map[string][]byte{
+		"EPIC packet": epicTestPacket(t, epicTestPath(t)),
+		"truncated":   pkt.raw[:len(pkt.raw)/2],
+	} {
+		if _, err := decodeFabridPacket(raw); err == nil {
+			t.Errorf("%s decoded", name)
+		}
+	}
+}
+
+func TestFabridPacketHopIAs(t *testing.T) {
+	p, err := decodeFabridPacket(newFabridTestPacket(t, fabridTestKey).raw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name  string
+		paths []fixturePath
+		// want are the ASes of the hop fields, empty if none is found.
+		want string
+	}{
+		{name: "matching path", paths: fabridTestReturnPaths[:1],
+			want: "1-ff00:0:110 1-ff00:0:111 1-ff00:0:112"},
+		{name: "among others", paths: []fixturePath{fabridTestReturnPaths[1],
+			fabridTestReturnPaths[0]}, want: "1-ff00:0:110 1-ff00:0:111 1-ff00:0:112"},
+		{name: "other interfaces", paths: fabridTestReturnPaths[1:]},
+		{name: "no paths"},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			ias, err := p.hopIAs(buildPaths(t, tc.paths...))
+			if tc.want == "" {
+				if err == nil {
+					t.Errorf("hop ASes %v, want an error", ias)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			got := make([]string, len(ias))
+			for i, ia := range ias {
+				got[i] = ia.String()
+			}
+			if strings.Join(got, " ") != tc.want {
+				t.Errorf("hop ASes %q, want %q", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestValidateFabridPacket(t *testing.T) {
+	localIA := addr.MustParseIA("1-ff00:0:112")
+	// The offsets within the FABRID option.
+	const (
+		middleHVF = 4 + 1
+		validator = 3 * 4
+	)
+	tests := []struct {
+		name string
+		// flip is the offset within the FABRID option of the byte to flip, -1
+		// for none.
+		flip int
+		key  drkey.Key
+		// validatorFails is whether the path validator check must fail.
+		validatorFails bool
+	}{
+		{name: "valid", flip: -1, key: fabridTestKey},
+		{name: "hop validation field", flip: middleHVF + 2, key: fabridTestKey,
+			validatorFails: true},
+		{name: "path validator", flip: validator, key: fabridTestKey, validatorFails: true},
+		{name: "other path key", flip: -1, key: drkey.Key{1}, validatorFails: true},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			pkt := newFabridTestPacket(t, fabridTestKey)
+			if tc.flip >= 0 {
+				pkt.raw[pkt.option+tc.flip] ^= 0x80
+			}
+			conn := &fabridKeyConnector{key: tc.key}
+			conn.paths = buildPaths(t, fabridTestReturnPaths...)
+
+			checks, err := validateFabridPacket(context.Background(), conn, localIA, pkt.raw)
+			if err != nil {
+				t.Fatal(err)
+			}
+			want := []string{
+				"[ OK ] hop 0 (1-ff00:0:110) without FABRID",
+				"[ -- ] hop 1 (1-ff00:0:111) unverifiable",
+				"[ OK ] hop 2 (1-ff00:0:112) without FABRID",
+				"[ OK ] path validator",
+			}
+			if tc.validatorFails {
+				want[3] = "[FAIL] path validator"
+			}
+			if len(checks) != len(want) {
+				t.Fatalf("%d checks, want %d", len(checks), len(want))
+			}
+			for i, c := range checks {
+				if !strings.HasPrefix(c.String(), want[i]) {
+					t.Errorf("check %d is %q, want %q", i, c, want[i])
+				}
+			}
+
+			// Only the path key is requested, the AS keys are derived for
+			// the source host.
+			meta := conn.meta
+			if meta == nil || meta.SrcAS != addr.MustParseIA("1-ff00:0:110") ||
+				meta.SrcHost != "10.0.0.1" || meta.DstAS != localIA ||
+				meta.DstHost == nil || *meta.DstHost != "10.0.0.2" || len(meta.PathASes) != 0 {
+
+				t.Errorf("key request %+v, want only the path key from 10.0.0.1 in "+
+					"1-ff00:0:110 to 10.0.0.2", meta)
+			}
+		})
+	}
+}
+
+func TestValidateFabridPacketUnknownPath(t *testing.T) {
+	conn := &fabridKeyConnector{key: fabridTestKey}
+	conn.paths = buildPaths(t, fabridTestReturnPaths[1])
+	_, err := validateFabridPacket(context.Background(), conn, addr.MustParseIA("1-ff00:0:112"),
+		newFabridTestPacket(t, fabridTestKey).raw)
+	if err == nil {
+		t.Error("packet over an unknown path validated")
+	}
+}
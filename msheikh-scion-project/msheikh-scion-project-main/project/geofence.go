@@ -0,0 +1,351 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+
+	"github.com/scionproto/scion/pkg/log"
+	"github.com/scionproto/scion/pkg/private/serrors"
+	"github.com/scionproto/scion/pkg/snet"
+	"gopkg.in/yaml.v3"
+)
+
+// Geo-fencing
+//
+// The geofence keeps traffic within named regions, bounding boxes or polygons
+// of WGS 84 coordinates. Every interface on a path must lie within one of the
+// allowed regions according to PathMetadata.Geo, and the notes the ASes
+// attach to the path are matched as an additional criterion. The geofence file
+// is YAML or JSON:
+//
+//	regions:
+//	  - name: CH
+//	    box: {min_lat: 45.8, max_lat: 47.9, min_lon: 5.9, max_lon: 10.5}
+//	  - name: Benelux
+//	    polygon: [[49.4, 2.5], [51.5, 2.5], [53.6, 7.2], [49.4, 6.4]]
+//	allow: [CH, Benelux]   # default: all regions
+//	notes:
+//	  require: ["(?i)green"]   # every pattern matches some note
+//	  deny: ["(?i)transit"]    # no pattern matches any note
+//	incomplete: reject        # or allow
+//
+// Interfaces without coordinates make a path incomplete. Incomplete paths are
+// rejected, unless incomplete is "allow", which only checks the interfaces
+// with coordinates.
+
+// geoBox is a bounding box in degrees.
+type geoBox struct {
+	MinLat float64 `yaml:"min_lat"`
+	MaxLat float64 `yaml:"max_lat"`
+	MinLon float64 `yaml:"min_lon"`
+	MaxLon float64 `yaml:"max_lon"`
+}
+
+// geoRegion is a named area, either a box or a polygon of [lat, lon]
+// vertices.
+type geoRegion struct {
+	Name    string       `yaml:"name"`
+	Box     *geoBox      `yaml:"box"`
+	Polygon [][2]float64 `yaml:"polygon"`
+}
+
+// contains reports whether the coordinates lie within the region. Points on
+// the border of a polygon may count as inside or outside.
+func (r *geoRegion) contains(lat, lon float64) bool {
+	if r.Box != nil {
+		return lat >= r.Box.MinLat && lat <= r.Box.MaxLat &&
+			lon >= r.Box.MinLon && lon <= r.Box.MaxLon
+	}
+	// Ray casting with the longitude as x and the latitude as y.
+	inside := false
+	for i, j := 0, len(r.Polygon)-1; i < len(r.Polygon); j, i = i, i+1 {
+		yi, xi := r.Polygon[i][0], r.Polygon[i][1]
+		yj, xj := r.Polygon[j][0], r.Polygon[j][1]
+		if (yi > lat) != (yj > lat) && lon < (xj-xi)*(lat-yi)/(yj-yi)+xi {
+			inside = !inside
+		}
+	}
+	return inside
+}
+
+func validCoordinates(lat, lon float64) bool {
+	return lat >= -90 && lat <= 90 && lon >= -180 && lon <= 180
+}
+
+// geofence is a parsed and validated geofence file.
+type geofence struct {
+	Regions []geoRegion `yaml:"regions"`
+	Allow   []string    `yaml:"allow"`
+	Notes   struct {
+		Require []string `yaml:"require"`
+		Deny    []string `yaml:"deny"`
+	} `yaml:"notes"`
+	Incomplete string `yaml:"incomplete"`
+
+	allowed      map[string]bool
+	requireNotes []*regexp.Regexp
+	denyNotes    []*regexp.Regexp
+}
+
+// loadGeofence reads and validates a geofence file.
+func loadGeofence(file string) (*geofence, error) {
+	raw, err := os.ReadFile(file)
+	if err != nil {
+		return nil, serrors.WrapStr("reading geofence", err, "file", file)
+	}
+	g := &geofence{}
+	dec := yaml.NewDecoder(bytes.NewReader(raw))
+	dec.KnownFields(true)
+	if err := dec.Decode(g); err != nil {
+		return nil, serrors.WrapStr("parsing geofence", err, "file", file)
+	}
+	if err := g.validate(); err != nil {
+		return nil, serrors.WrapStr("invalid geofence", err, "file", file)
+	}
+	return g, nil
+}
+
+func (g *geofence) validate() error {
+	if len(g.Regions) == 0 {
+		return serrors.New("no regions")
+	}
+	names := make(map[string]bool, len(g.Regions))
+	for _, r := range g.Regions {
+		switch {
+		case r.Name == "":
+			return serrors.New("region without a name")
+		case names[r.Name]:
+			return serrors.New("duplicate region", "region", r.Name)
+		case (r.Box == nil) == (len(r.Polygon) == 0):
+			return serrors.New("a region is either a box or a polygon", "region", r.Name)
+		case r.Box != nil && (r.Box.MinLat > r.Box.MaxLat || r.Box.MinLon > r.Box.MaxLon ||
+			!validCoordinates(r.Box.MinLat, r.Box.MinLon) ||
+			!validCoordinates(r.Box.MaxLat, r.Box.MaxLon)):
+			return serrors.New("invalid box", "region", r.Name)
+		case r.Box == nil && len(r.Polygon) < 3:
+			return serrors.New("a polygon needs at least 3 vertices", "region", r.Name)
+		}
+		for _, v := range r.Polygon {
+			if !validCoordinates(v[0], v[1]) {
+				return serrors.New("invalid polygon vertex", "region", r.Name,
+					"lat", v[0], "lon", v[1])
+			}
+		}
+		names[r.Name] = true
+	}
+
+	g.allowed = make(map[string]bool)
+	for _, name := range g.Allow {
+		if !names[name] {
+			return serrors.New("allowed region is not defined", "region", name)
+		}
+		g.allowed[name] = true
+	}
+	if len(g.Allow) == 0 {
+		g.allowed = names
+	}
+
+	for _, list := range []struct {
+		patterns []string
+		compiled *[]*regexp.Regexp
+	}{
+		{g.Notes.Require, &g.requireNotes},
+		{g.Notes.Deny, &g.denyNotes},
+	} {
+		for _, pattern := range list.patterns {
+			re, err := regexp.Compile(pattern)
+			if err != nil {
+				return serrors.WrapStr("invalid notes pattern", err, "pattern", pattern)
+			}
+			*list.compiled = append(*list.compiled, re)
+		}
+	}
+
+	switch g.Incomplete {
+	case "":
+		g.Incomplete = "reject"
+	case "reject", "allow":
+	default:
+		return serrors.New("incomplete must be reject or allow", "incomplete", g.Incomplete)
+	}
+	return nil
+}
+
+// region returns the name of the first region that contains the
+// coordinates, an empty string if there is none. It names a location in the
+// report, whether the location is allowed is up to inAllowedRegion.
+func (g *geofence) region(lat, lon float64) string {
+	if g == nil {
+		return ""
+	}
+	for i := range g.Regions {
+		if g.Regions[i].contains(lat, lon) {
+			return g.Regions[i].Name
+		}
+	}
+	return ""
+}
+
+// inAllowedRegion reports whether any allowed region contains the
+// coordinates. Regions may overlap, so a point in a region that is not
+// allowed may still lie in one that is.
+func (g *geofence) inAllowedRegion(lat, lon float64) bool {
+	for i := range g.Regions {
+		if g.allowed[g.Regions[i].Name] && g.Regions[i].contains(lat, lon) {
+			return true
+		}
+	}
+	return false
+}
+
+// violation returns why the path leaves the geofence, an empty string if it
+// stays within.
+func (g *geofence) violation(p snet.Path) string {
+	metadata := p.Metadata()
+	if metadata == nil {
+		return "no metadata"
+	}
+	for i, intf := range metadata.Interfaces {
+		geo, ok := interfaceGeo(metadata, i)
+		if !ok {
+			if g.Incomplete == "reject" {
+				return fmt.Sprintf("no coordinates for %s#%d", intf.IA, intf.ID)
+			}
+			continue
+		}
+		lat, lon := float64(geo.Latitude), float64(geo.Longitude)
+		if !g.inAllowedRegion(lat, lon) {
+			name := g.region(lat, lon)
+			if name == "" {
+				name = "no region"
+			}
+			return fmt.Sprintf("%s#%d at %.4f,%.4f is in %s", intf.IA, intf.ID, lat, lon, name)
+		}
+	}
+	for _, re := range g.requireNotes {
+		if !matchesAny(re, metadata.Notes) {
+			return fmt.Sprintf("no note matches %q", re)
+		}
+	}
+	for _, re := range g.denyNotes {
+		if matchesAny(re, metadata.Notes) {
+			return fmt.Sprintf("a note matches %q", re)
+		}
+	}
+	return ""
+}
+
+func matchesAny(re *regexp.Regexp, notes []string) bool {
+	for _, note := range notes {
+		if re.MatchString(note) {
+			return true
+		}
+	}
+	return false
+}
+
+// interfaceGeo returns the coordinates of interface i of the path. Zero
+// coordinates are announcements without coordinates, possibly with a civic
+// address.
+func interfaceGeo(metadata *snet.PathMetadata, i int) (snet.GeoCoordinates, bool) {
+	if i >= len(metadata.Geo) {
+		return snet.GeoCoordinates{}, false
+	}
+	geo := metadata.Geo[i]
+	return geo, geo.Latitude != 0 || geo.Longitude != 0
+}
+
+// filter removes the paths that leave the geofence.
+func (g *geofence) filter(ctx context.Context, query pathQueryKey,
+	paths []snet.Path) []snet.Path {
+
+	if g == nil {
+		return paths
+	}
+	logger := log.FromCtx(ctx)
+	allowed := make([]snet.Path, 0, len(paths))
+	for _, p := range paths {
+		if reason := g.violation(p); reason != "" {
+			logger.Debug("Path outside the geofence", pathFields(p, "reason", reason)...)
+			continue
+		}
+		allowed = append(allowed, p)
+	}
+	if len(allowed) < len(paths) {
+		logger.Info("Geofence removed paths", "query", query, "paths", len(paths),
+			"allowed", len(allowed))
+	}
+	return allowed
+}
+
+// hopRegions returns, for every hop as returned by fabridHopInterfaces, the
+// regions its interfaces lie in, e.g. "CH" or "CH/DE" for an AS whose
+// interfaces are in two regions. Interfaces outside all regions are named
+// after the last part of their civic address, usually the country, or
+// "unknown".
+func (g *geofence) hopRegions(metadata *snet.PathMetadata) []string {
+	interfaces := metadata.Interfaces
+	name := func(i int) string {
+		geo, ok := interfaceGeo(metadata, i)
+		if ok {
+			if region := g.region(float64(geo.Latitude), float64(geo.Longitude)); region != "" {
+				return region
+			}
+		}
+		if geo.Address != "" {
+			parts := strings.Split(geo.Address, ",")
+			return strings.TrimSpace(parts[len(parts)-1])
+		}
+		return "unknown"
+	}
+
+	var regions []string
+	for i := 0; i < len(interfaces); i++ {
+		region := name(i)
+		// A transit AS has an ingress and an egress interface.
+		if i > 0 && i < len(interfaces)-1 && interfaces[i].IA == interfaces[i+1].IA {
+			if other := name(i + 1); other != region {
+				region += "/" + other
+			}
+			i++
+		}
+		regions = append(regions, region)
+	}
+	return regions
+}
+
+// geofenceFlag is the value of the --geofence flag. The file is validated
+// while the flags are parsed.
+type geofenceFlag struct {
+	file  string
+	fence *geofence
+}
+
+func (f *geofenceFlag) String() string {
+	if f == nil {
+		return ""
+	}
+	return f.file
+}
+
+func (f *geofenceFlag) Set(file string) error {
+	fence, err := loadGeofence(file)
+	if err != nil {
+		return err
+	}
+	f.file, f.fence = file, fence
+	return nil
+}
+
+// The geofence every path query is filtered with.
+var pathGeofence geofenceFlag
+
+func init() {
+	flag.Var(&pathGeofence, "geofence",
+		"Geofence file (YAML or JSON) with the regions every path must stay within")
+}
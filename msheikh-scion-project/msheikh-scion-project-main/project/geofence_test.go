@@ -0,0 +1,206 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/scionproto/scion/pkg/snet"
+)
+
+// testGeofence loads a geofence from its YAML definition.
+func testGeofence(t *testing.T, def string) *geofence {
+	t.Helper()
+	file := filepath.Join(t.TempDir(), "geofence.yaml")
+	if err := os.WriteFile(file, []byte(def), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	g, err := loadGeofence(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return g
+}
+
+// geoPath returns a path 1-ff00:0:110 > 1-ff00:0:111 > 1-ff00:0:112 whose
+// four interfaces are at the given coordinates.
+func geoPath(t *testing.T, geo ...snet.GeoCoordinates) snet.Path {
+	t.Helper()
+	f := fixturePath{Interfaces: []string{"1-ff00:0:110#1", "1-ff00:0:111#2", "1-ff00:0:111#3",
+		"1-ff00:0:112#4"}}
+	p, err := f.build()
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.(*testPath).meta.Geo = geo
+	return p
+}
+
+var (
+	zurich    = snet.GeoCoordinates{Latitude: 47.37, Longitude: 8.54}
+	geneva    = snet.GeoCoordinates{Latitude: 46.20, Longitude: 6.14}
+	amsterdam = snet.GeoCoordinates{Latitude: 52.37, Longitude: 4.90}
+	berlin    = snet.GeoCoordinates{Latitude: 52.52, Longitude: 13.40}
+	newYork   = snet.GeoCoordinates{Latitude: 40.71, Longitude: -74.01}
+)
+
+func TestGeoRegionContains(t *testing.T) {
+	g := testGeofence(t, `
+regions:
+  - name: CH
+    box: {min_lat: 45.8, max_lat: 47.9, min_lon: 5.9, max_lon: 10.5}
+  # A concave L shape: the square 0..10 without its upper right quarter.
+  - name: L
+    polygon: [[0, 0], [10, 0], [10, 5], [5, 5], [5, 10], [0, 10]]
+`)
+	tests := []struct {
+		region   int
+		lat, lon float64
+		want     bool
+	}{
+		{0, 47.37, 8.54, true},
+		{0, 45.8, 5.9, true}, // corner
+		{0, 47.95, 8.54, false},
+		{0, 47.37, 10.6, false},
+		{1, 2, 2, true},
+		{1, 8, 2, true},
+		{1, 2, 8, true},
+		{1, 8, 8, false}, // the missing quarter
+		{1, -1, 2, false},
+		{1, 2, 11, false},
+	}
+	for _, tc := range tests {
+		r := &g.Regions[tc.region]
+		if got := r.contains(tc.lat, tc.lon); got != tc.want {
+			t.Errorf("%s contains %g,%g = %t, want %t", r.Name, tc.lat, tc.lon, got, tc.want)
+		}
+	}
+}
+
+func TestGeofenceViolation(t *testing.T) {
+	const regions = `
+regions:
+  - name: CH
+    box: {min_lat: 45.8, max_lat: 47.9, min_lon: 5.9, max_lon: 10.5}
+  - name: Europe
+    box: {min_lat: 35, max_lat: 71, min_lon: -10, max_lon: 40}
+  - name: Benelux
+    polygon: [[49.4, 2.5], [51.5, 2.5], [53.6, 7.2], [49.4, 6.4]]
+`
+	tests := []struct {
+		name  string
+		fence string
+		path  []snet.GeoCoordinates
+		// violation is a substring of the expected violation, empty if the
+		// path stays within the fence.
+		violation string
+	}{
+		{
+			name:  "within one region",
+			fence: regions + "allow: [CH]\n",
+			path:  []snet.GeoCoordinates{zurich, zurich, geneva, geneva},
+		},
+		{
+			name:      "leaves the region",
+			fence:     regions + "allow: [CH]\n",
+			path:      []snet.GeoCoordinates{zurich, zurich, berlin, berlin},
+			violation: "1-ff00:0:111#3 at 52.5200,13.4000 is in Europe",
+		},
+		{
+			// Zurich is in CH, which comes first, and in the allowed Europe.
+			name:  "overlapping regions",
+			fence: regions + "allow: [Europe]\n",
+			path:  []snet.GeoCoordinates{zurich, zurich, berlin, amsterdam},
+		},
+		{
+			name:  "polygon",
+			fence: regions + "allow: [CH, Benelux]\n",
+			path:  []snet.GeoCoordinates{zurich, zurich, amsterdam, amsterdam},
+		},
+		{
+			name:      "outside all regions",
+			fence:     regions,
+			path:      []snet.GeoCoordinates{zurich, zurich, newYork, newYork},
+			violation: "is in no region",
+		},
+		{
+			name:      "incomplete rejected",
+			fence:     regions + "incomplete: reject\n",
+			path:      []snet.GeoCoordinates{zurich, {}, geneva, geneva},
+			violation: "no coordinates for 1-ff00:0:111#2",
+		},
+		{
+			name:      "missing entries rejected",
+			fence:     regions,
+			path:      []snet.GeoCoordinates{zurich, zurich},
+			violation: "no coordinates for 1-ff00:0:111#3",
+		},
+		{
+			name:  "incomplete allowed",
+			fence: regions + "incomplete: allow\n",
+			path:  []snet.GeoCoordinates{zurich, {Address: "Bern, Switzerland"}, geneva},
+		},
+		{
+			// Known coordinates are checked even if incomplete paths are allowed.
+			name:      "incomplete allowed outside",
+			fence:     regions + "incomplete: allow\n",
+			path:      []snet.GeoCoordinates{zurich, {}, newYork},
+			violation: "1-ff00:0:111#3 at 40.7100,-74.0100 is in no region",
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			g := testGeofence(t, tc.fence)
+			got := g.violation(geoPath(t, tc.path...))
+			switch {
+			case tc.violation == "" && got != "":
+				t.Errorf("unexpected violation %q", got)
+			case tc.violation != "" && !strings.Contains(got, tc.violation):
+				t.Errorf("violation %q, want %q", got, tc.violation)
+			}
+		})
+	}
+}
+
+func TestGeofenceNotes(t *testing.T) {
+	g := testGeofence(t, `
+regions:
+  - name: World
+    box: {min_lat: -90, max_lat: 90, min_lon: -180, max_lon: 180}
+notes:
+  require: ["(?i)green"]
+  deny: ["(?i)transit"]
+`)
+	tests := []struct {
+		notes []string
+		ok    bool
+	}{
+		{[]string{"Green power", "peering"}, true},
+		{[]string{"peering"}, false},
+		{[]string{"green", "paid transit"}, false},
+		{nil, false},
+	}
+	for _, tc := range tests {
+		p := geoPath(t, zurich, zurich, berlin, berlin)
+		p.(*testPath).meta.Notes = tc.notes
+		if got := g.violation(p); (got == "") != tc.ok {
+			t.Errorf("notes %q: violation %q", tc.notes, got)
+		}
+	}
+}
+
+func TestGeofenceHopRegions(t *testing.T) {
+	g := testGeofence(t, `
+regions:
+  - name: CH
+    box: {min_lat: 45.8, max_lat: 47.9, min_lon: 5.9, max_lon: 10.5}
+  - name: Europe
+    box: {min_lat: 35, max_lat: 71, min_lon: -10, max_lon: 40}
+`)
+	p := geoPath(t, zurich, snet.GeoCoordinates{Address: "Somewhere, Austria"}, berlin, newYork)
+	got := strings.Join(g.hopRegions(p.Metadata()), " ")
+	if want := "CH Austria/Europe unknown"; got != want {
+		t.Errorf("hop regions %q, want %q", got, want)
+	}
+}
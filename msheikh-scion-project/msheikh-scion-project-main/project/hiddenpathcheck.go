@@ -0,0 +1,266 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/scionproto/scion/pkg/addr"
+	"github.com/scionproto/scion/pkg/private/serrors"
+	"gopkg.in/yaml.v3"
+)
+
+// hiddenPathChecker cross-checks the hidden path configuration of a topology
+// against its .topo file.
+type hiddenPathChecker struct {
+	config *hiddenPathConfig
+	issues []configIssue
+	// nodes holds the parsed document of every file, for line numbers.
+	nodes map[addr.IA]*yaml.Node
+	known map[addr.IA]bool
+}
+
+func (c *hiddenPathChecker) report(file string, line int, warning bool, format string,
+	args ...interface{}) {
+
+	c.issues = append(c.issues, configIssue{
+		file:    file,
+		line:    line,
+		warning: warning,
+		msg:     fmt.Sprintf(format, args...),
+	})
+}
+
+// checkHiddenPathConfig validates the <AS>_hidden_paths.yaml files of the
+// topology in dir.
+func checkHiddenPathConfig(dir string) ([]configIssue, error) {
+	config, err := loadHiddenPathConfig(dir)
+	if err != nil {
+		return nil, err
+	}
+	ias, err := config.topo.ias()
+	if err != nil {
+		return nil, err
+	}
+	c := &hiddenPathChecker{
+		config: config,
+		nodes:  make(map[addr.IA]*yaml.Node),
+		known:  make(map[addr.IA]bool, len(ias)),
+	}
+	for _, ia := range ias {
+		c.known[ia] = true
+	}
+
+	files := make([]addr.IA, 0, len(config.files))
+	for ia := range config.files {
+		files = append(files, ia)
+	}
+	sort.Slice(files, func(i, j int) bool { return files[i] < files[j] })
+	for _, ia := range files {
+		node, err := loadYAMLNode(config.names[ia])
+		if err != nil {
+			return nil, err
+		}
+		c.nodes[ia] = node
+	}
+
+	for _, ia := range files {
+		c.checkGroups(ia)
+		c.checkPolicies(ia)
+	}
+	sortConfigIssues(c.issues)
+	return c.issues, nil
+}
+
+// checkASList reports the entries of an AS list that are not ASes of the
+// topology.
+func (c *hiddenPathChecker) checkASList(file string, field string, node *yaml.Node) {
+	if node == nil {
+		return
+	}
+	entries := []*yaml.Node{node}
+	if node.Kind == yaml.SequenceNode {
+		entries = node.Content
+	}
+	for _, entry := range entries {
+		ia, err := addr.ParseIA(entry.Value)
+		switch {
+		case err != nil:
+			c.report(file, entry.Line, false, "%s: invalid ISD-AS %q", field, entry.Value)
+		case !c.known[ia]:
+			c.report(file, entry.Line, false, "%s: unknown AS %s", field, ia)
+		}
+	}
+}
+
+// checkGroups checks the group definitions of the file of ia.
+func (c *hiddenPathChecker) checkGroups(ia addr.IA) {
+	file := c.config.names[ia]
+	_, groupsNode := yamlLookup(c.nodes[ia], "groups")
+
+	ids := make([]string, 0, len(c.config.files[ia].Groups))
+	for id := range c.config.files[ia].Groups {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	for _, id := range ids {
+		g := c.config.files[ia].Groups[id]
+		keyNode, groupNode := yamlLookup(groupsNode, id)
+		line := 1
+		if keyNode != nil {
+			line = keyNode.Line
+		}
+
+		for _, field := range []string{"owner", "writers", "readers", "registries"} {
+			_, node := yamlLookup(groupNode, field)
+			c.checkASList(file, field, node)
+		}
+
+		// A group ID is the AS of its owner followed by a group number.
+		owner, err := addr.ParseIA(g.Owner)
+		if prefix, _, ok := strings.Cut(id, "-"); err == nil && ok &&
+			prefix != owner.AS().String() {
+			c.report(file, line, false, "group %s is not named after its owner %s", id, owner)
+		}
+
+		if len(g.Registries) == 0 {
+			c.report(file, line, false, "group %s has no registries, its segments are "+
+				"neither stored nor found", id)
+		}
+		for _, reg := range g.Registries {
+			regIA, err := addr.ParseIA(reg)
+			if err != nil || !c.known[regIA] {
+				continue
+			}
+			f, ok := c.config.files[regIA]
+			if ok {
+				_, ok = f.Groups[id]
+			}
+			if !ok {
+				c.report(file, line, false, "registry %s of group %s does not configure the group",
+					regIA, id)
+			}
+		}
+
+		if !c.readable(id, g) {
+			c.report(file, line, false, "nobody can read group %s: no reader is an AS of the "+
+				"topology that configures the group", id)
+		}
+
+		for other, f := range c.config.files {
+			og, ok := f.Groups[id]
+			if ok && other < ia && !reflect.DeepEqual(og, g) {
+				c.report(file, line, true, "group %s differs from its definition in %s", id,
+					filepath.Base(c.config.names[other]))
+			}
+		}
+	}
+}
+
+// readable reports whether any reader of the group is an AS of the topology
+// and configures the group, which it needs to look the segments up.
+func (c *hiddenPathChecker) readable(id string, g hiddenPathGroup) bool {
+	for _, reader := range g.Readers {
+		ia, err := addr.ParseIA(reader)
+		if err != nil || !c.known[ia] {
+			continue
+		}
+		if f, ok := c.config.files[ia]; ok {
+			if _, ok := f.Groups[id]; ok {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// checkPolicies checks the per-interface registration policies of ia.
+func (c *hiddenPathChecker) checkPolicies(ia addr.IA) {
+	file := c.config.names[ia]
+	f := c.config.files[ia]
+	_, policiesNode := yamlLookup(c.nodes[ia], "registration_policy_per_interface")
+
+	ifids := make([]int, 0, len(f.RegistrationPolicy))
+	for ifid := range f.RegistrationPolicy {
+		ifids = append(ifids, int(ifid))
+	}
+	sort.Ints(ifids)
+	for _, i := range ifids {
+		ifid := uint16(i)
+		keyNode, listNode := yamlLookup(policiesNode, strconv.Itoa(i))
+		line := 1
+		if keyNode != nil {
+			line = keyNode.Line
+		}
+
+		link, peer, isA, ok := c.config.topo.linkAt(ia, ifid)
+		switch {
+		case !ok:
+			c.report(file, line, false, "interface %d of %s has no matching link", ifid, ia)
+		case link.LinkAtoB == "CHILD" && isA:
+			// Beacons only arrive from parents, so no segment is ever
+			// registered for a child interface.
+			c.report(file, line, true, "interface %d of %s leads to its child %s, no segments "+
+				"are registered for it and the policy never takes effect", ifid, ia, peer)
+		}
+
+		for j, id := range f.RegistrationPolicy[ifid] {
+			entryLine := line
+			if listNode != nil && j < len(listNode.Content) {
+				entryLine = listNode.Content[j].Line
+			}
+			if id == hiddenPathPublic {
+				continue
+			}
+			g, ok := f.Groups[id]
+			if !ok {
+				c.report(file, entryLine, false, "interface %d registers with group %s, which "+
+					"is not defined in this file", ifid, id)
+				continue
+			}
+			if !containsIA(g.Writers, ia) {
+				c.report(file, entryLine, false, "%s is not a writer of group %s, the "+
+					"registration never takes effect", ia, id)
+			}
+			if !c.readable(id, g) {
+				c.report(file, entryLine, true, "interface %d registers with group %s, which "+
+					"nobody can read", ifid, id)
+			}
+		}
+	}
+}
+
+// runHiddenPathsCheck implements the hidden-paths-check subcommand. It prints
+// every problem found in the hidden path configuration and fails if any of
+// them is an error.
+func runHiddenPathsCheck(args []string) error {
+	fs := flag.NewFlagSet("hidden-paths-check", flag.ContinueOnError)
+	dir := fs.String("dir", "", "The topology directory (default: the directory of -topology)")
+	if err := fs.Parse(args); err != nil {
+		return serrors.WrapStr("parsing hidden-paths-check arguments", err)
+	}
+	if *dir == "" {
+		*dir = topologyDir()
+	}
+
+	issues, err := checkHiddenPathConfig(*dir)
+	if err != nil {
+		return err
+	}
+	failed := 0
+	for _, issue := range issues {
+		fmt.Println(issue)
+		if !issue.warning {
+			failed++
+		}
+	}
+	fmt.Printf("%d errors, %d warnings\n", failed, len(issues)-failed)
+	if failed > 0 {
+		return serrors.New("invalid hidden path configuration", "errors", failed)
+	}
+	return nil
+}
@@ -0,0 +1,311 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/scionproto/scion/pkg/addr"
+	"github.com/scionproto/scion/pkg/daemon"
+	"github.com/scionproto/scion/pkg/log"
+	"github.com/scionproto/scion/pkg/private/serrors"
+	"github.com/scionproto/scion/pkg/snet"
+	"gopkg.in/yaml.v3"
+)
+
+// hiddenPathPublic is the registration policy entry for public segments.
+const hiddenPathPublic = "public"
+
+// hiddenPathGroup is the definition of a hidden path group.
+type hiddenPathGroup struct {
+	Owner      string   `yaml:"owner"`
+	Writers    []string `yaml:"writers"`
+	Readers    []string `yaml:"readers"`
+	Registries []string `yaml:"registries"`
+}
+
+// hiddenPathsFile is the hidden path configuration of one AS: the groups it
+// knows and, for a writer, the groups it registers the segments of each
+// interface with.
+type hiddenPathsFile struct {
+	Groups             map[string]hiddenPathGroup `yaml:"groups"`
+	RegistrationPolicy map[uint16][]string        `yaml:"registration_policy_per_interface,omitempty"`
+}
+
+// hiddenPathConfig is the hidden path configuration of every AS of a
+// topology.
+type hiddenPathConfig struct {
+	topo  *topoFile
+	files map[addr.IA]*hiddenPathsFile
+	names map[addr.IA]string
+}
+
+// loadHiddenPathConfig reads the <AS>_hidden_paths.yaml files of the topology
+// in dir.
+func loadHiddenPathConfig(dir string) (*hiddenPathConfig, error) {
+	topo, err := loadTopoFile(dir)
+	if err != nil {
+		return nil, err
+	}
+	names, err := filepath.Glob(filepath.Join(dir, "*_hidden_paths.yaml"))
+	if err != nil {
+		return nil, err
+	}
+
+	c := &hiddenPathConfig{
+		topo:  topo,
+		files: make(map[addr.IA]*hiddenPathsFile),
+		names: make(map[addr.IA]string),
+	}
+	for _, name := range names {
+		asName := strings.TrimSuffix(filepath.Base(name), "_hidden_paths.yaml")
+		ia, ok := topo.iaForFileName(asName)
+		if !ok {
+			return nil, serrors.New("hidden path configuration of an AS missing from the topology",
+				"file", name)
+		}
+		raw, err := os.ReadFile(name)
+		if err != nil {
+			return nil, serrors.WrapStr("reading hidden path configuration", err, "file", name)
+		}
+		var f hiddenPathsFile
+		if err := yaml.Unmarshal(raw, &f); err != nil {
+			return nil, serrors.WrapStr("parsing hidden path configuration", err, "file", name)
+		}
+		c.files[ia] = &f
+		c.names[ia] = name
+	}
+	return c, nil
+}
+
+// group returns the definition of a group, preferring the one of the owner.
+func (c *hiddenPathConfig) group(id string) (hiddenPathGroup, bool) {
+	var found *hiddenPathGroup
+	for ia, f := range c.files {
+		g, ok := f.Groups[id]
+		if !ok {
+			continue
+		}
+		if g.Owner == ia.String() {
+			return g, true
+		}
+		found = &g
+	}
+	if found == nil {
+		return hiddenPathGroup{}, false
+	}
+	return *found, true
+}
+
+// readableGroups returns the groups ia is a reader of and has configured, so
+// that it looks up their segments.
+func (c *hiddenPathConfig) readableGroups(ia addr.IA) []string {
+	f, ok := c.files[ia]
+	if !ok {
+		return nil
+	}
+	var groups []string
+	for id, g := range f.Groups {
+		if containsIA(g.Readers, ia) {
+			groups = append(groups, id)
+		}
+	}
+	sort.Strings(groups)
+	return groups
+}
+
+// containsIA reports whether the list of ISD-AS strings contains ia.
+func containsIA(list []string, ia addr.IA) bool {
+	for _, s := range list {
+		if other, err := addr.ParseIA(s); err == nil && other == ia {
+			return true
+		}
+	}
+	return false
+}
+
+// hiddenPathReport explains whether the local AS can use a hidden path to a
+// destination.
+type hiddenPathReport struct {
+	local, dst addr.IA
+	available  bool
+	// readable are the groups the local AS reads.
+	readable []string
+	// lines explain every hidden registration of the destination.
+	lines []string
+}
+
+func (r hiddenPathReport) String() string {
+	status := "not available"
+	if r.available {
+		status = "available"
+	}
+	readable := strings.Join(r.readable, ", ")
+	if readable == "" {
+		readable = "none"
+	}
+	var b strings.Builder
+	fmt.Fprintf(&b, "hidden path %s -> %s: %s\n", r.local, r.dst, status)
+	fmt.Fprintf(&b, "  groups readable by %s: %s\n", r.local, readable)
+	for _, line := range r.lines {
+		fmt.Fprintf(&b, "  %s\n", line)
+	}
+	return strings.TrimSuffix(b.String(), "\n")
+}
+
+// explain checks the hidden segments the destination registers against the
+// groups the local AS can read. A hidden path is available through a group if
+// the destination registers an interface with it as a writer, the local AS is
+// a reader and has the group configured, and the group has registries.
+func (c *hiddenPathConfig) explain(local, dst addr.IA) hiddenPathReport {
+	r := hiddenPathReport{local: local, dst: dst, readable: c.readableGroups(local)}
+
+	f, ok := c.files[dst]
+	if !ok {
+		r.lines = append(r.lines, fmt.Sprintf("destination %s has no hidden path configuration", dst))
+		return r
+	}
+	ifids := make([]int, 0, len(f.RegistrationPolicy))
+	for ifid := range f.RegistrationPolicy {
+		ifids = append(ifids, int(ifid))
+	}
+	sort.Ints(ifids)
+
+	for _, i := range ifids {
+		ifid := uint16(i)
+		where := fmt.Sprintf("interface %d", ifid)
+		if peer, ok := c.topo.neighbor(dst, ifid); ok {
+			where += fmt.Sprintf(" (to %s)", peer)
+		}
+		public := false
+		for _, id := range f.RegistrationPolicy[ifid] {
+			if id == hiddenPathPublic {
+				public = true
+				continue
+			}
+			r.lines = append(r.lines, fmt.Sprintf("%s, group %s: %s", where, id,
+				c.checkGroup(local, dst, id, &r.available)))
+		}
+		if public {
+			r.lines = append(r.lines, fmt.Sprintf("%s: also registered publicly", where))
+		}
+	}
+	if len(r.lines) == 0 {
+		r.lines = append(r.lines, fmt.Sprintf("destination %s registers no hidden segments", dst))
+	}
+	return r
+}
+
+// checkGroup explains whether local can read the segments dst registers with
+// the group, and sets available if it can.
+func (c *hiddenPathConfig) checkGroup(local, dst addr.IA, id string, available *bool) string {
+	g, ok := c.group(id)
+	if !ok {
+		return "group is not defined in any configuration"
+	}
+	var problems []string
+	if !containsIA(g.Writers, dst) {
+		problems = append(problems, fmt.Sprintf("destination not in writers of %s", id))
+	}
+	if !containsIA(g.Readers, local) {
+		problems = append(problems, fmt.Sprintf("local AS not in readers of %s", id))
+	} else if lf := c.files[local]; lf == nil {
+		problems = append(problems, "local AS has no hidden path configuration")
+	} else if _, ok := lf.Groups[id]; !ok {
+		problems = append(problems, fmt.Sprintf("%s not configured in the local AS", id))
+	}
+	if len(g.Registries) == 0 {
+		problems = append(problems, fmt.Sprintf("%s has no registries", id))
+	}
+	if len(problems) > 0 {
+		return strings.Join(problems, "; ")
+	}
+	*available = true
+	return fmt.Sprintf("readable, registries %s", strings.Join(g.Registries, ", "))
+}
+
+// logHiddenPathDiagnostics logs why a hidden path from the local AS to dst is
+// or is not available according to the selected topology.
+func logHiddenPathDiagnostics(ctx context.Context, localIA, dst addr.IA) {
+	logger := log.FromCtx(ctx)
+
+	config, err := loadHiddenPathConfig(topologyDir())
+	if err != nil {
+		logger.Debug("No hidden path diagnostics", "err", err)
+		return
+	}
+	report := config.explain(localIA, dst)
+	logger.Info("Hidden path diagnostics", "available", report.available,
+		"readable_groups", report.readable, "reasons", report.lines)
+}
+
+// runHiddenPaths implements the hidden-paths subcommand. It explains whether
+// the local AS can use a hidden path to the destination and, if the daemon is
+// used to find the local AS, how many hidden paths the daemon returns.
+func runHiddenPaths(args []string) error {
+	fs := flag.NewFlagSet("hidden-paths", flag.ContinueOnError)
+	dir := fs.String("dir", "", "The topology directory (default: the directory of -topology)")
+	localFlag := fs.String("local-ia", "", "The local ISD-AS (default: asked from the daemon)")
+	dstFlag := fs.String("dst", "", "The destination ISD-AS (default: the ISD-AS of -remote)")
+	if err := fs.Parse(args); err != nil {
+		return serrors.WrapStr("parsing hidden-paths arguments", err)
+	}
+	if *dir == "" {
+		*dir = topologyDir()
+	}
+	dst := remote.IA
+	if *dstFlag != "" {
+		ia, err := addr.ParseIA(*dstFlag)
+		if err != nil {
+			return serrors.WrapStr("parsing destination", err)
+		}
+		dst = ia
+	}
+
+	config, err := loadHiddenPathConfig(*dir)
+	if err != nil {
+		return err
+	}
+
+	if *localFlag != "" {
+		localIA, err := addr.ParseIA(*localFlag)
+		if err != nil {
+			return serrors.WrapStr("parsing local ISD-AS", err)
+		}
+		fmt.Println(config.explain(localIA, dst))
+		return nil
+	}
+
+	ctx := context.Background()
+	daemonConn, localIA, err := connectDaemon(ctx)
+	if err != nil {
+		return err
+	}
+	defer daemonConn.Close()
+	fmt.Println(config.explain(localIA, dst))
+
+	public, err := daemonConn.Paths(ctx, dst, localIA, daemon.PathReqFlags{})
+	if err != nil {
+		return serrors.WrapStr("querying public paths", err)
+	}
+	withHidden, err := daemonConn.Paths(ctx, dst, localIA, daemon.PathReqFlags{Hidden: true})
+	if err != nil {
+		return serrors.WrapStr("querying hidden paths", err)
+	}
+	known := make(map[snet.PathFingerprint]bool, len(public))
+	for _, p := range public {
+		known[snet.Fingerprint(p)] = true
+	}
+	hidden := 0
+	for _, p := range withHidden {
+		if !known[snet.Fingerprint(p)] {
+			hidden++
+		}
+	}
+	fmt.Printf("daemon: %d public paths, %d hidden paths\n", len(public), hidden)
+	return nil
+}
@@ -0,0 +1,455 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/scionproto/scion/pkg/addr"
+	"github.com/scionproto/scion/pkg/log"
+	"github.com/scionproto/scion/pkg/private/serrors"
+	"github.com/scionproto/scion/pkg/snet"
+
+	_ "modernc.org/sqlite"
+)
+
+// The SQLite file the results of every run are appended to. An empty value
+// disables the run history.
+var historyDB = flag.String("history-db", "history.db",
+	"The SQLite database storing the results of every run (empty disables the history)")
+
+// A free-form identifier of the topology the run was executed against.
+var topologyID = flag.String("topology", "small_topology_1",
+	"The identifier of the topology the client runs against, stored with the run history")
+
+// currentRun collects the outcome of the tests executed by this invocation.
+var currentRun = newTestRun()
+
+const historySchema = `
+CREATE TABLE IF NOT EXISTS runs (
+	id         INTEGER PRIMARY KEY AUTOINCREMENT,
+	started_at INTEGER NOT NULL,
+	local_ia   TEXT NOT NULL,
+	remote_ia  TEXT NOT NULL,
+	topology   TEXT NOT NULL,
+	path_set   TEXT NOT NULL
+);
+CREATE TABLE IF NOT EXISTS results (
+	run_id  INTEGER NOT NULL REFERENCES runs(id),
+	test_id INTEGER NOT NULL,
+	state   TEXT NOT NULL,
+	error   TEXT NOT NULL,
+	PRIMARY KEY (run_id, test_id)
+);
+CREATE TABLE IF NOT EXISTS paths (
+	run_id      INTEGER NOT NULL REFERENCES runs(id),
+	test_id     INTEGER NOT NULL,
+	seq         INTEGER NOT NULL,
+	fingerprint TEXT NOT NULL,
+	hops        TEXT NOT NULL,
+	PRIMARY KEY (run_id, test_id, seq)
+);
+`
+
+// testRecord holds the outcome of a single test within a run.
+type testRecord struct {
+	State string
+	Err   string
+	Paths []pathRecord
+}
+
+// pathRecord identifies a path that was used by a test.
+type pathRecord struct {
+	Fingerprint string
+	Hops        string
+}
+
+// testRun collects the results of all tests of one client-app invocation.
+type testRun struct {
+	mu       sync.Mutex
+	started  time.Time
+	localIA  addr.IA
+	remoteIA addr.IA
+	pathSet  string
+	tests    map[int]*testRecord
+}
+
+func newTestRun() *testRun {
+	return &testRun{
+		started: time.Now(),
+		tests:   make(map[int]*testRecord),
+	}
+}
+
+// setTopology records the endpoints of the run and a digest over all paths
+// the daemon returned, so that changes of the topology are visible.
+func (r *testRun) setTopology(localIA, remoteIA addr.IA, paths []snet.Path) {
+	fingerprints := make([]string, 0, len(paths))
+	for _, p := range paths {
+		fingerprints = append(fingerprints, snet.Fingerprint(p).String())
+	}
+	sort.Strings(fingerprints)
+	h := sha256.Sum256([]byte(strings.Join(fingerprints, ",")))
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.localIA = localIA
+	r.remoteIA = remoteIA
+	r.pathSet = hex.EncodeToString(h[:8])
+}
+
+func (r *testRun) test(id int) *testRecord {
+	t, ok := r.tests[id]
+	if !ok {
+		t = &testRecord{}
+		r.tests[id] = t
+	}
+	return t
+}
+
+// recordPath appends a path that test id sent a packet on.
+func (r *testRun) recordPath(id int, p snet.Path) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	t := r.test(id)
+	t.Paths = append(t.Paths, pathRecord{
+		Fingerprint: snet.Fingerprint(p).String(),
+		Hops:        pathHopString(p),
+	})
+}
+
+// recordState stores the latest state the verifier reported for test id.
+func (r *testRun) recordState(id int, state string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.test(id).State = state
+}
+
+// recordError stores the error test id failed with. Tests without a verifier
+// state are marked as failed.
+func (r *testRun) recordError(id int, err error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	t := r.test(id)
+	t.Err = err.Error()
+	if t.State == "" || t.State == "TestRunning" {
+		t.State = "TestFailed"
+	}
+}
+
+func openHistory(ctx context.Context, file string) (*sql.DB, error) {
+	db, err := sql.Open("sqlite", file)
+	if err != nil {
+		return nil, serrors.WrapStr("opening history database", err, "file", file)
+	}
+	if _, err := db.ExecContext(ctx, historySchema); err != nil {
+		db.Close()
+		return nil, serrors.WrapStr("creating history schema", err, "file", file)
+	}
+	return db, nil
+}
+
+// store appends the run to the history database.
+func (r *testRun) store(ctx context.Context, file string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	db, err := openHistory(ctx, file)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return serrors.WrapStr("starting history transaction", err)
+	}
+	defer tx.Rollback()
+
+	res, err := tx.ExecContext(ctx,
+		`INSERT INTO runs (started_at, local_ia, remote_ia, topology, path_set) VALUES (?, ?, ?, ?, ?)`,
+		r.started.Unix(), r.localIA.String(), r.remoteIA.String(), *topologyID, r.pathSet)
+	if err != nil {
+		return serrors.WrapStr("inserting run", err)
+	}
+	runID, err := res.LastInsertId()
+	if err != nil {
+		return serrors.WrapStr("retrieving run id", err)
+	}
+
+	for id, t := range r.tests {
+		_, err := tx.ExecContext(ctx,
+			`INSERT INTO results (run_id, test_id, state, error) VALUES (?, ?, ?, ?)`,
+			runID, id, t.State, t.Err)
+		if err != nil {
+			return serrors.WrapStr("inserting result", err, "test_id", id)
+		}
+		for seq, p := range t.Paths {
+			_, err := tx.ExecContext(ctx,
+				`INSERT INTO paths (run_id, test_id, seq, fingerprint, hops) VALUES (?, ?, ?, ?, ?)`,
+				runID, id, seq, p.Fingerprint, p.Hops)
+			if err != nil {
+				return serrors.WrapStr("inserting path", err, "test_id", id)
+			}
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return serrors.WrapStr("committing history", err)
+	}
+	log.Info("Stored run in history", "run_id", runID, "file", file, "tests", len(r.tests))
+	return nil
+}
+
+// storedRun is a run as loaded back from the history database.
+type storedRun struct {
+	ID       int64
+	Started  time.Time
+	LocalIA  string
+	RemoteIA string
+	Topology string
+	PathSet  string
+	Tests    map[int]*testRecord
+}
+
+func (s *storedRun) group() string {
+	return fmt.Sprintf("%s -> %s (%s)", s.LocalIA, s.RemoteIA, s.Topology)
+}
+
+func loadRuns(ctx context.Context, db *sql.DB) ([]*storedRun, error) {
+	rows, err := db.QueryContext(ctx,
+		`SELECT id, started_at, local_ia, remote_ia, topology, path_set FROM runs ORDER BY id`)
+	if err != nil {
+		return nil, serrors.WrapStr("querying runs", err)
+	}
+	defer rows.Close()
+
+	var runs []*storedRun
+	byID := make(map[int64]*storedRun)
+	for rows.Next() {
+		var started int64
+		run := &storedRun{Tests: make(map[int]*testRecord)}
+		err := rows.Scan(&run.ID, &started, &run.LocalIA, &run.RemoteIA, &run.Topology, &run.PathSet)
+		if err != nil {
+			return nil, serrors.WrapStr("scanning run", err)
+		}
+		run.Started = time.Unix(started, 0)
+		runs = append(runs, run)
+		byID[run.ID] = run
+	}
+	if err := rows.Err(); err != nil {
+		return nil, serrors.WrapStr("iterating runs", err)
+	}
+
+	rows, err = db.QueryContext(ctx, `SELECT run_id, test_id, state, error FROM results`)
+	if err != nil {
+		return nil, serrors.WrapStr("querying results", err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var runID int64
+		var testID int
+		t := &testRecord{}
+		if err := rows.Scan(&runID, &testID, &t.State, &t.Err); err != nil {
+			return nil, serrors.WrapStr("scanning result", err)
+		}
+		if run, ok := byID[runID]; ok {
+			run.Tests[testID] = t
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return nil, serrors.WrapStr("iterating results", err)
+	}
+
+	rows, err = db.QueryContext(ctx,
+		`SELECT run_id, test_id, fingerprint, hops FROM paths ORDER BY run_id, test_id, seq`)
+	if err != nil {
+		return nil, serrors.WrapStr("querying paths", err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var runID int64
+		var testID int
+		var p pathRecord
+		if err := rows.Scan(&runID, &testID, &p.Fingerprint, &p.Hops); err != nil {
+			return nil, serrors.WrapStr("scanning path", err)
+		}
+		run, ok := byID[runID]
+		if !ok {
+			continue
+		}
+		t, ok := run.Tests[testID]
+		if !ok {
+			t = &testRecord{}
+			run.Tests[testID] = t
+		}
+		t.Paths = append(t.Paths, p)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, serrors.WrapStr("iterating paths", err)
+	}
+
+	return runs, nil
+}
+
+// findRegressions compares the latest run of a group against the previous
+// runs of the same group and describes every test that changed for the worse
+// and every test that picked a different path.
+func findRegressions(runs []*storedRun) []string {
+	if len(runs) < 2 {
+		return nil
+	}
+	latest := runs[len(runs)-1]
+	previous := runs[len(runs)-2]
+
+	var findings []string
+	if latest.PathSet != previous.PathSet {
+		findings = append(findings, fmt.Sprintf("path set changed: %s -> %s (topology changed?)",
+			previous.PathSet, latest.PathSet))
+	}
+
+	ids := make([]int, 0, len(latest.Tests))
+	for id := range latest.Tests {
+		ids = append(ids, id)
+	}
+	sort.Ints(ids)
+
+	for _, id := range ids {
+		curr := latest.Tests[id]
+
+		// Compare against the most recent earlier run that executed the test.
+		var prev *testRecord
+		var prevRun *storedRun
+		for i := len(runs) - 2; i >= 0; i-- {
+			if t, ok := runs[i].Tests[id]; ok {
+				prev, prevRun = t, runs[i]
+				break
+			}
+		}
+		if prev == nil {
+			continue
+		}
+
+		if prev.State == "TestPassed" && curr.State != "TestPassed" {
+			findings = append(findings, fmt.Sprintf(
+				"test %02d regressed: passed in run %d (%s), now %s: %s",
+				id, prevRun.ID, prevRun.Started.Format(time.RFC3339), curr.State, curr.Err))
+		}
+		if len(prev.Paths) > 0 && len(curr.Paths) > 0 &&
+			prev.Paths[len(prev.Paths)-1].Fingerprint != curr.Paths[len(curr.Paths)-1].Fingerprint {
+
+			findings = append(findings, fmt.Sprintf(
+				"test %02d selected a different path: [%s] -> [%s]",
+				id, prev.Paths[len(prev.Paths)-1].Hops, curr.Paths[len(curr.Paths)-1].Hops))
+		}
+	}
+	return findings
+}
+
+// runHistory implements the history subcommand. It lists the most recent runs
+// per topology and flags regressions of the latest run.
+func runHistory(args []string) error {
+	fs := flag.NewFlagSet("history", flag.ContinueOnError)
+	file := fs.String("db", *historyDB, "The SQLite history database")
+	last := fs.Int("last", 10, "The number of most recent runs to list per topology")
+	if err := fs.Parse(args); err != nil {
+		return serrors.WrapStr("parsing history arguments", err)
+	}
+	if *file == "" {
+		return serrors.New("no history database configured")
+	}
+
+	ctx := context.Background()
+	db, err := openHistory(ctx, *file)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	runs, err := loadRuns(ctx, db)
+	if err != nil {
+		return err
+	}
+	if len(runs) == 0 {
+		fmt.Println("No runs recorded in", *file)
+		return nil
+	}
+
+	var groups []string
+	grouped := make(map[string][]*storedRun)
+	for _, run := range runs {
+		g := run.group()
+		if _, ok := grouped[g]; !ok {
+			groups = append(groups, g)
+		}
+		grouped[g] = append(grouped[g], run)
+	}
+
+	for _, g := range groups {
+		groupRuns := grouped[g]
+
+		testIDs := make(map[int]bool)
+		for _, run := range groupRuns {
+			for id := range run.Tests {
+				testIDs[id] = true
+			}
+		}
+		ids := make([]int, 0, len(testIDs))
+		for id := range testIDs {
+			ids = append(ids, id)
+		}
+		sort.Ints(ids)
+
+		fmt.Printf("== %s: %d runs\n", g, len(groupRuns))
+		fmt.Printf("%-6s %-20s %-16s", "run", "started", "path set")
+		for _, id := range ids {
+			fmt.Printf(" %02d", id)
+		}
+		fmt.Println()
+
+		shown := groupRuns
+		if *last > 0 && len(shown) > *last {
+			shown = shown[len(shown)-*last:]
+		}
+		for _, run := range shown {
+			fmt.Printf("%-6d %-20s %-16s", run.ID, run.Started.Format("2006-01-02 15:04:05"), run.PathSet)
+			for _, id := range ids {
+				fmt.Printf(" %2s", stateSymbol(run.Tests[id]))
+			}
+			fmt.Println()
+		}
+
+		findings := findRegressions(groupRuns)
+		if len(findings) == 0 {
+			fmt.Println("No regressions in the latest run")
+		}
+		for _, finding := range findings {
+			fmt.Println("REGRESSION:", finding)
+		}
+		fmt.Println()
+	}
+	return nil
+}
+
+func stateSymbol(t *testRecord) string {
+	if t == nil {
+		return "-"
+	}
+	switch t.State {
+	case "TestPassed":
+		return "ok"
+	case "TestFailed":
+		return "F"
+	case "":
+		return "?"
+	default:
+		return "~"
+	}
+}
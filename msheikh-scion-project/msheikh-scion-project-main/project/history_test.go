@@ -0,0 +1,141 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestFindRegressions(t *testing.T) {
+	started := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	// run returns a run with the given tests. Every test is given as its
+	// state and the hops of the paths it used, the fingerprint of a path is
+	// its hops.
+	run := func(id int64, pathSet string, tests map[int][]string) *storedRun {
+		r := &storedRun{ID: id, Started: started.Add(time.Duration(id) * time.Hour),
+			PathSet: pathSet, Tests: make(map[int]*testRecord)}
+		for testID, t := range tests {
+			rec := &testRecord{State: t[0]}
+			if t[0] != "TestPassed" {
+				rec.Err = "no response"
+			}
+			for _, hops := range t[1:] {
+				rec.Paths = append(rec.Paths, pathRecord{Fingerprint: hops, Hops: hops})
+			}
+			r.Tests[testID] = rec
+		}
+		return r
+	}
+	tests := []struct {
+		name string
+		runs []*storedRun
+		want []string
+	}{
+		{
+			name: "single run",
+			runs: []*storedRun{run(1, "a", map[int][]string{1: {"TestFailed"}})},
+		},
+		{
+			name: "unchanged",
+			runs: []*storedRun{
+				run(1, "a", map[int][]string{1: {"TestPassed", "A>B"}}),
+				run(2, "a", map[int][]string{1: {"TestPassed", "A>B"}}),
+			},
+		},
+		{
+			name: "pass to fail",
+			runs: []*storedRun{
+				run(1, "a", map[int][]string{1: {"TestPassed"}, 2: {"TestPassed"}}),
+				run(2, "a", map[int][]string{1: {"TestPassed"}, 2: {"TestFailed"}}),
+			},
+			want: []string{"test 02 regressed: passed in run 1 (2024-05-01T13:00:00Z), " +
+				"now TestFailed: no response"},
+		},
+		{
+			// A test that failed before and still fails is no regression, one
+			// that was fixed neither.
+			name: "fail to fail and fail to pass",
+			runs: []*storedRun{
+				run(1, "a", map[int][]string{1: {"TestFailed"}, 2: {"TestFailed"}}),
+				run(2, "a", map[int][]string{1: {"TestFailed"}, 2: {"TestPassed"}}),
+			},
+		},
+		{
+			// The last path of a test counts, earlier ones were retries.
+			name: "different path",
+			runs: []*storedRun{
+				run(1, "a", map[int][]string{10: {"TestPassed", "A>C", "A>B"}}),
+				run(2, "a", map[int][]string{10: {"TestPassed", "A>B", "A>C"}}),
+			},
+			want: []string{"test 10 selected a different path: [A>B] -> [A>C]"},
+		},
+		{
+			name: "path unknown in one run",
+			runs: []*storedRun{
+				run(1, "a", map[int][]string{10: {"TestPassed"}}),
+				run(2, "a", map[int][]string{10: {"TestPassed", "A>C"}}),
+			},
+		},
+		{
+			name: "path set changed",
+			runs: []*storedRun{
+				run(1, "a", map[int][]string{1: {"TestPassed"}}),
+				run(2, "b", map[int][]string{1: {"TestPassed"}}),
+			},
+			want: []string{"path set changed: a -> b (topology changed?)"},
+		},
+		{
+			// A test the previous run skipped is compared against the last
+			// run that executed it.
+			name: "test skipped in the previous run",
+			runs: []*storedRun{
+				run(1, "a", map[int][]string{20: {"TestPassed", "A>B"}}),
+				run(2, "a", map[int][]string{1: {"TestPassed"}}),
+				run(3, "a", map[int][]string{1: {"TestPassed"}, 20: {"TestFailed", "A>C"}}),
+			},
+			want: []string{
+				"test 20 regressed: passed in run 1 (2024-05-01T13:00:00Z), now TestFailed: " +
+					"no response",
+				"test 20 selected a different path: [A>B] -> [A>C]",
+			},
+		},
+		{
+			name: "new test",
+			runs: []*storedRun{
+				run(1, "a", map[int][]string{1: {"TestPassed"}}),
+				run(2, "a", map[int][]string{1: {"TestPassed"}, 2: {"TestFailed"}}),
+			},
+		},
+		{
+			// Findings are ordered by test ID.
+			name: "several tests",
+			runs: []*storedRun{
+				run(1, "a", map[int][]string{31: {"TestPassed"}, 2: {"TestPassed", "A>B"}}),
+				run(2, "b", map[int][]string{31: {"TestFailed"}, 2: {"TestPassed", "A>C"}}),
+			},
+			want: []string{
+				"path set changed: a -> b (topology changed?)",
+				"test 02 selected a different path: [A>B] -> [A>C]",
+				"test 31 regressed: passed in run 1 (2024-05-01T13:00:00Z), now TestFailed: " +
+					"no response",
+			},
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			got := findRegressions(tc.runs)
+			if !reflect.DeepEqual(got, tc.want) {
+				t.Errorf("findings\n%q\nwant\n%q", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestRunSubcommandHelp(t *testing.T) {
+	if err := runSubcommand("history", []string{"-h"}); err != nil {
+		t.Errorf("-h failed: %v", err)
+	}
+	if err := runSubcommand("history", []string{"-no-such-flag"}); err == nil {
+		t.Error("unknown flag accepted")
+	}
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"context"
+	"flag"
+
+	"github.com/scionproto/scion/pkg/log"
+	"github.com/scionproto/scion/pkg/private/serrors"
+	"github.com/scionproto/scion/pkg/snet"
+)
+
+// linkTypePolicy decides how the announced type of the inter-AS links on a
+// path, direct, multihop or open internet, affects path selection.
+type linkTypePolicy string
+
+const (
+	// anyLinkType ignores the link types.
+	anyLinkType linkTypePolicy = "any"
+	// noOpennet removes every path with a link over the open internet.
+	noOpennet linkTypePolicy = "no-opennet"
+	// avoidOpennet ranks paths with fewer open internet links first.
+	avoidOpennet linkTypePolicy = "avoid-opennet"
+	// preferDirect ranks paths with fewer links that are not known to be
+	// direct first.
+	preferDirect linkTypePolicy = "prefer-direct"
+)
+
+func (p *linkTypePolicy) String() string {
+	return string(*p)
+}
+
+func (p *linkTypePolicy) Set(s string) error {
+	switch linkTypePolicy(s) {
+	case anyLinkType, noOpennet, avoidOpennet, preferDirect:
+		*p = linkTypePolicy(s)
+		return nil
+	default:
+		return serrors.New("unknown link type policy", "policy", s)
+	}
+}
+
+// The link type policy of all selectors.
+var pathLinkTypes = anyLinkType
+
+func init() {
+	flag.Var(&pathLinkTypes, "link-types",
+		"How link types affect path selection: any, no-opennet, avoid-opennet or prefer-direct")
+}
+
+// pathLinkTypeList returns the type of every inter-AS link of the path, in
+// path order. Links the path does not announce a type for are unset.
+func pathLinkTypeList(metadata *snet.PathMetadata) []snet.LinkType {
+	links := len(fabridHopInterfaces(metadata)) - 1
+	if links < 0 {
+		links = 0
+	}
+	types := make([]snet.LinkType, links)
+	copy(types, metadata.LinkType)
+	return types
+}
+
+// countLinks returns the number of links of the path with a type for which
+// match is true.
+func countLinks(metadata *snet.PathMetadata, match func(snet.LinkType) bool) int {
+	n := 0
+	for _, t := range pathLinkTypeList(metadata) {
+		if match(t) {
+			n++
+		}
+	}
+	return n
+}
+
+func isOpennet(t snet.LinkType) bool { return t == snet.LinkTypeOpennet }
+
+func isNotDirect(t snet.LinkType) bool { return t != snet.LinkTypeDirect }
+
+// penalty returns the number of links the policy penalizes on the path. Paths
+// without metadata get no penalty, they rank last anyway.
+func (p linkTypePolicy) penalty(path snet.Path) float64 {
+	if path == nil || path.Metadata() == nil {
+		return 0
+	}
+	switch p {
+	case avoidOpennet:
+		return float64(countLinks(path.Metadata(), isOpennet))
+	case preferDirect:
+		return float64(countLinks(path.Metadata(), isNotDirect))
+	}
+	return 0
+}
+
+// filter removes the paths with open internet links under the no-opennet
+// policy. Links without an announced type are kept.
+func (p linkTypePolicy) filter(ctx context.Context, query pathQueryKey,
+	paths []snet.Path) []snet.Path {
+
+	if p != noOpennet {
+		return paths
+	}
+	logger := log.FromCtx(ctx)
+	allowed := make([]snet.Path, 0, len(paths))
+	for _, path := range paths {
+		if metadata := path.Metadata(); metadata != nil && countLinks(metadata, isOpennet) > 0 {
+			logger.Debug("Path uses the open internet", pathFields(path)...)
+			continue
+		}
+		allowed = append(allowed, path)
+	}
+	if len(allowed) < len(paths) {
+		logger.Info("Link type policy removed paths", "policy", p, "query", query,
+			"paths", len(paths), "allowed", len(allowed))
+	}
+	return allowed
+}
@@ -3,6 +3,7 @@ package main
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
 	"net"
@@ -10,9 +11,7 @@ import (
 
 	"github.com/scionproto/scion/pkg/addr"
 	"github.com/scionproto/scion/pkg/daemon"
-	"github.com/scionproto/scion/pkg/experimental/fabrid"
 	"github.com/scionproto/scion/pkg/log"
-	"github.com/scionproto/scion/pkg/private/common"
 	"github.com/scionproto/scion/pkg/private/serrors"
 	"github.com/scionproto/scion/pkg/snet"
 	"github.com/scionproto/scion/pkg/snet/path"
@@ -66,24 +65,20 @@ func main() {
 
 func realMain() error {
 	ctx := context.Background()
+	defer pathSovereignty.close()
 
-	log.Info("Connecting to SCION daemon", "local", local, "daemon_port", daemonPort)
-
-	daemonAddr := net.JoinHostPort(local, fmt.Sprintf("%d", daemonPort))
-	daemonConn, err := daemon.NewService(daemonAddr).Connect(ctx)
-	if err != nil {
-		return serrors.WrapStr("connecting to SCION daemon", err)
+	if flag.NArg() > 0 {
+		return runSubcommand(flag.Arg(0), flag.Args()[1:])
 	}
-	defer daemonConn.Close()
-
-	log.Info("Successfully connected to SCION daemon")
 
-	localIA, err := daemonConn.LocalIA(ctx)
+	// All path queries of the tests go through the cache.
+	daemonConn, localIA, err := connectDaemon(ctx)
 	if err != nil {
-		return serrors.WrapStr("retrieving local ISD-AS", err)
+		return err
 	}
+	defer daemonConn.Close()
+	defer daemonConn.logStats()
 
-	log.Info("Local ISD-AS", "ia", localIA)
 	log.Info("Remote address", "remote", remote.String())
 
 	paths, err := daemonConn.Paths(ctx, remote.IA, localIA, daemon.PathReqFlags{})
@@ -92,10 +87,11 @@ func realMain() error {
 	}
 
 	if len(paths) == 0 {
-		return serrors.New("no paths available to remote")
+		return serrors.New("no paths available to remote", "path_policy", candidatePolicy.file)
 	}
 
 	log.Info("Found paths", "count", len(paths))
+	currentRun.setTopology(localIA, remote.IA, paths)
 
 	network := &snet.SCIONNetwork{
 		Topology: daemonConn,
@@ -110,11 +106,19 @@ func realMain() error {
 	log.Info("=== Starting Test ID 01 ===")
 
 	// Set path for Test 01
-	remote.Path = paths[0].Dataplane()
-	remote.NextHop = paths[0].UnderlayNextHop()
+	test01Paths, _, err := pinPaths(ctx, 1, paths)
+	if err != nil {
+		return err
+	}
+	dst := remote.Copy()
+	dst.Path = test01Paths[0].Dataplane()
+	dst.NextHop = test01Paths[0].UnderlayNextHop()
+	if err := usePath(ctx, 1, test01Paths[0]); err != nil {
+		return err
+	}
 
 	// Create connection for Test 01
-	conn, err := network.Dial(ctx, "udp", localAddr, &remote)
+	testConn, err := network.Dial(ctx, "udp", localAddr, dst)
 	if err != nil {
 		return serrors.WrapStr("dialing remote", err)
 	}
@@ -122,82 +126,148 @@ func realMain() error {
 	log.Info("Connection established for Test 01")
 
 	// Send Test ID 01
-	err = sendTest01(conn)
+	err = sendTest01(ctx, testConn)
 	if err != nil {
 		log.Error("Test ID 01 failed", "err", err)
+		currentRun.recordError(1, err)
 	}
 
 	// IMPORTANT: Close connection after Test 01
-	conn.Close()
+	testConn.Close()
 
 	// TEST ID 02
 	log.Info(" Starting Test ID 02")
 
 	// Pass network, localAddr, and paths to Test 02
 	// It will manage its own connections
-	err = sendTest02(network, localAddr, paths)
+	err = sendTest02(ctx, network, localAddr, paths)
 	if err != nil {
 		log.Error("Test ID 02 failed", "err", err)
-	}
+		currentRun.recordError(2, err)
+	}
+
+	// Tests 10, 11, 20 and 30-33 are independent of each other and may run
+	// concurrently (see --parallel).
+	runIndependentTests(ctx, []suiteTest{
+		// Test ID 10: Carbon Intensity
+		{ID: 10, Run: func(ctx context.Context) error {
+			return sendTest10(ctx, network, localAddr, paths)
+		}},
+		// Test ID 11: Maximize Bandwidth
+		{ID: 11, Run: func(ctx context.Context) error {
+			return sendTest11(ctx, network, localAddr, paths)
+		}},
+		// Test ID 20: EPIC Hidden Paths
+		{ID: 20, Run: func(ctx context.Context) error {
+			return sendTest20(ctx, daemonConn, network, localAddr, localIA)
+		}},
+		// Test ID 30: FABRID Basic Connectivity
+		{ID: 30, Run: func(ctx context.Context) error {
+			return sendTest30(ctx, daemonConn, network, localAddr, localIA)
+		}},
+		// Test ID 31: FABRID Manufacturer A or B
+		{ID: 31, Run: func(ctx context.Context) error {
+			return sendTest31(ctx, daemonConn, network, localAddr, localIA)
+		}},
+		// Test ID 32: FABRID ISD-specific policies
+		{ID: 32, Run: func(ctx context.Context) error {
+			return sendTest32(ctx, daemonConn, network, localAddr, localIA)
+		}},
+		// Test ID 33: FABRID Remote Attestation
+		{ID: 33, Run: func(ctx context.Context) error {
+			return sendTest33(ctx, daemonConn, network, localAddr, localIA)
+		}},
+	}, *parallelTests)
 
-	// Test ID 10: Carbon Intensity
-	log.Info("Starting Test ID 10")
-	err = sendTest10(network, localAddr, paths)
+	// Test ID 40: FABRID ISD-specific policies
+	log.Info("Starting Test ID 40")
+	err = sendTest40(ctx, daemonConn, network, localAddr, localIA)
 	if err != nil {
-		log.Error("Test ID 10 failed", "err", err)
+		log.Error("Test ID 40 failed", "err", err)
+		currentRun.recordError(40, err)
 	}
 
-	// Test ID 11: Maximize Bandwidth
-	log.Info("Starting Test ID 11")
-	err = sendTest11(network, localAddr, paths)
-	if err != nil {
-		log.Error("Test ID 11 failed", "err", err)
+	if *historyDB != "" {
+		if err := currentRun.store(ctx, *historyDB); err != nil {
+			log.Error("Storing run history failed", "err", err)
+		}
 	}
 
-	// Test ID 20: EPIC Hidden Paths
-	log.Info("Starting Test ID 20")
-	err = sendTest20(daemonConn, network, localAddr, localIA)
-	if err != nil {
-		log.Error("Test ID 20 failed", "err", err)
-	}
-	// Test ID 30: FABRID Basic Connectivity
-	log.Info("Starting Test ID 30")
-	err = sendTest30(daemonConn, network, localAddr, localIA)
-	if err != nil {
-		log.Error("Test ID 30 failed", "err", err)
-	}
+	return nil
+}
 
-	// Test ID 31: FABRID Manufacturer A or B
-	log.Info("Starting Test ID 31")
-	err = sendTest31(daemonConn, network, localAddr, localIA)
-	if err != nil {
-		log.Error("Test ID 31 failed", "err", err)
-	}
-	// Test ID 32: FABRID ISD-specific policies
-	log.Info("Starting Test ID 32")
-	err = sendTest32(daemonConn, network, localAddr, localIA)
+// connectDaemon connects to the SCION daemon of the local endhost. It returns
+// a path-caching connector and the local ISD-AS.
+func connectDaemon(ctx context.Context) (*pathCache, addr.IA, error) {
+	log.Info("Connecting to SCION daemon", "local", local, "daemon_port", daemonPort)
+
+	daemonAddr := net.JoinHostPort(local, fmt.Sprintf("%d", daemonPort))
+	conn, err := daemon.NewService(daemonAddr).Connect(ctx)
 	if err != nil {
-		log.Error("Test ID 32 failed", "err", err)
+		return nil, 0, serrors.WrapStr("connecting to SCION daemon", err)
 	}
 
-	// Test ID 33: FABRID ISD-specific policies
-	log.Info("Starting Test ID 33")
-	err = sendTest33(daemonConn, network, localAddr, localIA)
+	log.Info("Successfully connected to SCION daemon")
+
+	localIA, err := conn.LocalIA(ctx)
 	if err != nil {
-		log.Error("Test ID 33 failed", "err", err)
+		conn.Close()
+		return nil, 0, serrors.WrapStr("retrieving local ISD-AS", err)
 	}
 
-	// Test ID 40: FABRID ISD-specific policies
-	log.Info("Starting Test ID 40")
-	err = sendTest40(daemonConn, network, localAddr, localIA)
-	if err != nil {
-		log.Error("Test ID 40 failed", "err", err)
+	log.Info("Local ISD-AS", "ia", localIA)
+
+	return newPathCache(newDRKeyCache(conn)), localIA, nil
+}
+
+// runSubcommand runs one of the auxiliary client-app commands instead of the
+// test suite. A subcommand asked for help with -h has printed its usage and
+// succeeds.
+func runSubcommand(name string, args []string) error {
+	err := dispatchSubcommand(name, args)
+	if errors.Is(err, flag.ErrHelp) {
+		return nil
 	}
+	return err
+}
 
-	return nil
+func dispatchSubcommand(name string, args []string) error {
+	switch name {
+	case "history":
+		return runHistory(args)
+	case "transfer-server":
+		return runTransferServer(args)
+	case "transfer-bench":
+		return runTransferBench(args)
+	case "transfer-sim":
+		return runTransferSim(args)
+	case "epic-stream":
+		return runEPICStream(args)
+	case "epic-check":
+		return runEPICCheck(args)
+	case "fabrid-stream":
+		return runFabridStream(args)
+	case "fabrid-server":
+		return runFabridServer(args)
+	case "fabrid-plan":
+		return runFabridPlan(args)
+	case "fabrid-policies":
+		return runFabridPolicies(args)
+	case "hidden-paths":
+		return runHiddenPaths(args)
+	case "hidden-paths-check":
+		return runHiddenPathsCheck(args)
+	case "topology-lint":
+		return runTopologyLint(args)
+	case "topology-gen":
+		return runTopologyGen(args)
+	default:
+		return serrors.New("unknown subcommand", "subcommand", name)
+	}
 }
 
-func sendTest01(conn *snet.Conn) error {
+func sendTest01(ctx context.Context, conn *snet.Conn) error {
+	logger := log.FromCtx(ctx)
 
 	request := Request{
 		ID:      1,
@@ -209,7 +279,7 @@ func sendTest01(conn *snet.Conn) error {
 		return serrors.WrapStr("marshaling request", err)
 	}
 
-	log.Info("Sending Test ID 01", "payload", string(requestBytes))
+	logger.Info("Sending Test ID 01", "payload", string(requestBytes))
 
 	_, err = conn.Write(requestBytes)
 	if err != nil {
@@ -230,20 +300,26 @@ func sendTest01(conn *snet.Conn) error {
 		return serrors.WrapStr("unmarshaling response", err)
 	}
 
-	log.Info("Test ID 01 result", "id", response.ID, "state", response.State)
+	logger.Info("Test ID 01 result", "id", response.ID, "state", response.State)
+	currentRun.recordState(1, response.State)
 
 	return nil
 }
-func sendTest02(network *snet.SCIONNetwork, localAddr *net.UDPAddr, paths []snet.Path) error {
-	ctx := context.Background()
+func sendTest02(ctx context.Context, network *snet.SCIONNetwork, localAddr *net.UDPAddr, paths []snet.Path) error {
+	logger := log.FromCtx(ctx)
+
 	pathIndex := 0
 
-	log.Info("Test ID 02: Sending initial packet", "path_index", pathIndex)
+	logger.Info("Test ID 02: Sending initial packet", pathFields(paths[pathIndex], "path_index", pathIndex)...)
 
-	remote.Path = paths[pathIndex].Dataplane()
-	remote.NextHop = paths[pathIndex].UnderlayNextHop()
+	dst := remote.Copy()
+	dst.Path = paths[pathIndex].Dataplane()
+	dst.NextHop = paths[pathIndex].UnderlayNextHop()
+	if err := usePath(ctx, 2, paths[pathIndex]); err != nil {
+		return err
+	}
 
-	conn, err := network.Dial(ctx, "udp", localAddr, &remote)
+	conn, err := network.Dial(ctx, "udp", localAddr, dst)
 	if err != nil {
 		return serrors.WrapStr("dialing for test 02", err)
 	}
@@ -259,7 +335,7 @@ func sendTest02(network *snet.SCIONNetwork, localAddr *net.UDPAddr, paths []snet
 		return serrors.WrapStr("marshaling test 02 initial request", err)
 	}
 
-	log.Info("Test ID 02: Sending initial request", "payload", string(requestBytes))
+	logger.Info("Test ID 02: Sending initial request", "payload", string(requestBytes))
 
 	_, err = conn.Write(requestBytes)
 	if err != nil {
@@ -279,10 +355,11 @@ func sendTest02(network *snet.SCIONNetwork, localAddr *net.UDPAddr, paths []snet
 		return serrors.WrapStr("unmarshaling test 02 response", err)
 	}
 
-	log.Info("Test ID 02: Initial response", "id", response.ID, "state", response.State, "payload", response.Payload)
+	logger.Info("Test ID 02: Initial response", "id", response.ID, "state", response.State, "payload", response.Payload)
+	currentRun.recordState(2, response.State)
 
 	if response.State == "TestPassed" {
-		log.Info("Test ID 02: Passed on first try")
+		logger.Info("Test ID 02: Passed on first try")
 		return nil
 	}
 
@@ -292,22 +369,32 @@ func sendTest02(network *snet.SCIONNetwork, localAddr *net.UDPAddr, paths []snet
 	}
 
 	numAdditionalPaths := int(additionalPaths)
-	log.Info("Test ID 02: Additional paths needed", "count", numAdditionalPaths)
+	logger.Info("Test ID 02: Additional paths needed", "count", numAdditionalPaths)
 
 	if pathIndex+numAdditionalPaths >= len(paths) {
 		return serrors.New("not enough paths available for test 02", "needed", numAdditionalPaths+1, "available", len(paths))
 	}
 
+	// Continue with the paths that overlap the least with the initial one.
+	disjointPaths, err := selectDisjointPaths(ctx, paths, numAdditionalPaths+1, pathDisjointness, paths[pathIndex])
+	if err != nil {
+		return serrors.WrapStr("selecting disjoint paths for test 02", err)
+	}
+
 	for i := 0; i < numAdditionalPaths; i++ {
 		pathIndex++
-		log.Info("Test ID 02: Sending packet on different path", "path_index", pathIndex, "iteration", i+1, "of", numAdditionalPaths)
+		logger.Info("Test ID 02: Sending packet on different path", pathFields(disjointPaths[pathIndex],
+			"path_index", pathIndex, "iteration", i+1, "of", numAdditionalPaths)...)
 
 		conn.Close()
 
-		remote.Path = paths[pathIndex].Dataplane()
-		remote.NextHop = paths[pathIndex].UnderlayNextHop()
+		dst.Path = disjointPaths[pathIndex].Dataplane()
+		dst.NextHop = disjointPaths[pathIndex].UnderlayNextHop()
+		if err := usePath(ctx, 2, disjointPaths[pathIndex]); err != nil {
+			return err
+		}
 
-		conn, err = network.Dial(ctx, "udp", localAddr, &remote)
+		conn, err = network.Dial(ctx, "udp", localAddr, dst)
 		if err != nil {
 			return serrors.WrapStr("dialing for test 02 additional path", err, "path_index", pathIndex)
 		}
@@ -333,10 +420,11 @@ func sendTest02(network *snet.SCIONNetwork, localAddr *net.UDPAddr, paths []snet
 			return serrors.WrapStr("unmarshaling test 02 response", err)
 		}
 
-		log.Info("Test ID 02: Response received", "path_index", pathIndex, "state", response.State)
+		logger.Info("Test ID 02: Response received", "path_index", pathIndex, "state", response.State)
+		currentRun.recordState(2, response.State)
 
 		if response.State == "TestPassed" {
-			log.Info("Test ID 02: Passed!", "total_paths_used", pathIndex+1)
+			logger.Info("Test ID 02: Passed!", "total_paths_used", pathIndex+1)
 			conn.Close()
 			return nil
 		}
@@ -352,7 +440,9 @@ func sendTest02(network *snet.SCIONNetwork, localAddr *net.UDPAddr, paths []snet
 }
 
 // calculateCarbonIntensity uses the actual CarbonIntensity field from path metadata
-func calculateCarbonIntensity(path snet.Path) (totalIntensity float64, missingCount int, hasCompleteData bool) {
+func calculateCarbonIntensity(ctx context.Context, path snet.Path) (totalIntensity float64, missingCount int, hasCompleteData bool) {
+	logger := log.FromCtx(ctx)
+
 	metadata := path.Metadata()
 	if metadata == nil {
 		return 999999.0, 1, false
@@ -370,17 +460,17 @@ func calculateCarbonIntensity(path snet.Path) (totalIntensity float64, missingCo
 		if carbon == snet.CarbonIntensityUnset || carbon < 0 {
 
 			missingCount++
-			log.Debug("Missing carbon intensity", "index", i)
+			logger.Debug("Missing carbon intensity", "index", i)
 		} else {
 
 			totalIntensity += float64(carbon)
-			log.Debug("Carbon intensity", "index", i, "value", carbon)
+			logger.Debug("Carbon intensity", "index", i, "value", carbon)
 		}
 	}
 
 	hasCompleteData = (missingCount == 0)
 
-	log.Debug("Total carbon calculation",
+	logger.Debug("Total carbon calculation",
 		"total_gCO2_per_TB", totalIntensity,
 		"missing_count", missingCount,
 		"complete", hasCompleteData)
@@ -388,89 +478,66 @@ func calculateCarbonIntensity(path snet.Path) (totalIntensity float64, missingCo
 	return totalIntensity, missingCount, hasCompleteData
 }
 
-func findLowestCarbonPath(paths []snet.Path) (snet.Path, error) {
+func findLowestCarbonPath(ctx context.Context, paths []snet.Path) (snet.Path, error) {
+	logger := log.FromCtx(ctx)
+
 	if len(paths) == 0 {
 		return nil, serrors.New("no paths available")
 	}
 
-	var bestPath snet.Path
-	var bestIntensity float64
-	var bestMissingCount int
-	hasCompletePath := false
-
-	log.Info("Evaluating paths for carbon intensity", "total_paths", len(paths))
+	logger.Info("Evaluating paths for carbon intensity", "total_paths", len(paths))
 
+	// Complete data first, then fewer missing interfaces, then lower carbon
+	// intensity; ties are broken by the common path order.
+	ranks := make([]pathRank, len(paths))
 	for i, path := range paths {
-		intensity, missing, complete := calculateCarbonIntensity(path)
+		intensity, missing, complete := calculateCarbonIntensity(ctx, path)
 
-		log.Info("Path carbon analysis",
+		logger.Info("Path carbon analysis", pathFields(path,
 			"path_index", i,
 			"total_intensity", intensity,
 			"missing_interfaces", missing,
-			"complete_data", complete)
-
-		if bestPath == nil {
-
-			bestPath = path
-			bestIntensity = intensity
-			bestMissingCount = missing
-			hasCompletePath = complete
-			log.Info("Initialized best path", "path_index", i)
-		} else {
-
-			shouldReplace := false
-
-			if complete && !hasCompletePath {
-
-				shouldReplace = true
-				log.Info("Found path with complete data", "path_index", i)
-			} else if complete == hasCompletePath {
-
-				if missing < bestMissingCount {
-
-					shouldReplace = true
-					log.Info("Found path with fewer missing interfaces", "path_index", i)
-				} else if missing == bestMissingCount {
+			"complete_data", complete)...)
 
-					if intensity < bestIntensity {
-						shouldReplace = true
-						log.Info("Found path with lower carbon intensity", "path_index", i)
-					}
-				}
-			}
-
-			if shouldReplace {
-				bestPath = path
-				bestIntensity = intensity
-				bestMissingCount = missing
-				hasCompletePath = complete
-			}
+		incomplete := 1.0
+		if complete {
+			incomplete = 0
 		}
+		ranks[i] = newPathRank(path, incomplete, float64(missing), intensity)
 	}
 
-	log.Info("Selected path with minimum carbon intensity",
-		"total_intensity", bestIntensity,
-		"missing_interfaces", bestMissingCount,
-		"complete_data", hasCompletePath)
+	best := ranks[bestPathRank(ranks)]
+	logger.Info("Selected path with minimum carbon intensity", pathFields(best.path,
+		"total_intensity", best.metrics[2],
+		"missing_interfaces", int(best.metrics[1]),
+		"complete_data", best.metrics[0] == 0)...)
 
-	return bestPath, nil
+	return best.path, nil
 }
-func sendTest10(network *snet.SCIONNetwork, localAddr *net.UDPAddr, paths []snet.Path) error {
-	ctx := context.Background()
+func sendTest10(ctx context.Context, network *snet.SCIONNetwork, localAddr *net.UDPAddr, paths []snet.Path) error {
+	logger := log.FromCtx(ctx)
 
-	log.Info("Test ID 10: Finding path with minimum carbon intensity")
+	logger.Info("Test ID 10: Finding path with minimum carbon intensity")
 
-	bestPath, err := findLowestCarbonPath(paths)
+	paths, _, err := pinPaths(ctx, 10, paths)
+	if err != nil {
+		return err
+	}
+	bestPath, err := findLowestCarbonPath(ctx, paths)
 	if err != nil {
 		return serrors.WrapStr("finding lowest carbon path", err)
 	}
 
-	remote.Path = bestPath.Dataplane()
-	remote.NextHop = bestPath.UnderlayNextHop()
+	dst := remote.Copy()
+	dst.Path = bestPath.Dataplane()
+	dst.NextHop = bestPath.UnderlayNextHop()
+	if err := usePath(ctx, 10, bestPath); err != nil {
+		return err
+	}
 
-	log.Info("Test ID 10: Using selected low-carbon path")
+	logger.Info("Test ID 10: Using selected low-carbon path")
 
-	conn, err := network.Dial(ctx, "udp", localAddr, &remote)
+	conn, err := network.Dial(ctx, "udp", localAddr, dst)
 	if err != nil {
 		return serrors.WrapStr("dialing for test 10", err)
 	}
@@ -486,7 +553,7 @@ func sendTest10(network *snet.SCIONNetwork, localAddr *net.UDPAddr, paths []snet
 		return serrors.WrapStr("marshaling test 10 request", err)
 	}
 
-	log.Info("Test ID 10: Sending request", "payload", string(requestBytes))
+	logger.Info("Test ID 10: Sending request", "payload", string(requestBytes))
 
 	_, err = conn.Write(requestBytes)
 	if err != nil {
@@ -506,7 +573,8 @@ func sendTest10(network *snet.SCIONNetwork, localAddr *net.UDPAddr, paths []snet
 		return serrors.WrapStr("unmarshaling test 10 response", err)
 	}
 
-	log.Info("Test ID 10 result", "id", response.ID, "state", response.State)
+	logger.Info("Test ID 10 result", "id", response.ID, "state", response.State)
+	currentRun.recordState(10, response.State)
 
 	if response.State != "TestPassed" {
 		return serrors.New("test 10 did not pass", "state", response.State)
@@ -524,7 +592,9 @@ type PathScore struct {
 	PathLength      int
 }
 
-func calculateLatencyAndBandwidth(path snet.Path) (totalLatency time.Duration, minBandwidth uint64, missingCount int, hasCompleteData bool) {
+func calculateLatencyAndBandwidth(ctx context.Context, path snet.Path) (totalLatency time.Duration, minBandwidth uint64, missingCount int, hasCompleteData bool) {
+	logger := log.FromCtx(ctx)
+
 	metadata := path.Metadata()
 	if metadata == nil {
 		return time.Duration(999999) * time.Hour, 0, 1, false
@@ -543,29 +613,29 @@ func calculateLatencyAndBandwidth(path snet.Path) (totalLatency time.Duration, m
 		missingCount++
 	}
 
-	minBandwidth = ^uint64(0)
-	bandwidthFound := false
-
+	// A zero bandwidth entry was not announced. A path without any announced
+	// bandwidth must not rank above paths with a known bottleneck, so its
+	// bandwidth is zero rather than unbounded.
+	minBandwidth = 0
+	bandwidthMissing := 0
 	if len(metadata.Bandwidth) > 0 {
 		for _, bw := range metadata.Bandwidth {
-			if bw > 0 {
-				bandwidthFound = true
-				if bw < minBandwidth {
-					minBandwidth = bw
-				}
+			if bw == 0 {
+				bandwidthMissing++
+			} else if minBandwidth == 0 || bw < minBandwidth {
+				minBandwidth = bw
 			}
 		}
-	}
-
-	if !bandwidthFound {
-		minBandwidth = ^uint64(0)
+	} else {
+		bandwidthMissing++
 	}
 
 	latencyComplete := len(metadata.Latency) > 0 && missingCount == 0
-	bandwidthComplete := len(metadata.Bandwidth) > 0
+	bandwidthComplete := bandwidthMissing == 0
 	hasCompleteData = latencyComplete && bandwidthComplete
+	missingCount += bandwidthMissing
 
-	log.Debug("Path metrics",
+	logger.Debug("Path metrics",
 		"latency_ms", totalLatency.Milliseconds(),
 		"bandwidth_kbps", minBandwidth,
 		"missing", missingCount,
@@ -574,28 +644,30 @@ func calculateLatencyAndBandwidth(path snet.Path) (totalLatency time.Duration, m
 	return totalLatency, minBandwidth, missingCount, hasCompleteData
 }
 
-func findBestBandwidthPath(paths []snet.Path, maxLatencyMs int64) (snet.Path, error) {
+func findBestBandwidthPath(ctx context.Context, paths []snet.Path, maxLatencyMs int64) (snet.Path, error) {
+	logger := log.FromCtx(ctx)
+
 	if len(paths) == 0 {
 		return nil, serrors.New("no paths available")
 	}
 
 	maxLatency := time.Duration(maxLatencyMs) * time.Millisecond
 
-	log.Info("Finding best bandwidth path",
+	logger.Info("Finding best bandwidth path",
 		"max_latency_ms", maxLatencyMs,
 		"total_paths", len(paths))
 
 	var validPaths []PathScore
 
 	for i, path := range paths {
-		latency, bandwidth, missing, complete := calculateLatencyAndBandwidth(path)
+		latency, bandwidth, missing, complete := calculateLatencyAndBandwidth(ctx, path)
 
-		log.Info("Evaluating path",
+		logger.Info("Evaluating path", pathFields(path,
 			"path_index", i,
 			"latency_ms", latency.Milliseconds(),
 			"bandwidth_kbps", bandwidth,
 			"missing", missing,
-			"complete", complete)
+			"complete", complete)...)
 
 		if latency <= maxLatency {
 			score := PathScore{
@@ -604,12 +676,12 @@ func findBestBandwidthPath(paths []snet.Path, maxLatencyMs int64) (snet.Path, er
 				MinBandwidth:    bandwidth,
 				MissingCount:    missing,
 				HasCompleteData: complete,
-				PathLength:      len(path.Metadata().Interfaces),
+				PathLength:      getPathLength(path),
 			}
 			validPaths = append(validPaths, score)
-			log.Info("Path within latency bound", "path_index", i)
+			logger.Info("Path within latency bound", "path_index", i)
 		} else {
-			log.Info("Path exceeds latency bound", "path_index", i)
+			logger.Info("Path exceeds latency bound", "path_index", i)
 		}
 	}
 
@@ -617,64 +689,37 @@ func findBestBandwidthPath(paths []snet.Path, maxLatencyMs int64) (snet.Path, er
 		return nil, serrors.New("no paths within latency bound")
 	}
 
-	// Sort paths by priority
-	// 1. Complete data first
-	// 2. Fewer missing interfaces
-	// 3. Higher bandwidth
-	// 4. Shorter path
-	// 5. Lower interface IDs (implicit in path order)
-
-	bestIdx := 0
-	for i := 1; i < len(validPaths); i++ {
-		shouldReplace := false
-
-		curr := validPaths[i]
-		best := validPaths[bestIdx]
-
-		if curr.HasCompleteData && !best.HasCompleteData {
-			shouldReplace = true
-		} else if curr.HasCompleteData == best.HasCompleteData {
-
-			if curr.MissingCount < best.MissingCount {
-				shouldReplace = true
-			} else if curr.MissingCount == best.MissingCount {
-
-				if curr.MinBandwidth > best.MinBandwidth {
-					shouldReplace = true
-				} else if curr.MinBandwidth == best.MinBandwidth {
-
-					if curr.PathLength < best.PathLength {
-						shouldReplace = true
-					}
-
-				}
-			}
-		}
-
-		if shouldReplace {
-			bestIdx = i
-			log.Info("New best path", "path_index", i)
+	// Complete data first, then fewer missing entries, then higher bandwidth;
+	// ties are broken by the common path order, which prefers shorter paths.
+	ranks := make([]pathRank, len(validPaths))
+	for i, score := range validPaths {
+		incomplete := 1.0
+		if score.HasCompleteData {
+			incomplete = 0
 		}
+		ranks[i] = newPathRank(score.Path, incomplete, float64(score.MissingCount),
+			-float64(score.MinBandwidth))
 	}
 
-	best := validPaths[bestIdx]
-	log.Info("Selected best bandwidth path",
+	best := validPaths[bestPathRank(ranks)]
+	logger.Info("Selected best bandwidth path", pathFields(best.Path,
 		"latency_ms", best.TotalLatency.Milliseconds(),
 		"bandwidth_kbps", best.MinBandwidth,
 		"path_length", best.PathLength,
-		"complete", best.HasCompleteData)
+		"complete", best.HasCompleteData)...)
 
 	return best.Path, nil
 }
-func sendTest11(network *snet.SCIONNetwork, localAddr *net.UDPAddr, paths []snet.Path) error {
-	ctx := context.Background()
+func sendTest11(ctx context.Context, network *snet.SCIONNetwork, localAddr *net.UDPAddr, paths []snet.Path) error {
+	logger := log.FromCtx(ctx)
 
-	log.Info("Test ID 11: Getting latency bound from verifier")
+	logger.Info("Test ID 11: Getting latency bound from verifier")
 
-	remote.Path = paths[0].Dataplane()
-	remote.NextHop = paths[0].UnderlayNextHop()
+	dst := remote.Copy()
+	dst.Path = paths[0].Dataplane()
+	dst.NextHop = paths[0].UnderlayNextHop()
 
-	conn, err := network.Dial(ctx, "udp", localAddr, &remote)
+	conn, err := network.Dial(ctx, "udp", localAddr, dst)
 	if err != nil {
 		return serrors.WrapStr("dialing for test 11 initial", err)
 	}
@@ -690,7 +735,7 @@ func sendTest11(network *snet.SCIONNetwork, localAddr *net.UDPAddr, paths []snet
 		return serrors.WrapStr("marshaling test 11 initial request", err)
 	}
 
-	log.Info("Test ID 11: Requesting latency bound", "payload", string(requestBytes))
+	logger.Info("Test ID 11: Requesting latency bound", "payload", string(requestBytes))
 
 	_, err = conn.Write(requestBytes)
 	if err != nil {
@@ -713,30 +758,43 @@ func sendTest11(network *snet.SCIONNetwork, localAddr *net.UDPAddr, paths []snet
 		return serrors.WrapStr("unmarshaling test 11 response", err)
 	}
 
-	log.Info("Test ID 11: Received response", "state", response.State, "payload", response.Payload)
+	logger.Info("Test ID 11: Received response", "state", response.State, "payload", response.Payload)
 
 	maxLatencyMs, ok := response.Payload.(float64)
 	if !ok {
 		return serrors.New("unexpected payload type for latency bound")
 	}
 
-	log.Info("Test ID 11: Latency bound", "max_latency_ms", maxLatencyMs)
+	logger.Info("Test ID 11: Latency bound", "max_latency_ms", maxLatencyMs)
 
-	bestPath, err := findBestBandwidthPath(paths, int64(maxLatencyMs))
+	// A pinned path is used even if it exceeds the latency bound.
+	pinned, isPinned, err := pinPaths(ctx, 11, paths)
 	if err != nil {
-		return serrors.WrapStr("finding best bandwidth path", err)
+		return err
+	}
+	var bestPath snet.Path
+	if isPinned {
+		bestPath = pinned[0]
+	} else {
+		bestPath, err = findBestBandwidthPath(ctx, paths, int64(maxLatencyMs))
+		if err != nil {
+			return serrors.WrapStr("finding best bandwidth path", err)
+		}
 	}
 
-	remote.Path = bestPath.Dataplane()
-	remote.NextHop = bestPath.UnderlayNextHop()
+	dst.Path = bestPath.Dataplane()
+	dst.NextHop = bestPath.UnderlayNextHop()
+	if err := usePath(ctx, 11, bestPath); err != nil {
+		return err
+	}
 
-	conn, err = network.Dial(ctx, "udp", localAddr, &remote)
+	conn, err = network.Dial(ctx, "udp", localAddr, dst)
 	if err != nil {
 		return serrors.WrapStr("dialing for test 11 final", err)
 	}
 	defer conn.Close()
 
-	log.Info("Test ID 11: Sending on best bandwidth path")
+	logger.Info("Test ID 11: Sending on best bandwidth path")
 
 	requestBytes, err = json.Marshal(request)
 	if err != nil {
@@ -759,7 +817,8 @@ func sendTest11(network *snet.SCIONNetwork, localAddr *net.UDPAddr, paths []snet
 		return serrors.WrapStr("unmarshaling test 11 final response", err)
 	}
 
-	log.Info("Test ID 11 result", "id", response.ID, "state", response.State)
+	logger.Info("Test ID 11 result", "id", response.ID, "state", response.State)
+	currentRun.recordState(11, response.State)
 
 	if response.State != "TestPassed" {
 		return serrors.New("test 11 did not pass", "state", response.State)
@@ -785,48 +844,14 @@ func getPathLength(path snet.Path) int {
 	return len(metadata.Interfaces)
 }
 
-// compareInterfaceIDs compares two paths by their interface IDs
-// Returns true if path1 should be preferred over path2
-func compareInterfaceIDs(path1, path2 snet.Path) bool {
-	meta1 := path1.Metadata()
-	meta2 := path2.Metadata()
-
-	if meta1 == nil {
-		return false
-	}
-	if meta2 == nil {
-		return true
-	}
-
-	interfaces1 := meta1.Interfaces
-	interfaces2 := meta2.Interfaces
-
-	// Compare interface by interface
-	minLen := len(interfaces1)
-	if len(interfaces2) < minLen {
-		minLen = len(interfaces2)
-	}
-
-	for i := 0; i < minLen; i++ {
-		id1 := interfaces1[i].ID
-		id2 := interfaces2[i].ID
-
-		if id1 < id2 {
-			return true
-		} else if id1 > id2 {
-			return false
-		}
-	}
-
-	return len(interfaces1) < len(interfaces2)
-}
+func findEPICPath(ctx context.Context, paths []snet.Path) (snet.Path, error) {
+	logger := log.FromCtx(ctx)
 
-func findEPICPath(paths []snet.Path) (snet.Path, error) {
 	if len(paths) == 0 {
 		return nil, serrors.New("no paths available")
 	}
 
-	log.Info("Finding EPIC hidden path", "total_paths", len(paths))
+	logger.Info("Finding EPIC hidden path", "total_paths", len(paths))
 
 	var hiddenPaths []snet.Path
 	var normalPaths []snet.Path
@@ -835,10 +860,10 @@ func findEPICPath(paths []snet.Path) (snet.Path, error) {
 		hasEPIC := hasEPICPath(path)
 		pathLen := getPathLength(path)
 
-		log.Info("Analyzing path for EPIC",
+		logger.Info("Analyzing path for EPIC", pathFields(path,
 			"path_index", i,
 			"has_epic", hasEPIC,
-			"length", pathLen)
+			"length", pathLen)...)
 
 		if hasEPIC {
 			hiddenPaths = append(hiddenPaths, path)
@@ -849,10 +874,10 @@ func findEPICPath(paths []snet.Path) (snet.Path, error) {
 
 	var candidatePaths []snet.Path
 	if len(hiddenPaths) > 0 {
-		log.Info("Found EPIC hidden paths", "count", len(hiddenPaths))
+		logger.Info("Found EPIC hidden paths", "count", len(hiddenPaths))
 		candidatePaths = hiddenPaths
 	} else {
-		log.Info("No EPIC hidden paths found, using normal paths", "count", len(normalPaths))
+		logger.Info("No EPIC hidden paths found, using normal paths", "count", len(normalPaths))
 		candidatePaths = normalPaths
 	}
 
@@ -860,37 +885,25 @@ func findEPICPath(paths []snet.Path) (snet.Path, error) {
 		return nil, serrors.New("no candidate paths available")
 	}
 
-	bestPath := candidatePaths[0]
-	bestLength := getPathLength(bestPath)
-
-	for i := 1; i < len(candidatePaths); i++ {
-		currPath := candidatePaths[i]
-		currLength := getPathLength(currPath)
-
-		if currLength < bestLength {
-
-			bestPath = currPath
-			bestLength = currLength
-			log.Info("Found shorter path", "path_index", i, "length", currLength)
-		} else if currLength == bestLength {
-
-			if compareInterfaceIDs(currPath, bestPath) {
-				bestPath = currPath
-				log.Info("Found path with lower interface IDs", "path_index", i)
-			}
-		}
+	// EPIC paths have no metric of their own, the common path order prefers
+	// the shortest path and then the lowest interface IDs.
+	ranks := make([]pathRank, len(candidatePaths))
+	for i, path := range candidatePaths {
+		ranks[i] = newPathRank(path)
 	}
+	bestPath := candidatePaths[bestPathRank(ranks)]
+	bestLength := getPathLength(bestPath)
 
-	log.Info("Selected EPIC path",
+	logger.Info("Selected EPIC path", pathFields(bestPath,
 		"has_epic", hasEPICPath(bestPath),
-		"length", bestLength)
+		"length", bestLength)...)
 
 	return bestPath, nil
 }
-func sendTest20(daemonConn daemon.Connector, network *snet.SCIONNetwork, localAddr *net.UDPAddr, localIA addr.IA) error {
-	ctx := context.Background()
+func sendTest20(ctx context.Context, daemonConn daemon.Connector, network *snet.SCIONNetwork, localAddr *net.UDPAddr, localIA addr.IA) error {
+	logger := log.FromCtx(ctx)
 
-	log.Info("Test ID 20: Fetching EPIC-enabled paths")
+	logger.Info("Test ID 20: Fetching EPIC-enabled paths")
 
 	epicPaths, err := daemonConn.Paths(ctx, remote.IA, localIA, daemon.PathReqFlags{
 		Hidden: true,
@@ -899,55 +912,27 @@ func sendTest20(daemonConn daemon.Connector, network *snet.SCIONNetwork, localAd
 		return serrors.WrapStr("querying EPIC paths", err)
 	}
 
-	log.Info("Test ID 20: Finding EPIC hidden path", "total_paths", len(epicPaths))
+	logger.Info("Test ID 20: Finding EPIC hidden path", "total_paths", len(epicPaths))
 
-	bestPath, err := findEPICPath(epicPaths)
+	epicPaths, _, err = pinPaths(ctx, 20, epicPaths)
+	if err != nil {
+		return err
+	}
+
+	bestPath, err := findEPICPath(ctx, epicPaths)
 	if err != nil {
 		return serrors.WrapStr("finding EPIC path", err)
 	}
 
-	var finalPath snet.Path = bestPath
 	hasEPIC := hasEPICPath(bestPath)
-
-	if hasEPIC {
-		log.Info("Setting up EPIC dataplane path")
-
-		metadata := bestPath.Metadata()
-
-		scionPath, ok := bestPath.Dataplane().(path.SCION)
-		if !ok {
-			log.Error("Failed to cast to SCION path for EPIC")
-		} else {
-
-			epicDataplane, err := path.NewEPICDataplanePath(
-				scionPath,
-				metadata.EpicAuths,
-			)
-
-			if err != nil {
-				log.Error("Failed to create EPIC dataplane", "err", err)
-			} else {
-				log.Info("EPIC dataplane path created successfully")
-
-				finalPath = &epicPathWrapper{
-					originalPath:  bestPath,
-					epicDataplane: epicDataplane,
-				}
-			}
-		}
+	if err := usePath(ctx, 20, bestPath); err != nil {
+		return err
 	}
-
-	remote.Path = finalPath.Dataplane()
-	remote.NextHop = finalPath.UnderlayNextHop()
-
-	log.Info("Test ID 20: Using selected EPIC path", "has_epic", hasEPIC)
-
-	// Create connection
-	conn, err := network.Dial(ctx, "udp", localAddr, &remote)
-	if err != nil {
-		return serrors.WrapStr("dialing for test 20", err)
+	if !hasEPIC {
+		logHiddenPathDiagnostics(ctx, localIA, remote.IA)
 	}
-	defer conn.Close()
+
+	logger.Info("Test ID 20: Using selected EPIC path", "has_epic", hasEPIC)
 
 	// Create request
 	request := Request{
@@ -960,20 +945,49 @@ func sendTest20(daemonConn daemon.Connector, network *snet.SCIONNetwork, localAd
 		return serrors.WrapStr("marshaling test 20 request", err)
 	}
 
-	log.Info("Test ID 20: Sending request", "payload", string(requestBytes))
-
-	// Send packet
-	_, err = conn.Write(requestBytes)
-	if err != nil {
-		return serrors.WrapStr("writing test 20 packet", err)
+	var session *epicSession
+	if hasEPIC {
+		logger.Info("Setting up EPIC session")
+		session, err = newEPICSession(ctx, daemonConn, network, localAddr, localIA, bestPath)
+		if err != nil {
+			logger.Error("Failed to create EPIC session", "err", err)
+		} else {
+			defer session.Close()
+			defer session.logStats(ctx)
+		}
 	}
 
-	// Read response
-	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	logger.Info("Test ID 20: Sending request", "payload", string(requestBytes))
+
 	buffer := make([]byte, 16000)
-	n, err := conn.Read(buffer)
-	if err != nil {
-		return serrors.WrapStr("reading test 20 response", err)
+	var n int
+	if session != nil {
+		if _, err := session.Write(ctx, requestBytes); err != nil {
+			return serrors.WrapStr("writing test 20 packet", err)
+		}
+		n, err = session.Read(buffer, time.Now().Add(5*time.Second))
+		if err != nil {
+			return serrors.WrapStr("reading test 20 response", err)
+		}
+	} else {
+		dst := remote.Copy()
+		dst.Path = bestPath.Dataplane()
+		dst.NextHop = bestPath.UnderlayNextHop()
+
+		conn, err := network.Dial(ctx, "udp", localAddr, dst)
+		if err != nil {
+			return serrors.WrapStr("dialing for test 20", err)
+		}
+		defer conn.Close()
+
+		if _, err := conn.Write(requestBytes); err != nil {
+			return serrors.WrapStr("writing test 20 packet", err)
+		}
+		conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		n, err = conn.Read(buffer)
+		if err != nil {
+			return serrors.WrapStr("reading test 20 response", err)
+		}
 	}
 
 	var response Response
@@ -982,7 +996,8 @@ func sendTest20(daemonConn daemon.Connector, network *snet.SCIONNetwork, localAd
 		return serrors.WrapStr("unmarshaling test 20 response", err)
 	}
 
-	log.Info("Test ID 20 result", "id", response.ID, "state", response.State)
+	logger.Info("Test ID 20 result", "id", response.ID, "state", response.State)
+	currentRun.recordState(20, response.State)
 
 	if response.State != "TestPassed" {
 		return serrors.New("test 20 did not pass", "state", response.State)
@@ -991,36 +1006,10 @@ func sendTest20(daemonConn daemon.Connector, network *snet.SCIONNetwork, localAd
 	return nil
 }
 
-// epicPathWrapper wraps a path with EPIC dataplane
-type epicPathWrapper struct {
-	originalPath  snet.Path
-	epicDataplane snet.DataplanePath
-}
-
-func (e *epicPathWrapper) UnderlayNextHop() *net.UDPAddr {
-	return e.originalPath.UnderlayNextHop()
-}
-
-func (e *epicPathWrapper) Dataplane() snet.DataplanePath {
-	return e.epicDataplane
-}
-
-func (e *epicPathWrapper) Metadata() *snet.PathMetadata {
-	return e.originalPath.Metadata()
-}
-
-func (e *epicPathWrapper) Destination() addr.IA {
-	return e.originalPath.Destination()
-}
-
-func (e *epicPathWrapper) Source() addr.IA {
-	return e.originalPath.Source()
-}
-
-func sendTest30(daemonConn daemon.Connector, network *snet.SCIONNetwork, localAddr *net.UDPAddr, localIA addr.IA) error {
-	ctx := context.Background()
+func sendTest30(ctx context.Context, daemonConn daemon.Connector, network *snet.SCIONNetwork, localAddr *net.UDPAddr, localIA addr.IA) error {
+	logger := log.FromCtx(ctx)
 
-	log.Info("Test ID 30: FABRID Basic Connectivity")
+	logger.Info("Test ID 30: FABRID Basic Connectivity")
 
 	fabridPaths, err := daemonConn.Paths(ctx, remote.IA, localIA, daemon.PathReqFlags{
 		FetchFabridDetachedMaps: true,
@@ -1033,7 +1022,12 @@ func sendTest30(daemonConn daemon.Connector, network *snet.SCIONNetwork, localAd
 		return serrors.New("no paths available")
 	}
 
-	log.Info("Test ID 30: Found paths", "count", len(fabridPaths))
+	logger.Info("Test ID 30: Found paths", "count", len(fabridPaths))
+
+	fabridPaths, _, err = pinPaths(ctx, 30, fabridPaths)
+	if err != nil {
+		return err
+	}
 
 	var selectedPath snet.Path
 	var hasFabrid bool
@@ -1048,7 +1042,7 @@ func sendTest30(daemonConn daemon.Connector, network *snet.SCIONNetwork, localAd
 			if info.Enabled {
 				selectedPath = path
 				hasFabrid = true
-				log.Info("Selected FABRID-enabled path", "path_index", i)
+				logger.Info("Selected FABRID-enabled path", pathFields(path, "path_index", i)...)
 				break
 			}
 		}
@@ -1059,80 +1053,27 @@ func sendTest30(daemonConn daemon.Connector, network *snet.SCIONNetwork, localAd
 
 	if selectedPath == nil {
 		selectedPath = fabridPaths[0]
-		log.Info("No FABRID-enabled paths, using first path")
+		logger.Info("No FABRID-enabled paths, using first path", pathFields(selectedPath)...)
 	}
 
+	dst := remote.Copy()
+
 	if hasFabrid {
-		log.Info("Setting up FABRID dataplane path")
+		logger.Info("Setting up FABRID dataplane path")
 
 		metadata := selectedPath.Metadata()
 		scionPath, ok := selectedPath.Dataplane().(path.SCION)
 		if !ok {
-			log.Error("Failed to cast to path.SCION")
+			logger.Error("Failed to cast to path.SCION")
 			hasFabrid = false
 		} else {
-			interfaces := metadata.Interfaces
-
-			hopInterfaces := make([]snet.HopInterface, 0)
-
-			i := 0
-			for i < len(interfaces) {
-				var igIf, egIf common.IFIDType
-				var ia addr.IA
-
-				if i == 0 {
-
-					igIf = 0
-					egIf = interfaces[i].ID
-					ia = interfaces[i].IA
-					i++
-				} else if i == len(interfaces)-1 {
+			hopInterfaces := fabridHopInterfaces(metadata)
 
-					igIf = interfaces[i].ID
-					egIf = 0
-					ia = interfaces[i].IA
-					i++
-				} else {
-
-					if interfaces[i].IA == interfaces[i+1].IA {
-
-						igIf = interfaces[i].ID
-						egIf = interfaces[i+1].ID
-						ia = interfaces[i].IA
-						i += 2
-					} else {
-
-						igIf = interfaces[i].ID
-						egIf = 0
-						ia = interfaces[i].IA
-						i++
-					}
-				}
-
-				// Get FABRID info for this hop
-				hopIdx := len(hopInterfaces)
-				var fabridEnabled bool
-				var policies []*fabrid.Policy
-
-				if hopIdx < len(metadata.FabridInfo) {
-					fabridEnabled = metadata.FabridInfo[hopIdx].Enabled
-					policies = metadata.FabridInfo[hopIdx].Policies
-				}
-
-				hopInterfaces = append(hopInterfaces, snet.HopInterface{
-					IgIf:          igIf,
-					EgIf:          egIf,
-					IA:            ia,
-					FabridEnabled: fabridEnabled,
-					Policies:      policies,
-				})
-			}
-
-			log.Info("Constructed hop interfaces", "count", len(hopInterfaces))
+			logger.Info("Constructed hop interfaces", "count", len(hopInterfaces))
 
 			fabridQuery, err := fabridquery.ParseFabridQuery("0-0#0,0@0")
 			if err != nil {
-				log.Error("Failed to parse FABRID query", "err", err)
+				logger.Error("Failed to parse FABRID query", "err", err)
 				hasFabrid = false
 			} else {
 				matchList := fabridquery.MatchList{
@@ -1140,13 +1081,13 @@ func sendTest30(daemonConn daemon.Connector, network *snet.SCIONNetwork, localAd
 				}
 
 				matched, resultMatchList := fabridQuery.Evaluate(hopInterfaces, &matchList)
-				log.Info("FABRID query evaluation", "matched", matched)
+				logger.Info("FABRID query evaluation", "matched", matched)
 
 				policyIDs := resultMatchList.Policies()
-				log.Info("Extracted policy IDs", "count", len(policyIDs))
+				logger.Info("Extracted policy IDs", "count", len(policyIDs))
 
 				if len(policyIDs) == 0 {
-					log.Error("No policy IDs from MatchList")
+					logger.Error("No policy IDs from MatchList")
 					hasFabrid = false
 				} else {
 					fabridConfig := &path.FabridConfig{
@@ -1165,12 +1106,12 @@ func sendTest30(daemonConn daemon.Connector, network *snet.SCIONNetwork, localAd
 					)
 
 					if err != nil {
-						log.Error("Failed to create FABRID dataplane", "err", err)
+						logger.Error("Failed to create FABRID dataplane", "err", err)
 						hasFabrid = false
 					} else {
-						log.Info("FABRID dataplane created successfully")
-						remote.Path = fabridDataplane
-						remote.NextHop = selectedPath.UnderlayNextHop()
+						logger.Info("FABRID dataplane created successfully")
+						dst.Path = fabridDataplane
+						dst.NextHop = selectedPath.UnderlayNextHop()
 					}
 				}
 			}
@@ -1178,13 +1119,16 @@ func sendTest30(daemonConn daemon.Connector, network *snet.SCIONNetwork, localAd
 	}
 
 	if !hasFabrid {
-		remote.Path = selectedPath.Dataplane()
-		remote.NextHop = selectedPath.UnderlayNextHop()
+		dst.Path = selectedPath.Dataplane()
+		dst.NextHop = selectedPath.UnderlayNextHop()
 	}
 
-	log.Info("Test ID 30: Using path", "has_fabrid", hasFabrid)
+	logger.Info("Test ID 30: Using path", "has_fabrid", hasFabrid)
+	if err := usePath(ctx, 30, selectedPath); err != nil {
+		return err
+	}
 
-	conn, err := network.Dial(ctx, "udp", localAddr, &remote)
+	conn, err := network.Dial(ctx, "udp", localAddr, dst)
 	if err != nil {
 		return serrors.WrapStr("dialing for test 30", err)
 	}
@@ -1200,7 +1144,7 @@ func sendTest30(daemonConn daemon.Connector, network *snet.SCIONNetwork, localAd
 		return serrors.WrapStr("marshaling test 30 request", err)
 	}
 
-	log.Info("Test ID 30: Sending request", "payload", string(requestBytes))
+	logger.Info("Test ID 30: Sending request", "payload", string(requestBytes))
 
 	_, err = conn.Write(requestBytes)
 	if err != nil {
@@ -1220,7 +1164,8 @@ func sendTest30(daemonConn daemon.Connector, network *snet.SCIONNetwork, localAd
 		return serrors.WrapStr("unmarshaling test 30 response", err)
 	}
 
-	log.Info("Test ID 30 result", "id", response.ID, "state", response.State)
+	logger.Info("Test ID 30 result", "id", response.ID, "state", response.State)
+	currentRun.recordState(30, response.State)
 
 	if response.State != "TestPassed" {
 		return serrors.New("test 30 did not pass", "state", response.State)
@@ -1228,10 +1173,60 @@ func sendTest30(daemonConn daemon.Connector, network *snet.SCIONNetwork, localAd
 
 	return nil
 }
-func sendTest31(daemonConn daemon.Connector, network *snet.SCIONNetwork, localAddr *net.UDPAddr, localIA addr.IA) error {
-	ctx := context.Background()
 
-	log.Info("Test ID 31: FABRID Manufacturer A or B")
+// The FABRID queries of tests 31 to 33.
+const (
+	fabridQuery31 = "0-0#0,0@L1000#0-0#0,0@L1001#0-0#0,0@REJECT"
+	// ISD 1: manufacturer A (L1000), ISD 2: manufacturer B or C (L1001 or L1002)
+	fabridQuery32 = "{1-0#0,0@0 ? 1-0#0,0@L1000 + 1-0#0,0@REJECT : 1-0#0,0@0} + " +
+		"{2-0#0,0@0 ? 2-0#0,0@L1001 + 2-0#0,0@L1002 + 2-0#0,0@REJECT : 2-0#0,0@0}"
+	fabridQuery33 = "0-0#0,0@L2000#0-0#0,0@L1002#0-0#0,0@REJECT"
+)
+
+func sendTest31(ctx context.Context, daemonConn daemon.Connector, network *snet.SCIONNetwork, localAddr *net.UDPAddr, localIA addr.IA) error {
+	log.FromCtx(ctx).Info("Test ID 31: FABRID Manufacturer A or B")
+	return sendFabridTest(ctx, 31, fabridQuery31, nil, daemonConn, network, localAddr, localIA)
+}
+
+func sendTest32(ctx context.Context, daemonConn daemon.Connector, network *snet.SCIONNetwork, localAddr *net.UDPAddr, localIA addr.IA) error {
+	log.FromCtx(ctx).Info("Test ID 32: FABRID ISD-specific policies")
+	return sendFabridTest(ctx, 32, fabridQuery32, nil, daemonConn, network, localAddr, localIA)
+}
+
+func sendTest33(ctx context.Context, daemonConn daemon.Connector, network *snet.SCIONNetwork, localAddr *net.UDPAddr, localIA addr.IA) error {
+	logger := log.FromCtx(ctx)
+	logger.Info("Test ID 33: FABRID Remote Attestation")
+	return sendFabridTest(ctx, 33, fabridQuery33,
+		func(m fabridMatch) bool {
+			if lastAttested(m) {
+				return true
+			}
+			logger.Info("Path rejected - last hop lacks L2000",
+				pathFields(m.path, "num_hops", len(m.hops))...)
+			return false
+		},
+		daemonConn, network, localAddr, localIA)
+}
+
+// lastAttested reports whether the last transit hop of a match, the hop
+// before the destination AS, uses the remote attestation policy L2000. Paths
+// without transit hops have no such hop and are accepted.
+func lastAttested(m fabridMatch) bool {
+	last := len(m.hops) - 2
+	if last < 1 {
+		return true
+	}
+	return last < len(m.selected) && fabridHopPolicy(m.selected[last]) == "L2000"
+}
+
+// sendFabridTest sends the request of a FABRID test over the path chosen for
+// the query with the -fabrid-prefer and -fabrid-optimize preferences. The
+// payload tells the verifier whether the query could be fulfilled.
+func sendFabridTest(ctx context.Context, id int, query string, accept func(fabridMatch) bool,
+	daemonConn daemon.Connector, network *snet.SCIONNetwork, localAddr *net.UDPAddr,
+	localIA addr.IA) error {
+
+	logger := log.FromCtx(ctx)
 
 	fabridPaths, err := daemonConn.Paths(ctx, remote.IA, localIA, daemon.PathReqFlags{
 		FetchFabridDetachedMaps: true,
@@ -1244,1092 +1239,115 @@ func sendTest31(daemonConn daemon.Connector, network *snet.SCIONNetwork, localAd
 		return serrors.New("no paths available")
 	}
 
-	log.Info("Test ID 31: Found paths", "count", len(fabridPaths))
+	logger.Info(fmt.Sprintf("Test ID %02d: Found paths", id), "count", len(fabridPaths))
 
-	fabridQuery, err := fabridquery.ParseFabridQuery("0-0#0,0@L1000#0-0#0,0@L1001#0-0#0,0@REJECT")
+	fabridPaths, _, err = pinPaths(ctx, id, fabridPaths)
 	if err != nil {
-		return serrors.WrapStr("parsing FABRID query", err)
+		return err
 	}
 
-	type pathCandidate struct {
-		path          snet.Path
-		matchList     *fabridquery.MatchList
-		numHops       int
-		hopInterfaces []snet.HopInterface
+	prefs, err := parseFabridPreferences(*fabridTestPrefer, *fabridTestOptimize)
+	if err != nil {
+		return err
+	}
+	fabridQuery, err := parseFabridQuery(query)
+	if err != nil {
+		return err
+	}
+	wildcardQuery, err := fabridquery.ParseFabridQuery("0-0#0,0@0")
+	if err != nil {
+		return serrors.WrapStr("parsing FABRID wildcard query", err)
 	}
 
-	var candidates []pathCandidate
+	match, policyFulfilled, err := selectFabridTestPath(ctx, fabridQuery, wildcardQuery,
+		fabridPaths, prefs, accept)
+	if err != nil {
+		return err
+	}
 
-	for _, p := range fabridPaths {
-		metadata := p.Metadata()
-		if metadata == nil || len(metadata.FabridInfo) == 0 {
-			continue
-		}
+	scionPath, ok := match.path.Dataplane().(path.SCION)
+	if !ok {
+		return serrors.New("failed to cast to path.SCION")
+	}
 
-		interfaces := metadata.Interfaces
-		hopInterfaces := make([]snet.HopInterface, 0)
-
-		i := 0
-		for i < len(interfaces) {
-			var igIf, egIf common.IFIDType
-			var ia addr.IA
-
-			if i == 0 {
-				igIf = 0
-				egIf = interfaces[i].ID
-				ia = interfaces[i].IA
-				i++
-			} else if i == len(interfaces)-1 {
-				igIf = interfaces[i].ID
-				egIf = 0
-				ia = interfaces[i].IA
-				i++
-			} else {
-				if interfaces[i].IA == interfaces[i+1].IA {
-					igIf = interfaces[i].ID
-					egIf = interfaces[i+1].ID
-					ia = interfaces[i].IA
-					i += 2
-				} else {
-					igIf = interfaces[i].ID
-					egIf = 0
-					ia = interfaces[i].IA
-					i++
-				}
-			}
+	fabridConfig := &path.FabridConfig{
+		LocalIA:         localIA,
+		LocalAddr:       localAddr.IP.String(),
+		DestinationIA:   remote.IA,
+		DestinationAddr: remote.Host.IP.String(),
+	}
 
-			hopIdx := len(hopInterfaces)
-			var fabridEnabled bool
-			var policies []*fabrid.Policy
+	fabridDataplane, err := path.NewFABRIDDataplanePath(
+		scionPath,
+		match.hops,
+		match.policyIDs,
+		fabridConfig,
+		daemonConn.FabridKeys,
+	)
 
-			if hopIdx < len(metadata.FabridInfo) {
-				fabridEnabled = metadata.FabridInfo[hopIdx].Enabled
-				policies = metadata.FabridInfo[hopIdx].Policies
-			}
+	if err != nil {
+		return serrors.WrapStr("creating FABRID dataplane", err)
+	}
 
-			hopInterfaces = append(hopInterfaces, snet.HopInterface{
-				IgIf:          igIf,
-				EgIf:          egIf,
-				IA:            ia,
-				FabridEnabled: fabridEnabled,
-				Policies:      policies,
-			})
-		}
-
-		matchList := fabridquery.MatchList{
-			SelectedPolicies: make([]*fabridquery.Policy, len(hopInterfaces)),
-		}
-
-		matched, resultMatchList := fabridQuery.Evaluate(hopInterfaces, &matchList)
+	dst := remote.Copy()
+	dst.Path = fabridDataplane
+	dst.NextHop = match.path.UnderlayNextHop()
 
-		if matched {
-			candidates = append(candidates, pathCandidate{
-				path:          p,
-				matchList:     resultMatchList,
-				numHops:       len(hopInterfaces),
-				hopInterfaces: hopInterfaces,
-			})
-			log.Info("Found matching path", "num_hops", len(hopInterfaces))
-		}
+	logger.Info(fmt.Sprintf("Test ID %02d: Using FABRID path", id),
+		"policy_fulfilled", policyFulfilled, "policies", match.String())
+	if err := usePath(ctx, id, match.path); err != nil {
+		return err
 	}
 
-	var selectedPath snet.Path
-	var selectedMatchList *fabridquery.MatchList
-	var policyFulfilled bool
-
-	if len(candidates) == 0 {
-		log.Info("No paths match policy, using fallback")
-		policyFulfilled = false
-
-		for _, p := range fabridPaths {
-			metadata := p.Metadata()
-			if metadata != nil && len(metadata.FabridInfo) > 0 {
-				selectedPath = p
-				break
-			}
-		}
-
-		if selectedPath == nil {
-			selectedPath = fabridPaths[0]
-		}
-
-		metadata := selectedPath.Metadata()
-		interfaces := metadata.Interfaces
-		hopInterfaces := make([]snet.HopInterface, 0)
-
-		i := 0
-		for i < len(interfaces) {
-			var igIf, egIf common.IFIDType
-			var ia addr.IA
-
-			if i == 0 {
-				igIf = 0
-				egIf = interfaces[i].ID
-				ia = interfaces[i].IA
-				i++
-			} else if i == len(interfaces)-1 {
-				igIf = interfaces[i].ID
-				egIf = 0
-				ia = interfaces[i].IA
-				i++
-			} else {
-				if interfaces[i].IA == interfaces[i+1].IA {
-					igIf = interfaces[i].ID
-					egIf = interfaces[i+1].ID
-					ia = interfaces[i].IA
-					i += 2
-				} else {
-					igIf = interfaces[i].ID
-					egIf = 0
-					ia = interfaces[i].IA
-					i++
-				}
-			}
-
-			hopIdx := len(hopInterfaces)
-			var fabridEnabled bool
-			var policies []*fabrid.Policy
-
-			if hopIdx < len(metadata.FabridInfo) {
-				fabridEnabled = metadata.FabridInfo[hopIdx].Enabled
-				policies = metadata.FabridInfo[hopIdx].Policies
-			}
-
-			hopInterfaces = append(hopInterfaces, snet.HopInterface{
-				IgIf:          igIf,
-				EgIf:          egIf,
-				IA:            ia,
-				FabridEnabled: fabridEnabled,
-				Policies:      policies,
-			})
-		}
-
-		wildcardQuery, _ := fabridquery.ParseFabridQuery("0-0#0,0@0")
-		matchList := fabridquery.MatchList{
-			SelectedPolicies: make([]*fabridquery.Policy, len(hopInterfaces)),
-		}
-		_, resultMatchList := wildcardQuery.Evaluate(hopInterfaces, &matchList)
-		selectedMatchList = resultMatchList
-
-	} else {
-		policyFulfilled = true
-
-		minHops := candidates[0].numHops
-		for _, candidate := range candidates[1:] {
-			if candidate.numHops < minHops {
-				minHops = candidate.numHops
-			}
-		}
-
-		var shortestPaths []pathCandidate
-		for _, candidate := range candidates {
-			if candidate.numHops == minHops {
-				shortestPaths = append(shortestPaths, candidate)
-			}
-		}
-
-		log.Info("Found shortest paths", "count", len(shortestPaths), "hop_count", minHops)
-
-		if len(shortestPaths) == 1 {
-
-			selectedPath = shortestPaths[0].path
-			selectedMatchList = shortestPaths[0].matchList
-			log.Info("Selected unique shortest path")
-		} else {
-
-			selectedCandidate := shortestPaths[0]
-
-			for _, candidate := range shortestPaths[1:] {
-
-				if len(selectedCandidate.hopInterfaces) > 1 && len(candidate.hopInterfaces) > 1 {
-					hop1Selected := selectedCandidate.hopInterfaces[1]
-					hop1Candidate := candidate.hopInterfaces[1]
-
-					if hop1Candidate.IgIf < hop1Selected.IgIf {
-						selectedCandidate = candidate
-					}
-
-				}
-			}
-
-			selectedPath = selectedCandidate.path
-			selectedMatchList = selectedCandidate.matchList
-			log.Info("Selected path after comparing first hop ingress", "first_hop_ingress",
-				selectedCandidate.hopInterfaces[1].IgIf)
-		}
-	}
-
-	metadata := selectedPath.Metadata()
-	scionPath, ok := selectedPath.Dataplane().(path.SCION)
-	if !ok {
-		return serrors.New("failed to cast to path.SCION")
-	}
-
-	interfaces := metadata.Interfaces
-	hopInterfaces := make([]snet.HopInterface, 0)
-
-	i := 0
-	for i < len(interfaces) {
-		var igIf, egIf common.IFIDType
-		var ia addr.IA
-
-		if i == 0 {
-			igIf = 0
-			egIf = interfaces[i].ID
-			ia = interfaces[i].IA
-			i++
-		} else if i == len(interfaces)-1 {
-			igIf = interfaces[i].ID
-			egIf = 0
-			ia = interfaces[i].IA
-			i++
-		} else {
-			if interfaces[i].IA == interfaces[i+1].IA {
-				igIf = interfaces[i].ID
-				egIf = interfaces[i+1].ID
-				ia = interfaces[i].IA
-				i += 2
-			} else {
-				igIf = interfaces[i].ID
-				egIf = 0
-				ia = interfaces[i].IA
-				i++
-			}
-		}
-
-		hopIdx := len(hopInterfaces)
-		var fabridEnabled bool
-		var policies []*fabrid.Policy
-
-		if hopIdx < len(metadata.FabridInfo) {
-			fabridEnabled = metadata.FabridInfo[hopIdx].Enabled
-			policies = metadata.FabridInfo[hopIdx].Policies
-		}
-
-		hopInterfaces = append(hopInterfaces, snet.HopInterface{
-			IgIf:          igIf,
-			EgIf:          egIf,
-			IA:            ia,
-			FabridEnabled: fabridEnabled,
-			Policies:      policies,
-		})
-	}
-
-	policyIDs := selectedMatchList.Policies()
-
-	fabridConfig := &path.FabridConfig{
-		LocalIA:         localIA,
-		LocalAddr:       localAddr.IP.String(),
-		DestinationIA:   remote.IA,
-		DestinationAddr: remote.Host.IP.String(),
-	}
-
-	fabridDataplane, err := path.NewFABRIDDataplanePath(
-		scionPath,
-		hopInterfaces,
-		policyIDs,
-		fabridConfig,
-		daemonConn.FabridKeys,
-	)
-
+	conn, err := network.Dial(ctx, "udp", localAddr, dst)
 	if err != nil {
-		return serrors.WrapStr("creating FABRID dataplane", err)
-	}
-
-	remote.Path = fabridDataplane
-	remote.NextHop = selectedPath.UnderlayNextHop()
-
-	log.Info("Test ID 31: Using FABRID path", "policy_fulfilled", policyFulfilled)
-
-	conn, err := network.Dial(ctx, "udp", localAddr, &remote)
-	if err != nil {
-		return serrors.WrapStr("dialing for test 31", err)
+		return serrors.WrapStr(fmt.Sprintf("dialing for test %d", id), err)
 	}
 	defer conn.Close()
 
 	request := Request{
-		ID:      31,
+		ID:      id,
 		Payload: policyFulfilled,
 	}
 
 	requestBytes, err := json.Marshal(request)
 	if err != nil {
-		return serrors.WrapStr("marshaling test 31 request", err)
+		return serrors.WrapStr(fmt.Sprintf("marshaling test %d request", id), err)
 	}
 
-	log.Info("Test ID 31: Sending request", "payload", string(requestBytes))
+	logger.Info(fmt.Sprintf("Test ID %02d: Sending request", id), "payload", string(requestBytes))
 
 	_, err = conn.Write(requestBytes)
 	if err != nil {
-		return serrors.WrapStr("writing test 31 packet", err)
+		return serrors.WrapStr(fmt.Sprintf("writing test %d packet", id), err)
 	}
 
 	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
 	buffer := make([]byte, 16000)
 	n, err := conn.Read(buffer)
 	if err != nil {
-		return serrors.WrapStr("reading test 31 response", err)
+		return serrors.WrapStr(fmt.Sprintf("reading test %d response", id), err)
 	}
 
 	var response Response
 	err = json.Unmarshal(buffer[:n], &response)
 	if err != nil {
-		return serrors.WrapStr("unmarshaling test 31 response", err)
+		return serrors.WrapStr(fmt.Sprintf("unmarshaling test %d response", id), err)
 	}
 
-	log.Info("Test ID 31 result", "id", response.ID, "state", response.State)
+	logger.Info(fmt.Sprintf("Test ID %02d result", id), "id", response.ID, "state", response.State)
+	currentRun.recordState(id, response.State)
 
 	if response.State != "TestPassed" {
-		return serrors.New("test 31 did not pass", "state", response.State)
+		return serrors.New(fmt.Sprintf("test %d did not pass", id), "state", response.State)
 	}
 
 	return nil
 }
-func sendTest32(daemonConn daemon.Connector, network *snet.SCIONNetwork, localAddr *net.UDPAddr, localIA addr.IA) error {
-	ctx := context.Background()
-
-	log.Info("Test ID 32: FABRID ISD-specific policies")
-
-	fabridPaths, err := daemonConn.Paths(ctx, remote.IA, localIA, daemon.PathReqFlags{
-		FetchFabridDetachedMaps: true,
-	})
-	if err != nil {
-		return serrors.WrapStr("querying FABRID paths", err)
-	}
-
-	if len(fabridPaths) == 0 {
-		return serrors.New("no paths available")
-	}
-
-	log.Info("Test ID 32: Found paths", "count", len(fabridPaths))
-
-	// ISD 1: manufacturer A (L1000), ISD 2: manufacturer B or C (L1001 or L1002)
-	fabridQuery, err := fabridquery.ParseFabridQuery(
-		"{1-0#0,0@0 ? 1-0#0,0@L1000 + 1-0#0,0@REJECT : 1-0#0,0@0} + " +
-			"{2-0#0,0@0 ? 2-0#0,0@L1001 + 2-0#0,0@L1002 + 2-0#0,0@REJECT : 2-0#0,0@0}",
-	)
+func sendTest40(ctx context.Context, daemonConn daemon.Connector, network *snet.SCIONNetwork, localAddr *net.UDPAddr, localIA addr.IA) error {
+	logger := log.FromCtx(ctx)
 
-	if err != nil {
-		return serrors.WrapStr("parsing FABRID query", err)
-	}
-
-	type pathCandidate struct {
-		path          snet.Path
-		matchList     *fabridquery.MatchList
-		numHops       int
-		hopInterfaces []snet.HopInterface
-	}
-
-	var candidates []pathCandidate
-
-	for _, p := range fabridPaths {
-		metadata := p.Metadata()
-		if metadata == nil || len(metadata.FabridInfo) == 0 {
-			continue
-		}
-
-		interfaces := metadata.Interfaces
-		hopInterfaces := make([]snet.HopInterface, 0)
-
-		i := 0
-		for i < len(interfaces) {
-			var igIf, egIf common.IFIDType
-			var ia addr.IA
-
-			if i == 0 {
-				igIf = 0
-				egIf = interfaces[i].ID
-				ia = interfaces[i].IA
-				i++
-			} else if i == len(interfaces)-1 {
-				igIf = interfaces[i].ID
-				egIf = 0
-				ia = interfaces[i].IA
-				i++
-			} else {
-				if interfaces[i].IA == interfaces[i+1].IA {
-					igIf = interfaces[i].ID
-					egIf = interfaces[i+1].ID
-					ia = interfaces[i].IA
-					i += 2
-				} else {
-					igIf = interfaces[i].ID
-					egIf = 0
-					ia = interfaces[i].IA
-					i++
-				}
-			}
-
-			hopIdx := len(hopInterfaces)
-			var fabridEnabled bool
-			var policies []*fabrid.Policy
-
-			if hopIdx < len(metadata.FabridInfo) {
-				fabridEnabled = metadata.FabridInfo[hopIdx].Enabled
-				policies = metadata.FabridInfo[hopIdx].Policies
-			}
-
-			hopInterfaces = append(hopInterfaces, snet.HopInterface{
-				IgIf:          igIf,
-				EgIf:          egIf,
-				IA:            ia,
-				FabridEnabled: fabridEnabled,
-				Policies:      policies,
-			})
-		}
-
-		matchList := fabridquery.MatchList{
-			SelectedPolicies: make([]*fabridquery.Policy, len(hopInterfaces)),
-		}
-
-		matched, resultMatchList := fabridQuery.Evaluate(hopInterfaces, &matchList)
-		if matched {
-			policyInfo := make([]string, len(resultMatchList.SelectedPolicies))
-			for j, selectedPolicy := range resultMatchList.SelectedPolicies {
-				if selectedPolicy != nil {
-					policyInfo[j] = fmt.Sprintf("Hop%d:%v", j, selectedPolicy)
-				} else {
-					policyInfo[j] = fmt.Sprintf("Hop%d:nil", j)
-				}
-			}
-			log.Info("Path policies", "policies", policyInfo)
-			candidates = append(candidates, pathCandidate{
-				path:          p,
-				matchList:     resultMatchList,
-				numHops:       len(hopInterfaces),
-				hopInterfaces: hopInterfaces,
-			})
-			log.Info("Found matching path", "num_hops", len(hopInterfaces))
-		}
-	}
-
-	var selectedPath snet.Path
-	var selectedMatchList *fabridquery.MatchList
-	var policyFulfilled bool
-
-	if len(candidates) == 0 {
-		log.Info("No paths match policy, using fallback")
-		policyFulfilled = false
-
-		for _, p := range fabridPaths {
-			metadata := p.Metadata()
-			if metadata != nil && len(metadata.FabridInfo) > 0 {
-				selectedPath = p
-				break
-			}
-		}
-
-		if selectedPath == nil {
-			selectedPath = fabridPaths[0]
-		}
-
-		metadata := selectedPath.Metadata()
-		interfaces := metadata.Interfaces
-		hopInterfaces := make([]snet.HopInterface, 0)
-
-		i := 0
-		for i < len(interfaces) {
-			var igIf, egIf common.IFIDType
-			var ia addr.IA
-
-			if i == 0 {
-				igIf = 0
-				egIf = interfaces[i].ID
-				ia = interfaces[i].IA
-				i++
-			} else if i == len(interfaces)-1 {
-				igIf = interfaces[i].ID
-				egIf = 0
-				ia = interfaces[i].IA
-				i++
-			} else {
-				if interfaces[i].IA == interfaces[i+1].IA {
-					igIf = interfaces[i].ID
-					egIf = interfaces[i+1].ID
-					ia = interfaces[i].IA
-					i += 2
-				} else {
-					igIf = interfaces[i].ID
-					egIf = 0
-					ia = interfaces[i].IA
-					i++
-				}
-			}
-
-			hopIdx := len(hopInterfaces)
-			var fabridEnabled bool
-			var policies []*fabrid.Policy
-
-			if hopIdx < len(metadata.FabridInfo) {
-				fabridEnabled = metadata.FabridInfo[hopIdx].Enabled
-				policies = metadata.FabridInfo[hopIdx].Policies
-			}
-
-			hopInterfaces = append(hopInterfaces, snet.HopInterface{
-				IgIf:          igIf,
-				EgIf:          egIf,
-				IA:            ia,
-				FabridEnabled: fabridEnabled,
-				Policies:      policies,
-			})
-		}
-
-		wildcardQuery, _ := fabridquery.ParseFabridQuery("0-0#0,0@0")
-		matchList := fabridquery.MatchList{
-			SelectedPolicies: make([]*fabridquery.Policy, len(hopInterfaces)),
-		}
-		_, resultMatchList := wildcardQuery.Evaluate(hopInterfaces, &matchList)
-		selectedMatchList = resultMatchList
-
-	} else {
-		policyFulfilled = true
-
-		// Find minimum hop count
-		minHops := candidates[0].numHops
-		for _, candidate := range candidates[1:] {
-			if candidate.numHops < minHops {
-				minHops = candidate.numHops
-			}
-		}
-
-		// Filter to only shortest paths
-		var shortestPaths []pathCandidate
-		for _, candidate := range candidates {
-			if candidate.numHops == minHops {
-				shortestPaths = append(shortestPaths, candidate)
-			}
-		}
-
-		log.Info("Found shortest paths", "count", len(shortestPaths), "hop_count", minHops)
-
-		if len(shortestPaths) == 1 {
-			selectedPath = shortestPaths[0].path
-			selectedMatchList = shortestPaths[0].matchList
-			log.Info("Selected unique shortest path")
-		} else {
-
-			selectedCandidate := shortestPaths[0]
-
-			for _, candidate := range shortestPaths[1:] {
-				if len(selectedCandidate.hopInterfaces) > 1 && len(candidate.hopInterfaces) > 1 {
-					hop1Selected := selectedCandidate.hopInterfaces[1]
-					hop1Candidate := candidate.hopInterfaces[1]
-
-					if hop1Candidate.IgIf < hop1Selected.IgIf {
-						selectedCandidate = candidate
-					}
-				}
-			}
-
-			selectedPath = selectedCandidate.path
-			selectedMatchList = selectedCandidate.matchList
-			log.Info("Selected path after comparing first hop ingress",
-				"first_hop_ingress", selectedCandidate.hopInterfaces[1].IgIf)
-		}
-	}
-
-	metadata := selectedPath.Metadata()
-	scionPath, ok := selectedPath.Dataplane().(path.SCION)
-	if !ok {
-		return serrors.New("failed to cast to path.SCION")
-	}
-
-	interfaces := metadata.Interfaces
-	hopInterfaces := make([]snet.HopInterface, 0)
-
-	i := 0
-	for i < len(interfaces) {
-		var igIf, egIf common.IFIDType
-		var ia addr.IA
-
-		if i == 0 {
-			igIf = 0
-			egIf = interfaces[i].ID
-			ia = interfaces[i].IA
-			i++
-		} else if i == len(interfaces)-1 {
-			igIf = interfaces[i].ID
-			egIf = 0
-			ia = interfaces[i].IA
-			i++
-		} else {
-			if interfaces[i].IA == interfaces[i+1].IA {
-				igIf = interfaces[i].ID
-				egIf = interfaces[i+1].ID
-				ia = interfaces[i].IA
-				i += 2
-			} else {
-				igIf = interfaces[i].ID
-				egIf = 0
-				ia = interfaces[i].IA
-				i++
-			}
-		}
-
-		hopIdx := len(hopInterfaces)
-		var fabridEnabled bool
-		var policies []*fabrid.Policy
-
-		if hopIdx < len(metadata.FabridInfo) {
-			fabridEnabled = metadata.FabridInfo[hopIdx].Enabled
-			policies = metadata.FabridInfo[hopIdx].Policies
-		}
-
-		hopInterfaces = append(hopInterfaces, snet.HopInterface{
-			IgIf:          igIf,
-			EgIf:          egIf,
-			IA:            ia,
-			FabridEnabled: fabridEnabled,
-			Policies:      policies,
-		})
-	}
-
-	policyIDs := selectedMatchList.Policies()
-
-	fabridConfig := &path.FabridConfig{
-		LocalIA:         localIA,
-		LocalAddr:       localAddr.IP.String(),
-		DestinationIA:   remote.IA,
-		DestinationAddr: remote.Host.IP.String(),
-	}
-
-	fabridDataplane, err := path.NewFABRIDDataplanePath(
-		scionPath,
-		hopInterfaces,
-		policyIDs,
-		fabridConfig,
-		daemonConn.FabridKeys,
-	)
-
-	if err != nil {
-		return serrors.WrapStr("creating FABRID dataplane", err)
-	}
-
-	remote.Path = fabridDataplane
-	remote.NextHop = selectedPath.UnderlayNextHop()
-
-	log.Info("Test ID 32: Using FABRID path", "policy_fulfilled", policyFulfilled)
-
-	conn, err := network.Dial(ctx, "udp", localAddr, &remote)
-	if err != nil {
-		return serrors.WrapStr("dialing for test 32", err)
-	}
-	defer conn.Close()
-
-	request := Request{
-		ID:      32,
-		Payload: policyFulfilled,
-	}
-
-	requestBytes, err := json.Marshal(request)
-	if err != nil {
-		return serrors.WrapStr("marshaling test 32 request", err)
-	}
-
-	log.Info("Test ID 32: Sending request", "payload", string(requestBytes))
-
-	_, err = conn.Write(requestBytes)
-	if err != nil {
-		return serrors.WrapStr("writing test 32 packet", err)
-	}
-
-	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
-	buffer := make([]byte, 16000)
-	n, err := conn.Read(buffer)
-	if err != nil {
-		return serrors.WrapStr("reading test 32 response", err)
-	}
-
-	var response Response
-	err = json.Unmarshal(buffer[:n], &response)
-	if err != nil {
-		return serrors.WrapStr("unmarshaling test 32 response", err)
-	}
-
-	log.Info("Test ID 32 result", "id", response.ID, "state", response.State)
-
-	if response.State != "TestPassed" {
-		return serrors.New("test 32 did not pass", "state", response.State)
-	}
-
-	return nil
-}
-func sendTest33(daemonConn daemon.Connector, network *snet.SCIONNetwork, localAddr *net.UDPAddr, localIA addr.IA) error {
-	ctx := context.Background()
-
-	log.Info("Test ID 33: FABRID Remote Attestation")
-
-	fabridPaths, err := daemonConn.Paths(ctx, remote.IA, localIA, daemon.PathReqFlags{
-		FetchFabridDetachedMaps: true,
-	})
-	if err != nil {
-		return serrors.WrapStr("querying FABRID paths", err)
-	}
-
-	if len(fabridPaths) == 0 {
-		return serrors.New("no paths available")
-	}
-
-	log.Info("Test ID 33: Found paths", "count", len(fabridPaths))
-
-	fabridQuery, err := fabridquery.ParseFabridQuery("0-0#0,0@L2000#0-0#0,0@L1002#0-0#0,0@REJECT")
-	if err != nil {
-		return serrors.WrapStr("parsing FABRID query", err)
-	}
-
-	type pathCandidate struct {
-		path          snet.Path
-		matchList     *fabridquery.MatchList
-		numHops       int
-		hopInterfaces []snet.HopInterface
-	}
-
-	var candidates []pathCandidate
-
-	for _, p := range fabridPaths {
-		metadata := p.Metadata()
-		if metadata == nil || len(metadata.FabridInfo) == 0 {
-			continue
-		}
-
-		interfaces := metadata.Interfaces
-		hopInterfaces := make([]snet.HopInterface, 0)
-
-		i := 0
-		for i < len(interfaces) {
-			var igIf, egIf common.IFIDType
-			var ia addr.IA
-
-			if i == 0 {
-				igIf = 0
-				egIf = interfaces[i].ID
-				ia = interfaces[i].IA
-				i++
-			} else if i == len(interfaces)-1 {
-				igIf = interfaces[i].ID
-				egIf = 0
-				ia = interfaces[i].IA
-				i++
-			} else {
-				if interfaces[i].IA == interfaces[i+1].IA {
-					igIf = interfaces[i].ID
-					egIf = interfaces[i+1].ID
-					ia = interfaces[i].IA
-					i += 2
-				} else {
-					igIf = interfaces[i].ID
-					egIf = 0
-					ia = interfaces[i].IA
-					i++
-				}
-			}
-
-			hopIdx := len(hopInterfaces)
-			var fabridEnabled bool
-			var policies []*fabrid.Policy
-
-			if hopIdx < len(metadata.FabridInfo) {
-				fabridEnabled = metadata.FabridInfo[hopIdx].Enabled
-				policies = metadata.FabridInfo[hopIdx].Policies
-			}
-
-			hopInterfaces = append(hopInterfaces, snet.HopInterface{
-				IgIf:          igIf,
-				EgIf:          egIf,
-				IA:            ia,
-				FabridEnabled: fabridEnabled,
-				Policies:      policies,
-			})
-		}
-
-		matchList := fabridquery.MatchList{
-			SelectedPolicies: make([]*fabridquery.Policy, len(hopInterfaces)),
-		}
-
-		matched, resultMatchList := fabridQuery.Evaluate(hopInterfaces, &matchList)
-
-		if matched {
-
-			lastHopIdx := len(hopInterfaces) - 2
-			if lastHopIdx >= 1 {
-				lastHopValid := false
-
-				if lastHopIdx < len(resultMatchList.SelectedPolicies) {
-					policy := resultMatchList.SelectedPolicies[lastHopIdx]
-					if policy != nil && fmt.Sprintf("%v", policy) == "L2000" {
-						lastHopValid = true
-					}
-				}
-
-				if !lastHopValid {
-					log.Info("Path rejected - last hop lacks L2000", "num_hops", len(hopInterfaces))
-					continue
-				}
-			}
-
-			candidates = append(candidates, pathCandidate{
-				path:          p,
-				matchList:     resultMatchList,
-				numHops:       len(hopInterfaces),
-				hopInterfaces: hopInterfaces,
-			})
-			log.Info("Found matching path", "num_hops", len(hopInterfaces))
-		}
-	}
-
-	var selectedPath snet.Path
-	var selectedMatchList *fabridquery.MatchList
-	var policyFulfilled bool
-
-	if len(candidates) == 0 {
-		log.Info("No paths match policy, using fallback")
-		policyFulfilled = false
-
-		for _, p := range fabridPaths {
-			metadata := p.Metadata()
-			if metadata != nil && len(metadata.FabridInfo) > 0 {
-				selectedPath = p
-				break
-			}
-		}
-
-		if selectedPath == nil {
-			selectedPath = fabridPaths[0]
-		}
-
-		metadata := selectedPath.Metadata()
-		interfaces := metadata.Interfaces
-		hopInterfaces := make([]snet.HopInterface, 0)
-
-		i := 0
-		for i < len(interfaces) {
-			var igIf, egIf common.IFIDType
-			var ia addr.IA
-
-			if i == 0 {
-				igIf = 0
-				egIf = interfaces[i].ID
-				ia = interfaces[i].IA
-				i++
-			} else if i == len(interfaces)-1 {
-				igIf = interfaces[i].ID
-				egIf = 0
-				ia = interfaces[i].IA
-				i++
-			} else {
-				if interfaces[i].IA == interfaces[i+1].IA {
-					igIf = interfaces[i].ID
-					egIf = interfaces[i+1].ID
-					ia = interfaces[i].IA
-					i += 2
-				} else {
-					igIf = interfaces[i].ID
-					egIf = 0
-					ia = interfaces[i].IA
-					i++
-				}
-			}
-
-			hopIdx := len(hopInterfaces)
-			var fabridEnabled bool
-			var policies []*fabrid.Policy
-
-			if hopIdx < len(metadata.FabridInfo) {
-				fabridEnabled = metadata.FabridInfo[hopIdx].Enabled
-				policies = metadata.FabridInfo[hopIdx].Policies
-			}
-
-			hopInterfaces = append(hopInterfaces, snet.HopInterface{
-				IgIf:          igIf,
-				EgIf:          egIf,
-				IA:            ia,
-				FabridEnabled: fabridEnabled,
-				Policies:      policies,
-			})
-		}
-
-		wildcardQuery, _ := fabridquery.ParseFabridQuery("0-0#0,0@0")
-		matchList := fabridquery.MatchList{
-			SelectedPolicies: make([]*fabridquery.Policy, len(hopInterfaces)),
-		}
-		_, resultMatchList := wildcardQuery.Evaluate(hopInterfaces, &matchList)
-		selectedMatchList = resultMatchList
-
-	} else {
-		policyFulfilled = true
-
-		minHops := candidates[0].numHops
-		for _, candidate := range candidates[1:] {
-			if candidate.numHops < minHops {
-				minHops = candidate.numHops
-			}
-		}
-
-		var shortestPaths []pathCandidate
-		for _, candidate := range candidates {
-			if candidate.numHops == minHops {
-				shortestPaths = append(shortestPaths, candidate)
-			}
-		}
-
-		log.Info("Found shortest paths", "count", len(shortestPaths), "hop_count", minHops)
-
-		if len(shortestPaths) == 1 {
-			selectedPath = shortestPaths[0].path
-			selectedMatchList = shortestPaths[0].matchList
-			log.Info("Selected unique shortest path")
-		} else {
-
-			selectedCandidate := shortestPaths[0]
-
-			for _, candidate := range shortestPaths[1:] {
-				if len(selectedCandidate.hopInterfaces) > 1 && len(candidate.hopInterfaces) > 1 {
-					hop1Selected := selectedCandidate.hopInterfaces[1]
-					hop1Candidate := candidate.hopInterfaces[1]
-
-					if hop1Candidate.IgIf < hop1Selected.IgIf {
-						selectedCandidate = candidate
-					}
-				}
-			}
-
-			selectedPath = selectedCandidate.path
-			selectedMatchList = selectedCandidate.matchList
-			log.Info("Selected path after comparing first hop ingress",
-				"first_hop_ingress", selectedCandidate.hopInterfaces[1].IgIf)
-		}
-	}
-
-	metadata := selectedPath.Metadata()
-	scionPath, ok := selectedPath.Dataplane().(path.SCION)
-	if !ok {
-		return serrors.New("failed to cast to path.SCION")
-	}
-
-	interfaces := metadata.Interfaces
-	hopInterfaces := make([]snet.HopInterface, 0)
-
-	i := 0
-	for i < len(interfaces) {
-		var igIf, egIf common.IFIDType
-		var ia addr.IA
-
-		if i == 0 {
-			igIf = 0
-			egIf = interfaces[i].ID
-			ia = interfaces[i].IA
-			i++
-		} else if i == len(interfaces)-1 {
-			igIf = interfaces[i].ID
-			egIf = 0
-			ia = interfaces[i].IA
-			i++
-		} else {
-			if interfaces[i].IA == interfaces[i+1].IA {
-				igIf = interfaces[i].ID
-				egIf = interfaces[i+1].ID
-				ia = interfaces[i].IA
-				i += 2
-			} else {
-				igIf = interfaces[i].ID
-				egIf = 0
-				ia = interfaces[i].IA
-				i++
-			}
-		}
-
-		hopIdx := len(hopInterfaces)
-		var fabridEnabled bool
-		var policies []*fabrid.Policy
-
-		if hopIdx < len(metadata.FabridInfo) {
-			fabridEnabled = metadata.FabridInfo[hopIdx].Enabled
-			policies = metadata.FabridInfo[hopIdx].Policies
-		}
-
-		hopInterfaces = append(hopInterfaces, snet.HopInterface{
-			IgIf:          igIf,
-			EgIf:          egIf,
-			IA:            ia,
-			FabridEnabled: fabridEnabled,
-			Policies:      policies,
-		})
-	}
-
-	policyIDs := selectedMatchList.Policies()
-
-	fabridConfig := &path.FabridConfig{
-		LocalIA:         localIA,
-		LocalAddr:       localAddr.IP.String(),
-		DestinationIA:   remote.IA,
-		DestinationAddr: remote.Host.IP.String(),
-	}
-
-	fabridDataplane, err := path.NewFABRIDDataplanePath(
-		scionPath,
-		hopInterfaces,
-		policyIDs,
-		fabridConfig,
-		daemonConn.FabridKeys,
-	)
-
-	if err != nil {
-		return serrors.WrapStr("creating FABRID dataplane", err)
-	}
-
-	remote.Path = fabridDataplane
-	remote.NextHop = selectedPath.UnderlayNextHop()
-
-	log.Info("Test ID 33: Using FABRID path", "policy_fulfilled", policyFulfilled)
-
-	conn, err := network.Dial(ctx, "udp", localAddr, &remote)
-	if err != nil {
-		return serrors.WrapStr("dialing for test 33", err)
-	}
-	defer conn.Close()
-
-	request := Request{
-		ID:      33,
-		Payload: policyFulfilled,
-	}
-
-	requestBytes, err := json.Marshal(request)
-	if err != nil {
-		return serrors.WrapStr("marshaling test 33 request", err)
-	}
-
-	log.Info("Test ID 33: Sending request", "payload", string(requestBytes))
-
-	_, err = conn.Write(requestBytes)
-	if err != nil {
-		return serrors.WrapStr("writing test 33 packet", err)
-	}
-
-	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
-	buffer := make([]byte, 16000)
-	n, err := conn.Read(buffer)
-	if err != nil {
-		return serrors.WrapStr("reading test 33 response", err)
-	}
-
-	var response Response
-	err = json.Unmarshal(buffer[:n], &response)
-	if err != nil {
-		return serrors.WrapStr("unmarshaling test 33 response", err)
-	}
-
-	log.Info("Test ID 33 result", "id", response.ID, "state", response.State)
-
-	if response.State != "TestPassed" {
-		return serrors.New("test 33 did not pass", "state", response.State)
-	}
-
-	return nil
-}
-func sendTest40(daemonConn daemon.Connector, network *snet.SCIONNetwork, localAddr *net.UDPAddr, localIA addr.IA) error {
-	ctx := context.Background()
-
-	log.Info("Test ID 40: AS Finder Test")
+	logger.Info("Test ID 40: AS Finder Test")
 
 	paths, err := daemonConn.Paths(ctx, remote.IA, localIA, daemon.PathReqFlags{})
 	if err != nil {
@@ -2340,11 +1358,20 @@ func sendTest40(daemonConn daemon.Connector, network *snet.SCIONNetwork, localAd
 		return serrors.New("no paths available")
 	}
 
+	paths, _, err = pinPaths(ctx, 40, paths)
+	if err != nil {
+		return err
+	}
 	selectedPath := paths[0]
-	remote.Path = selectedPath.Dataplane()
-	remote.NextHop = selectedPath.UnderlayNextHop()
+	logger.Info("Test ID 40: Using path", pathFields(selectedPath)...)
+	dst := remote.Copy()
+	dst.Path = selectedPath.Dataplane()
+	dst.NextHop = selectedPath.UnderlayNextHop()
+	if err := usePath(ctx, 40, selectedPath); err != nil {
+		return err
+	}
 
-	conn, err := network.Dial(ctx, "udp", localAddr, &remote)
+	conn, err := network.Dial(ctx, "udp", localAddr, dst)
 	if err != nil {
 		return serrors.WrapStr("dialing for test 40", err)
 	}
@@ -2360,7 +1387,7 @@ func sendTest40(daemonConn daemon.Connector, network *snet.SCIONNetwork, localAd
 		return serrors.WrapStr("marshaling initial request", err)
 	}
 
-	log.Info("Test ID 40: Sending initial request")
+	logger.Info("Test ID 40: Sending initial request")
 
 	_, err = conn.Write(requestBytes)
 	if err != nil {
@@ -2369,7 +1396,7 @@ func sendTest40(daemonConn daemon.Connector, network *snet.SCIONNetwork, localAd
 
 	maxIterations := 10
 	for iteration := 0; iteration < maxIterations; iteration++ {
-		log.Info("Test ID 40: Waiting for response", "iteration", iteration)
+		logger.Info("Test ID 40: Waiting for response", "iteration", iteration)
 
 		conn.SetReadDeadline(time.Now().Add(5 * time.Second))
 		buffer := make([]byte, 16000)
@@ -2385,10 +1412,11 @@ func sendTest40(daemonConn daemon.Connector, network *snet.SCIONNetwork, localAd
 			return serrors.WrapStr("unmarshaling response", err)
 		}
 
-		log.Info("Test ID 40: Received response", "state", response.State)
+		logger.Info("Test ID 40: Received response", "state", response.State)
+		currentRun.recordState(40, response.State)
 
 		if response.State == "TestPassed" {
-			log.Info("Test ID 40: Test passed")
+			logger.Info("Test ID 40: Test passed")
 			return nil
 		}
 
@@ -2401,7 +1429,7 @@ func sendTest40(daemonConn daemon.Connector, network *snet.SCIONNetwork, localAd
 			return serrors.WrapStr("extracting AS list", err)
 		}
 
-		log.Info("Test ID 40: Extracted AS list", "ases", asList)
+		logger.Info("Test ID 40: Extracted AS list", "ases", asList)
 
 		replyRequest := struct {
 			ID      int      `json:"ID"`
@@ -2416,7 +1444,7 @@ func sendTest40(daemonConn daemon.Connector, network *snet.SCIONNetwork, localAd
 			return serrors.WrapStr("marshaling reply", err)
 		}
 
-		log.Info("Test ID 40: Sending AS list reply", "list", asList)
+		logger.Info("Test ID 40: Sending AS list reply", "list", asList)
 
 		_, err = conn.Write(replyBytes)
 		if err != nil {
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/scionproto/scion/pkg/log"
+	"golang.org/x/sync/errgroup"
+)
+
+// The maximum number of independent tests that run at the same time. Values
+// below 2 run the tests one after another.
+var parallelTests = flag.Int("parallel", 1,
+	"The number of independent tests (10, 11, 20, 30-33) to run concurrently")
+
+// suiteTest is a test that can be scheduled independently of the others.
+type suiteTest struct {
+	ID  int
+	Run func(ctx context.Context) error
+}
+
+// runIndependentTests runs the given tests with at most limit of them in
+// flight. In parallel mode every test logs into its own buffer, which is
+// written out in one piece once the test finished, so that the log output
+// stays grouped per test.
+func runIndependentTests(ctx context.Context, tests []suiteTest, limit int) {
+	if limit < 2 {
+		for _, t := range tests {
+			runSuiteTest(ctx, t)
+		}
+		return
+	}
+
+	log.Info("Running independent tests concurrently", "tests", len(tests), "limit", limit)
+	start := time.Now()
+
+	var g errgroup.Group
+	g.SetLimit(limit)
+	for _, t := range tests {
+		t := t
+		g.Go(func() error {
+			buffer := newBufferedLogger()
+			runSuiteTest(log.CtxWith(ctx, buffer), t)
+			buffer.flush()
+			return nil
+		})
+	}
+	// Failures are reported per test, the group itself never fails.
+	_ = g.Wait()
+
+	log.Info("Independent tests finished", "duration", time.Since(start))
+}
+
+func runSuiteTest(ctx context.Context, t suiteTest) {
+	logger := log.FromCtx(ctx)
+
+	logger.Info(fmt.Sprintf("Starting Test ID %02d", t.ID))
+	if err := t.Run(ctx); err != nil {
+		logger.Error(fmt.Sprintf("Test ID %02d failed", t.ID), "err", err)
+		currentRun.recordError(t.ID, err)
+	}
+}
+
+// flushMu serializes the flushing of buffered loggers so that the entries of
+// different tests never interleave.
+var flushMu sync.Mutex
+
+type logEntry struct {
+	level log.Level
+	msg   string
+	ctx   []interface{}
+}
+
+// bufferedLogger is a log.Logger that keeps all entries in memory until flush
+// is called.
+type bufferedLogger struct {
+	mu      *sync.Mutex
+	entries *[]logEntry
+	fields  []interface{}
+}
+
+func newBufferedLogger() *bufferedLogger {
+	return &bufferedLogger{
+		mu:      &sync.Mutex{},
+		entries: &[]logEntry{},
+	}
+}
+
+func (b *bufferedLogger) New(ctx ...interface{}) log.Logger {
+	fields := append(append([]interface{}{}, b.fields...), ctx...)
+	return &bufferedLogger{mu: b.mu, entries: b.entries, fields: fields}
+}
+
+func (b *bufferedLogger) Debug(msg string, ctx ...interface{}) {
+	b.add(log.DebugLevel, msg, ctx)
+}
+
+func (b *bufferedLogger) Info(msg string, ctx ...interface{}) {
+	b.add(log.InfoLevel, msg, ctx)
+}
+
+func (b *bufferedLogger) Error(msg string, ctx ...interface{}) {
+	b.add(log.ErrorLevel, msg, ctx)
+}
+
+func (b *bufferedLogger) Enabled(lvl log.Level) bool {
+	return log.Root().Enabled(lvl)
+}
+
+func (b *bufferedLogger) add(lvl log.Level, msg string, ctx []interface{}) {
+	if !b.Enabled(lvl) {
+		return
+	}
+	fields := append(append([]interface{}{}, b.fields...), ctx...)
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	*b.entries = append(*b.entries, logEntry{level: lvl, msg: msg, ctx: fields})
+}
+
+// flush writes all buffered entries to the root logger and clears the buffer.
+func (b *bufferedLogger) flush() {
+	b.mu.Lock()
+	entries := *b.entries
+	*b.entries = nil
+	b.mu.Unlock()
+
+	flushMu.Lock()
+	defer flushMu.Unlock()
+	for _, e := range entries {
+		switch e.level {
+		case log.DebugLevel:
+			log.Debug(e.msg, e.ctx...)
+		case log.ErrorLevel:
+			log.Error(e.msg, e.ctx...)
+		default:
+			log.Info(e.msg, e.ctx...)
+		}
+	}
+}
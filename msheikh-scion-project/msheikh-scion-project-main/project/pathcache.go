@@ -0,0 +1,200 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/scionproto/scion/pkg/addr"
+	"github.com/scionproto/scion/pkg/daemon"
+	"github.com/scionproto/scion/pkg/log"
+	"github.com/scionproto/scion/pkg/snet"
+	"golang.org/x/sync/singleflight"
+)
+
+// pathExpiryMargin is subtracted from the expiry of the cached paths so that
+// no path is handed out shortly before it becomes invalid.
+const pathExpiryMargin = 10 * time.Second
+
+// pathFetchTimeout bounds a daemon query. The query is shared by all callers
+// waiting for the same paths, so it does not end with the context of the
+// caller that started it.
+const pathFetchTimeout = 10 * time.Second
+
+// pathQueryKey identifies a path query. The Refresh flag is not part of the
+// key, it only forces the cached entry to be replaced.
+type pathQueryKey struct {
+	dst   addr.IA
+	src   addr.IA
+	flags daemon.PathReqFlags
+}
+
+func (k pathQueryKey) String() string {
+	return fmt.Sprintf("%s>%s hidden=%t fabrid=%t",
+		k.src, k.dst, k.flags.Hidden, k.flags.FetchFabridDetachedMaps)
+}
+
+// pathCacheEntry holds the filtered paths of a query, or the error filtering
+// them failed with.
+type pathCacheEntry struct {
+	paths  []snet.Path
+	err    error
+	expiry time.Time
+}
+
+// result returns a copy of the cached paths that the caller may reorder.
+func (e pathCacheEntry) result() ([]snet.Path, error) {
+	if e.err != nil {
+		return nil, e.err
+	}
+	return append([]snet.Path(nil), e.paths...), nil
+}
+
+// pathCache is a daemon.Connector that caches the result of path queries until
+// the first of the returned paths expires. Concurrent identical queries are
+// collapsed into a single request to the daemon.
+type pathCache struct {
+	daemon.Connector
+
+	mu      sync.Mutex
+	entries map[pathQueryKey]pathCacheEntry
+	group   singleflight.Group
+
+	hits   atomic.Int64
+	misses atomic.Int64
+	shared atomic.Int64
+}
+
+func newPathCache(conn daemon.Connector) *pathCache {
+	return &pathCache{
+		Connector: conn,
+		entries:   make(map[pathQueryKey]pathCacheEntry),
+	}
+}
+
+// Paths returns the cached paths for the query if they are still valid and
+// queries the daemon otherwise. Setting f.Refresh bypasses the cache. Only the
+// paths that satisfy the --path-policy, the sovereignty constraints, the
+// geofence and the --link-types policy are returned. They are filtered once per
+// daemon query and cached filtered. A caller whose context ends stops waiting,
+// but the query continues for the others.
+func (c *pathCache) Paths(ctx context.Context, dst, src addr.IA,
+	f daemon.PathReqFlags) ([]snet.Path, error) {
+
+	key := pathQueryKey{dst: dst, src: src, flags: f}
+	key.flags.Refresh = false
+
+	if !f.Refresh {
+		c.mu.Lock()
+		entry, ok := c.entries[key]
+		c.mu.Unlock()
+		if ok && time.Now().Before(entry.expiry) {
+			c.hits.Add(1)
+			log.FromCtx(ctx).Debug("Path cache hit", "query", key, "paths", len(entry.paths))
+			return entry.result()
+		}
+	}
+
+	c.misses.Add(1)
+	ch := c.group.DoChan(fmt.Sprintf("%s refresh=%t", key, f.Refresh), func() (interface{}, error) {
+		fetchCtx, cancel := context.WithTimeout(context.WithoutCancel(ctx), pathFetchTimeout)
+		defer cancel()
+		return c.fetch(fetchCtx, key, f)
+	})
+	select {
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case res := <-ch:
+		if res.Shared {
+			c.shared.Add(1)
+		}
+		if res.Err != nil {
+			return nil, res.Err
+		}
+		return res.Val.(pathCacheEntry).result()
+	}
+}
+
+// filter returns the paths that satisfy the path policy, the
+// sovereignty constraints, the geofence and the link type policy.
+func (c *pathCache) filter(ctx context.Context, key pathQueryKey,
+	paths []snet.Path) ([]snet.Path, error) {
+
+	paths = candidatePolicy.filter(ctx, key, paths)
+	paths, err := pathSovereignty.filter(ctx, key, paths)
+	if err != nil {
+		return nil, err
+	}
+	paths = pathGeofence.fence.filter(ctx, key, paths)
+	return pathLinkTypes.filter(ctx, key, paths), nil
+}
+
+// Refresh discards the cached paths for the query and fetches them again.
+func (c *pathCache) Refresh(ctx context.Context, dst, src addr.IA,
+	f daemon.PathReqFlags) ([]snet.Path, error) {
+
+	f.Refresh = true
+	return c.Paths(ctx, dst, src, f)
+}
+
+// fetch queries the daemon, filters the paths and caches the result. A
+// filter that rejects all paths is cached as well, daemon errors are not.
+func (c *pathCache) fetch(ctx context.Context, key pathQueryKey,
+	f daemon.PathReqFlags) (pathCacheEntry, error) {
+
+	paths, err := c.Connector.Paths(ctx, key.dst, key.src, f)
+	if err != nil {
+		return pathCacheEntry{}, err
+	}
+
+	entry := pathCacheEntry{expiry: earliestExpiry(paths).Add(-pathExpiryMargin)}
+	entry.paths, entry.err = c.filter(ctx, key, paths)
+	c.mu.Lock()
+	c.entries[key] = entry
+	c.mu.Unlock()
+
+	log.FromCtx(ctx).Debug("Path cache miss", "query", key, "paths", len(paths),
+		"allowed", len(entry.paths), "valid_until", entry.expiry)
+	return entry, nil
+}
+
+// earliestExpiry returns the expiry of the path that expires first. Paths
+// without metadata do not limit the validity.
+func earliestExpiry(paths []snet.Path) time.Time {
+	var expiry time.Time
+	for _, p := range paths {
+		metadata := p.Metadata()
+		if metadata == nil || metadata.Expiry.IsZero() {
+			continue
+		}
+		if expiry.IsZero() || metadata.Expiry.Before(expiry) {
+			expiry = metadata.Expiry
+		}
+	}
+	if expiry.IsZero() {
+		// Without any expiry information the result is only reused briefly.
+		return time.Now().Add(time.Minute)
+	}
+	return expiry
+}
+
+// logStats logs the hit and miss counters of the cache and of the DRKey cache
+// below it.
+func (c *pathCache) logStats() {
+	hits, misses := c.hits.Load(), c.misses.Load()
+	var hitRate float64
+	if hits+misses > 0 {
+		hitRate = float64(hits) / float64(hits+misses)
+	}
+	log.Info("Path cache statistics",
+		"hits", hits,
+		"misses", misses,
+		"shared", c.shared.Load(),
+		"hit_rate", fmt.Sprintf("%.2f", hitRate))
+
+	if keys, ok := c.Connector.(*drkeyCache); ok {
+		keys.logStats()
+	}
+}
@@ -0,0 +1,191 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/scionproto/scion/pkg/addr"
+	"github.com/scionproto/scion/pkg/daemon"
+	"github.com/scionproto/scion/pkg/snet"
+)
+
+// pathCacheTestPaths returns a path from 1-ff00:0:110 to 1-ff00:0:112 for
+// every expiry, relative to now. A zero expiry leaves it unset.
+func pathCacheTestPaths(t *testing.T, expiries ...time.Duration) []snet.Path {
+	t.Helper()
+	paths := make([]snet.Path, len(expiries))
+	for i, expiry := range expiries {
+		p := buildPaths(t, fixturePath{Interfaces: []string{"1-ff00:0:110#1",
+			"1-ff00:0:112#2"}})[0]
+		if expiry != 0 {
+			p.(*testPath).meta.Expiry = time.Now().Add(expiry)
+		}
+		paths[i] = p
+	}
+	return paths
+}
+
+// pathCacheStats returns the daemon queries, hits and misses.
+func pathCacheStats(conn *countingConnector, cache *pathCache) [3]int64 {
+	return [3]int64{int64(conn.queries), cache.hits.Load(), cache.misses.Load()}
+}
+
+func TestPathCacheExpiry(t *testing.T) {
+	tests := []struct {
+		name     string
+		expiries []time.Duration
+		// want are the daemon queries, hits and misses of two queries.
+		want [3]int64
+	}{
+		{
+			name:     "valid",
+			expiries: []time.Duration{time.Hour},
+			want:     [3]int64{1, 1, 1},
+		},
+		{
+			name:     "expires within the margin",
+			expiries: []time.Duration{pathExpiryMargin / 2},
+			want:     [3]int64{2, 0, 2},
+		},
+		{
+			name:     "earliest expiry counts",
+			expiries: []time.Duration{time.Hour, pathExpiryMargin / 2},
+			want:     [3]int64{2, 0, 2},
+		},
+		{
+			// Paths without expiry are reused for a minute.
+			name:     "no expiry",
+			expiries: []time.Duration{0},
+			want:     [3]int64{1, 1, 1},
+		},
+	}
+	src, dst := addr.MustParseIA("1-ff00:0:110"), addr.MustParseIA("1-ff00:0:112")
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			conn := &countingConnector{paths: pathCacheTestPaths(t, tc.expiries...)}
+			cache := newPathCache(conn)
+			for i := 0; i < 2; i++ {
+				got, err := cache.Paths(context.Background(), dst, src, daemon.PathReqFlags{})
+				if err != nil {
+					t.Fatal(err)
+				}
+				if len(got) != len(tc.expiries) {
+					t.Fatalf("query %d returned %d paths, want %d", i, len(got),
+						len(tc.expiries))
+				}
+			}
+			if got := pathCacheStats(conn, cache); got != tc.want {
+				t.Errorf("queries, hits, misses %v, want %v", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestPathCacheRefresh(t *testing.T) {
+	src, dst := addr.MustParseIA("1-ff00:0:110"), addr.MustParseIA("1-ff00:0:112")
+	old, fresh := pathCacheTestPaths(t, time.Hour), pathCacheTestPaths(t, time.Hour)
+	conn := &countingConnector{paths: old}
+	cache := newPathCache(conn)
+	ctx := context.Background()
+
+	if _, err := cache.Paths(ctx, dst, src, daemon.PathReqFlags{}); err != nil {
+		t.Fatal(err)
+	}
+	conn.paths = fresh
+	got, err := cache.Refresh(ctx, dst, src, daemon.PathReqFlags{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 1 || got[0] != fresh[0] {
+		t.Fatalf("refresh returned the cached paths")
+	}
+	// The refreshed paths replace the cached ones.
+	got, err = cache.Paths(ctx, dst, src, daemon.PathReqFlags{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 1 || got[0] != fresh[0] {
+		t.Errorf("query after the refresh returned the old paths")
+	}
+	if got, want := pathCacheStats(conn, cache), [3]int64{2, 1, 2}; got != want {
+		t.Errorf("queries, hits, misses %v, want %v", got, want)
+	}
+
+	// Other queries are not refreshed.
+	if _, err := cache.Paths(ctx, src, dst, daemon.PathReqFlags{}); err != nil {
+		t.Fatal(err)
+	}
+	if conn.queries != 3 {
+		t.Errorf("daemon queried %d times, want 3", conn.queries)
+	}
+}
+
+// blockingConnector returns its paths once released and records the context
+// of the query.
+type blockingConnector struct {
+	daemon.Connector
+	paths   []snet.Path
+	started chan struct{}
+	release chan struct{}
+
+	mu       sync.Mutex
+	queries  int
+	err      error
+	deadline bool
+}
+
+func (c *blockingConnector) Paths(ctx context.Context, _, _ addr.IA,
+	_ daemon.PathReqFlags) ([]snet.Path, error) {
+
+	c.mu.Lock()
+	c.queries++
+	c.mu.Unlock()
+	close(c.started)
+	<-c.release
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.err = ctx.Err()
+	_, c.deadline = ctx.Deadline()
+	return c.paths, nil
+}
+
+func TestPathCacheFetchOutlivesCaller(t *testing.T) {
+	src, dst := addr.MustParseIA("1-ff00:0:110"), addr.MustParseIA("1-ff00:0:112")
+	conn := &blockingConnector{paths: pathCacheTestPaths(t, time.Hour),
+		started: make(chan struct{}), release: make(chan struct{})}
+	cache := newPathCache(conn)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	errs := make(chan error, 1)
+	go func() {
+		_, err := cache.Paths(ctx, dst, src, daemon.PathReqFlags{})
+		errs <- err
+	}()
+	<-conn.started
+	cancel()
+	if err := <-errs; !errors.Is(err, context.Canceled) {
+		t.Fatalf("cancelled caller got %v", err)
+	}
+
+	close(conn.release)
+	got, err := cache.Paths(context.Background(), dst, src, daemon.PathReqFlags{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 1 {
+		t.Errorf("returned %d paths, want 1", len(got))
+	}
+	conn.mu.Lock()
+	defer conn.mu.Unlock()
+	if conn.err != nil || !conn.deadline {
+		t.Errorf("daemon queried with context error %v, deadline %t, want a live "+
+			"context with a deadline", conn.err, conn.deadline)
+	}
+	if conn.queries != 1 {
+		t.Errorf("daemon queried %d times, want once", conn.queries)
+	}
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"github.com/scionproto/scion/pkg/snet"
+)
+
+// Path order
+//
+// Every selector ranks paths by the same comparator chain, so that the path it
+// picks does not depend on the order in which the daemon returns the paths:
+//
+//  0. The link type penalty of the --link-types policy, fewer penalized links
+//     first. It is zero for every path unless a policy penalizes link types.
+//  1. The metrics of the selector, most important first. Lower values rank
+//     first, so a selector negates a metric it maximizes, e.g. bandwidth.
+//  2. The hop count, i.e. the number of ASes on the path, fewer first.
+//  3. The sequence of interface IDs along the path, compared lexicographically
+//     with a path that is a prefix of another ranking first.
+//  4. The sequence of ISD-AS identifiers of the interfaces, compared the same
+//     way, for paths that use the same interface IDs in different ASes.
+//
+// Paths without metadata rank after all paths with metadata. Two paths that
+// are equal under the chain traverse the same interfaces, i.e. they have the
+// same fingerprint and the same metrics, and are interchangeable.
+
+// pathRank is a path with the metrics a selector ranks it by.
+type pathRank struct {
+	path        snet.Path
+	linkPenalty float64
+	metrics     []float64
+}
+
+func newPathRank(path snet.Path, metrics ...float64) pathRank {
+	return pathRank{path: path, linkPenalty: pathLinkTypes.penalty(path), metrics: metrics}
+}
+
+// comparePathRanks compares two paths ranked by the same selector. It returns
+// a negative number if a ranks before b, a positive one if it ranks after b,
+// and zero if they are equal.
+func comparePathRanks(a, b pathRank) int {
+	switch {
+	case a.linkPenalty < b.linkPenalty:
+		return -1
+	case a.linkPenalty > b.linkPenalty:
+		return 1
+	}
+	for i := 0; i < len(a.metrics) && i < len(b.metrics); i++ {
+		switch {
+		case a.metrics[i] < b.metrics[i]:
+			return -1
+		case a.metrics[i] > b.metrics[i]:
+			return 1
+		}
+	}
+	return comparePathOrder(a.path, b.path)
+}
+
+// comparePathOrder compares two paths by hop count and then by their
+// interfaces, the part of the chain that does not depend on a selector.
+func comparePathOrder(a, b snet.Path) int {
+	var ma, mb *snet.PathMetadata
+	if a != nil {
+		ma = a.Metadata()
+	}
+	if b != nil {
+		mb = b.Metadata()
+	}
+	switch {
+	case ma == nil && mb == nil:
+		return 0
+	case ma == nil:
+		return 1
+	case mb == nil:
+		return -1
+	}
+
+	if ha, hb := pathHopCount(ma), pathHopCount(mb); ha != hb {
+		return ha - hb
+	}
+	ia, ib := ma.Interfaces, mb.Interfaces
+	for i := 0; i < len(ia) && i < len(ib); i++ {
+		switch {
+		case ia[i].ID < ib[i].ID:
+			return -1
+		case ia[i].ID > ib[i].ID:
+			return 1
+		}
+	}
+	if len(ia) != len(ib) {
+		return len(ia) - len(ib)
+	}
+	for i := range ia {
+		switch {
+		case ia[i].IA < ib[i].IA:
+			return -1
+		case ia[i].IA > ib[i].IA:
+			return 1
+		}
+	}
+	return 0
+}
+
+// pathHopCount returns the number of ASes on the path. Consecutive interfaces
+// in the same AS belong to one hop.
+func pathHopCount(metadata *snet.PathMetadata) int {
+	hops := 0
+	for i, intf := range metadata.Interfaces {
+		if i == 0 || intf.IA != metadata.Interfaces[i-1].IA {
+			hops++
+		}
+	}
+	return hops
+}
+
+// bestPathRank returns the index of the first path that ranks before all
+// others, -1 if there are none.
+func bestPathRank(ranks []pathRank) int {
+	if len(ranks) == 0 {
+		return -1
+	}
+	best := 0
+	for i := 1; i < len(ranks); i++ {
+		if comparePathRanks(ranks[i], ranks[best]) < 0 {
+			best = i
+		}
+	}
+	return best
+}
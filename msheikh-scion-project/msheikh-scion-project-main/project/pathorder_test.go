@@ -0,0 +1,195 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"math/rand"
+	"reflect"
+	"strings"
+	"testing"
+	"testing/quick"
+
+	"github.com/scionproto/scion/pkg/addr"
+	"github.com/scionproto/scion/pkg/private/common"
+	"github.com/scionproto/scion/pkg/snet"
+)
+
+// referencePathKey encodes the selector-independent part of the path order as
+// a string, so that the order is plain string comparison: the hop count, the
+// interface IDs and, after a separator that sorts before every digit, the
+// ISD-AS identifiers. Paths without metadata sort last.
+func referencePathKey(p snet.Path) string {
+	m := p.Metadata()
+	if m == nil {
+		return "~"
+	}
+	var b strings.Builder
+	hops := 0
+	for i, intf := range m.Interfaces {
+		if i == 0 || intf.IA != m.Interfaces[i-1].IA {
+			hops++
+		}
+	}
+	fmt.Fprintf(&b, "%08d", hops)
+	for _, intf := range m.Interfaces {
+		fmt.Fprintf(&b, "%05d", intf.ID)
+	}
+	b.WriteString("!")
+	for _, intf := range m.Interfaces {
+		fmt.Fprintf(&b, "%016x", uint64(intf.IA))
+	}
+	return b.String()
+}
+
+func referencePathLess(a, b snet.Path) bool {
+	return referencePathKey(a) < referencePathKey(b)
+}
+
+func sign(n int) int {
+	switch {
+	case n < 0:
+		return -1
+	case n > 0:
+		return 1
+	}
+	return 0
+}
+
+// rankedPaths are three paths ranked by the same selector, drawn from a small
+// set of ASes, interface IDs and metric values so that ties are common.
+type rankedPaths [3]pathRank
+
+var pathOrderIAs = []addr.IA{
+	addr.MustParseIA("1-ff00:0:110"),
+	addr.MustParseIA("1-ff00:0:111"),
+	addr.MustParseIA("2-ff00:0:210"),
+}
+
+func (rankedPaths) Generate(rng *rand.Rand, size int) reflect.Value {
+	var r rankedPaths
+	metrics := rng.Intn(3)
+	values := []float64{0, 1, 2, math.Inf(1)}
+	for i := range r {
+		if i > 0 && rng.Float64() < 0.3 {
+			r[i].path = r[rng.Intn(i)].path
+		} else {
+			p := &testPath{}
+			if rng.Float64() > 0.1 {
+				p.meta = &snet.PathMetadata{}
+				for hop := 0; hop < 1+rng.Intn(4); hop++ {
+					ia := pathOrderIAs[rng.Intn(len(pathOrderIAs))]
+					for n := 0; n < 2; n++ {
+						p.meta.Interfaces = append(p.meta.Interfaces, snet.PathInterface{
+							IA: ia,
+							ID: common.IFIDType(1 + rng.Intn(2)),
+						})
+					}
+				}
+				// The first and the last hop have only one interface.
+				if l := len(p.meta.Interfaces); l > 0 {
+					p.meta.Interfaces = p.meta.Interfaces[1 : l-1]
+				}
+			}
+			r[i].path = p
+		}
+		for k := 0; k < metrics; k++ {
+			r[i].metrics = append(r[i].metrics, values[rng.Intn(len(values))])
+		}
+	}
+	return reflect.ValueOf(r)
+}
+
+var pathOrderConfig = &quick.Config{MaxCount: 5000}
+
+func TestComparePathOrderMatchesSpec(t *testing.T) {
+	property := func(r rankedPaths) bool {
+		a, b := r[0].path, r[1].path
+		want := strings.Compare(referencePathKey(a), referencePathKey(b))
+		return sign(comparePathOrder(a, b)) == want
+	}
+	if err := quick.Check(property, pathOrderConfig); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestComparePathRanksIsTotalOrder(t *testing.T) {
+	antisymmetric := func(r rankedPaths) bool {
+		return sign(comparePathRanks(r[0], r[1])) == -sign(comparePathRanks(r[1], r[0]))
+	}
+	transitive := func(r rankedPaths) bool {
+		if comparePathRanks(r[0], r[1]) <= 0 && comparePathRanks(r[1], r[2]) <= 0 {
+			return comparePathRanks(r[0], r[2]) <= 0
+		}
+		return true
+	}
+	reflexive := func(r rankedPaths) bool {
+		return comparePathRanks(r[0], r[0]) == 0
+	}
+	// Paths are only equal if they are interchangeable: the same metrics and
+	// the same interfaces.
+	equalOnlyIfSame := func(r rankedPaths) bool {
+		if comparePathRanks(r[0], r[1]) != 0 {
+			return true
+		}
+		return reflect.DeepEqual(r[0].metrics, r[1].metrics) &&
+			referencePathKey(r[0].path) == referencePathKey(r[1].path)
+	}
+	for name, property := range map[string]func(rankedPaths) bool{
+		"antisymmetric":      antisymmetric,
+		"transitive":         transitive,
+		"reflexive":          reflexive,
+		"equal only if same": equalOnlyIfSame,
+	} {
+		if err := quick.Check(property, pathOrderConfig); err != nil {
+			t.Errorf("%s: %v", name, err)
+		}
+	}
+}
+
+// TestSelectorsIgnorePathOrder checks that every selector picks the same path
+// however the daemon orders the paths.
+func TestSelectorsIgnorePathOrder(t *testing.T) {
+	ctx := context.Background()
+	for seed := int64(1); seed <= 200; seed++ {
+		rng := rand.New(rand.NewSource(seed))
+		fixtures, err := randomSelectionPaths(rng, seed)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, chk := range selectionChecks {
+			c := randomSelectionCase(rng, chk.name, seed, fixtures)
+			paths, err := c.build()
+			if err != nil {
+				t.Fatal(err)
+			}
+			var prefer snet.Path
+			if c.PreferPath >= 0 {
+				prefer = paths[c.PreferPath]
+			}
+			want := chk.answer(ctx, c, paths)
+
+			perm := rng.Perm(len(paths))
+			shuffled := make([]snet.Path, len(paths))
+			c.PreferPath = -1
+			for i, j := range perm {
+				shuffled[i] = paths[j]
+				if prefer != nil && paths[j] == prefer {
+					c.PreferPath = i
+				}
+			}
+			got := chk.answer(ctx, c, shuffled)
+
+			if (want.path < 0) != (got.path < 0) {
+				t.Errorf("seed %d: %s selector picked %s, %s after shuffling", seed, chk.name,
+					want, got)
+				continue
+			}
+			if want.path >= 0 &&
+				referencePathKey(paths[want.path]) != referencePathKey(shuffled[got.path]) {
+				t.Errorf("seed %d: %s selector picked %s, %s after shuffling (%v)", seed,
+					chk.name, want, got, perm)
+			}
+		}
+	}
+}
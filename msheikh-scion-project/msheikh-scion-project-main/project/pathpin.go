@@ -0,0 +1,188 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/scionproto/scion/pkg/log"
+	"github.com/scionproto/scion/pkg/private/serrors"
+	"github.com/scionproto/scion/pkg/snet"
+)
+
+// pinnableTests are the tests that send on a single path of their choice.
+var pinnableTests = map[int]bool{1: true, 10: true, 11: true, 20: true, 30: true, 31: true,
+	32: true, 33: true, 40: true}
+
+// minPinPrefix is the shortest fingerprint prefix accepted by --pin-path.
+const minPinPrefix = 8
+
+// pathHopString returns the hops of a path in the form
+// "1-ff00:0:111#0>2 1-ff00:0:110#1>3 1-ff00:0:112#4>0", i.e. every AS with its
+// ingress and egress interface, 0 standing for none.
+func pathHopString(p snet.Path) string {
+	metadata := p.Metadata()
+	if metadata == nil {
+		return ""
+	}
+	hops := fabridHopInterfaces(metadata)
+	parts := make([]string, len(hops))
+	for i, hop := range hops {
+		parts[i] = fmt.Sprintf("%s#%d>%d", hop.IA, hop.IgIf, hop.EgIf)
+	}
+	return strings.Join(parts, " ")
+}
+
+// pathFields appends the fingerprint and the hops of a path to the log
+// context, so that log lines identify the path across runs.
+func pathFields(p snet.Path, ctx ...interface{}) []interface{} {
+	return append(ctx, "fingerprint", snet.Fingerprint(p).String(), "hops", pathHopString(p))
+}
+
+// pathPin forces a test, or every test if test is 0, onto one path.
+type pathPin struct {
+	test int
+	// fingerprint is a prefix of the hex fingerprint, hops a hop string as
+	// returned by pathHopString. Exactly one of them is set.
+	fingerprint string
+	hops        string
+}
+
+func (p pathPin) String() string {
+	s := p.fingerprint
+	if p.hops != "" {
+		s = p.hops
+	}
+	if p.test != 0 {
+		s = fmt.Sprintf("%d=%s", p.test, s)
+	}
+	return s
+}
+
+// matches reports whether path is the pinned path.
+func (p pathPin) matches(path snet.Path) bool {
+	if p.hops != "" {
+		return pathHopString(path) == p.hops
+	}
+	return strings.HasPrefix(snet.Fingerprint(path).String(), p.fingerprint)
+}
+
+// parsePathPin parses "[<test>=]<fingerprint|hops>". Hops may be separated
+// by spaces or commas.
+func parsePathPin(s string) (pathPin, error) {
+	var pin pathPin
+	if test, rest, ok := strings.Cut(s, "="); ok {
+		id, err := strconv.Atoi(strings.TrimSpace(test))
+		if err != nil || !pinnableTests[id] {
+			return pathPin{}, serrors.New("path pins apply to tests 1, 10, 11, 20, 30-33 "+
+				"and 40", "test", test)
+		}
+		pin.test, s = id, rest
+	}
+	s = strings.TrimSpace(s)
+
+	if strings.Contains(s, "#") {
+		pin.hops = strings.Join(strings.Fields(strings.ReplaceAll(s, ",", " ")), " ")
+		return pin, nil
+	}
+	s = strings.ToLower(s)
+	if strings.Trim(s, "0123456789abcdef") != "" || len(s) < minPinPrefix {
+		return pathPin{}, serrors.New("a pinned path is a hop sequence or a fingerprint "+
+			"of at least 8 hex digits", "pin", s)
+	}
+	pin.fingerprint = s
+	return pin, nil
+}
+
+// pathPins is the value of the repeatable --pin-path flag.
+type pathPins []pathPin
+
+func (p *pathPins) String() string {
+	if p == nil {
+		return ""
+	}
+	parts := make([]string, len(*p))
+	for i, pin := range *p {
+		parts[i] = pin.String()
+	}
+	return strings.Join(parts, ", ")
+}
+
+func (p *pathPins) Set(s string) error {
+	pin, err := parsePathPin(s)
+	if err != nil {
+		return err
+	}
+	*p = append(*p, pin)
+	return nil
+}
+
+// forTest returns the pin of the test, a test-specific pin taking precedence
+// over one for all tests.
+func (p pathPins) forTest(id int) (pathPin, bool) {
+	var general *pathPin
+	for i := range p {
+		switch p[i].test {
+		case id:
+			return p[i], true
+		case 0:
+			general = &p[i]
+		}
+	}
+	if general == nil {
+		return pathPin{}, false
+	}
+	return *general, true
+}
+
+// The paths tests are pinned to.
+var pinnedPaths pathPins
+
+func init() {
+	flag.Var(&pinnedPaths, "pin-path",
+		"Force a test onto a path, as [<test>=]<fingerprint|hops>, e.g. "+
+			"'11=1-ff00:0:111#0>2 1-ff00:0:110#1>0' (repeatable)")
+}
+
+// pinPaths restricts the candidate paths of a test to its pinned path. It
+// returns the candidates unchanged if the test is not pinned, and fails if the
+// pinned path is not among them.
+func pinPaths(ctx context.Context, id int, paths []snet.Path) ([]snet.Path, bool, error) {
+	pin, ok := pinnedPaths.forTest(id)
+	if !ok {
+		return paths, false, nil
+	}
+
+	var matches []snet.Path
+	seen := make(map[snet.PathFingerprint]bool)
+	for _, p := range paths {
+		if fp := snet.Fingerprint(p); pin.matches(p) && !seen[fp] {
+			seen[fp] = true
+			matches = append(matches, p)
+		}
+	}
+	switch len(matches) {
+	case 0:
+		available := make([]string, 0, len(paths))
+		for _, p := range paths {
+			fp := snet.Fingerprint(p).String()
+			if len(fp) > minPinPrefix {
+				fp = fp[:minPinPrefix]
+			}
+			available = append(available, fp+" "+pathHopString(p))
+		}
+		sort.Strings(available)
+		return nil, true, serrors.New("pinned path not available", "test", id, "pin", pin,
+			"available", available)
+	case 1:
+		log.FromCtx(ctx).Info(fmt.Sprintf("Test ID %02d: Using pinned path", id),
+			pathFields(matches[0], "pin", pin.String())...)
+		return matches, true, nil
+	default:
+		return nil, true, serrors.New("pinned fingerprint prefix is ambiguous", "test", id,
+			"pin", pin, "matches", len(matches))
+	}
+}
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"flag"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/scionproto/scion/pkg/log"
+	"github.com/scionproto/scion/pkg/private/serrors"
+	"github.com/scionproto/scion/pkg/snet"
+	"github.com/scionproto/scion/private/path/pathpol"
+	"gopkg.in/yaml.v3"
+)
+
+// Path policies
+//
+// A path policy restricts the paths the daemon returns before any selector
+// sees them. The policy file is a SCION path policy in YAML or JSON, with the
+// ACL and sequence syntax of `scion showpaths --sequence`:
+//
+//	# Never traverse 1-ff00:0:111 and always go via 2-ff00:0:211.
+//	acl:
+//	  - "- 1-ff00:0:111"
+//	  - "+"
+//	sequence: "0* 2-ff00:0:211 0*"
+//
+// The ACL must end in a default entry. Paths without metadata cannot be
+// checked against a policy and are dropped.
+
+// pathPolicy is the value of the --path-policy flag. The file is loaded and
+// checked while the flags are parsed, so that an invalid policy stops the
+// client before it connects to the daemon.
+type pathPolicy struct {
+	file   string
+	policy *pathpol.Policy
+}
+
+func (p *pathPolicy) String() string {
+	if p == nil {
+		return ""
+	}
+	return p.file
+}
+
+func (p *pathPolicy) Set(file string) error {
+	policy, err := loadPathPolicy(file)
+	if err != nil {
+		return err
+	}
+	p.file, p.policy = file, policy
+	return nil
+}
+
+// The policy every path query is filtered with.
+var candidatePolicy pathPolicy
+
+func init() {
+	flag.Var(&candidatePolicy, "path-policy",
+		"SCION path policy file (YAML or JSON) with an ACL and/or sequence that every path must satisfy")
+}
+
+// loadPathPolicy reads a path policy file. Files ending in .json are JSON,
+// everything else is YAML.
+func loadPathPolicy(file string) (*pathpol.Policy, error) {
+	raw, err := os.ReadFile(file)
+	if err != nil {
+		return nil, serrors.WrapStr("reading path policy", err, "file", file)
+	}
+	if !strings.EqualFold(filepath.Ext(file), ".json") {
+		// The policy types only know JSON, so YAML is converted first.
+		var doc interface{}
+		if err := yaml.Unmarshal(raw, &doc); err != nil {
+			return nil, serrors.WrapStr("parsing path policy", err, "file", file)
+		}
+		if raw, err = json.Marshal(doc); err != nil {
+			return nil, serrors.WrapStr("converting path policy", err, "file", file)
+		}
+	}
+
+	policy := &pathpol.Policy{}
+	dec := json.NewDecoder(bytes.NewReader(raw))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(policy); err != nil {
+		return nil, serrors.WrapStr("invalid path policy", err, "file", file)
+	}
+	if policy.ACL == nil && policy.Sequence == nil && policy.LocalISDAS == nil &&
+		policy.RemoteISDAS == nil && len(policy.Options) == 0 {
+
+		return nil, serrors.New("path policy is empty", "file", file)
+	}
+	if err := sortPolicyOptions(policy); err != nil {
+		return nil, serrors.WrapStr("invalid path policy", err, "file", file)
+	}
+	policy.Name = filepath.Base(file)
+	return policy, nil
+}
+
+// sortPolicyOptions orders the options of the policy and of its sub-policies
+// by weight, highest first, as pathpol.NewPolicy does. Sub-policies cannot
+// extend named policies, a policy file has none.
+func sortPolicyOptions(policy *pathpol.Policy) error {
+	sort.SliceStable(policy.Options, func(i, j int) bool {
+		return policy.Options[i].Weight > policy.Options[j].Weight
+	})
+	for _, option := range policy.Options {
+		switch {
+		case option.Policy == nil || option.Policy.Policy == nil:
+			return serrors.New("option without a policy", "weight", option.Weight)
+		case len(option.Policy.Extends) > 0:
+			return serrors.New("options cannot extend other policies",
+				"extends", option.Policy.Extends)
+		}
+		if err := sortPolicyOptions(option.Policy.Policy); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// filter returns the paths that satisfy the policy, all paths if no policy is
+// set.
+func (p *pathPolicy) filter(ctx context.Context, query pathQueryKey,
+	paths []snet.Path) []snet.Path {
+
+	if p.policy == nil {
+		return paths
+	}
+	withMetadata := make([]snet.Path, 0, len(paths))
+	for _, path := range paths {
+		if path.Metadata() != nil {
+			withMetadata = append(withMetadata, path)
+		}
+	}
+	accepted := p.policy.Filter(withMetadata)
+
+	logger := log.FromCtx(ctx)
+	if len(accepted) < len(paths) {
+		logger.Info("Path policy rejected paths", "policy", p.file, "query", query,
+			"paths", len(paths), "accepted", len(accepted),
+			"without_metadata", len(paths)-len(withMetadata))
+		kept := make(map[snet.PathFingerprint]bool, len(accepted))
+		for _, path := range accepted {
+			kept[snet.Fingerprint(path)] = true
+		}
+		for _, path := range paths {
+			if !kept[snet.Fingerprint(path)] {
+				logger.Debug("Path rejected by path policy", pathFields(path)...)
+			}
+		}
+	}
+	return accepted
+}
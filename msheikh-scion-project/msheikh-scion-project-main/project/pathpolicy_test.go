@@ -0,0 +1,125 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"testing"
+
+	"github.com/scionproto/scion/pkg/snet"
+)
+
+// policyTestPaths are three paths to tell the policy shapes apart: two from
+// 1-ff00:0:110 to 2-ff00:0:211, one via 1-ff00:0:111 and one via
+// 1-ff00:0:112, and one from 1-ff00:0:120 to 1-ff00:0:112.
+var policyTestPaths = map[string]fixturePath{
+	"via111": {Interfaces: []string{"1-ff00:0:110#1", "1-ff00:0:111#2", "1-ff00:0:111#3",
+		"2-ff00:0:211#4"}},
+	"via112": {Interfaces: []string{"1-ff00:0:110#5", "1-ff00:0:112#6", "1-ff00:0:112#7",
+		"2-ff00:0:211#8"}},
+	"to112": {Interfaces: []string{"1-ff00:0:120#1", "1-ff00:0:112#2"}},
+}
+
+func TestLoadPathPolicy(t *testing.T) {
+	paths := make([]snet.Path, 0, len(policyTestPaths))
+	names := make(map[snet.PathFingerprint]string)
+	for name, f := range policyTestPaths {
+		p := buildPaths(t, f)[0]
+		paths = append(paths, p)
+		names[snet.Fingerprint(p)] = name
+	}
+
+	tests := []struct {
+		name   string
+		file   string
+		policy string
+		want   []string
+	}{
+		{
+			name:   "acl",
+			file:   "acl.yaml",
+			policy: "acl:\n  - \"- 1-ff00:0:111\"\n  - \"+\"\n",
+			want:   []string{"to112", "via112"},
+		},
+		{
+			name:   "sequence",
+			file:   "sequence.json",
+			policy: `{"sequence": "1-ff00:0:110 1-ff00:0:112 0*"}`,
+			want:   []string{"via112"},
+		},
+		{
+			name:   "local isd-as",
+			file:   "local.yaml",
+			policy: "local_isd_ases: [\"1-ff00:0:120\"]\n",
+			want:   []string{"to112"},
+		},
+		{
+			name:   "remote isd-as",
+			file:   "remote.yaml",
+			policy: "remote_isd_ases:\n  - {isd_as: \"2-0\", reject: true}\n  - {isd_as: \"0-0\"}\n",
+			want:   []string{"to112"},
+		},
+		{
+			// Only rejecting rules reject everything, no rule accepts a path.
+			name:   "remote isd-as reject only",
+			file:   "reject.yaml",
+			policy: "remote_isd_ases: [{isd_as: \"2-0\", reject: true}]\n",
+			want:   nil,
+		},
+		{
+			// The option with the highest weight that matches any path wins,
+			// wherever it is in the file.
+			name: "options",
+			file: "options.yaml",
+			policy: "options:\n" +
+				"  - weight: 1\n" +
+				"    policy: {sequence: \"0* 1-ff00:0:112 0*\"}\n" +
+				"  - weight: 2\n" +
+				"    policy: {acl: [\"- 1-ff00:0:112\", \"- 1-ff00:0:120\", \"+\"]}\n",
+			want: []string{"via111"},
+		},
+	}
+	dir := t.TempDir()
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			file := filepath.Join(dir, tc.file)
+			if err := os.WriteFile(file, []byte(tc.policy), 0o644); err != nil {
+				t.Fatal(err)
+			}
+			policy, err := loadPathPolicy(file)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var got []string
+			for _, p := range policy.Filter(append([]snet.Path(nil), paths...)) {
+				got = append(got, names[snet.Fingerprint(p)])
+			}
+			sort.Strings(got)
+			if !reflect.DeepEqual(got, tc.want) {
+				t.Errorf("policy kept %v, want %v", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestLoadPathPolicyRejectsInvalid(t *testing.T) {
+	tests := map[string]string{
+		"empty":                 "",
+		"unknown field":         "acl: [\"+\"]\nsequnce: \"0*\"\n",
+		"acl without default":   "acl: [\"- 1-ff00:0:111\"]\n",
+		"invalid sequence":      "sequence: \"((\"\n",
+		"option without policy": "options: [{weight: 1}]\n",
+		"option extends":        "options: [{weight: 1, policy: {extends: [other], acl: [\"+\"]}}]\n",
+	}
+	dir := t.TempDir()
+	for name, policy := range tests {
+		file := filepath.Join(dir, "policy.yaml")
+		if err := os.WriteFile(file, []byte(policy), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := loadPathPolicy(file); err == nil {
+			t.Errorf("%s: policy was accepted", name)
+		}
+	}
+}
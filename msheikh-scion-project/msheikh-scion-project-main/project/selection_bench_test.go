@@ -0,0 +1,242 @@
+package main
+
+// Benchmarks of the path selectors on synthetic path sets of 10 to 10,000
+// paths drawn from a random topology. The selectors that log for every path
+// they look at run once with the default logger, which drops everything, and
+// once with a logger that formats every Info entry like the console logger
+// does. Allocation profiles are written with
+//
+//	go test -run '^$' -bench . -benchmem -memprofile mem.out ./project
+//	go tool pprof -sample_index=alloc_space mem.out
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"math/rand"
+	"sync"
+	"testing"
+
+	"github.com/scionproto/scion/pkg/addr"
+	"github.com/scionproto/scion/pkg/log"
+	"github.com/scionproto/scion/pkg/snet"
+	"github.com/scionproto/scion/private/path/fabridquery"
+)
+
+// benchmarkSizes are the numbers of paths the selectors are benchmarked with.
+var benchmarkSizes = []int{10, 100, 1000, 10000}
+
+// formattingLogger formats every enabled entry and discards the result, to
+// account for the cost of Info logging without writing to the console.
+type formattingLogger struct {
+	fields []interface{}
+}
+
+func (l formattingLogger) New(ctx ...interface{}) log.Logger {
+	return formattingLogger{fields: append(append([]interface{}(nil), l.fields...), ctx...)}
+}
+
+func (l formattingLogger) Debug(msg string, ctx ...interface{}) {}
+
+func (l formattingLogger) Info(msg string, ctx ...interface{}) { l.write("INFO", msg, ctx) }
+
+func (l formattingLogger) Error(msg string, ctx ...interface{}) { l.write("ERROR", msg, ctx) }
+
+// Enabled reports Info and above, the console default. Level 0 is Info.
+func (l formattingLogger) Enabled(lvl log.Level) bool { return lvl >= 0 }
+
+func (l formattingLogger) write(level, msg string, ctx []interface{}) {
+	fmt.Fprintf(io.Discard, "%s\t%s", level, msg)
+	for _, fields := range [][]interface{}{l.fields, ctx} {
+		for i := 0; i+1 < len(fields); i += 2 {
+			fmt.Fprintf(io.Discard, " %v=%v", fields[i], fields[i+1])
+		}
+	}
+}
+
+var (
+	benchmarkPathsOnce sync.Once
+	benchmarkPathSet   []snet.Path
+)
+
+// benchmarkPaths returns n paths with complete metadata as the daemon
+// announces it: latency, bandwidth and carbon intensity from the links of a
+// random topology, EPIC on some paths and FABRID policies on most hops.
+func benchmarkPaths(b *testing.B, n int) []snet.Path {
+	benchmarkPathsOnce.Do(func() {
+		rng := rand.New(rand.NewSource(1))
+		g, err := newTopologyGenerator(topologyGenConfig{
+			isds:      3,
+			cores:     3,
+			children:  30,
+			peers:     20,
+			multihome: 0.5,
+			seed:      1,
+		})
+		if err != nil {
+			panic(err)
+		}
+		g.generate()
+		byIA := make(map[addr.IA]*genAS, len(g.ases))
+		for _, as := range g.ases {
+			byIA[as.ia] = as
+		}
+		largest := benchmarkSizes[len(benchmarkSizes)-1]
+		for len(benchmarkPathSet) < largest {
+			f, ok := benchmarkPath(rng, g.ases[rng.Intn(len(g.ases))], byIA)
+			if !ok {
+				continue
+			}
+			p, err := f.build()
+			if err != nil {
+				panic(err)
+			}
+			benchmarkPathSet = append(benchmarkPathSet, p)
+		}
+	})
+	if n > len(benchmarkPathSet) {
+		b.Fatalf("only %d benchmark paths", len(benchmarkPathSet))
+	}
+	return benchmarkPathSet[:n]
+}
+
+// benchmarkPath walks two to eight links from the AS without revisiting an
+// AS.
+func benchmarkPath(rng *rand.Rand, as *genAS, byIA map[addr.IA]*genAS) (fixturePath, bool) {
+	var f fixturePath
+	visited := map[addr.IA]bool{as.ia: true}
+	var links []genInterface
+	for steps := 2 + rng.Intn(7); steps > 0; steps-- {
+		var next []genInterface
+		for _, intf := range as.interfaces {
+			if !visited[intf.peer] {
+				next = append(next, intf)
+			}
+		}
+		if len(next) == 0 {
+			break
+		}
+		intf := next[rng.Intn(len(next))]
+		peer := byIA[intf.peer]
+		for _, back := range peer.interfaces {
+			if back.peer == as.ia {
+				f.Interfaces = append(f.Interfaces, fmt.Sprintf("%s#%d", as.ia, intf.id),
+					fmt.Sprintf("%s#%d", peer.ia, back.id))
+				break
+			}
+		}
+		links = append(links, intf)
+		visited[peer.ia] = true
+		as = peer
+	}
+	if len(links) < 2 {
+		return fixturePath{}, false
+	}
+
+	// Entries alternate between a link and the transit through the next AS.
+	for i, link := range links {
+		if i > 0 {
+			f.LatencyMs = append(f.LatencyMs, int64(rng.Intn(4)))
+			f.Bandwidth = append(f.Bandwidth, uint64(100*(1+rng.Intn(10))))
+			f.CarbonIntensity = append(f.CarbonIntensity, int64(rng.Intn(21)))
+		}
+		f.LatencyMs = append(f.LatencyMs, int64(link.latencyMs))
+		f.Bandwidth = append(f.Bandwidth, uint64(link.bandwidth))
+		f.CarbonIntensity = append(f.CarbonIntensity, int64(link.carbon))
+	}
+	f.EPIC = rng.Float64() < 0.2
+	for i := 0; i <= len(links); i++ {
+		hop := fixtureHop{Enabled: rng.Float64() < 0.9}
+		for _, k := range rng.Perm(len(selectionPolicies))[:rng.Intn(4)] {
+			hop.Policies = append(hop.Policies, selectionPolicies[k])
+		}
+		f.Fabrid = append(f.Fabrid, hop)
+	}
+	return f, true
+}
+
+// benchmarkSelector runs the selector on every path set size, with and
+// without Info logging.
+func benchmarkSelector(b *testing.B, selector func(ctx context.Context, paths []snet.Path) error) {
+	loggers := []struct {
+		name string
+		ctx  context.Context
+	}{
+		{"nolog", context.Background()},
+		{"log", log.CtxWith(context.Background(), formattingLogger{})},
+	}
+	for _, n := range benchmarkSizes {
+		for _, l := range loggers {
+			b.Run(fmt.Sprintf("paths=%d/%s", n, l.name), func(b *testing.B) {
+				paths := benchmarkPaths(b, n)
+				b.ReportAllocs()
+				b.ResetTimer()
+				for i := 0; i < b.N; i++ {
+					if err := selector(l.ctx, paths); err != nil {
+						b.Fatal(err)
+					}
+				}
+			})
+		}
+	}
+}
+
+func BenchmarkLowestCarbonPath(b *testing.B) {
+	benchmarkSelector(b, func(ctx context.Context, paths []snet.Path) error {
+		_, err := findLowestCarbonPath(ctx, paths)
+		return err
+	})
+}
+
+func BenchmarkBestBandwidthPath(b *testing.B) {
+	benchmarkSelector(b, func(ctx context.Context, paths []snet.Path) error {
+		_, err := findBestBandwidthPath(ctx, paths, 1000)
+		return err
+	})
+}
+
+func BenchmarkEPICPath(b *testing.B) {
+	benchmarkSelector(b, func(ctx context.Context, paths []snet.Path) error {
+		_, err := findEPICPath(ctx, paths)
+		return err
+	})
+}
+
+// BenchmarkFabridQuery evaluates the queries of Tests 31 and 32, once keeping
+// the policies the query picks and once optimizing for preferred policies and
+// carbon intensity. Matching does not log, so it only runs without a logger.
+func BenchmarkFabridQuery(b *testing.B) {
+	for _, q := range []struct {
+		name, query string
+	}{
+		{"test31", fabridQuery31},
+		{"test32", fabridQuery32},
+	} {
+		query, err := fabridquery.ParseFabridQuery(q.query)
+		if err != nil {
+			b.Fatal(err)
+		}
+		for _, bench := range []struct {
+			name  string
+			prefs fabridPreferences
+		}{
+			{"plain", fabridPreferences{}},
+			{"optimized", fabridPreferences{
+				preferred: []string{"L1002", "L1001"},
+				criteria:  []string{"preferred", "carbon"},
+			}},
+		} {
+			for _, n := range benchmarkSizes {
+				b.Run(fmt.Sprintf("%s/%s/paths=%d", q.name, bench.name, n), func(b *testing.B) {
+					paths := benchmarkPaths(b, n)
+					ctx := context.Background()
+					b.ReportAllocs()
+					b.ResetTimer()
+					for i := 0; i < b.N; i++ {
+						fabridCandidates(ctx, query, paths, bench.prefs)
+					}
+				})
+			}
+		}
+	}
+}
@@ -0,0 +1,889 @@
+package main
+
+// Differential tests of the path selectors against brute-force reference
+// implementations of their intended semantics. Every round generates a random
+// topology, draws a set of paths from it and compares the path each selector
+// picks with the reference answer. A disagreement is minimized to the fewest
+// paths that still reproduce it and saved to testdata/selection, where
+// TestSelectionFixtures replays it from then on.
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"math"
+	"math/rand"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/scionproto/scion/pkg/addr"
+	"github.com/scionproto/scion/pkg/experimental/fabrid"
+	"github.com/scionproto/scion/pkg/private/common"
+	"github.com/scionproto/scion/pkg/snet"
+	"github.com/scionproto/scion/private/path/fabridquery"
+)
+
+var (
+	selectionRounds = flag.Int("selection-rounds", 300,
+		"The number of random path sets of the differential selection test")
+	selectionSeed = flag.Int64("selection-seed", 1,
+		"The seed of the first round of the differential selection test")
+)
+
+// selectionFixtures holds the minimized disagreements.
+const selectionFixtures = "testdata/selection"
+
+// selectionPolicies are the FABRID policies hops of generated paths offer.
+var selectionPolicies = []string{"L1000", "L1001", "L1002", "G1"}
+
+// fixturePath describes a path in a fixture. Unset latency and carbon entries
+// are -1, unset bandwidth entries 0, as in the path metadata.
+type fixturePath struct {
+	Interfaces      []string     `json:"interfaces"`
+	NoMetadata      bool         `json:"no_metadata,omitempty"`
+	LatencyMs       []int64      `json:"latency_ms,omitempty"`
+	Bandwidth       []uint64     `json:"bandwidth,omitempty"`
+	CarbonIntensity []int64      `json:"carbon_intensity,omitempty"`
+	EPIC            bool         `json:"epic,omitempty"`
+	Fabrid          []fixtureHop `json:"fabrid,omitempty"`
+}
+
+// fixtureHop is the FABRID information of one on-path AS.
+type fixtureHop struct {
+	Enabled  bool     `json:"enabled"`
+	Policies []string `json:"policies,omitempty"`
+}
+
+// selectionCase is the input of one selector and the answer of the reference
+// implementation.
+type selectionCase struct {
+	Selector     string `json:"selector"`
+	Seed         int64  `json:"seed"`
+	MaxLatencyMs int64  `json:"max_latency_ms,omitempty"`
+	// Allowed and Strict describe the FABRID query, see testFabridQuery.
+	Allowed  []string `json:"allowed,omitempty"`
+	Strict   bool     `json:"strict,omitempty"`
+	Prefer   []string `json:"prefer,omitempty"`
+	Criteria []string `json:"criteria,omitempty"`
+	// PreferPath is the index of the path whose fingerprint the FABRID
+	// selector keeps on ties, -1 for none.
+	PreferPath int           `json:"prefer_path"`
+	Paths      []fixturePath `json:"paths"`
+	// Want is the index of the expected path, -1 if the selector must fail.
+	Want int `json:"want"`
+}
+
+// selectionAnswer is the path a selector picked and, for FABRID, how well the
+// chosen policies match the preferences.
+type selectionAnswer struct {
+	path   int
+	detail string
+}
+
+func (a selectionAnswer) String() string {
+	s := fmt.Sprintf("path %d", a.path)
+	if a.path < 0 {
+		s = "no path"
+	}
+	if a.detail != "" {
+		s += ", " + a.detail
+	}
+	return s
+}
+
+// testPath is a path with fixed metadata. Unlike snet/path.Path it can have no
+// metadata at all.
+type testPath struct {
+	src, dst addr.IA
+	meta     *snet.PathMetadata
+}
+
+func (p *testPath) UnderlayNextHop() *net.UDPAddr { return nil }
+func (p *testPath) Dataplane() snet.DataplanePath { return nil }
+func (p *testPath) Source() addr.IA               { return p.src }
+func (p *testPath) Destination() addr.IA          { return p.dst }
+func (p *testPath) Metadata() *snet.PathMetadata  { return p.meta }
+
+func parseTestPolicy(s string) (*fabrid.Policy, error) {
+	id, err := strconv.ParseUint(s[1:], 10, 32)
+	if err != nil || (s[0] != 'L' && s[0] != 'G') {
+		return nil, fmt.Errorf("invalid policy %q", s)
+	}
+	return &fabrid.Policy{IsLocal: s[0] == 'L', Identifier: uint32(id)}, nil
+}
+
+// build turns the fixture path into a path.
+func (f fixturePath) build() (snet.Path, error) {
+	p := &testPath{}
+	var meta snet.PathMetadata
+	for _, s := range f.Interfaces {
+		iaStr, ifStr, ok := strings.Cut(s, "#")
+		if !ok {
+			return nil, fmt.Errorf("invalid interface %q", s)
+		}
+		ia, err := addr.ParseIA(iaStr)
+		if err != nil {
+			return nil, err
+		}
+		ifid, err := strconv.ParseUint(ifStr, 10, 16)
+		if err != nil {
+			return nil, err
+		}
+		meta.Interfaces = append(meta.Interfaces, snet.PathInterface{IA: ia,
+			ID: common.IFIDType(ifid)})
+	}
+	if len(meta.Interfaces) > 0 {
+		p.src, p.dst = meta.Interfaces[0].IA, meta.Interfaces[len(meta.Interfaces)-1].IA
+	}
+	if f.NoMetadata {
+		return p, nil
+	}
+
+	for _, l := range f.LatencyMs {
+		latency := snet.LatencyUnset
+		if l >= 0 {
+			latency = time.Duration(l) * time.Millisecond
+		}
+		meta.Latency = append(meta.Latency, latency)
+	}
+	meta.Bandwidth = f.Bandwidth
+	meta.CarbonIntensity = f.CarbonIntensity
+	if f.EPIC {
+		meta.EpicAuths = snet.EpicAuths{AuthPHVF: make([]byte, 16), AuthLHVF: make([]byte, 16)}
+	}
+	for _, hop := range f.Fabrid {
+		info := snet.FabridInfo{Enabled: hop.Enabled}
+		for i, s := range hop.Policies {
+			policy, err := parseTestPolicy(s)
+			if err != nil {
+				return nil, err
+			}
+			policy.Index = fabrid.PolicyID(i)
+			info.Policies = append(info.Policies, policy)
+		}
+		meta.FabridInfo = append(meta.FabridInfo, info)
+	}
+	p.meta = &meta
+	return p, nil
+}
+
+func (c selectionCase) build() ([]snet.Path, error) {
+	paths := make([]snet.Path, len(c.Paths))
+	for i, f := range c.Paths {
+		p, err := f.build()
+		if err != nil {
+			return nil, err
+		}
+		paths[i] = p
+	}
+	return paths, nil
+}
+
+// buildPaths builds the fixture paths and fails the test if one is invalid.
+func buildPaths(t testing.TB, fixtures ...fixturePath) []snet.Path {
+	t.Helper()
+	paths, err := selectionCase{Paths: fixtures}.build()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return paths
+}
+
+// testFabridQuery is a FABRID query that, at every FABRID-enabled hop, uses
+// the first policy of the hop that is allowed. A strict query rejects a path
+// with a FABRID-enabled hop that offers policies but none that is allowed.
+type testFabridQuery struct {
+	allowed map[string]bool
+	strict  bool
+}
+
+func (q testFabridQuery) Evaluate(hops []snet.HopInterface,
+	ml *fabridquery.MatchList) (bool, *fabridquery.MatchList) {
+
+	for i, hop := range hops {
+		ml.SelectedPolicies[i] = &fabridquery.Policy{Type: fabridquery.WILDCARD_POLICY_TYPE}
+		if !hop.FabridEnabled {
+			continue
+		}
+		found := false
+		for _, p := range hop.Policies {
+			if q.allowed[p.String()] {
+				ml.SelectedPolicies[i] = &fabridquery.Policy{
+					Type:   fabridquery.STANDARD_POLICY_TYPE,
+					Policy: p,
+				}
+				found = true
+				break
+			}
+		}
+		if !found && q.strict && len(hop.Policies) > 0 {
+			return false, ml
+		}
+	}
+	return true, ml
+}
+
+// selectionCheck runs one selector and its reference implementation.
+type selectionCheck struct {
+	name   string
+	run    func(ctx context.Context, c selectionCase, paths []snet.Path) (snet.Path, string, error)
+	oracle func(c selectionCase, paths []snet.Path) selectionAnswer
+}
+
+var selectionChecks = []selectionCheck{
+	{
+		name: "carbon",
+		run: func(ctx context.Context, _ selectionCase, paths []snet.Path) (snet.Path, string,
+			error) {
+
+			p, err := findLowestCarbonPath(ctx, paths)
+			return p, "", err
+		},
+		oracle: oracleLowestCarbon,
+	},
+	{
+		name: "bandwidth",
+		run: func(ctx context.Context, c selectionCase, paths []snet.Path) (snet.Path, string,
+			error) {
+
+			p, err := findBestBandwidthPath(ctx, paths, c.MaxLatencyMs)
+			return p, "", err
+		},
+		oracle: oracleBestBandwidth,
+	},
+	{
+		name: "epic",
+		run: func(ctx context.Context, _ selectionCase, paths []snet.Path) (snet.Path, string,
+			error) {
+
+			p, err := findEPICPath(ctx, paths)
+			return p, "", err
+		},
+		oracle: oracleEPIC,
+	},
+	{
+		name:   "fabrid",
+		run:    runFabridSelector,
+		oracle: oracleFabrid,
+	},
+}
+
+func runFabridSelector(ctx context.Context, c selectionCase, paths []snet.Path) (snet.Path,
+	string, error) {
+
+	query := testFabridQuery{allowed: make(map[string]bool), strict: c.Strict}
+	for _, id := range c.Allowed {
+		query.allowed[id] = true
+	}
+	var prefer snet.PathFingerprint
+	if c.PreferPath >= 0 {
+		prefer = snet.Fingerprint(paths[c.PreferPath])
+	}
+	m, err := matchFabridQuery(ctx, query, paths, prefer,
+		fabridPreferences{preferred: c.Prefer, criteria: c.Criteria})
+	if err != nil {
+		return nil, "", err
+	}
+	rank := 0
+	for _, p := range m.selected {
+		if p != nil && p.Type == fabridquery.STANDARD_POLICY_TYPE {
+			rank += testPolicyRank(c.Prefer, p.Policy.String())
+		}
+	}
+	return m.path, fmt.Sprintf("preferred rank %d", rank), nil
+}
+
+// answer runs the selector and returns the index of the path it picked.
+func (chk selectionCheck) answer(ctx context.Context, c selectionCase,
+	paths []snet.Path) selectionAnswer {
+
+	p, detail, err := chk.run(ctx, c, paths)
+	if err != nil || p == nil {
+		return selectionAnswer{path: -1}
+	}
+	for i, other := range paths {
+		if other == p {
+			return selectionAnswer{path: i, detail: detail}
+		}
+	}
+	return selectionAnswer{path: -1, detail: "a path that was not offered"}
+}
+
+// compare runs the selector and the reference implementation on the case.
+func (chk selectionCheck) compare(ctx context.Context,
+	c selectionCase) (got, want selectionAnswer, err error) {
+
+	paths, err := c.build()
+	if err != nil {
+		return selectionAnswer{}, selectionAnswer{}, err
+	}
+	return chk.answer(ctx, c, paths), chk.oracle(c, paths), nil
+}
+
+// bruteForceBest returns the first of n candidates that no other candidate is
+// better than, -1 if there are no candidates.
+func bruteForceBest(n int, candidate func(i int) bool, better func(i, j int) bool) int {
+	for i := 0; i < n; i++ {
+		if !candidate(i) {
+			continue
+		}
+		beaten := false
+		for j := 0; j < n && !beaten; j++ {
+			beaten = j != i && candidate(j) && better(j, i)
+		}
+		if !beaten {
+			return i
+		}
+	}
+	return -1
+}
+
+func allPaths(int) bool { return true }
+
+// oracleLowestCarbon prefers paths with a carbon intensity for every entry,
+// then fewer missing entries, then the lowest total intensity, then the
+// common path order. A path without entries counts as one missing entry.
+func oracleLowestCarbon(_ selectionCase, paths []snet.Path) selectionAnswer {
+	type key struct {
+		missing int
+		total   float64
+	}
+	keys := make([]key, len(paths))
+	for i, p := range paths {
+		m := p.Metadata()
+		if m == nil || len(m.CarbonIntensity) == 0 {
+			keys[i] = key{missing: 1, total: math.Inf(1)}
+			continue
+		}
+		for _, v := range m.CarbonIntensity {
+			if v < 0 {
+				keys[i].missing++
+			} else {
+				keys[i].total += float64(v)
+			}
+		}
+	}
+	best := bruteForceBest(len(paths), allPaths, func(i, j int) bool {
+		a, b := keys[i], keys[j]
+		if (a.missing == 0) != (b.missing == 0) {
+			return a.missing == 0
+		}
+		if a.missing != b.missing {
+			return a.missing < b.missing
+		}
+		if a.total != b.total {
+			return a.total < b.total
+		}
+		return referencePathLess(paths[i], paths[j])
+	})
+	return selectionAnswer{path: best}
+}
+
+// oracleBestBandwidth only considers paths with metadata whose announced
+// latencies add up to at most the bound. Unset latency and zero bandwidth
+// entries are missing, as is a metric without any entry. It prefers complete
+// paths, then fewer missing entries, then the highest known bottleneck
+// bandwidth (zero if no entry is known), then the common path order.
+func oracleBestBandwidth(c selectionCase, paths []snet.Path) selectionAnswer {
+	type key struct {
+		ok        bool
+		missing   int
+		bandwidth uint64
+	}
+	keys := make([]key, len(paths))
+	for i, p := range paths {
+		m := p.Metadata()
+		if m == nil {
+			continue
+		}
+		var k key
+		var latency time.Duration
+		for _, l := range m.Latency {
+			if l < 0 {
+				k.missing++
+			} else {
+				latency += l
+			}
+		}
+		if len(m.Latency) == 0 {
+			k.missing++
+		}
+		for _, bw := range m.Bandwidth {
+			switch {
+			case bw == 0:
+				k.missing++
+			case k.bandwidth == 0 || bw < k.bandwidth:
+				k.bandwidth = bw
+			}
+		}
+		if len(m.Bandwidth) == 0 {
+			k.missing++
+		}
+		k.ok = latency <= time.Duration(c.MaxLatencyMs)*time.Millisecond
+		keys[i] = k
+	}
+	best := bruteForceBest(len(paths), func(i int) bool { return keys[i].ok },
+		func(i, j int) bool {
+			a, b := keys[i], keys[j]
+			if (a.missing == 0) != (b.missing == 0) {
+				return a.missing == 0
+			}
+			if a.missing != b.missing {
+				return a.missing < b.missing
+			}
+			if a.bandwidth != b.bandwidth {
+				return a.bandwidth > b.bandwidth
+			}
+			return referencePathLess(paths[i], paths[j])
+		})
+	return selectionAnswer{path: best}
+}
+
+// oracleEPIC considers the EPIC-enabled paths if there are any, and all paths
+// otherwise, and picks the first of them in the common path order.
+func oracleEPIC(_ selectionCase, paths []snet.Path) selectionAnswer {
+	anyEPIC := false
+	for _, p := range paths {
+		if m := p.Metadata(); m != nil && m.EpicAuths.SupportsEpic() {
+			anyEPIC = true
+		}
+	}
+	best := bruteForceBest(len(paths),
+		func(i int) bool {
+			m := paths[i].Metadata()
+			return !anyEPIC || m != nil && m.EpicAuths.SupportsEpic()
+		},
+		func(i, j int) bool { return referencePathLess(paths[i], paths[j]) })
+	return selectionAnswer{path: best}
+}
+
+// testPolicyRank is the position of the policy in the preferred list, or the
+// length of the list.
+func testPolicyRank(prefer []string, policy string) int {
+	for i, id := range prefer {
+		if id == policy {
+			return i
+		}
+	}
+	return len(prefer)
+}
+
+// oracleFabrid enumerates every assignment of allowed policies to the hops of
+// every path to find the best preferred rank the path can reach. Paths are
+// ordered by the criteria and then the common path order, but among the paths
+// with the best criteria the one with the preferred fingerprint wins.
+func oracleFabrid(c selectionCase, paths []snet.Path) selectionAnswer {
+	allowed := make(map[string]bool)
+	for _, id := range c.Allowed {
+		allowed[id] = true
+	}
+	type key struct {
+		ok     bool
+		scores map[string]float64
+		rank   int
+	}
+	keys := make([]key, len(paths))
+	for i, p := range paths {
+		m := p.Metadata()
+		if m == nil || len(m.FabridInfo) == 0 {
+			continue
+		}
+		// Every run of interfaces in the same AS is one hop.
+		hops := 0
+		for k, intf := range m.Interfaces {
+			if k == 0 || intf.IA != m.Interfaces[k-1].IA {
+				hops++
+			}
+		}
+
+		// options holds the ranks of the policies each hop can use.
+		options := make([][]int, hops)
+		ok := true
+		for h := range options {
+			options[h] = []int{0}
+			if h >= len(m.FabridInfo) || !m.FabridInfo[h].Enabled {
+				continue
+			}
+			var ranks []int
+			for _, policy := range m.FabridInfo[h].Policies {
+				if allowed[policy.String()] {
+					ranks = append(ranks, testPolicyRank(c.Prefer, policy.String()))
+				}
+			}
+			switch {
+			case len(ranks) > 0:
+				options[h] = ranks
+			case c.Strict && len(m.FabridInfo[h].Policies) > 0:
+				ok = false
+			}
+		}
+		if !ok {
+			continue
+		}
+		rank := math.MaxInt
+		var enumerate func(h, sum int)
+		enumerate = func(h, sum int) {
+			if h == len(options) {
+				rank = min(rank, sum)
+				return
+			}
+			for _, r := range options[h] {
+				enumerate(h+1, sum+r)
+			}
+		}
+		enumerate(0, 0)
+
+		carbon := math.Inf(1)
+		if len(m.CarbonIntensity) > 0 {
+			carbon = 0
+			for _, v := range m.CarbonIntensity {
+				if v < 0 {
+					carbon = math.Inf(1)
+					break
+				}
+				carbon += float64(v)
+			}
+		}
+		keys[i] = key{ok: true, rank: rank, scores: map[string]float64{
+			"preferred": float64(rank),
+			"carbon":    carbon,
+			"hops":      float64(hops),
+		}}
+	}
+
+	// scoreBetter compares the criteria only, the preferred fingerprint wins
+	// over the path order.
+	scoreBetter := func(i, j int) bool {
+		for _, criterion := range c.Criteria {
+			a, b := keys[i].scores[criterion], keys[j].scores[criterion]
+			if a != b {
+				return a < b
+			}
+		}
+		return false
+	}
+	better := func(i, j int) bool {
+		if scoreBetter(i, j) || scoreBetter(j, i) {
+			return scoreBetter(i, j)
+		}
+		return referencePathLess(paths[i], paths[j])
+	}
+	candidate := func(i int) bool { return keys[i].ok }
+	best := bruteForceBest(len(paths), candidate, better)
+	if best < 0 {
+		return selectionAnswer{path: -1}
+	}
+	if c.PreferPath >= 0 {
+		prefer := snet.Fingerprint(paths[c.PreferPath])
+		for i := range paths {
+			if candidate(i) && !scoreBetter(best, i) && snet.Fingerprint(paths[i]) == prefer {
+				best = i
+				break
+			}
+		}
+	}
+	return selectionAnswer{path: best, detail: fmt.Sprintf("preferred rank %d", keys[best].rank)}
+}
+
+// randomSelectionPaths draws paths from a random topology. The metrics come
+// from small ranges so that ties are common, and some paths lack metadata,
+// have unset entries or duplicate an earlier path.
+func randomSelectionPaths(rng *rand.Rand, seed int64) ([]fixturePath, error) {
+	g, err := newTopologyGenerator(topologyGenConfig{
+		isds:      1 + rng.Intn(2),
+		cores:     1 + rng.Intn(2),
+		children:  2 + rng.Intn(5),
+		peers:     rng.Intn(3),
+		multihome: 0.3,
+		seed:      seed,
+	})
+	if err != nil {
+		return nil, err
+	}
+	g.generate()
+	byIA := make(map[addr.IA]*genAS, len(g.ases))
+	for _, as := range g.ases {
+		byIA[as.ia] = as
+	}
+
+	var paths []fixturePath
+	for n := 1 + rng.Intn(12); len(paths) < n; {
+		if len(paths) > 0 && rng.Float64() < 0.15 {
+			paths = append(paths, paths[rng.Intn(len(paths))])
+			continue
+		}
+
+		// A random walk of one to five links that never revisits an AS.
+		as := g.ases[rng.Intn(len(g.ases))]
+		visited := map[addr.IA]bool{as.ia: true}
+		var f fixturePath
+		for steps := 1 + rng.Intn(5); steps > 0; steps-- {
+			var next []genInterface
+			for _, intf := range as.interfaces {
+				if !visited[intf.peer] {
+					next = append(next, intf)
+				}
+			}
+			if len(next) == 0 {
+				break
+			}
+			intf := next[rng.Intn(len(next))]
+			peer := byIA[intf.peer]
+			var back genInterface
+			for _, other := range peer.interfaces {
+				if other.peer == as.ia {
+					back = other
+				}
+			}
+			f.Interfaces = append(f.Interfaces, fmt.Sprintf("%s#%d", as.ia, intf.id),
+				fmt.Sprintf("%s#%d", peer.ia, back.id))
+			visited[peer.ia] = true
+			as = peer
+		}
+		if len(f.Interfaces) == 0 {
+			continue
+		}
+		fillSelectionMetadata(rng, &f, len(visited))
+		paths = append(paths, f)
+	}
+	return paths, nil
+}
+
+// fillSelectionMetadata draws the metadata of a path through hops ASes.
+func fillSelectionMetadata(rng *rand.Rand, f *fixturePath, hops int) {
+	if rng.Float64() < 0.03 {
+		f.NoMetadata = true
+		return
+	}
+	entries := len(f.Interfaces) - 1
+	if rng.Float64() > 0.05 {
+		for i := 0; i < entries; i++ {
+			l := int64(1 + rng.Intn(5))
+			if rng.Float64() < 0.1 {
+				l = -1
+			}
+			f.LatencyMs = append(f.LatencyMs, l)
+		}
+	}
+	if rng.Float64() > 0.05 {
+		zero := rng.Float64() < 0.1
+		for i := 0; i < entries; i++ {
+			bw := uint64(10 * (1 + rng.Intn(3)))
+			if zero || rng.Float64() < 0.1 {
+				bw = 0
+			}
+			f.Bandwidth = append(f.Bandwidth, bw)
+		}
+	}
+	if rng.Float64() > 0.05 {
+		for i := 0; i < entries; i++ {
+			c := int64(rng.Intn(6))
+			if rng.Float64() < 0.1 {
+				c = -1
+			}
+			f.CarbonIntensity = append(f.CarbonIntensity, c)
+		}
+	}
+	f.EPIC = rng.Float64() < 0.3
+	if rng.Float64() < 0.15 {
+		return
+	}
+	for i := 0; i < hops; i++ {
+		hop := fixtureHop{Enabled: rng.Float64() < 0.8}
+		for _, k := range rng.Perm(len(selectionPolicies))[:rng.Intn(3)] {
+			hop.Policies = append(hop.Policies, selectionPolicies[k])
+		}
+		f.Fabrid = append(f.Fabrid, hop)
+	}
+}
+
+// randomSubset returns a random selection of the items in random order.
+func randomSubset(rng *rand.Rand, items []string) []string {
+	var subset []string
+	for _, i := range rng.Perm(len(items))[:rng.Intn(len(items)+1)] {
+		subset = append(subset, items[i])
+	}
+	return subset
+}
+
+// randomSelectionCase returns the input of the selector for one round.
+func randomSelectionCase(rng *rand.Rand, selector string, seed int64,
+	paths []fixturePath) selectionCase {
+
+	c := selectionCase{
+		Selector:     selector,
+		Seed:         seed,
+		MaxLatencyMs: int64(2 + rng.Intn(20)),
+		Allowed:      randomSubset(rng, selectionPolicies),
+		Strict:       rng.Float64() < 0.5,
+		Prefer:       randomSubset(rng, selectionPolicies),
+		Criteria:     randomSubset(rng, []string{"preferred", "carbon", "hops"}),
+		PreferPath:   -1,
+		Paths:        paths,
+	}
+	if rng.Float64() < 0.3 {
+		c.PreferPath = rng.Intn(len(paths))
+	}
+	return c
+}
+
+// caseReductions drop the parts of a case a selector may not depend on.
+var caseReductions = []func(c *selectionCase){
+	func(c *selectionCase) { c.Allowed = nil },
+	func(c *selectionCase) { c.Strict = false },
+	func(c *selectionCase) { c.Prefer = nil },
+	func(c *selectionCase) { c.Criteria = nil },
+	func(c *selectionCase) { c.PreferPath = -1 },
+}
+
+// pathReductions drop the metadata of a path a selector may not depend on.
+var pathReductions = []func(f *fixturePath){
+	func(f *fixturePath) { f.Fabrid = nil },
+	func(f *fixturePath) { f.EPIC = false },
+	func(f *fixturePath) { f.CarbonIntensity = nil },
+	func(f *fixturePath) { f.LatencyMs = nil },
+	func(f *fixturePath) { f.Bandwidth = nil },
+}
+
+// minimizeSelectionCase removes paths and metadata from the case as long as
+// the selector and the reference implementation still disagree.
+func minimizeSelectionCase(ctx context.Context, chk selectionCheck,
+	c selectionCase) selectionCase {
+
+	disagree := func(trial selectionCase) bool {
+		got, want, err := chk.compare(ctx, trial)
+		return err == nil && got != want
+	}
+	for i := 0; i < len(c.Paths); {
+		trial := c
+		trial.Paths = append(append([]fixturePath(nil), c.Paths[:i]...), c.Paths[i+1:]...)
+		switch {
+		case c.PreferPath == i:
+			trial.PreferPath = -1
+		case c.PreferPath > i:
+			trial.PreferPath--
+		}
+		if disagree(trial) {
+			c = trial
+			continue
+		}
+		i++
+	}
+	for _, reduce := range caseReductions {
+		trial := c
+		reduce(&trial)
+		if disagree(trial) {
+			c = trial
+		}
+	}
+	for i := range c.Paths {
+		for _, reduce := range pathReductions {
+			trial := c
+			trial.Paths = append([]fixturePath(nil), c.Paths...)
+			reduce(&trial.Paths[i])
+			if disagree(trial) {
+				c = trial
+			}
+		}
+	}
+	return c
+}
+
+// saveSelectionFixture stores a minimized disagreement for
+// TestSelectionFixtures.
+func saveSelectionFixture(c selectionCase) (string, error) {
+	if err := os.MkdirAll(selectionFixtures, 0755); err != nil {
+		return "", err
+	}
+	raw, err := json.MarshalIndent(c, "", "    ")
+	if err != nil {
+		return "", err
+	}
+	name := filepath.Join(selectionFixtures, fmt.Sprintf("%s_%d.json", c.Selector, c.Seed))
+	return name, os.WriteFile(name, append(raw, '\n'), 0644)
+}
+
+func TestSelectionDifferential(t *testing.T) {
+	ctx := context.Background()
+	failed := make(map[string]int)
+	for round := 0; round < *selectionRounds; round++ {
+		seed := *selectionSeed + int64(round)
+		rng := rand.New(rand.NewSource(seed))
+		paths, err := randomSelectionPaths(rng, seed)
+		if err != nil {
+			t.Fatalf("seed %d: generating paths: %v", seed, err)
+		}
+		for _, chk := range selectionChecks {
+			c := randomSelectionCase(rng, chk.name, seed, paths)
+			got, want, err := chk.compare(ctx, c)
+			if err != nil {
+				t.Fatalf("seed %d: %s: %v", seed, chk.name, err)
+			}
+			if got == want {
+				continue
+			}
+			// Save a few disagreements per selector, they tend to share a
+			// cause.
+			if failed[chk.name]++; failed[chk.name] > 3 {
+				continue
+			}
+			c = minimizeSelectionCase(ctx, chk, c)
+			got, want, _ = chk.compare(ctx, c)
+			c.Want = want.path
+			name, err := saveSelectionFixture(c)
+			if err != nil {
+				t.Errorf("seed %d: saving fixture: %v", seed, err)
+			}
+			t.Errorf("seed %d: %s selector picked %s, want %s (%d paths, saved to %s)",
+				seed, chk.name, got, want, len(c.Paths), name)
+		}
+	}
+	for name, n := range failed {
+		t.Errorf("%s selector disagreed with the reference in %d of %d rounds", name, n,
+			*selectionRounds)
+	}
+}
+
+func TestSelectionFixtures(t *testing.T) {
+	ctx := context.Background()
+	names, err := filepath.Glob(filepath.Join(selectionFixtures, "*.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	checks := make(map[string]selectionCheck, len(selectionChecks))
+	for _, chk := range selectionChecks {
+		checks[chk.name] = chk
+	}
+	for _, name := range names {
+		t.Run(filepath.Base(name), func(t *testing.T) {
+			raw, err := os.ReadFile(name)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var c selectionCase
+			if err := json.Unmarshal(raw, &c); err != nil {
+				t.Fatal(err)
+			}
+			chk, ok := checks[c.Selector]
+			if !ok {
+				t.Fatalf("unknown selector %q", c.Selector)
+			}
+			got, want, err := chk.compare(ctx, c)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if want.path != c.Want {
+				t.Errorf("reference picked %s, fixture wants path %d", want, c.Want)
+			}
+			if got != want {
+				t.Errorf("%s selector picked %s, want %s", c.Selector, got, want)
+			}
+		})
+	}
+}
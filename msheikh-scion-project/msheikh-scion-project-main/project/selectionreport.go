@@ -0,0 +1,52 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/scionproto/scion/pkg/log"
+	"github.com/scionproto/scion/pkg/private/serrors"
+	"github.com/scionproto/scion/pkg/snet"
+)
+
+// usePath is called with every path a test sends on. It enforces the
+// sovereignty constraints and the geofence once more on the final choice,
+// logs the selection report and records the path in the run history.
+func usePath(ctx context.Context, id int, p snet.Path) error {
+	if err := pathSovereignty.enforce(ctx, id, p); err != nil {
+		return err
+	}
+	if fence := pathGeofence.fence; fence != nil {
+		if reason := fence.violation(p); reason != "" {
+			return serrors.New("selected path leaves the geofence", "test", id,
+				"reason", reason, "fingerprint", snet.Fingerprint(p))
+		}
+	}
+	logSelectionReport(ctx, id, p)
+	currentRun.recordPath(id, p)
+	return nil
+}
+
+// logSelectionReport logs the path a test selected with the region of every
+// hop and the type of every link, e.g.
+// "1-ff00:0:110 [CH] -direct-> 1-ff00:0:111 [CH/DE] -opennet-> 1-ff00:0:112 [DE]".
+func logSelectionReport(ctx context.Context, id int, p snet.Path) {
+	metadata := p.Metadata()
+	if metadata == nil {
+		log.FromCtx(ctx).Info(fmt.Sprintf("Test ID %02d: Selection report", id),
+			pathFields(p)...)
+		return
+	}
+	regions := pathGeofence.fence.hopRegions(metadata)
+	links := pathLinkTypeList(metadata)
+	var route strings.Builder
+	for i, hop := range fabridHopInterfaces(metadata) {
+		if i > 0 {
+			fmt.Fprintf(&route, " -%s-> ", links[i-1])
+		}
+		fmt.Fprintf(&route, "%s [%s]", hop.IA, regions[i])
+	}
+	log.FromCtx(ctx).Info(fmt.Sprintf("Test ID %02d: Selection report", id),
+		pathFields(p, "route", route.String(), "link_types", pathLinkTypes)...)
+}
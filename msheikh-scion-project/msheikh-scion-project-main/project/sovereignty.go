@@ -0,0 +1,296 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/scionproto/scion/pkg/addr"
+	"github.com/scionproto/scion/pkg/log"
+	"github.com/scionproto/scion/pkg/private/serrors"
+	"github.com/scionproto/scion/pkg/snet"
+)
+
+// Sovereignty constraints
+//
+// The allow and deny lists restrict the ISDs and ASes traffic may traverse.
+// They apply to every AS on a path, the source and destination included:
+//
+//   - --deny-isd and --deny-as remove every path through a listed ISD or AS.
+//   - --allow-isd and --allow-as, if set, remove every path through an ISD or
+//     AS that is not listed.
+//
+// Paths without metadata cannot be checked and are removed as soon as any list
+// is set. The lists are enforced on the paths of every daemon query, before
+// they are cached, so that no selector, hidden, EPIC or FABRID flow ever sees a
+// violating path, and once more on the path each test sends on. Every removal
+// is audited once per daemon query, not on every cache hit. A query whose
+// paths all violate the constraints fails instead of returning no paths.
+
+// isdList is the value of a repeatable flag with comma-separated ISDs.
+type isdList []addr.ISD
+
+func (l *isdList) String() string {
+	if l == nil {
+		return ""
+	}
+	parts := make([]string, len(*l))
+	for i, isd := range *l {
+		parts[i] = isd.String()
+	}
+	return strings.Join(parts, ",")
+}
+
+func (l *isdList) Set(s string) error {
+	for _, entry := range strings.Split(s, ",") {
+		isd, err := addr.ParseISD(strings.TrimSpace(entry))
+		if err != nil {
+			return serrors.WrapStr("parsing ISD", err, "isd", entry)
+		}
+		*l = append(*l, isd)
+	}
+	return nil
+}
+
+func (l isdList) contains(isd addr.ISD) bool {
+	for _, entry := range l {
+		if entry == isd {
+			return true
+		}
+	}
+	return false
+}
+
+// iaList is the value of a repeatable flag with comma-separated ISD-ASes.
+type iaList []addr.IA
+
+func (l *iaList) String() string {
+	if l == nil {
+		return ""
+	}
+	parts := make([]string, len(*l))
+	for i, ia := range *l {
+		parts[i] = ia.String()
+	}
+	return strings.Join(parts, ",")
+}
+
+func (l *iaList) Set(s string) error {
+	for _, entry := range strings.Split(s, ",") {
+		ia, err := addr.ParseIA(strings.TrimSpace(entry))
+		if err != nil {
+			return serrors.WrapStr("parsing ISD-AS", err, "ia", entry)
+		}
+		*l = append(*l, ia)
+	}
+	return nil
+}
+
+func (l iaList) contains(ia addr.IA) bool {
+	for _, entry := range l {
+		if entry == ia {
+			return true
+		}
+	}
+	return false
+}
+
+// auditLog is the value of the --audit-log flag. The file is opened while the
+// flags are parsed, so that a run with an unusable audit log fails at once
+// instead of silently losing the records.
+type auditLog struct {
+	file string
+
+	mu  sync.Mutex
+	out *os.File
+}
+
+func (l *auditLog) String() string {
+	if l == nil {
+		return ""
+	}
+	return l.file
+}
+
+func (l *auditLog) Set(file string) error {
+	out, err := os.OpenFile(file, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0o644)
+	if err != nil {
+		return serrors.WrapStr("opening audit log", err, "file", file)
+	}
+	l.close()
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.file, l.out = file, out
+	return nil
+}
+
+// write appends the record to the file, if one is set.
+func (l *auditLog) write(ctx context.Context, rec auditRecord) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.out == nil {
+		return
+	}
+	enc := json.NewEncoder(l.out)
+	enc.SetEscapeHTML(false)
+	if err := enc.Encode(rec); err != nil {
+		log.FromCtx(ctx).Error("Writing audit log failed", "file", l.file, "err", err)
+	}
+}
+
+// close closes the file.
+func (l *auditLog) close() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.out != nil {
+		l.out.Close()
+		l.out = nil
+	}
+}
+
+// sovereignty holds the allow and deny lists.
+type sovereignty struct {
+	allowISDs, denyISDs isdList
+	allowASes, denyASes iaList
+	audit               auditLog
+}
+
+var pathSovereignty sovereignty
+
+func init() {
+	flag.Var(&pathSovereignty.allowISDs, "allow-isd",
+		"Only use paths that stay within these ISDs (comma-separated, repeatable)")
+	flag.Var(&pathSovereignty.denyISDs, "deny-isd",
+		"Never use paths that enter these ISDs (comma-separated, repeatable)")
+	flag.Var(&pathSovereignty.allowASes, "allow-as",
+		"Only use paths that traverse nothing but these ASes (comma-separated, repeatable)")
+	flag.Var(&pathSovereignty.denyASes, "deny-as",
+		"Never use paths that traverse these ASes (comma-separated, repeatable)")
+	flag.Var(&pathSovereignty.audit, "audit-log",
+		"File the sovereignty audit records are appended to as JSON lines")
+}
+
+func (s *sovereignty) enabled() bool {
+	return len(s.allowISDs) > 0 || len(s.denyISDs) > 0 ||
+		len(s.allowASes) > 0 || len(s.denyASes) > 0
+}
+
+// violation returns the first constraint the path violates and the AS it
+// violates it in, an empty constraint if the path satisfies all of them.
+func (s *sovereignty) violation(p snet.Path) (string, addr.IA) {
+	metadata := p.Metadata()
+	if metadata == nil {
+		return "metadata", 0
+	}
+	for _, intf := range metadata.Interfaces {
+		ia := intf.IA
+		switch {
+		case s.denyISDs.contains(ia.ISD()):
+			return "deny-isd " + ia.ISD().String(), ia
+		case s.denyASes.contains(ia):
+			return "deny-as " + ia.String(), ia
+		case len(s.allowISDs) > 0 && !s.allowISDs.contains(ia.ISD()):
+			return "allow-isd " + s.allowISDs.String(), ia
+		case len(s.allowASes) > 0 && !s.allowASes.contains(ia):
+			return "allow-as " + s.allowASes.String(), ia
+		}
+	}
+	return "", 0
+}
+
+// auditRecord is one entry of the audit log.
+type auditRecord struct {
+	Time        time.Time `json:"time"`
+	Action      string    `json:"action"`
+	Context     string    `json:"context"`
+	Constraint  string    `json:"constraint"`
+	IA          string    `json:"ia,omitempty"`
+	Fingerprint string    `json:"fingerprint"`
+	Hops        string    `json:"hops"`
+}
+
+// record logs an audit record and appends it to the audit log file.
+func (s *sovereignty) record(ctx context.Context, rec auditRecord) {
+	rec.Time = time.Now().UTC()
+	log.FromCtx(ctx).Info("Sovereignty audit", "action", rec.Action, "context", rec.Context,
+		"constraint", rec.Constraint, "ia", rec.IA, "fingerprint", rec.Fingerprint,
+		"hops", rec.Hops)
+	s.audit.write(ctx, rec)
+}
+
+func newAuditRecord(action, where, constraint string, ia addr.IA, p snet.Path) auditRecord {
+	rec := auditRecord{
+		Action:      action,
+		Context:     where,
+		Constraint:  constraint,
+		Fingerprint: snet.Fingerprint(p).String(),
+		Hops:        pathHopString(p),
+	}
+	if ia != 0 {
+		rec.IA = ia.String()
+	}
+	return rec
+}
+
+// filter removes the paths that violate a constraint and records every
+// removal. It fails if paths were found but none of them is allowed.
+func (s *sovereignty) filter(ctx context.Context, query pathQueryKey,
+	paths []snet.Path) ([]snet.Path, error) {
+
+	if !s.enabled() {
+		return paths, nil
+	}
+	allowed := make([]snet.Path, 0, len(paths))
+	removed := make(map[string]int)
+	for _, p := range paths {
+		constraint, ia := s.violation(p)
+		if constraint == "" {
+			allowed = append(allowed, p)
+			continue
+		}
+		removed[constraint]++
+		s.record(ctx, newAuditRecord("removed", query.String(), constraint, ia, p))
+	}
+	if len(allowed) == len(paths) {
+		return allowed, nil
+	}
+
+	constraints := make([]string, 0, len(removed))
+	for constraint, n := range removed {
+		constraints = append(constraints, fmt.Sprintf("%s: %d", constraint, n))
+	}
+	sort.Strings(constraints)
+	log.FromCtx(ctx).Info("Sovereignty constraints removed paths", "query", query,
+		"paths", len(paths), "allowed", len(allowed), "removed", constraints)
+	if len(allowed) == 0 {
+		return nil, serrors.New("all paths violate the sovereignty constraints",
+			"query", query, "removed", constraints)
+	}
+	return allowed, nil
+}
+
+// enforce fails if test id is about to send on a path that violates a
+// constraint.
+func (s *sovereignty) enforce(ctx context.Context, id int, p snet.Path) error {
+	if !s.enabled() {
+		return nil
+	}
+	constraint, ia := s.violation(p)
+	if constraint == "" {
+		return nil
+	}
+	s.record(ctx, newAuditRecord("blocked", fmt.Sprintf("test %02d", id), constraint, ia, p))
+	return serrors.New("selected path violates a sovereignty constraint", "test", id,
+		"constraint", constraint, "ia", ia, "fingerprint", snet.Fingerprint(p))
+}
+
+// close closes the audit log file.
+func (s *sovereignty) close() {
+	s.audit.close()
+}
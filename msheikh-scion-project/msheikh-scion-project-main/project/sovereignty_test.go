@@ -0,0 +1,249 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/scionproto/scion/pkg/addr"
+	"github.com/scionproto/scion/pkg/daemon"
+	"github.com/scionproto/scion/pkg/snet"
+)
+
+// sovereigntyTestPaths are paths from 1-ff00:0:110 to 1-ff00:0:112, one within
+// ISD 1 and one through 2-ff00:0:211, and a path without metadata.
+var sovereigntyTestPaths = []fixturePath{
+	{Interfaces: []string{"1-ff00:0:110#1", "1-ff00:0:111#2", "1-ff00:0:111#3",
+		"1-ff00:0:112#4"}},
+	{Interfaces: []string{"1-ff00:0:110#5", "2-ff00:0:211#6", "2-ff00:0:211#7",
+		"1-ff00:0:112#8"}},
+	{Interfaces: []string{"1-ff00:0:110#9", "1-ff00:0:112#10"}, NoMetadata: true},
+}
+
+// testSovereignty returns constraints set from flag values, e.g. "deny-isd"
+// "2". The audit log is written to a temporary file.
+func testSovereignty(t *testing.T, flags ...string) *sovereignty {
+	t.Helper()
+	s := &sovereignty{}
+	setSovereignty(t, s, flags...)
+	return s
+}
+
+// setSovereignty sets the flag values on s and directs its audit log to a
+// temporary file. Everything is reset when the test ends.
+func setSovereignty(t *testing.T, s *sovereignty, flags ...string) {
+	t.Helper()
+	values := map[string]interface{ Set(string) error }{
+		"allow-isd": &s.allowISDs,
+		"deny-isd":  &s.denyISDs,
+		"allow-as":  &s.allowASes,
+		"deny-as":   &s.denyASes,
+	}
+	t.Cleanup(func() {
+		s.close()
+		s.allowISDs, s.denyISDs, s.allowASes, s.denyASes = nil, nil, nil, nil
+		s.audit.file = ""
+	})
+	for i := 0; i+1 < len(flags); i += 2 {
+		if err := values[flags[i]].Set(flags[i+1]); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := s.audit.Set(filepath.Join(t.TempDir(), "audit.jsonl")); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// auditRecords reads the audit log of s.
+func auditRecords(t *testing.T, s *sovereignty) []auditRecord {
+	t.Helper()
+	f, err := os.Open(s.audit.file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	var records []auditRecord
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var rec auditRecord
+		if err := json.Unmarshal(scanner.Bytes(), &rec); err != nil {
+			t.Fatal(err)
+		}
+		records = append(records, rec)
+	}
+	return records
+}
+
+func TestSovereigntyViolation(t *testing.T) {
+	tests := []struct {
+		name  string
+		flags []string
+		// want are the constraint and AS each path violates, empty if it
+		// satisfies all of them.
+		want [3]string
+	}{
+		{
+			name:  "deny isd",
+			flags: []string{"deny-isd", "2"},
+			want:  [3]string{"", "deny-isd 2 in 2-ff00:0:211", "metadata"},
+		},
+		{
+			name:  "deny as",
+			flags: []string{"deny-as", "1-ff00:0:111"},
+			want:  [3]string{"deny-as 1-ff00:0:111 in 1-ff00:0:111", "", "metadata"},
+		},
+		{
+			name:  "allow isd",
+			flags: []string{"allow-isd", "1"},
+			want:  [3]string{"", "allow-isd 1 in 2-ff00:0:211", "metadata"},
+		},
+		{
+			// The source and destination are checked like every other AS.
+			name:  "allow as",
+			flags: []string{"allow-as", "1-ff00:0:110,1-ff00:0:111"},
+			want: [3]string{"allow-as 1-ff00:0:110,1-ff00:0:111 in 1-ff00:0:112",
+				"allow-as 1-ff00:0:110,1-ff00:0:111 in 2-ff00:0:211", "metadata"},
+		},
+		{
+			// Deny lists are checked before allow lists at every AS.
+			name:  "deny before allow",
+			flags: []string{"allow-isd", "1", "deny-as", "2-ff00:0:211"},
+			want:  [3]string{"", "deny-as 2-ff00:0:211 in 2-ff00:0:211", "metadata"},
+		},
+	}
+	paths := buildPaths(t, sovereigntyTestPaths...)
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			s := testSovereignty(t, tc.flags...)
+			for i, p := range paths {
+				constraint, ia := s.violation(p)
+				got := constraint
+				if ia != 0 {
+					got += " in " + ia.String()
+				}
+				if got != tc.want[i] {
+					t.Errorf("path %d violates %q, want %q", i, got, tc.want[i])
+				}
+			}
+		})
+	}
+}
+
+func TestSovereigntyFilter(t *testing.T) {
+	query := pathQueryKey{src: addr.MustParseIA("1-ff00:0:110"),
+		dst: addr.MustParseIA("1-ff00:0:112")}
+	paths := buildPaths(t, sovereigntyTestPaths...)
+
+	t.Run("disabled", func(t *testing.T) {
+		s := testSovereignty(t)
+		got, err := s.filter(context.Background(), query, paths)
+		if err != nil || len(got) != len(paths) {
+			t.Errorf("kept %d of %d paths, err %v", len(got), len(paths), err)
+		}
+		if records := auditRecords(t, s); len(records) != 0 {
+			t.Errorf("audited %d removals", len(records))
+		}
+	})
+	t.Run("removes violating paths", func(t *testing.T) {
+		s := testSovereignty(t, "deny-isd", "2")
+		got, err := s.filter(context.Background(), query, paths)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(got) != 1 || got[0] != paths[0] {
+			t.Errorf("kept %d paths, want only path 0", len(got))
+		}
+		records := auditRecords(t, s)
+		if len(records) != 2 {
+			t.Fatalf("audited %d removals, want 2", len(records))
+		}
+		want := auditRecord{Action: "removed", Context: query.String(),
+			Constraint: "deny-isd 2", IA: "2-ff00:0:211",
+			Fingerprint: snet.Fingerprint(paths[1]).String(), Hops: pathHopString(paths[1])}
+		got1 := records[0]
+		got1.Time = want.Time
+		if got1 != want {
+			t.Errorf("audit record %+v, want %+v", got1, want)
+		}
+		if records[1].Constraint != "metadata" {
+			t.Errorf("path without metadata removed by %q", records[1].Constraint)
+		}
+	})
+	t.Run("all paths violate", func(t *testing.T) {
+		s := testSovereignty(t, "allow-isd", "3")
+		if got, err := s.filter(context.Background(), query, paths); err == nil {
+			t.Errorf("kept %d paths, want an error", len(got))
+		}
+		if records := auditRecords(t, s); len(records) != len(paths) {
+			t.Errorf("audited %d removals, want %d", len(records), len(paths))
+		}
+	})
+	t.Run("no paths", func(t *testing.T) {
+		s := testSovereignty(t, "allow-isd", "3")
+		if got, err := s.filter(context.Background(), query, nil); err != nil || len(got) != 0 {
+			t.Errorf("kept %d paths, err %v", len(got), err)
+		}
+	})
+}
+
+func TestAuditLogOpenedAtParse(t *testing.T) {
+	var l auditLog
+	if err := l.Set(filepath.Join(t.TempDir(), "missing", "audit.jsonl")); err == nil {
+		l.close()
+		t.Error("audit log in a missing directory was accepted")
+	}
+}
+
+// countingConnector returns fixed paths and counts the path queries.
+type countingConnector struct {
+	daemon.Connector
+	paths   []snet.Path
+	queries int
+}
+
+func (c *countingConnector) Paths(context.Context, addr.IA, addr.IA,
+	daemon.PathReqFlags) ([]snet.Path, error) {
+
+	c.queries++
+	return append([]snet.Path(nil), c.paths...), nil
+}
+
+func TestPathCacheFiltersOncePerFetch(t *testing.T) {
+	// The cache filters with the constraints set on the command line.
+	s := &pathSovereignty
+	setSovereignty(t, s, "deny-isd", "2")
+
+	paths := buildPaths(t, sovereigntyTestPaths...)
+	conn := &countingConnector{paths: paths}
+	cache := newPathCache(conn)
+	ctx := context.Background()
+	src, dst := addr.MustParseIA("1-ff00:0:110"), addr.MustParseIA("1-ff00:0:112")
+	for i := 0; i < 3; i++ {
+		got, err := cache.Paths(ctx, dst, src, daemon.PathReqFlags{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(got) != 1 || got[0] != paths[0] {
+			t.Fatalf("query %d returned %d paths, want only path 0", i, len(got))
+		}
+		// Callers may reorder and truncate their copy.
+		got[0] = paths[1]
+	}
+	if conn.queries != 1 {
+		t.Errorf("daemon queried %d times, want once", conn.queries)
+	}
+	if records := auditRecords(t, s); len(records) != 2 {
+		t.Errorf("audited %d removals, want the 2 of the single fetch", len(records))
+	}
+
+	if _, err := cache.Refresh(ctx, dst, src, daemon.PathReqFlags{}); err != nil {
+		t.Fatal(err)
+	}
+	if records := auditRecords(t, s); conn.queries != 2 || len(records) != 4 {
+		t.Errorf("refresh queried the daemon %d times and audited %d removals, want 2 and 4",
+			conn.queries, len(records))
+	}
+}
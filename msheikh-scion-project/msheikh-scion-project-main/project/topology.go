@@ -0,0 +1,232 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/scionproto/scion/pkg/addr"
+	"github.com/scionproto/scion/pkg/private/serrors"
+	"gopkg.in/yaml.v3"
+)
+
+// topologyStorage is the directory holding the configuration of every
+// topology, relative to the repository root the client is started from.
+const topologyStorage = "topology_storage"
+
+// topologyDir returns the configuration directory of the topology selected
+// with the -topology flag.
+func topologyDir() string {
+	return filepath.Join(topologyStorage, *topologyID)
+}
+
+// topoAS is the configuration of one AS in a .topo file.
+type topoAS struct {
+	Core          bool   `yaml:"core,omitempty"`
+	Voting        bool   `yaml:"voting,omitempty"`
+	Authoritative bool   `yaml:"authoritative,omitempty"`
+	Issuing       bool   `yaml:"issuing,omitempty"`
+	CertIssuer    string `yaml:"cert_issuer,omitempty"`
+	MTU           int    `yaml:"mtu,omitempty"`
+	Underlay      string `yaml:"underlay,omitempty"`
+}
+
+// topoLink is a link between two border router interfaces in a .topo file.
+type topoLink struct {
+	A        string `yaml:"a"`
+	B        string `yaml:"b"`
+	LinkAtoB string `yaml:"linkAtoB"`
+	BW       int    `yaml:"bw,omitempty"`
+	MTU      int    `yaml:"mtu,omitempty"`
+	Underlay string `yaml:"underlay,omitempty"`
+}
+
+// topoFile is the topology description consumed by the SCION topology
+// generator.
+type topoFile struct {
+	ASes  map[string]topoAS `yaml:"ASes"`
+	Links []topoLink        `yaml:"links"`
+}
+
+// loadTopoFile reads the .topo file of the topology in dir.
+func loadTopoFile(dir string) (*topoFile, error) {
+	name := filepath.Join(dir, filepath.Base(dir)+".topo")
+	raw, err := os.ReadFile(name)
+	if err != nil {
+		return nil, serrors.WrapStr("reading topology", err, "file", name)
+	}
+	var topo topoFile
+	if err := yaml.Unmarshal(raw, &topo); err != nil {
+		return nil, serrors.WrapStr("parsing topology", err, "file", name)
+	}
+	return &topo, nil
+}
+
+// ias returns the ISD-AS of every AS in the topology, sorted.
+func (t *topoFile) ias() ([]addr.IA, error) {
+	ias := make([]addr.IA, 0, len(t.ASes))
+	for name := range t.ASes {
+		ia, err := addr.ParseIA(name)
+		if err != nil {
+			return nil, serrors.WrapStr("parsing AS of topology", err, "as", name)
+		}
+		ias = append(ias, ia)
+	}
+	sort.Slice(ias, func(i, j int) bool { return ias[i] < ias[j] })
+	return ias, nil
+}
+
+// iaForFileName maps a per-AS configuration name such as "ASff00_0_113" to
+// the ISD-AS of the topology.
+func (t *topoFile) iaForFileName(name string) (addr.IA, bool) {
+	if !strings.HasPrefix(name, "AS") {
+		return 0, false
+	}
+	as, err := addr.ParseFormattedAS(name[2:], addr.WithFileSeparator())
+	if err != nil {
+		return 0, false
+	}
+	ias, err := t.ias()
+	if err != nil {
+		return 0, false
+	}
+	for _, ia := range ias {
+		if ia.AS() == as {
+			return ia, true
+		}
+	}
+	return 0, false
+}
+
+// parseTopoInterface parses one end of a link such as "1-ff00:0:110-A#1" into
+// the ISD-AS and the interface ID.
+func parseTopoInterface(s string) (addr.IA, uint16, error) {
+	name, id, ok := strings.Cut(s, "#")
+	if !ok {
+		return 0, 0, serrors.New("link end without interface ID", "end", s)
+	}
+	parts := strings.SplitN(name, "-", 3)
+	if len(parts) < 2 {
+		return 0, 0, serrors.New("invalid link end", "end", s)
+	}
+	ia, err := addr.ParseIA(parts[0] + "-" + parts[1])
+	if err != nil {
+		return 0, 0, serrors.WrapStr("parsing AS of link end", err, "end", s)
+	}
+	ifid, err := strconv.ParseUint(id, 10, 16)
+	if err != nil {
+		return 0, 0, serrors.WrapStr("parsing interface ID of link end", err, "end", s)
+	}
+	return ia, uint16(ifid), nil
+}
+
+// linkAt returns the link attached to interface ifid of ia, the AS at its
+// other end, and whether ia is the A end of the link.
+func (t *topoFile) linkAt(ia addr.IA, ifid uint16) (topoLink, addr.IA, bool, bool) {
+	for _, link := range t.Links {
+		aIA, aID, errA := parseTopoInterface(link.A)
+		bIA, bID, errB := parseTopoInterface(link.B)
+		if errA != nil || errB != nil {
+			continue
+		}
+		switch {
+		case aIA == ia && aID == ifid:
+			return link, bIA, true, true
+		case bIA == ia && bID == ifid:
+			return link, aIA, false, true
+		}
+	}
+	return topoLink{}, 0, false, false
+}
+
+// interfaces returns the IDs of the interfaces of ia that have a link, sorted.
+func (t *topoFile) interfaces(ia addr.IA) []uint16 {
+	var ifids []uint16
+	for _, link := range t.Links {
+		for _, end := range []string{link.A, link.B} {
+			if endIA, ifid, err := parseTopoInterface(end); err == nil && endIA == ia {
+				ifids = append(ifids, ifid)
+			}
+		}
+	}
+	sort.Slice(ifids, func(i, j int) bool { return ifids[i] < ifids[j] })
+	return ifids
+}
+
+// neighbor returns the AS at the other end of interface ifid of ia.
+func (t *topoFile) neighbor(ia addr.IA, ifid uint16) (addr.IA, bool) {
+	_, peer, _, ok := t.linkAt(ia, ifid)
+	return peer, ok
+}
+
+// configIssue is a problem found in a configuration file of a topology.
+type configIssue struct {
+	file    string
+	line    int
+	warning bool
+	msg     string
+}
+
+func (i configIssue) String() string {
+	level := "error"
+	if i.warning {
+		level = "warning"
+	}
+	return fmt.Sprintf("%s:%d: %s: %s", i.file, i.line, level, i.msg)
+}
+
+// sortConfigIssues orders issues by file and line.
+func sortConfigIssues(issues []configIssue) {
+	sort.SliceStable(issues, func(i, j int) bool {
+		if issues[i].file != issues[j].file {
+			return issues[i].file < issues[j].file
+		}
+		return issues[i].line < issues[j].line
+	})
+}
+
+// yamlPairs returns the key and value nodes of the mapping node n in file
+// order.
+func yamlPairs(n *yaml.Node) [][2]*yaml.Node {
+	if n == nil || n.Kind != yaml.MappingNode {
+		return nil
+	}
+	pairs := make([][2]*yaml.Node, 0, len(n.Content)/2)
+	for i := 0; i+1 < len(n.Content); i += 2 {
+		pairs = append(pairs, [2]*yaml.Node{n.Content[i], n.Content[i+1]})
+	}
+	return pairs
+}
+
+// yamlLookup returns the key and value nodes of key in the mapping node n, or
+// nil if n has no such key.
+func yamlLookup(n *yaml.Node, key string) (*yaml.Node, *yaml.Node) {
+	if n == nil || n.Kind != yaml.MappingNode {
+		return nil, nil
+	}
+	for i := 0; i+1 < len(n.Content); i += 2 {
+		if n.Content[i].Value == key {
+			return n.Content[i], n.Content[i+1]
+		}
+	}
+	return nil, nil
+}
+
+// loadYAMLNode parses a YAML file into its document node.
+func loadYAMLNode(name string) (*yaml.Node, error) {
+	raw, err := os.ReadFile(name)
+	if err != nil {
+		return nil, serrors.WrapStr("reading file", err, "file", name)
+	}
+	var doc yaml.Node
+	if err := yaml.Unmarshal(raw, &doc); err != nil {
+		return nil, serrors.WrapStr("parsing file", err, "file", name)
+	}
+	if len(doc.Content) == 0 {
+		return &yaml.Node{Kind: yaml.MappingNode, Line: 1}, nil
+	}
+	return doc.Content[0], nil
+}
@@ -0,0 +1,469 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+
+	"github.com/scionproto/scion/pkg/addr"
+	"github.com/scionproto/scion/pkg/private/serrors"
+	"gopkg.in/yaml.v3"
+)
+
+// topologyGenConfig sizes a generated topology.
+type topologyGenConfig struct {
+	isds     int
+	cores    int
+	children int
+	peers    int
+	// hiddenGroups is the number of hidden path groups, each owned by a
+	// random non-core AS.
+	hiddenGroups int
+	// multihome is the probability that a non-core AS gets a second parent.
+	multihome float64
+	seed      int64
+}
+
+// genInterface is an interface of a generated AS with the metrics of its link.
+type genInterface struct {
+	id   uint16
+	peer addr.IA
+	// kind is how the AS sees its neighbor: parent, child, peer or core.
+	kind      string
+	latencyMs int
+	bandwidth int
+	carbon    int
+}
+
+type genAS struct {
+	ia         addr.IA
+	core       bool
+	interfaces []genInterface
+}
+
+// topologyGenerator builds a random topology in the layout of
+// topology_storage.
+type topologyGenerator struct {
+	cfg    topologyGenConfig
+	rng    *rand.Rand
+	ases   []*genAS
+	links  []topoLink
+	linked map[[2]addr.IA]bool
+}
+
+func newTopologyGenerator(cfg topologyGenConfig) (*topologyGenerator, error) {
+	switch {
+	case cfg.isds < 1 || cfg.isds > 99:
+		return nil, serrors.New("the number of ISDs must be between 1 and 99", "isds", cfg.isds)
+	case cfg.cores < 1:
+		return nil, serrors.New("every ISD needs at least one core AS", "cores", cfg.cores)
+	case cfg.cores+cfg.children > 90:
+		return nil, serrors.New("at most 90 ASes per ISD are supported",
+			"cores", cfg.cores, "children", cfg.children)
+	}
+	return &topologyGenerator{
+		cfg:    cfg,
+		rng:    rand.New(rand.NewSource(cfg.seed)),
+		linked: make(map[[2]addr.IA]bool),
+	}, nil
+}
+
+// asFileName is the name of the per-AS files of ia, e.g. "ASff00_0_110".
+func asFileName(ia addr.IA) string {
+	return "AS" + addr.FormatAS(ia.AS(), addr.WithFileSeparator())
+}
+
+// link connects a and b. For a CHILD link, a is the parent.
+func (g *topologyGenerator) link(a, b *genAS, linkType string) {
+	ifA := uint16(len(a.interfaces) + 1)
+	ifB := uint16(len(b.interfaces) + 1)
+	g.links = append(g.links, topoLink{
+		A:        fmt.Sprintf("%s#%d", a.ia, ifA),
+		B:        fmt.Sprintf("%s#%d", b.ia, ifB),
+		LinkAtoB: linkType,
+		BW:       500,
+		MTU:      1280,
+	})
+	g.linked[[2]addr.IA{a.ia, b.ia}] = true
+	g.linked[[2]addr.IA{b.ia, a.ia}] = true
+
+	kindA, kindB := "core", "core"
+	switch linkType {
+	case "CHILD":
+		kindA, kindB = "child", "parent"
+	case "PEER":
+		kindA, kindB = "peer", "peer"
+	}
+	// Both ends of a link report the same inter-AS metrics.
+	latency := 1 + g.rng.Intn(20)
+	bandwidth := 10 + 5*g.rng.Intn(19)
+	carbon := g.rng.Intn(101)
+	a.interfaces = append(a.interfaces, genInterface{id: ifA, peer: b.ia, kind: kindA,
+		latencyMs: latency, bandwidth: bandwidth, carbon: carbon})
+	b.interfaces = append(b.interfaces, genInterface{id: ifB, peer: a.ia, kind: kindB,
+		latencyMs: latency, bandwidth: bandwidth, carbon: carbon})
+}
+
+// generate creates the ASes and links: a chain of core ASes per ISD, core
+// links between neighboring ISDs, non-core ASes hanging off cores or earlier
+// non-core ASes of their ISD, and peering links between non-core ASes.
+func (g *topologyGenerator) generate() {
+	var firstCores []*genAS
+	var nonCore []*genAS
+	for isd := 1; isd <= g.cfg.isds; isd++ {
+		var isdASes []*genAS
+		for k := 0; k < g.cfg.cores+g.cfg.children; k++ {
+			ia := addr.MustParseIA(fmt.Sprintf("%d-ff00:0:%d%02d", isd, isd, 10+k))
+			as := &genAS{ia: ia, core: k < g.cfg.cores}
+			g.ases = append(g.ases, as)
+			isdASes = append(isdASes, as)
+		}
+		cores := isdASes[:g.cfg.cores]
+		for k := 1; k < len(cores); k++ {
+			g.link(cores[k-1], cores[k], "CORE")
+		}
+		if len(firstCores) > 0 {
+			prev := firstCores[len(firstCores)-1]
+			g.link(prev, cores[0], "CORE")
+			if g.rng.Float64() < 0.5 {
+				// A parallel core link gives the selection algorithms a choice.
+				g.link(prev, cores[g.rng.Intn(len(cores))], "CORE")
+			}
+		}
+		firstCores = append(firstCores, cores[0])
+
+		for k := g.cfg.cores; k < len(isdASes); k++ {
+			child := isdASes[k]
+			parent := isdASes[g.rng.Intn(k)]
+			g.link(parent, child, "CHILD")
+			if k > 1 && g.rng.Float64() < g.cfg.multihome {
+				second := isdASes[g.rng.Intn(k)]
+				if !g.linked[[2]addr.IA{second.ia, child.ia}] {
+					g.link(second, child, "CHILD")
+				}
+			}
+			nonCore = append(nonCore, child)
+		}
+	}
+
+	for added, attempts := 0, 0; added < g.cfg.peers && attempts < 10*g.cfg.peers &&
+		len(nonCore) > 1; attempts++ {
+
+		a, b := nonCore[g.rng.Intn(len(nonCore))], nonCore[g.rng.Intn(len(nonCore))]
+		if a == b || g.linked[[2]addr.IA{a.ia, b.ia}] {
+			continue
+		}
+		g.link(a, b, "PEER")
+		added++
+	}
+}
+
+// topo returns the .topo description of the generated topology.
+func (g *topologyGenerator) topo() topoFile {
+	t := topoFile{ASes: make(map[string]topoAS, len(g.ases)), Links: g.links}
+	issuers := make(map[addr.ISD]addr.IA)
+	for _, as := range g.ases {
+		if _, ok := issuers[as.ia.ISD()]; !ok && as.core {
+			issuers[as.ia.ISD()] = as.ia
+		}
+	}
+	for _, as := range g.ases {
+		if as.core {
+			t.ASes[as.ia.String()] = topoAS{Core: true, Voting: true, Authoritative: true,
+				Issuing: true, MTU: 1400}
+			continue
+		}
+		t.ASes[as.ia.String()] = topoAS{CertIssuer: issuers[as.ia.ISD()].String()}
+	}
+	return t
+}
+
+// staticInfoMeta describes the neighbor behind an interface.
+type staticInfoMeta struct {
+	To   string `json:"to"`
+	Type string `json:"type"`
+}
+
+// staticInfoValue is the inter-AS value of an interface and the intra-AS
+// values towards the other interfaces.
+type staticInfoValue struct {
+	Inter interface{}            `json:"Inter"`
+	Intra map[string]interface{} `json:"Intra"`
+}
+
+// staticInfoFile is the staticInfoConfig.json of an AS.
+type staticInfoFile struct {
+	Meta            map[string]staticInfoMeta  `json:"Meta"`
+	Bandwidth       map[string]staticInfoValue `json:"Bandwidth"`
+	CarbonIntensity map[string]staticInfoValue `json:"CarbonIntensity"`
+	Latency         map[string]staticInfoValue `json:"Latency"`
+}
+
+// staticInfo returns the staticInfo of as. Intra values are drawn once per
+// pair of interfaces, so they are the same in both directions.
+func (g *topologyGenerator) staticInfo(as *genAS) staticInfoFile {
+	f := staticInfoFile{
+		Meta:            make(map[string]staticInfoMeta),
+		Bandwidth:       make(map[string]staticInfoValue),
+		CarbonIntensity: make(map[string]staticInfoValue),
+		Latency:         make(map[string]staticInfoValue),
+	}
+	type intra struct {
+		latencyMs, bandwidth, carbon int
+	}
+	pairs := make(map[[2]uint16]intra)
+	for i, a := range as.interfaces {
+		for _, b := range as.interfaces[i+1:] {
+			v := intra{
+				latencyMs: g.rng.Intn(4),
+				bandwidth: 100 * (1 + g.rng.Intn(10)),
+				carbon:    g.rng.Intn(21),
+			}
+			pairs[[2]uint16{a.id, b.id}] = v
+			pairs[[2]uint16{b.id, a.id}] = v
+		}
+	}
+
+	for _, intf := range as.interfaces {
+		id := strconv.Itoa(int(intf.id))
+		peerAS := intf.peer.AS().String()
+		f.Meta[id] = staticInfoMeta{To: peerAS[len(peerAS)-3:], Type: intf.kind}
+
+		bandwidth := staticInfoValue{Inter: intf.bandwidth, Intra: map[string]interface{}{}}
+		carbon := staticInfoValue{Inter: intf.carbon, Intra: map[string]interface{}{}}
+		latency := staticInfoValue{Inter: fmt.Sprintf("%dms", intf.latencyMs),
+			Intra: map[string]interface{}{}}
+		for _, other := range as.interfaces {
+			if other.id == intf.id {
+				continue
+			}
+			v := pairs[[2]uint16{intf.id, other.id}]
+			otherID := strconv.Itoa(int(other.id))
+			bandwidth.Intra[otherID] = v.bandwidth
+			carbon.Intra[otherID] = v.carbon
+			latency.Intra[otherID] = fmt.Sprintf("%dms", v.latencyMs)
+		}
+		f.Bandwidth[id] = bandwidth
+		f.CarbonIntensity[id] = carbon
+		f.Latency[id] = latency
+	}
+	return f
+}
+
+// genFabridPolicies are the local policies generated ASes pick from, the same
+// as in small_topology_1.
+var genFabridPolicies = []struct {
+	id          uint32
+	description string
+}{
+	{1000, "Route only over routers produced by manufacturer A"},
+	{1001, "Route only over routers produced by manufacturer B"},
+	{1002, "Route only over routers produced by manufacturer C"},
+	{2000, "Route only over routers that support remote attestation"},
+}
+
+// fabridPolicies returns the FABRID policies of as: most ASes with at least
+// two interfaces offer a few local policies, each on a random set of
+// interface pairs in both directions.
+func (g *topologyGenerator) fabridPolicies(as *genAS) []fabridPolicyFile {
+	if len(as.interfaces) < 2 || g.rng.Float64() < 0.4 {
+		return nil
+	}
+	var files []fabridPolicyFile
+	for _, i := range g.rng.Perm(len(genFabridPolicies))[:1+g.rng.Intn(3)] {
+		p := genFabridPolicies[i]
+		f := fabridPolicyFile{
+			Local:            true,
+			LocalIdentifier:  p.id,
+			LocalDescription: p.description,
+		}
+		for a, in := range as.interfaces {
+			for _, out := range as.interfaces[a+1:] {
+				if len(f.Connections) > 0 && g.rng.Float64() < 0.5 {
+					continue
+				}
+				for _, pair := range [][2]uint16{{in.id, out.id}, {out.id, in.id}} {
+					f.Connections = append(f.Connections, fabridConnection{
+						Ingress:   fabridConnectionEnd{Type: "interface", Interface: pair[0]},
+						Egress:    fabridConnectionEnd{Type: "interface", Interface: pair[1]},
+						MPLSLabel: 1,
+					})
+				}
+			}
+		}
+		files = append(files, f)
+	}
+	sort.Slice(files, func(i, j int) bool {
+		return files[i].LocalIdentifier < files[j].LocalIdentifier
+	})
+	return files
+}
+
+// hiddenPaths returns the hidden path files of the topology. Every group is
+// owned by a non-core AS that registers the segments of its parent interfaces
+// with the group, and read by the owner and a few random other ASes.
+func (g *topologyGenerator) hiddenPaths() map[addr.IA]*hiddenPathsFile {
+	files := make(map[addr.IA]*hiddenPathsFile)
+	fileOf := func(ia addr.IA) *hiddenPathsFile {
+		if files[ia] == nil {
+			files[ia] = &hiddenPathsFile{Groups: make(map[string]hiddenPathGroup)}
+		}
+		return files[ia]
+	}
+
+	var owners []*genAS
+	for _, as := range g.ases {
+		if !as.core {
+			owners = append(owners, as)
+		}
+	}
+	for n := 0; n < g.cfg.hiddenGroups && len(owners) > 0; n++ {
+		owner := owners[g.rng.Intn(len(owners))]
+		id := fmt.Sprintf("%s-%x", owner.ia.AS(), 0xaaaa+n)
+		group := hiddenPathGroup{
+			Owner:      owner.ia.String(),
+			Writers:    []string{owner.ia.String()},
+			Readers:    []string{owner.ia.String()},
+			Registries: []string{owner.ia.String()},
+		}
+		for _, i := range g.rng.Perm(len(g.ases))[:min(3, len(g.ases))] {
+			if reader := g.ases[i]; reader != owner {
+				group.Readers = append(group.Readers, reader.ia.String())
+			}
+		}
+
+		policy := fileOf(owner.ia)
+		for _, intf := range owner.interfaces {
+			if intf.kind != "parent" {
+				continue
+			}
+			if policy.RegistrationPolicy == nil {
+				policy.RegistrationPolicy = make(map[uint16][]string)
+			}
+			policy.RegistrationPolicy[intf.id] = append(policy.RegistrationPolicy[intf.id], id)
+		}
+		for _, reader := range group.Readers {
+			fileOf(addr.MustParseIA(reader)).Groups[id] = group
+		}
+	}
+	for _, f := range files {
+		for ifid, groups := range f.RegistrationPolicy {
+			f.RegistrationPolicy[ifid] = append([]string{hiddenPathPublic}, groups...)
+		}
+	}
+	return files
+}
+
+// write stores the topology in dir, in the layout topo-generator.py reads.
+func (g *topologyGenerator) write(dir string) error {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return serrors.WrapStr("creating topology directory", err, "dir", dir)
+	}
+	writeYAML := func(name, header string, v interface{}) error {
+		raw, err := yaml.Marshal(v)
+		if err != nil {
+			return serrors.WrapStr("encoding file", err, "file", name)
+		}
+		return os.WriteFile(name, append([]byte(header), raw...), 0644)
+	}
+
+	topo := g.topo()
+	header := fmt.Sprintf("--- # Random topology, %d ISDs, seed %d\n", g.cfg.isds, g.cfg.seed)
+	name := filepath.Join(dir, filepath.Base(dir)+".topo")
+	if err := writeYAML(name, header, topo); err != nil {
+		return err
+	}
+
+	for _, as := range g.ases {
+		raw, err := json.MarshalIndent(g.staticInfo(as), "", "    ")
+		if err != nil {
+			return serrors.WrapStr("encoding staticInfo", err, "as", as.ia)
+		}
+		name := filepath.Join(dir, asFileName(as.ia)+".json")
+		if err := os.WriteFile(name, raw, 0644); err != nil {
+			return serrors.WrapStr("writing staticInfo", err, "file", name)
+		}
+
+		policies := g.fabridPolicies(as)
+		if len(policies) == 0 {
+			continue
+		}
+		fabridDir := filepath.Join(dir, asFileName(as.ia)+"_fabrid")
+		if err := os.MkdirAll(fabridDir, 0755); err != nil {
+			return serrors.WrapStr("creating FABRID policy directory", err, "dir", fabridDir)
+		}
+		for _, p := range policies {
+			name := filepath.Join(fabridDir, fmt.Sprintf("L%d.yaml", p.LocalIdentifier))
+			if err := writeYAML(name, "", p); err != nil {
+				return err
+			}
+		}
+	}
+
+	for ia, f := range g.hiddenPaths() {
+		name := filepath.Join(dir, asFileName(ia)+"_hidden_paths.yaml")
+		if err := writeYAML(name, "", f); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// runTopologyGen implements the topology-gen subcommand. It writes a random
+// topology to the topology storage and lints it.
+func runTopologyGen(args []string) error {
+	fs := flag.NewFlagSet("topology-gen", flag.ContinueOnError)
+	out := fs.String("out", topologyStorage, "The directory the topology directory is created in")
+	name := fs.String("name", "", "The name of the topology (default: random_topology_<seed>)")
+	force := fs.Bool("force", false, "Replace an existing topology of the same name")
+	var cfg topologyGenConfig
+	fs.IntVar(&cfg.isds, "isds", 2, "The number of ISDs")
+	fs.IntVar(&cfg.cores, "cores", 1, "The number of core ASes per ISD")
+	fs.IntVar(&cfg.children, "children", 4, "The number of non-core ASes per ISD")
+	fs.IntVar(&cfg.peers, "peers", 2, "The number of peering links between non-core ASes")
+	fs.IntVar(&cfg.hiddenGroups, "hidden-groups", 1, "The number of hidden path groups")
+	fs.Float64Var(&cfg.multihome, "multihome", 0.3,
+		"The probability that a non-core AS gets a second parent")
+	fs.Int64Var(&cfg.seed, "seed", 1, "The seed of the random generator")
+	if err := fs.Parse(args); err != nil {
+		return serrors.WrapStr("parsing topology-gen arguments", err)
+	}
+	if *name == "" {
+		*name = fmt.Sprintf("random_topology_%d", cfg.seed)
+	}
+
+	dir := filepath.Join(*out, *name)
+	if _, err := os.Stat(dir); err == nil {
+		if !*force {
+			return serrors.New("topology already exists, use --force to replace it", "dir", dir)
+		}
+		if err := os.RemoveAll(dir); err != nil {
+			return serrors.WrapStr("removing existing topology", err, "dir", dir)
+		}
+	}
+
+	g, err := newTopologyGenerator(cfg)
+	if err != nil {
+		return err
+	}
+	g.generate()
+	if err := g.write(dir); err != nil {
+		return err
+	}
+
+	issues, err := lintTopology(dir)
+	if err != nil {
+		return err
+	}
+	for _, issue := range issues {
+		fmt.Println(issue)
+	}
+	fmt.Printf("wrote %s: %d ASes, %d links\n", dir, len(g.ases), len(g.links))
+	fmt.Printf("generate it with: python3 topo-generator.py %s %s.topo\n", dir, *name)
+	return nil
+}
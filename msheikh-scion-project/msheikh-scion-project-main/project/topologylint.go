@@ -0,0 +1,382 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/scionproto/scion/pkg/addr"
+	"github.com/scionproto/scion/pkg/private/serrors"
+	"gopkg.in/yaml.v3"
+)
+
+// staticInfoTables are the staticInfo properties that hold an Inter value and
+// an Intra table per interface.
+var staticInfoTables = []string{"Latency", "Bandwidth", "CarbonIntensity"}
+
+// topologyLinter checks the staticInfo and FABRID policy files of one
+// topology against its .topo file.
+type topologyLinter struct {
+	dir    string
+	topo   *topoFile
+	issues []configIssue
+}
+
+func (l *topologyLinter) report(file string, line int, warning bool, format string,
+	args ...interface{}) {
+
+	l.issues = append(l.issues, configIssue{
+		file:    file,
+		line:    line,
+		warning: warning,
+		msg:     fmt.Sprintf(format, args...),
+	})
+}
+
+// lintTopology checks the topology in dir, including its hidden path
+// configuration.
+func lintTopology(dir string) ([]configIssue, error) {
+	topo, err := loadTopoFile(dir)
+	if err != nil {
+		return nil, err
+	}
+	l := &topologyLinter{dir: dir, topo: topo}
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, serrors.WrapStr("reading topology directory", err, "dir", dir)
+	}
+	for _, e := range entries {
+		name := filepath.Join(dir, e.Name())
+		switch {
+		case e.IsDir() && strings.HasSuffix(e.Name(), "_fabrid"):
+			if err := l.lintFabridPolicies(name); err != nil {
+				return nil, err
+			}
+		case !e.IsDir() && filepath.Ext(e.Name()) == ".json":
+			if err := l.lintStaticInfo(name); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	hidden, err := checkHiddenPathConfig(dir)
+	if err != nil {
+		return nil, err
+	}
+	issues := append(l.issues, hidden...)
+	sortConfigIssues(issues)
+	return issues, nil
+}
+
+// fileIA returns the AS a per-AS file or directory such as ASff00_0_112.json
+// belongs to, reporting the file if the AS is not part of the topology.
+func (l *topologyLinter) fileIA(name, suffix string) (addr.IA, bool) {
+	asName := strings.TrimSuffix(filepath.Base(name), suffix)
+	ia, ok := l.topo.iaForFileName(asName)
+	if !ok {
+		l.report(name, 1, false, "%s is not an AS of the topology", asName)
+	}
+	return ia, ok
+}
+
+// linkType returns how ia sees the AS behind interface ifid: parent, child,
+// peer or core.
+func (l *topologyLinter) linkType(ia addr.IA, ifid uint16) (string, addr.IA, bool) {
+	link, peer, isA, ok := l.topo.linkAt(ia, ifid)
+	if !ok {
+		return "", 0, false
+	}
+	switch strings.ToUpper(link.LinkAtoB) {
+	case "CHILD":
+		if isA {
+			return "child", peer, true
+		}
+		return "parent", peer, true
+	case "PEER":
+		return "peer", peer, true
+	case "CORE":
+		return "core", peer, true
+	}
+	return strings.ToLower(link.LinkAtoB), peer, true
+}
+
+// interfaceKey parses a mapping key holding an interface ID and reports it if
+// the interface has no link.
+func (l *topologyLinter) interfaceKey(file string, ia addr.IA, key *yaml.Node,
+	where string) (uint16, bool) {
+
+	ifid, err := strconv.ParseUint(key.Value, 10, 16)
+	if err != nil {
+		l.report(file, key.Line, false, "%s: invalid interface ID %q", where, key.Value)
+		return 0, false
+	}
+	if _, _, _, ok := l.topo.linkAt(ia, uint16(ifid)); !ok {
+		l.report(file, key.Line, false, "%s: interface %d of %s has no link in the topology",
+			where, ifid, ia)
+		return uint16(ifid), false
+	}
+	return uint16(ifid), true
+}
+
+// lintStaticInfo checks a staticInfo JSON file.
+func (l *topologyLinter) lintStaticInfo(name string) error {
+	ia, ok := l.fileIA(name, ".json")
+	if !ok {
+		return nil
+	}
+	root, err := loadYAMLNode(name)
+	if err != nil {
+		return err
+	}
+	ifids := l.topo.interfaces(ia)
+
+	_, meta := yamlLookup(root, "Meta")
+	for _, pair := range yamlPairs(meta) {
+		ifid, ok := l.interfaceKey(name, ia, pair[0], "Meta")
+		if !ok {
+			continue
+		}
+		want, peer, _ := l.linkType(ia, ifid)
+		if toKey, to := yamlLookup(pair[1], "to"); to != nil && !sameAS(to.Value, peer) {
+			l.report(name, toKey.Line, false, "Meta: interface %d leads to %s, not %q",
+				ifid, peer, to.Value)
+		}
+		if typeKey, typ := yamlLookup(pair[1], "type"); typ != nil &&
+			!strings.EqualFold(typ.Value, want) {
+			l.report(name, typeKey.Line, false, "Meta: interface %d is a %s link, not %q",
+				ifid, want, typ.Value)
+		}
+	}
+
+	for _, table := range staticInfoTables {
+		tableKey, node := yamlLookup(root, table)
+		if node == nil {
+			continue
+		}
+		l.lintStaticInfoTable(name, ia, table, tableKey, node, ifids)
+	}
+	return nil
+}
+
+// lintStaticInfoTable checks that every interface of the AS has an entry,
+// that every entry has an Intra value towards each other interface, and that
+// the Intra values are symmetric.
+func (l *topologyLinter) lintStaticInfoTable(name string, ia addr.IA, table string,
+	tableKey, node *yaml.Node, ifids []uint16) {
+
+	type intraValue struct {
+		value string
+		line  int
+	}
+	intra := make(map[[2]uint16]intraValue)
+	present := make(map[uint16]int)
+
+	for _, pair := range yamlPairs(node) {
+		ifid, ok := l.interfaceKey(name, ia, pair[0], table)
+		if !ok {
+			continue
+		}
+		present[ifid] = pair[0].Line
+		intraKey, intraNode := yamlLookup(pair[1], "Intra")
+		for _, entry := range yamlPairs(intraNode) {
+			other, ok := l.interfaceKey(name, ia, entry[0], table+" Intra")
+			if !ok {
+				continue
+			}
+			if other == ifid {
+				l.report(name, entry[0].Line, true, "%s: Intra entry of interface %d to itself",
+					table, ifid)
+				continue
+			}
+			intra[[2]uint16{ifid, other}] = intraValue{value: entry[1].Value, line: entry[0].Line}
+		}
+		line := pair[0].Line
+		if intraKey != nil {
+			line = intraKey.Line
+		}
+		for _, other := range ifids {
+			if other == ifid {
+				continue
+			}
+			if _, ok := intra[[2]uint16{ifid, other}]; !ok {
+				l.report(name, line, false, "%s: missing Intra entry %d->%d", table, ifid, other)
+			}
+		}
+	}
+
+	for _, ifid := range ifids {
+		if _, ok := present[ifid]; !ok {
+			l.report(name, tableKey.Line, true, "%s: no entry for interface %d", table, ifid)
+		}
+	}
+	keys := make([][2]uint16, 0, len(intra))
+	for k := range intra {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		return keys[i][0] < keys[j][0] || keys[i][0] == keys[j][0] && keys[i][1] < keys[j][1]
+	})
+	for _, k := range keys {
+		if k[0] > k[1] {
+			continue
+		}
+		back, ok := intra[[2]uint16{k[1], k[0]}]
+		if ok && back.value != intra[k].value {
+			l.report(name, back.line, true, "%s: asymmetric Intra values %d->%d = %s, "+
+				"%d->%d = %s", table, k[0], k[1], intra[k].value, k[1], k[0], back.value)
+		}
+	}
+}
+
+// sameAS reports whether a Meta "to" value such as "110", "ff00:0:110" or
+// "1-ff00:0:110" names ia.
+func sameAS(to string, ia addr.IA) bool {
+	switch {
+	case to == ia.String() || to == ia.AS().String():
+		return true
+	case strings.Contains(to, ":") || strings.Contains(to, "-"):
+		return false
+	}
+	as := ia.AS().String()
+	return as[strings.LastIndex(as, ":")+1:] == to
+}
+
+// lintFabridPolicies checks the FABRID policy files of one AS.
+func (l *topologyLinter) lintFabridPolicies(dir string) error {
+	ia, ok := l.fileIA(dir, "_fabrid")
+	if !ok {
+		return nil
+	}
+	names, err := filepath.Glob(filepath.Join(dir, "*.yaml"))
+	if err != nil {
+		return err
+	}
+
+	seen := make(map[string]string)
+	for _, name := range names {
+		root, err := loadYAMLNode(name)
+		if err != nil {
+			return err
+		}
+		var pf fabridPolicyFile
+		if err := root.Decode(&pf); err != nil {
+			l.report(name, root.Line, false, "invalid FABRID policy: %s", err)
+			continue
+		}
+
+		id := fmt.Sprintf("G%d", pf.GlobalIdentifier)
+		idKey, _ := yamlLookup(root, "global_identifier")
+		if pf.Local {
+			id = fmt.Sprintf("L%d", pf.LocalIdentifier)
+			idKey, _ = yamlLookup(root, "local_identifier")
+		}
+		line := root.Line
+		if idKey != nil {
+			line = idKey.Line
+		}
+		if idKey == nil {
+			l.report(name, line, false, "policy has no identifier")
+		}
+		if other, ok := seen[id]; ok {
+			l.report(name, line, false, "duplicate policy identifier %s, also defined in %s",
+				id, filepath.Base(other))
+		} else {
+			seen[id] = name
+		}
+		if base := strings.TrimSuffix(filepath.Base(name), ".yaml"); base != id {
+			l.report(name, line, true, "file name %s does not match policy identifier %s",
+				base, id)
+		}
+
+		_, connections := yamlLookup(root, "connections")
+		if connections == nil || len(connections.Content) == 0 {
+			l.report(name, root.Line, true, "policy has no connections")
+			continue
+		}
+		for _, conn := range connections.Content {
+			for _, side := range []string{"ingress", "egress"} {
+				_, end := yamlLookup(conn, side)
+				_, typ := yamlLookup(end, "type")
+				ifKey, ifNode := yamlLookup(end, "interface")
+				if typ == nil || typ.Value != "interface" || ifNode == nil {
+					continue
+				}
+				ifid, err := strconv.ParseUint(ifNode.Value, 10, 16)
+				if err != nil {
+					l.report(name, ifKey.Line, false, "%s: invalid interface ID %q", side,
+						ifNode.Value)
+					continue
+				}
+				if _, _, _, ok := l.topo.linkAt(ia, uint16(ifid)); !ok {
+					l.report(name, ifKey.Line, false, "%s: interface %d of %s has no link in "+
+						"the topology", side, ifid, ia)
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// topologyDirs returns dir if it holds a topology, or every topology below it.
+func topologyDirs(dir string) ([]string, error) {
+	if _, err := os.Stat(filepath.Join(dir, filepath.Base(dir)+".topo")); err == nil {
+		return []string{dir}, nil
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, serrors.WrapStr("reading topology storage", err, "dir", dir)
+	}
+	var dirs []string
+	for _, e := range entries {
+		sub := filepath.Join(dir, e.Name())
+		if _, err := os.Stat(filepath.Join(sub, e.Name()+".topo")); e.IsDir() && err == nil {
+			dirs = append(dirs, sub)
+		}
+	}
+	if len(dirs) == 0 {
+		return nil, serrors.New("no topology found", "dir", dir)
+	}
+	return dirs, nil
+}
+
+// runTopologyLint implements the topology-lint subcommand. It checks every
+// topology below a topology_storage directory and prints file:line
+// diagnostics.
+func runTopologyLint(args []string) error {
+	fs := flag.NewFlagSet("topology-lint", flag.ContinueOnError)
+	dir := fs.String("dir", topologyStorage,
+		"The topology storage directory, or the directory of a single topology")
+	if err := fs.Parse(args); err != nil {
+		return serrors.WrapStr("parsing topology-lint arguments", err)
+	}
+
+	dirs, err := topologyDirs(*dir)
+	if err != nil {
+		return err
+	}
+	failed, warnings := 0, 0
+	for _, d := range dirs {
+		issues, err := lintTopology(d)
+		if err != nil {
+			return err
+		}
+		for _, issue := range issues {
+			fmt.Println(issue)
+			if issue.warning {
+				warnings++
+			} else {
+				failed++
+			}
+		}
+	}
+	fmt.Printf("%d topologies, %d errors, %d warnings\n", len(dirs), failed, warnings)
+	if failed > 0 {
+		return serrors.New("topology storage has errors", "errors", failed)
+	}
+	return nil
+}
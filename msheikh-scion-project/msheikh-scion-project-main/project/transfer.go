@@ -0,0 +1,326 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"math/rand"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/scionproto/scion/pkg/daemon"
+	"github.com/scionproto/scion/pkg/log"
+	"github.com/scionproto/scion/pkg/private/serrors"
+	"github.com/scionproto/scion/pkg/snet"
+
+	"gitlab.inf.ethz.ch/PRV-PERRIG/netsec-course/project-scion/lib/transport"
+)
+
+// The port the transfer server listens on by default.
+const transferPort = 31300
+
+// fecFlag parses forward error correction settings of the form "k,m".
+type fecFlag transport.FECConfig
+
+func (f *fecFlag) String() string {
+	if f.DataShards == 0 {
+		return "off"
+	}
+	return fmt.Sprintf("%d,%d", f.DataShards, f.ParityShards)
+}
+
+func (f *fecFlag) Set(s string) error {
+	if s == "off" {
+		*f = fecFlag{}
+		return nil
+	}
+	parts := strings.Split(s, ",")
+	if len(parts) != 2 {
+		return serrors.New("FEC must be given as k,m", "value", s)
+	}
+	k, err := strconv.Atoi(parts[0])
+	if err != nil {
+		return serrors.WrapStr("parsing data shards", err)
+	}
+	m, err := strconv.Atoi(parts[1])
+	if err != nil {
+		return serrors.WrapStr("parsing parity shards", err)
+	}
+	if k <= 0 || m < 0 || k+m > 256 {
+		return serrors.New("invalid shard counts", "data", k, "parity", m)
+	}
+	*f = fecFlag{DataShards: k, ParityShards: m}
+	return nil
+}
+
+// runTransferServer implements the transfer-server subcommand. It receives
+// multipath transfers one after another and discards the data.
+func runTransferServer(args []string) error {
+	fs := flag.NewFlagSet("transfer-server", flag.ContinueOnError)
+	port := fs.Int("port", transferPort, "The UDP port to receive transfers on")
+	count := fs.Int("count", 0, "The number of transfers to receive before exiting (0 = unlimited)")
+	first := fs.Uint("first-transfer", 1, "The ID of the first transfer, every further one increments it")
+	if err := fs.Parse(args); err != nil {
+		return serrors.WrapStr("parsing transfer-server arguments", err)
+	}
+
+	ctx := context.Background()
+	daemonConn, _, err := connectDaemon(ctx)
+	if err != nil {
+		return err
+	}
+	defer daemonConn.Close()
+
+	network := &snet.SCIONNetwork{
+		Topology: daemonConn,
+	}
+	conn, err := network.Listen(ctx, "udp", &net.UDPAddr{IP: net.ParseIP(local), Port: *port})
+	if err != nil {
+		return serrors.WrapStr("listening for transfers", err)
+	}
+	defer conn.Close()
+
+	log.Info("Waiting for transfers", "addr", conn.LocalAddr())
+
+	for i := 0; *count == 0 || i < *count; i++ {
+		transfer := uint32(*first) + uint32(i)
+		stats, err := transport.Receive(ctx, conn, io.Discard,
+			transport.Options{Transfer: transfer})
+		if err != nil {
+			return serrors.WrapStr("receiving transfer", err)
+		}
+		log.Info("Transfer received",
+			"transfer", transfer,
+			"bytes", stats.Bytes,
+			"chunks", stats.Chunks,
+			"duration", stats.Duration,
+			"throughput_mbps", fmt.Sprintf("%.2f", stats.Throughput()*8/1e6))
+	}
+	return nil
+}
+
+// runTransferBench implements the transfer-bench subcommand. It sends the same
+// amount of data to a transfer server, first over the best single path and
+// then striped over several disjoint paths, and compares the throughput.
+func runTransferBench(args []string) error {
+	fs := flag.NewFlagSet("transfer-bench", flag.ContinueOnError)
+	size := fs.Int64("size", 4<<20, "The number of bytes to transfer per run")
+	numPaths := fs.Int("paths", 3, "The number of disjoint paths for the multipath run")
+	rounds := fs.Int("rounds", 3, "The number of runs per mode")
+	first := fs.Uint("first-transfer", 1,
+		"The ID of the first transfer, must match the one of the transfer server")
+	var fec fecFlag
+	fs.Var(&fec, "fec", "Additionally run the multipath transfer with k,m Reed-Solomon shards")
+	if err := fs.Parse(args); err != nil {
+		return serrors.WrapStr("parsing transfer-bench arguments", err)
+	}
+
+	ctx := context.Background()
+	daemonConn, localIA, err := connectDaemon(ctx)
+	if err != nil {
+		return err
+	}
+	defer daemonConn.Close()
+
+	paths, err := daemonConn.Paths(ctx, remote.IA, localIA, daemon.PathReqFlags{})
+	if err != nil {
+		return serrors.WrapStr("querying paths", err)
+	}
+	if len(paths) == 0 {
+		return serrors.New("no paths available to remote")
+	}
+	k := *numPaths
+	if k > len(paths) {
+		log.Info("Fewer paths available than requested", "requested", k, "available", len(paths))
+		k = len(paths)
+	}
+	multipath, err := selectDisjointPaths(ctx, paths, k, pathDisjointness, nil)
+	if err != nil {
+		return serrors.WrapStr("selecting disjoint paths", err)
+	}
+
+	network := &snet.SCIONNetwork{
+		Topology: daemonConn,
+	}
+	localAddr := &net.UDPAddr{IP: net.ParseIP(local)}
+
+	modes := []struct {
+		name  string
+		paths []snet.Path
+		opts  transport.Options
+	}{
+		{name: "single-path", paths: multipath[:1]},
+		{name: "multipath", paths: multipath},
+	}
+	if fec.DataShards > 0 {
+		modes = append(modes, struct {
+			name  string
+			paths []snet.Path
+			opts  transport.Options
+		}{
+			name:  "multipath-fec",
+			paths: multipath,
+			opts:  transport.Options{FEC: transport.FECConfig(fec)},
+		})
+	}
+	transfer := uint32(*first)
+	for _, mode := range modes {
+		var total time.Duration
+		var bytes int64
+		for round := 0; round < *rounds; round++ {
+			stats, err := benchTransfer(ctx, network, localAddr, mode.paths, *size, transfer,
+				mode.opts)
+			transfer++
+			if err != nil {
+				return serrors.WrapStr("running transfer", err, "mode", mode.name, "round", round)
+			}
+			total += stats.Duration
+			bytes += stats.Bytes
+			logTransferStats(mode.name, round, stats)
+		}
+		fmt.Printf("%-13s paths=%d bytes=%d time=%v throughput=%.2f Mbit/s\n",
+			mode.name, len(mode.paths), bytes, total, float64(bytes)*8/1e6/total.Seconds())
+	}
+	return nil
+}
+
+// logTransferStats logs how each path was used in a transfer.
+func logTransferStats(mode string, round int, stats transport.Stats) {
+	for i, ps := range stats.Paths {
+		log.Info("Transfer path statistics", "mode", mode, "round", round,
+			"path", i, "sent", ps.Sent, "acked", ps.Acked, "timeouts", ps.Timeouts,
+			"retransmitted", ps.Retransmitted, "srtt", ps.SmoothedRTT,
+			"window", fmt.Sprintf("%.1f", ps.FinalWindow), "dead", ps.Dead)
+	}
+}
+
+// benchTransfer sends size pseudo-random bytes over the given paths as the
+// given transfer.
+func benchTransfer(ctx context.Context, network *snet.SCIONNetwork, localAddr *net.UDPAddr,
+	paths []snet.Path, size int64, transfer uint32,
+	opts transport.Options) (transport.Stats, error) {
+
+	var senderPaths []transport.SenderPath
+	for _, p := range paths {
+		dst := remote.Copy()
+		dst.Path = p.Dataplane()
+		dst.NextHop = p.UnderlayNextHop()
+		conn, err := network.Dial(ctx, "udp", localAddr, dst)
+		if err != nil {
+			return transport.Stats{}, serrors.WrapStr("dialing transfer path", err)
+		}
+		defer conn.Close()
+		senderPaths = append(senderPaths, transport.SenderPath{
+			Name: snet.Fingerprint(p).String(),
+			Conn: conn,
+		})
+	}
+
+	sender, err := transport.NewSender(senderPaths, transfer, opts)
+	if err != nil {
+		return transport.Stats{}, err
+	}
+	data := io.LimitReader(rand.New(rand.NewSource(size)), size)
+	return sender.Send(ctx, data)
+}
+
+// runTransferSim implements the transfer-sim subcommand. It runs the
+// multipath transfer with and without FEC over an in-memory network with
+// packet loss, optionally taking one path down during the transfer, and
+// reports how many retransmissions each mode needed.
+func runTransferSim(args []string) error {
+	fs := flag.NewFlagSet("transfer-sim", flag.ContinueOnError)
+	size := fs.Int64("size", 1<<20, "The number of bytes to transfer per run")
+	numPaths := fs.Int("paths", 3, "The number of simulated paths")
+	loss := fs.Float64("loss", 0.02, "The packet loss rate of every path")
+	delay := fs.Duration("delay", 10*time.Millisecond, "The one-way delay of every path")
+	failPath := fs.Int("fail-path", -1, "The path to take down during the transfer (-1 = none)")
+	failAfter := fs.Duration("fail-after", 50*time.Millisecond, "When to take the path down")
+	seed := fs.Int64("seed", 1, "The seed for the simulated packet loss")
+	fec := fecFlag{DataShards: 4, ParityShards: 2}
+	fs.Var(&fec, "fec", "The k,m Reed-Solomon shards of the FEC run")
+	if err := fs.Parse(args); err != nil {
+		return serrors.WrapStr("parsing transfer-sim arguments", err)
+	}
+	if *numPaths <= 0 || *failPath >= *numPaths {
+		return serrors.New("invalid simulated paths", "paths", *numPaths, "fail_path", *failPath)
+	}
+
+	modes := []struct {
+		name string
+		opts transport.Options
+	}{
+		{name: "multipath"},
+		{name: "multipath-fec", opts: transport.Options{FEC: transport.FECConfig(fec)}},
+	}
+	for _, mode := range modes {
+		network := transport.NewFakeNetwork(*numPaths, *seed)
+		var senderPaths []transport.SenderPath
+		for i := 0; i < *numPaths; i++ {
+			network.SetLoss(i, *loss)
+			network.SetDelay(i, *delay)
+			senderPaths = append(senderPaths, transport.SenderPath{
+				Name: fmt.Sprintf("path-%d", i),
+				Conn: network.PathConn(i),
+			})
+		}
+		if *failPath >= 0 {
+			path := *failPath
+			timer := time.AfterFunc(*failAfter, func() { network.SetLoss(path, 1) })
+			defer timer.Stop()
+		}
+
+		stats, recvStats, err := simulateTransfer(network, senderPaths, *size, mode.opts)
+		if err != nil {
+			return serrors.WrapStr("running simulated transfer", err, "mode", mode.name)
+		}
+		logTransferStats(mode.name, 0, stats)
+		fmt.Printf("%-13s paths=%d bytes=%d time=%v retransmissions=%d recovered_groups=%d\n",
+			mode.name, *numPaths, recvStats.Bytes, stats.Duration, stats.Retransmissions,
+			recvStats.Recovered)
+	}
+	return nil
+}
+
+// simulateTransfer sends size pseudo-random bytes over the fake network and
+// checks that the receiver got exactly the same bytes.
+func simulateTransfer(network *transport.FakeNetwork, paths []transport.SenderPath,
+	size int64, opts transport.Options) (transport.Stats, transport.Stats, error) {
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+
+	transfer := rand.Uint32()
+	var received bytes.Buffer
+	recvDone := make(chan error, 1)
+	var recvStats transport.Stats
+	go func() {
+		var err error
+		recvStats, err = transport.Receive(ctx, network.ReceiverConn(), &received,
+			transport.Options{Linger: 100 * time.Millisecond, Transfer: transfer})
+		recvDone <- err
+	}()
+
+	sender, err := transport.NewSender(paths, transfer, opts)
+	if err != nil {
+		return transport.Stats{}, transport.Stats{}, err
+	}
+	data := make([]byte, size)
+	rand.New(rand.NewSource(size)).Read(data)
+	stats, err := sender.Send(ctx, bytes.NewReader(data))
+	if err != nil {
+		return stats, transport.Stats{}, err
+	}
+	if err := <-recvDone; err != nil {
+		return stats, recvStats, serrors.WrapStr("receiving transfer", err)
+	}
+	if !bytes.Equal(received.Bytes(), data) {
+		return stats, recvStats, serrors.New("received data differs",
+			"sent", len(data), "received", received.Len())
+	}
+	return stats, recvStats, nil
+}